@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// enableForwarding lets gerbil turn on the IP forwarding sysctls itself
+var enableForwarding bool
+
+// ipForwarding and enableIPForwarding read and turn on the kernel IP
+// forwarding sysctls
+var (
+	ipForwarding       = tailscale.IPForwarding
+	enableIPForwarding = tailscale.EnableIPForwarding
+)
+
+// exitNodeMetricsTTL is how long scrapes reuse the exit node state, which
+// takes a prefs and a status query to collect
+const exitNodeMetricsTTL = 30 * time.Second
+
+var exitNodeMetricsCache struct {
+	mu            sync.Mutex
+	advertisement *ExitNodeAdvertisement
+	fetched       time.Time
+}
+
+// errForwardingDisabled means the kernel would drop the traffic of exit node clients
+var errForwardingDisabled = errors.New("IP forwarding is disabled")
+
+// ExitNodeAdvertisement is the response of /exit-node/advertise
+type ExitNodeAdvertisement struct {
+	Advertised bool                  `json:"advertised"`
+	Approved   bool                  `json:"approved"`
+	Forwarding *tailscale.Forwarding `json:"forwarding,omitempty"`
+}
+
+// handleAdvertiseExitNode shows whether this node is an exit node on GET,
+// offers it on PUT or POST and withdraws it on DELETE
+var handleAdvertiseExitNode = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet:    writeExitNodeAdvertisement,
+	http.MethodPut:    handleChangeExitNodeAdvertisement,
+	http.MethodPost:   handleChangeExitNodeAdvertisement,
+	http.MethodDelete: handleChangeExitNodeAdvertisement,
+})
+
+func handleChangeExitNodeAdvertisement(w http.ResponseWriter, r *http.Request) {
+	err := advertiseExitNode(r.Context(), r.Method != http.MethodDelete)
+	if errors.Is(err, errForwardingDisabled) {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "%v", err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "%v", err)
+		return
+	}
+	writeExitNodeAdvertisement(w, r)
+}
+
+func writeExitNodeAdvertisement(w http.ResponseWriter, r *http.Request) {
+	advertisement, err := exitNodeAdvertisement(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, advertisement)
+}
+
+// advertiseExitNode offers or withdraws this node as an exit node. Before
+// advertising with a kernel TUN device, IP forwarding is checked, and enabled
+// when enableForwarding is set.
+func advertiseExitNode(ctx context.Context, advertise bool) error {
+	required, err := forwardingRequired(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check IP forwarding: %v", err)
+	}
+	if advertise && required {
+		forwarding, err := ipForwarding()
+		if err != nil {
+			return fmt.Errorf("failed to check IP forwarding: %v", err)
+		}
+		if !forwarding.Enabled() {
+			if !enableForwarding {
+				return fmt.Errorf("%w (ipv4: %t, ipv6: %t), enable it or set enable-ip-forwarding", errForwardingDisabled, forwarding.IPv4, forwarding.IPv6)
+			}
+			if err := enableIPForwarding(); err != nil {
+				return err
+			}
+			logger.Info("Enabled IP forwarding")
+		}
+	}
+
+	if err := tailscaleClient(ctx).SetAdvertiseExitNode(advertise); err != nil {
+		return err
+	}
+	resetExitNodeMetrics()
+	if advertise {
+		logger.Info("Advertising this node as an exit node")
+	} else {
+		logger.Info("Stopped advertising this node as an exit node")
+	}
+	return nil
+}
+
+// exitNodeAdvertisement collects whether this node is advertised and approved
+// as an exit node, and the forwarding state when the kernel does the forwarding
+func exitNodeAdvertisement(ctx context.Context) (*ExitNodeAdvertisement, error) {
+	client := tailscaleClient(ctx)
+	prefs, err := client.GetPrefs()
+	if err != nil {
+		return nil, err
+	}
+	approved, err := client.ExitNodeApproved()
+	if err != nil {
+		return nil, err
+	}
+
+	advertisement := &ExitNodeAdvertisement{
+		Advertised: prefs.AdvertiseExitNode(),
+		Approved:   approved,
+	}
+	required, err := forwardingRequired(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check IP forwarding: %v", err)
+	}
+	if required {
+		forwarding, err := ipForwarding()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check IP forwarding: %v", err)
+		}
+		advertisement.Forwarding = &forwarding
+	}
+	return advertisement, nil
+}
+
+// forwardingRequired reports whether the kernel forwards exit node traffic.
+// Embedded nodes and userspace networking forward it in process. A tailscaled
+// gerbil didn't launch is asked whether it has a TUN device.
+func forwardingRequired(ctx context.Context) (bool, error) {
+	switch {
+	case tsEmbedded != nil:
+		return false, nil
+	case tsDaemon != nil:
+		return !daemonConfig.Userspace(), nil
+	}
+	status, err := tailscaleClient(ctx).Status()
+	if err != nil {
+		return false, err
+	}
+	return status.TUN, nil
+}
+
+// cachedExitNodeAdvertisement returns the exit node state collected within
+// exitNodeMetricsTTL, or collects it again
+func cachedExitNodeAdvertisement() (*ExitNodeAdvertisement, error) {
+	exitNodeMetricsCache.mu.Lock()
+	defer exitNodeMetricsCache.mu.Unlock()
+
+	if exitNodeMetricsCache.advertisement != nil && time.Since(exitNodeMetricsCache.fetched) < exitNodeMetricsTTL {
+		return exitNodeMetricsCache.advertisement, nil
+	}
+	advertisement, err := exitNodeAdvertisement(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	exitNodeMetricsCache.advertisement = advertisement
+	exitNodeMetricsCache.fetched = time.Now()
+	return advertisement, nil
+}
+
+// resetExitNodeMetrics makes the next scrape collect the exit node state again
+func resetExitNodeMetrics() {
+	exitNodeMetricsCache.mu.Lock()
+	defer exitNodeMetricsCache.mu.Unlock()
+	exitNodeMetricsCache.advertisement = nil
+}
+
+// exitNodeMetrics reports the exit node state, and the kernel IP forwarding
+// state when the kernel forwards the traffic. Tailscale doesn't count exit
+// node traffic on its own; hostTrafficMetrics reports the closest counters.
+func exitNodeMetrics() []metrics.Metric {
+	advertisement, err := cachedExitNodeAdvertisement()
+	if err != nil {
+		logger.Debug("Failed to collect exit node metrics: %v", err)
+		return nil
+	}
+
+	collected := []metrics.Metric{
+		{
+			Name:    "gerbil_exit_node_advertised",
+			Help:    "Whether this node advertises itself as an exit node.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(advertisement.Advertised)}},
+		},
+		{
+			Name:    "gerbil_exit_node_approved",
+			Help:    "Whether the control plane has approved this node as an exit node.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(advertisement.Approved)}},
+		},
+	}
+	if advertisement.Forwarding == nil {
+		return collected
+	}
+
+	return append(collected, metrics.Metric{
+		Name: "gerbil_ip_forwarding_enabled",
+		Help: "Whether the kernel forwards packets for the address family.",
+		Type: metrics.Gauge,
+		Samples: []metrics.Sample{
+			{Labels: map[string]string{"family": "ipv4"}, Value: metrics.Bool(advertisement.Forwarding.IPv4)},
+			{Labels: map[string]string{"family": "ipv6"}, Value: metrics.Bool(advertisement.Forwarding.IPv6)},
+		},
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// fakeForwarding replaces the IP forwarding sysctls with the given state and
+// returns how often enabling was asked for
+func fakeForwarding(t *testing.T, forwarding tailscale.Forwarding) *int {
+	t.Helper()
+	var enabled int
+	previousRead, previousEnable := ipForwarding, enableIPForwarding
+	ipForwarding = func() (tailscale.Forwarding, error) { return forwarding, nil }
+	enableIPForwarding = func() error {
+		enabled++
+		forwarding = tailscale.Forwarding{IPv4: true, IPv6: true}
+		return nil
+	}
+	t.Cleanup(func() { ipForwarding, enableIPForwarding = previousRead, previousEnable })
+	return &enabled
+}
+
+func TestAdvertiseExitNode(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		tun        bool
+		forwarding tailscale.Forwarding
+		enable     bool
+		status     int
+		set        string
+		enabled    int
+	}{
+		{name: "get", method: "GET", tun: true, forwarding: tailscale.Forwarding{IPv4: true, IPv6: true}, status: 200},
+		{name: "advertise with forwarding", method: "PUT", tun: true, forwarding: tailscale.Forwarding{IPv4: true, IPv6: true}, status: 200, set: "set --advertise-exit-node=true"},
+		{name: "advertise without forwarding", method: "POST", tun: true, forwarding: tailscale.Forwarding{IPv4: true}, status: 409},
+		{name: "advertise enabling forwarding", method: "PUT", tun: true, enable: true, status: 200, set: "set --advertise-exit-node=true", enabled: 1},
+		// Userspace networking forwards in process
+		{name: "advertise in userspace", method: "PUT", status: 200, set: "set --advertise-exit-node=true"},
+		// Withdrawing never needs forwarding
+		{name: "withdraw without forwarding", method: "DELETE", tun: true, status: 200, set: "set --advertise-exit-node=false"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := strings.Replace(testStatusJSON, `"BackendState": "Running",`, `"BackendState": "Running", "TUN": `+strconv.FormatBool(test.tun)+`,`, 1)
+			dir := fakeTailscaleCLI(t, status)
+			enabled := fakeForwarding(t, test.forwarding)
+			enableForwarding = test.enable
+			defer func() { enableForwarding = false }()
+
+			recorder := httptest.NewRecorder()
+			handleAdvertiseExitNode(recorder, httptest.NewRequest(test.method, "/exit-node/advertise", nil))
+			if recorder.Code != test.status {
+				t.Fatalf("Got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			set := readLines(t, filepath.Join(dir, "set.log"))
+			if test.set == "" && len(set) > 0 || test.set != "" && !slices.Equal(set, []string{test.set}) {
+				t.Errorf("Got tailscale %q, want %q", set, test.set)
+			}
+			if *enabled != test.enabled {
+				t.Errorf("Enabled forwarding %d times, want %d", *enabled, test.enabled)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var advertisement ExitNodeAdvertisement
+			if err := json.Unmarshal(recorder.Body.Bytes(), &advertisement); err != nil {
+				t.Fatal(err)
+			}
+			// The fake tailscaled advertises and has approved the default routes
+			if !advertisement.Advertised || !advertisement.Approved {
+				t.Errorf("Got %+v, want advertised and approved", advertisement)
+			}
+			if test.tun != (advertisement.Forwarding != nil) {
+				t.Errorf("Got forwarding %+v with a TUN device %v", advertisement.Forwarding, test.tun)
+			}
+		})
+	}
+}
+
+func TestExitNodeMetricsAreCached(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	resetExitNodeMetrics()
+	defer resetExitNodeMetrics()
+
+	advertised := func() float64 {
+		for _, metric := range exitNodeMetrics() {
+			if metric.Name == "gerbil_exit_node_advertised" {
+				return metric.Samples[0].Value
+			}
+		}
+		t.Fatal("No gerbil_exit_node_advertised metric")
+		return 0
+	}
+	if advertised() != metrics.Bool(true) {
+		t.Fatalf("Got the exit node not advertised")
+	}
+
+	// Scrapes reuse the state until it is changed through gerbil
+	writeFile(t, filepath.Join(dir, "prefs.json"), `{"AdvertiseRoutes": ["10.0.0.0/24"]}`)
+	if advertised() != metrics.Bool(true) {
+		t.Errorf("Got the prefs queried again on the next scrape")
+	}
+	resetExitNodeMetrics()
+	if advertised() != metrics.Bool(false) {
+		t.Errorf("Got the exit node advertised after a reset")
+	}
+}
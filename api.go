@@ -0,0 +1,151 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// apiPrefix is where the versioned API is served. The unversioned paths it
+// replaced remain as aliases.
+const apiPrefix = "/api/v1"
+
+// Error codes of ErrorDetail. Clients match on these rather than the message.
+const (
+	errCodeBadRequest       = "bad_request"
+	errCodeForbidden        = "forbidden"
+	errCodeNotFound         = "not_found"
+	errCodeConflict         = "conflict"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeNotImplemented   = "not_implemented"
+	errCodeUnavailable      = "unavailable"
+	errCodeTailscale        = "tailscale_error"
+	errCodeDaemonDown       = "tailscale_unavailable"
+	errCodeNeedsLogin       = "tailscale_needs_login"
+	errCodeNeedsMachineAuth = "tailscale_needs_machine_auth"
+	errCodeStopped          = "tailscale_stopped"
+	errCodeControlPlane     = "control_plane_error"
+	errCodeInternal         = "internal_error"
+)
+
+// openAPISpec is the OpenAPI 3 document of the versioned API
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// ErrorResponse is the body of every API error
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes a failed request
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// HealthResponse is served by GET /api/v1/health when the node is healthy
+type HealthResponse struct {
+	Status   string `json:"status"`
+	LoggedIn bool   `json:"loggedIn"`
+}
+
+// PeerChangeResponse lists the actions applied by a peer change
+type PeerChangeResponse struct {
+	PublicKey string   `json:"publicKey"`
+	Actions   []string `json:"actions"`
+}
+
+// registerAPI adds the versioned routes to mux
+func registerAPI(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"/peers", handlePeer)
+	mux.HandleFunc(apiPrefix+"/peers/{id}", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet: handleGetPeer,
+	}))
+	mux.HandleFunc(apiPrefix+"/peers/{id}/latency", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet: handlePeerLatency,
+	}))
+	mux.HandleFunc(apiPrefix+"/status", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet: handleStatus,
+	}))
+	mux.HandleFunc(apiPrefix+"/health", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet: handleHealth,
+	}))
+	mux.HandleFunc(apiPrefix+"/routes", handleRoutes)
+	mux.HandleFunc(apiPrefix+"/exit-node", handleExitNode)
+	mux.HandleFunc(apiPrefix+"/exit-node/advertise", handleAdvertiseExitNode)
+	mux.HandleFunc(apiPrefix+"/diagnostics/netcheck", handleNetcheck)
+	mux.HandleFunc(apiPrefix+"/admin/log-level", handleLogLevel)
+	mux.HandleFunc(apiPrefix+"/openapi.json", allowMethods(map[string]http.HandlerFunc{
+		http.MethodGet: handleOpenAPI,
+	}))
+	// Anything else under the prefix gets a JSON 404 rather than the mux's text one
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "No such endpoint %s", r.URL.Path)
+	})
+}
+
+// allowMethods routes a request to the handler for its method and answers
+// any other method with a 405 error
+func allowMethods(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	var allowed []string
+	for method := range handlers {
+		allowed = append(allowed, method)
+	}
+	slices.Sort(allowed)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method %s not allowed, expected %s", r.Method, strings.Join(allowed, " or "))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// writeJSON sends v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError sends an ErrorResponse carrying the ID of the request
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, format string, args ...interface{}) {
+	writeJSON(w, status, ErrorResponse{Error: ErrorDetail{
+		Code:      code,
+		Message:   fmt.Sprintf(format, args...),
+		RequestID: requestID(r.Context()),
+	}})
+}
+
+// writeStatusError sends the error of a failed Tailscale status query. The
+// node not being up is a 503, so callers can tell it from a failed request.
+func writeStatusError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, tailscale.ErrDaemonUnavailable):
+		writeError(w, r, http.StatusServiceUnavailable, errCodeDaemonDown, "%v", err)
+	case errors.Is(err, tailscale.ErrNeedsLogin):
+		writeError(w, r, http.StatusServiceUnavailable, errCodeNeedsLogin, "%v", err)
+	case errors.Is(err, tailscale.ErrNeedsMachineAuth):
+		writeError(w, r, http.StatusServiceUnavailable, errCodeNeedsMachineAuth, "%v", err)
+	case errors.Is(err, tailscale.ErrStopped):
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStopped, "%v", err)
+	default:
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to get Tailscale status: %v", err)
+	}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+const testStatusJSON = `{
+	"BackendState": "Running",
+	"CurrentTailnet": {"Name": "example.com", "MagicDNSSuffix": "tail1234.ts.net", "MagicDNSEnabled": true},
+	"Self": {
+		"HostName": "gerbil",
+		"DNSName": "gerbil.tail1234.ts.net.",
+		"PublicKey": "nodekey:self",
+		"Online": true,
+		"TailscaleIPs": ["100.64.0.1", "fd7a:115c:a1e0::1"],
+		"AllowedIPs": ["100.64.0.1/32", "0.0.0.0/0", "::/0"],
+		"PrimaryRoutes": ["10.0.0.0/24"],
+		"KeyExpiry": "2030-01-01T00:00:00Z"
+	},
+	"Peer": {
+		"nodekey:exit": {
+			"HostName": "exit",
+			"PublicKey": "nodekey:exit",
+			"OS": "linux",
+			"Online": true,
+			"ExitNodeOption": true,
+			"TailscaleIPs": ["100.64.0.2"],
+			"RxBytes": 10,
+			"TxBytes": 20,
+			"Location": {"Country": "Sweden", "CountryCode": "SE", "City": "Stockholm", "CityCode": "STO"}
+		},
+		"nodekey:laptop": {
+			"HostName": "laptop",
+			"PublicKey": "nodekey:laptop",
+			"OS": "macOS",
+			"Online": false,
+			"TailscaleIPs": ["100.64.0.3"],
+			"LastSeen": "2024-01-01T00:00:00Z"
+		}
+	}
+}`
+
+const testPrefsJSON = `{
+	"ControlURL": "https://controlplane.tailscale.com",
+	"AdvertiseRoutes": ["10.0.0.0/24", "0.0.0.0/0", "::/0"],
+	"ExitNodeAllowLANAccess": false
+}`
+
+const testNetcheckJSON = `{"UDP": true, "IPv4": true, "IPv4CanSend": true, "GlobalV4": "198.51.100.1:41641", "MappingVariesByDestIP": false, "PreferredDERP": 1, "RegionLatency": {"1": 12000000}}`
+
+// fakeTailscaleCLI puts a tailscale CLI on PATH that answers from the files
+// in the returned directory. Removing status.json makes tailscaled look down.
+func fakeTailscaleCLI(t *testing.T, status string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tailscale CLI is a shell script")
+	}
+
+	dir := t.TempDir()
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in --socket=*) shift ;; esac
+case "$*" in
+"status --json") exec cat %[1]s/status.json ;;
+"debug prefs") exec cat %[1]s/prefs.json ;;
+"netcheck --format=json") exec cat %[1]s/netcheck.json ;;
+"whois --json "*) exec cat %[1]s/whois.json ;;
+"set --advertise-routes="*)
+	# Like the real CLI, keep advertising the exit node routes
+	routes=$(echo "${2#--advertise-routes=}" | sed -e 's/[^,][^,]*/"&"/g' -e 's/,/, /g')
+	if grep -q '"0.0.0.0/0"' %[1]s/prefs.json; then
+		routes="${routes:+$routes, }\"0.0.0.0/0\", \"::/0\""
+	fi
+	sed "s|\"AdvertiseRoutes\": \[.*\]|\"AdvertiseRoutes\": [$routes]|" %[1]s/prefs.json > %[1]s/prefs.tmp
+	mv %[1]s/prefs.tmp %[1]s/prefs.json ;;
+"ping -c 1 --until-direct=false "*)
+	# Detailed pings answer directly from the addresses listed in ping-ok
+	echo "$5" >> %[1]s/ping.log
+	grep -qx "$5" %[1]s/ping-ok 2>/dev/null || { echo "timeout waiting for ping reply"; exit 1; }
+	echo "pong from peer ($5) via 198.51.100.9:41641 in 12ms" ;;
+"ping -c 1 "[0-9]*)
+	# Only the addresses listed in ping-ok answer
+	echo "$4" >> %[1]s/ping.log
+	[ -f %[1]s/ping-delay ] && sleep "$(cat %[1]s/ping-delay)"
+	grep -qx "$4" %[1]s/ping-ok 2>/dev/null ;;
+"version") echo 1.80.3; echo "  tailscale commit: test" ;;
+set\ *) echo "$*" >> %[1]s/set.log ;;
+*) echo "unexpected command $*" >&2; exit 1 ;;
+esac
+`, dir)
+	files := map[string]string{
+		"tailscale":     script,
+		"status.json":   status,
+		"prefs.json":    testPrefsJSON,
+		"netcheck.json": testNetcheckJSON,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	previous := tsClient
+	tsClient = tailscale.NewClient()
+	t.Cleanup(func() { tsClient = previous })
+	return dir
+}
+
+// openAPIDocument checks responses against the embedded OpenAPI document
+type openAPIDocument struct {
+	doc map[string]interface{}
+}
+
+func loadOpenAPI(t *testing.T) *openAPIDocument {
+	t.Helper()
+	var doc map[string]interface{}
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("Embedded OpenAPI document is invalid: %v", err)
+	}
+	return &openAPIDocument{doc: doc}
+}
+
+// resolve follows a local $ref such as #/components/schemas/PeerInfo
+func (d *openAPIDocument) resolve(node map[string]interface{}) (map[string]interface{}, error) {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node, nil
+		}
+		var current interface{} = d.doc
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			object, ok := current.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unresolvable $ref %s", ref)
+			}
+			current = object[part]
+		}
+		if node, ok = current.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("unresolvable $ref %s", ref)
+		}
+	}
+}
+
+// responseSchema returns the schema of the response the document declares for
+// path, method and status, falling back to the default response
+func (d *openAPIDocument) responseSchema(path, method string, status int) (map[string]interface{}, error) {
+	paths, _ := d.doc["paths"].(map[string]interface{})
+	item, ok := paths[path].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("path %s is not documented", path)
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s is not documented", method, path)
+	}
+	responses, _ := operation["responses"].(map[string]interface{})
+	response, ok := responses[fmt.Sprint(status)].(map[string]interface{})
+	if !ok {
+		if response, ok = responses["default"].(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%s %s has no %d response", method, path, status)
+		}
+	}
+	response, err := d.resolve(response)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := response["content"].(map[string]interface{})
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s %d has no JSON content", method, path, status)
+	}
+	schema, ok := media["schema"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s %s %d has no schema", method, path, status)
+	}
+	return schema, nil
+}
+
+// validate checks value against the subset of JSON Schema the document uses
+func (d *openAPIDocument) validate(schema map[string]interface{}, value interface{}, at string) error {
+	schema, err := d.resolve(schema)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable || schema["type"] == nil {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not nullable", at)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %T", at, value)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing required property %s", at, name)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		additional, _ := schema["additionalProperties"].(map[string]interface{})
+		for name, property := range object {
+			propertySchema, ok := properties[name].(map[string]interface{})
+			if !ok {
+				if additional == nil {
+					return fmt.Errorf("%s: undocumented property %s", at, name)
+				}
+				propertySchema = additional
+			}
+			if err := d.validate(propertySchema, property, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %T", at, value)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			if err := d.validate(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: expected a string, got %T", at, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return fmt.Errorf("%s: expected an integer, got %v", at, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected a number, got %T", at, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean, got %T", at, value)
+		}
+	}
+	return nil
+}
+
+func TestAPIContract(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	spec := loadOpenAPI(t)
+
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	server := httptest.NewServer(requestMiddleware(mux))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		// path is the documented path the request is checked against
+		path       string
+		url        string
+		body       string
+		status     int
+		daemonDown bool
+	}{
+		{name: "list peers", method: "GET", path: "/peers", url: "/peers?sort=hostname", status: 200},
+		{name: "list peers with a bad filter", method: "GET", path: "/peers", url: "/peers?cidr=nonsense", status: 400},
+		{name: "list peers without tailscaled", method: "GET", path: "/peers", url: "/peers", status: 503, daemonDown: true},
+		{name: "change peer without admin API", method: "POST", path: "/peers", url: "/peers", body: `{"publicKey": "nodekey:laptop", "expire": true}`, status: 501},
+		{name: "get peer", method: "GET", path: "/peers/{id}", url: "/peers/exit", status: 200},
+		{name: "get missing peer", method: "GET", path: "/peers/{id}", url: "/peers/nobody", status: 404},
+		{name: "peer latency without prober", method: "GET", path: "/peers/{id}/latency", url: "/peers/exit/latency", status: 501},
+		{name: "status", method: "GET", path: "/status", url: "/status", status: 200},
+		{name: "status without tailscaled", method: "GET", path: "/status", url: "/status", status: 200, daemonDown: true},
+		{name: "health", method: "GET", path: "/health", url: "/health", status: 200},
+		{name: "health without tailscaled", method: "GET", path: "/health", url: "/health", status: 503, daemonDown: true},
+		{name: "list routes", method: "GET", path: "/routes", url: "/routes", status: 200},
+		{name: "add route", method: "POST", path: "/routes", url: "/routes", body: `{"routes": ["10.1.0.0/24"]}`, status: 200},
+		{name: "add overlapping route", method: "POST", path: "/routes", url: "/routes?route=10.0.0.0/16", status: 409},
+		{name: "add invalid route", method: "POST", path: "/routes", url: "/routes?route=10.0.0.1/24", status: 400},
+		{name: "replace routes", method: "PUT", path: "/routes", url: "/routes", body: `{"routes": ["10.2.0.0/24"]}`, status: 200},
+		{name: "remove route", method: "DELETE", path: "/routes", url: "/routes?route=10.0.0.0/24", status: 200},
+		{name: "get exit node", method: "GET", path: "/exit-node", url: "/exit-node", status: 200},
+		{name: "set exit node", method: "PUT", path: "/exit-node", url: "/exit-node", body: `{"exitNode": "exit"}`, status: 200},
+		{name: "set missing exit node", method: "PUT", path: "/exit-node", url: "/exit-node", body: `{"exitNode": "nobody"}`, status: 404},
+		{name: "set peer that is no exit node", method: "PUT", path: "/exit-node", url: "/exit-node", body: `{"exitNode": "laptop"}`, status: 400},
+		{name: "set exit node with a bad body", method: "POST", path: "/exit-node", url: "/exit-node", body: `{`, status: 400},
+		{name: "clear exit node", method: "DELETE", path: "/exit-node", url: "/exit-node", status: 200},
+		{name: "get exit node advertisement", method: "GET", path: "/exit-node/advertise", url: "/exit-node/advertise", status: 200},
+		{name: "netcheck", method: "GET", path: "/diagnostics/netcheck", url: "/diagnostics/netcheck?refresh=true", status: 200},
+		{name: "get log levels", method: "GET", path: "/admin/log-level", url: "/admin/log-level", status: 200},
+		{name: "set log level", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"logger": "http", "level": "debug"}`, status: 200},
+		{name: "reset log level", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"logger": "http", "level": ""}`, status: 200},
+		{name: "set unknown logger", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"logger": "nonsense", "level": "debug"}`, status: 400},
+		{name: "set unknown log level", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"level": "loud"}`, status: 400},
+		{name: "switch to debug logging", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"debug": true, "duration": "1m"}`, status: 200},
+		{name: "switch off debug logging", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"debug": false}`, status: 200},
+		{name: "switch to debug logging with a bad duration", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{"debug": true, "duration": "soon"}`, status: 400},
+		{name: "set log level without a level", method: "PUT", path: "/admin/log-level", url: "/admin/log-level", body: `{}`, status: 400},
+		{name: "method not allowed", method: "PATCH", path: "/routes", url: "/routes", status: 405},
+		{name: "unknown endpoint", method: "GET", path: "/status", url: "/nonsense", status: 404},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statusFile := filepath.Join(dir, "status.json")
+			if test.daemonDown {
+				os.Rename(statusFile, statusFile+".down")
+				defer os.Rename(statusFile+".down", statusFile)
+			}
+
+			req, err := http.NewRequest(test.method, server.URL+apiPrefix+test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var body interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("Response is not JSON: %v", err)
+			}
+			if resp.StatusCode != test.status {
+				t.Fatalf("Got status %d, want %d: %v", resp.StatusCode, test.status, body)
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Got Content-Type %q, want application/json", contentType)
+			}
+
+			method := test.method
+			if test.status == http.StatusMethodNotAllowed {
+				// Undocumented methods are answered with the default error
+				method = http.MethodGet
+			}
+			schema, err := spec.responseSchema(test.path, method, resp.StatusCode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := spec.validate(schema, body, "response"); err != nil {
+				t.Errorf("Response doesn't match the OpenAPI document: %v\n%v", err, body)
+			}
+
+			if resp.StatusCode >= 400 {
+				detail := body.(map[string]interface{})["error"].(map[string]interface{})
+				if detail["requestId"] != resp.Header.Get(requestIDHeader) {
+					t.Errorf("Error has request ID %v, header has %q", detail["requestId"], resp.Header.Get(requestIDHeader))
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAPIDocumentsRoutes(t *testing.T) {
+	spec := loadOpenAPI(t)
+	paths := spec.doc["paths"].(map[string]interface{})
+	for _, path := range []string{
+		"/peers", "/peers/{id}", "/peers/{id}/latency", "/status", "/health",
+		"/routes", "/exit-node", "/exit-node/advertise", "/diagnostics/netcheck",
+		"/admin/log-level", "/openapi.json",
+	} {
+		if _, ok := paths[path]; !ok {
+			t.Errorf("%s is served but not documented", path)
+		}
+	}
+}
+
+func TestLegacyHealth(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	statusFile := filepath.Join(dir, "status.json")
+
+	tests := []struct {
+		name   string
+		status string
+		code   int
+		body   string
+	}{
+		{name: "logged in", status: testStatusJSON, code: http.StatusOK, body: "OK"},
+		{name: "needs login", status: `{"BackendState": "NeedsLogin"}`, code: http.StatusServiceUnavailable, body: "Not logged in\n"},
+		{name: "tailscaled down", code: http.StatusServiceUnavailable, body: "Unhealthy\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(statusFile)
+			if test.status != "" {
+				if err := os.WriteFile(statusFile, []byte(test.status), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			handleLegacyHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if w.Code != test.code || w.Body.String() != test.body {
+				t.Errorf("Got %d %q, want %d %q", w.Code, w.Body.String(), test.code, test.body)
+			}
+		})
+	}
+}
+
+func TestStatusListenPort(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	defer func(config tailscale.DaemonConfig) { daemonConfig, tsDaemon = config, nil }(daemonConfig)
+
+	// The node's endpoints: a STUN endpoint mapped to another port by a NAT
+	// and the host's own socket
+	endpoints := strings.Replace(testStatusJSON, `"HostName": "gerbil",`, `"HostName": "gerbil", "Addrs": ["198.51.100.7:62000", "192.168.1.10:41641"],`, 1)
+	tests := []struct {
+		name      string
+		launched  bool
+		port      int
+		endpoints bool
+		want      interface{}
+	}{
+		{name: "launched with a port", launched: true, port: 41000, endpoints: true, want: float64(41000)},
+		{name: "launched with a picked port", launched: true, endpoints: true, want: float64(41641)},
+		{name: "already running", port: 41000, endpoints: true, want: float64(41641)},
+		{name: "no endpoints yet"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := testStatusJSON
+			if test.endpoints {
+				status = endpoints
+			}
+			writeFile(t, filepath.Join(dir, "status.json"), status)
+			daemonConfig = tailscale.DaemonConfig{Port: test.port}
+			tsDaemon = nil
+			if test.launched {
+				tsDaemon = tailscale.NewDaemon(daemonConfig)
+			}
+
+			w := httptest.NewRecorder()
+			handleStatus(w, httptest.NewRequest(http.MethodGet, apiPrefix+"/status", nil))
+			var body map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if port := body["listenPort"]; port != test.want {
+				t.Errorf("Got listen port %v, want %v", port, test.want)
+			}
+		})
+	}
+}
+
+func TestNetworkingMode(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	defer func(config tailscale.DaemonConfig) { daemonConfig, tsDaemon = config, nil }(daemonConfig)
+
+	tests := []struct {
+		name     string
+		launched bool
+		tun      string
+		// status is what an external tailscaled reports
+		status     string
+		mode       string
+		forwarding bool
+	}{
+		{name: "kernel", launched: true, tun: "tailscale0", mode: "kernel", forwarding: true},
+		{name: "userspace", launched: true, tun: tailscale.TunUserspace, mode: "userspace"},
+		// The configured mode doesn't apply to a tailscaled gerbil didn't launch
+		{name: "external kernel", tun: tailscale.TunUserspace, status: `{"BackendState": "Running", "TUN": true}`, mode: "external", forwarding: true},
+		{name: "external userspace", tun: "tailscale0", status: `{"BackendState": "Running", "TUN": false}`, mode: "external"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := test.status
+			if status == "" {
+				status = testStatusJSON
+			}
+			if err := os.WriteFile(filepath.Join(dir, "status.json"), []byte(status), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			daemonConfig = tailscale.DaemonConfig{Tun: test.tun}
+			tsDaemon = nil
+			if test.launched {
+				tsDaemon = tailscale.NewDaemon(daemonConfig)
+			}
+
+			if mode := networkingStatus().Mode; mode != test.mode {
+				t.Errorf("Got mode %q, want %q", mode, test.mode)
+			}
+			forwarding, err := forwardingRequired(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if forwarding != test.forwarding {
+				t.Errorf("Got forwarding required %v, want %v", forwarding, test.forwarding)
+			}
+		})
+	}
+}
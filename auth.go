@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// apiAccess lists the tailnet users and tags allowed to call the API
+type apiAccess struct {
+	users map[string]bool
+	tags  map[string]bool
+}
+
+// probePaths are served without an identity check
+var probePaths = map[string]bool{
+	"/health": true,
+	"/livez":  true,
+	"/readyz": true,
+}
+
+// newAPIAccess builds an access list from comma separated users and tags
+func newAPIAccess(users, tags string) apiAccess {
+	return apiAccess{
+		users: splitSet(users),
+		tags:  splitSet(tags),
+	}
+}
+
+// enabled reports whether callers have to be authorized at all
+func (a apiAccess) enabled() bool {
+	return len(a.users) > 0 || len(a.tags) > 0
+}
+
+// middleware rejects requests whose tailnet identity is not on the access
+// list. The identity is kept in the request context for the request log line.
+func (a apiAccess) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Orchestrators probe from outside the tailnet
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		identity, err := tailscaleClient(r.Context()).WhoIs(r.RemoteAddr)
+		if err != nil {
+			httpLog.Warnw(fmt.Sprintf("Rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err), "request_id", requestID(r.Context()))
+			writeError(w, r, http.StatusForbidden, errCodeForbidden, "Forbidden")
+			return
+		}
+		setRequestIdentity(r.Context(), identity)
+
+		allowed := a.users[identity.LoginName]
+		for _, tag := range identity.Tags {
+			if a.tags[tag] {
+				allowed = true
+			}
+		}
+		if !allowed {
+			httpLog.Warnw(fmt.Sprintf("Rejected %s %s from %s: %s is not allowed", r.Method, r.URL.Path, r.RemoteAddr, identity), "request_id", requestID(r.Context()))
+			writeError(w, r, http.StatusForbidden, errCodeForbidden, "Forbidden")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identityTTL is how long a caller's identity is reused before it is looked
+// up again when identities are only recorded
+const identityTTL = time.Minute
+
+// identityRecorder records the tailnet identity of callers on an API that is
+// served on the tailnet without an access list. Nobody is rejected, and the
+// identities are cached by address so a busy caller doesn't cost a whois
+// lookup per request.
+type identityRecorder struct {
+	mu         sync.Mutex
+	identities map[string]cachedIdentity
+	now        func() time.Time
+}
+
+// cachedIdentity is an identity with the time it was looked up
+type cachedIdentity struct {
+	identity *tailscale.Identity
+	at       time.Time
+}
+
+// newIdentityRecorder returns a recorder with an empty cache
+func newIdentityRecorder() *identityRecorder {
+	return &identityRecorder{
+		identities: make(map[string]cachedIdentity),
+		now:        time.Now,
+	}
+}
+
+// middleware records the identity of each caller for the request log line
+func (c *identityRecorder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !probePaths[r.URL.Path] {
+			if identity := c.lookup(r); identity != nil {
+				setRequestIdentity(r.Context(), identity)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookup returns the caller's identity from the cache or a whois lookup, or
+// nil when the caller isn't known to the tailnet
+func (c *identityRecorder) lookup(r *http.Request) *tailscale.Identity {
+	host := r.RemoteAddr
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		host = addr.Addr().String()
+	}
+
+	c.mu.Lock()
+	cached, ok := c.identities[host]
+	c.mu.Unlock()
+	if ok && c.now().Sub(cached.at) < identityTTL {
+		return cached.identity
+	}
+
+	identity, err := tailscaleClient(r.Context()).WhoIs(r.RemoteAddr)
+	if err != nil {
+		httpLog.Debugw(fmt.Sprintf("No tailnet identity for %s: %v", r.RemoteAddr, err), "request_id", requestID(r.Context()))
+		return nil
+	}
+	c.mu.Lock()
+	c.identities[host] = cachedIdentity{identity: identity, at: c.now()}
+	c.mu.Unlock()
+	return identity
+}
+
+// splitSet turns a comma separated list into a set, ignoring blanks
+func splitSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range splitList(list) {
+		set[item] = true
+	}
+	return set
+}
+
+// splitList parses a comma separated list, keeping the order of the items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// logRecorder is a sink that keeps the entries logged during a test
+type logRecorder struct {
+	mu      sync.Mutex
+	entries []logger.Entry
+}
+
+func (r *logRecorder) Write(e logger.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+	return nil
+}
+
+func (r *logRecorder) Close() error {
+	return nil
+}
+
+// find returns the first entry with the message, or false
+func (r *logRecorder) find(message string) (logger.Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.Message == message {
+			return e, true
+		}
+	}
+	return logger.Entry{}, false
+}
+
+// recordLogs sends log entries to a recorder until the test ends
+func recordLogs(t *testing.T) *logRecorder {
+	recorder := &logRecorder{}
+	root := logger.GetLogger()
+	previous := root.Outputs()
+	root.SetOutputs(logger.Output{Sink: recorder, Level: logger.DEBUG})
+	t.Cleanup(func() { root.SetOutputs(previous...) })
+	return recorder
+}
+
+// entryField returns the value of a field of a log entry
+func entryField(e logger.Entry, key string) (interface{}, bool) {
+	for i := 0; i+1 < len(e.Fields); i += 2 {
+		if e.Fields[i] == key {
+			return e.Fields[i+1], true
+		}
+	}
+	return nil, false
+}
+
+func TestAPIAccess(t *testing.T) {
+	const (
+		userWhoIs = `{"Node": {"Name": "laptop.example.ts.net."}, "UserProfile": {"LoginName": "alice@example.com"}}`
+		tagWhoIs  = `{"Node": {"Name": "ci.example.ts.net.", "Tags": ["tag:ci", "tag:monitoring"]}, "UserProfile": {"LoginName": "tagged-devices"}}`
+	)
+	tests := []struct {
+		name  string
+		whois string
+		users string
+		tags  string
+		path  string
+
+		wantStatus int
+		// wantIdentity is the identity field of the request log line
+		wantIdentity string
+	}{
+		{name: "allowed user", whois: userWhoIs, users: "bob@example.com, alice@example.com", wantStatus: http.StatusOK, wantIdentity: "alice@example.com (laptop.example.ts.net.)"},
+		{name: "user not listed", whois: userWhoIs, users: "bob@example.com", tags: "tag:ci", wantStatus: http.StatusForbidden, wantIdentity: "alice@example.com (laptop.example.ts.net.)"},
+		{name: "allowed tag", whois: tagWhoIs, tags: "tag:monitoring", wantStatus: http.StatusOK, wantIdentity: "ci.example.ts.net. [tag:ci tag:monitoring]"},
+		{name: "tag not listed", whois: tagWhoIs, users: "tagged-devices@example.com", tags: "tag:prod", wantStatus: http.StatusForbidden, wantIdentity: "ci.example.ts.net. [tag:ci tag:monitoring]"},
+		{name: "failed lookup", users: "alice@example.com", wantStatus: http.StatusForbidden},
+		{name: "probe without lookup", users: "alice@example.com", path: "/livez", wantStatus: http.StatusOK},
+		{name: "legacy health probe without lookup", users: "alice@example.com", path: "/health", wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := fakeTailscaleCLI(t, testStatusJSON)
+			if test.whois != "" {
+				if err := os.WriteFile(filepath.Join(dir, "whois.json"), []byte(test.whois), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			logs := recordLogs(t)
+
+			access := newAPIAccess(test.users, test.tags)
+			handler := requestMiddleware(access.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if identity := requestIdentity(r.Context()); (identity == nil) != (test.wantIdentity == "") {
+					t.Errorf("Got identity %v in the request context, want %q", identity, test.wantIdentity)
+				}
+				w.WriteHeader(http.StatusOK)
+			})))
+			path := test.path
+			if path == "" {
+				path = apiPrefix + "/status"
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.RemoteAddr = "100.64.0.2:41641"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("Got status %d, want %d", w.Code, test.wantStatus)
+			}
+			entry, ok := logs.find("GET " + path)
+			if !ok {
+				t.Fatal("Got no request log line")
+			}
+			identity, ok := entryField(entry, "identity")
+			if test.wantIdentity == "" {
+				if ok {
+					t.Errorf("Got identity %v in the log line, want none", identity)
+				}
+			} else if identity != test.wantIdentity {
+				t.Errorf("Got identity %v in the log line, want %q", identity, test.wantIdentity)
+			}
+		})
+	}
+}
+
+func TestIdentityRecorder(t *testing.T) {
+	const whois = `{"Node": {"Name": "laptop.example.ts.net."}, "UserProfile": {"LoginName": "alice@example.com"}}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		// tailnet is whether whois knows the caller
+		tailnet      bool
+		wantIdentity string
+	}{
+		{name: "read from the tailnet", method: http.MethodGet, tailnet: true, wantIdentity: "alice@example.com (laptop.example.ts.net.)"},
+		{name: "change from the tailnet", method: http.MethodDelete, tailnet: true, wantIdentity: "alice@example.com (laptop.example.ts.net.)"},
+		{name: "unknown caller is served", method: http.MethodPost},
+		{name: "probe without lookup", method: http.MethodGet, path: "/health", tailnet: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := fakeTailscaleCLI(t, testStatusJSON)
+			if test.tailnet {
+				if err := os.WriteFile(filepath.Join(dir, "whois.json"), []byte(whois), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			logs := recordLogs(t)
+
+			handler := requestMiddleware(newIdentityRecorder().middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+			path := test.path
+			if path == "" {
+				path = apiPrefix + "/routes"
+			}
+			req := httptest.NewRequest(test.method, path, nil)
+			req.RemoteAddr = "100.64.0.2:41641"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Got status %d, want %d", w.Code, http.StatusOK)
+			}
+			entry, ok := logs.find(test.method + " " + path)
+			if !ok {
+				t.Fatal("Got no request log line")
+			}
+			identity, ok := entryField(entry, "identity")
+			if test.wantIdentity == "" {
+				if ok {
+					t.Errorf("Got identity %v in the log line, want none", identity)
+				}
+			} else if identity != test.wantIdentity {
+				t.Errorf("Got identity %v in the log line, want %q", identity, test.wantIdentity)
+			}
+		})
+	}
+}
+
+func TestIdentityRecorderCache(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	whois := filepath.Join(dir, "whois.json")
+	if err := os.WriteFile(whois, []byte(`{"Node": {"Name": "laptop.example.ts.net."}, "UserProfile": {"LoginName": "alice@example.com"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	recorder := newIdentityRecorder()
+	recorder.now = func() time.Time { return now }
+	lookup := func(remote string) *tailscale.Identity {
+		req := httptest.NewRequest(http.MethodGet, apiPrefix+"/status", nil)
+		req.RemoteAddr = remote
+		return recorder.lookup(req)
+	}
+
+	if identity := lookup("100.64.0.2:41641"); identity == nil {
+		t.Fatal("Got no identity for a tailnet caller")
+	}
+	// Without whois answering, only the cache can know the caller
+	if err := os.Remove(whois); err != nil {
+		t.Fatal(err)
+	}
+	if identity := lookup("100.64.0.2:50000"); identity == nil {
+		t.Error("Got no identity from the cache for another port of the same caller")
+	}
+	now = now.Add(identityTTL)
+	if identity := lookup("100.64.0.2:41641"); identity != nil {
+		t.Errorf("Got identity %v after the cache expired, want a new lookup", identity)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// Config holds the parsed command line flags and environment variables
+type Config struct {
+	ConfigFile      string
+	RemoteConfigURL string
+	ListenAddr      string
+	NotifyURL       string
+
+	LogLevel  logger.LogLevel
+	LogFormat logger.Format
+	LogLevels string
+	LogSinks  string
+
+	// Tailscale holds the node settings given without a config file
+	Tailscale TailscaleConfig
+	Timeouts  startupTimeouts
+	Daemon    tailscale.DaemonConfig
+	Embedded  bool
+
+	TailnetOnly  bool
+	AllowedUsers string
+	AllowedTags  string
+
+	APIKey        string
+	OAuthClientID string
+	OAuthSecret   string
+	Tailnet       string
+	AdminAPIURL   string
+
+	HeadscaleURL  string
+	HeadscaleKey  string
+	HeadscaleUser string
+
+	RoutesFile string
+
+	ExitNodes         []string
+	ExitNodeCheck     time.Duration
+	AdvertiseExitNode bool
+	EnableForwarding  bool
+
+	NetcheckInterval time.Duration
+
+	ProbePeers    []string
+	ProbeInterval time.Duration
+	ProbeHistory  int
+	ProbePingType string
+
+	KeyExpiryThresholds []time.Duration
+	KeyExpiryReauth     time.Duration
+
+	// OTLPEndpoint enables exporting request traces to an OTLP/HTTP collector
+	OTLPEndpoint string
+	OTLPHeaders  map[string]string
+
+	// ReadyGracePeriod is how long Tailscale may be down before /readyz fails
+	ReadyGracePeriod time.Duration
+	// BandwidthMaxAge is how old the last successful bandwidth report may be
+	// before /readyz fails
+	BandwidthMaxAge time.Duration
+}
+
+// parseConfig reads the configuration from environment variables, falling
+// back to command line flags for those that are not set
+func parseConfig(name string, args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var (
+		configFile      string
+		remoteConfigURL string
+		listenAddr      string
+		notifyURL       string
+		logLevel        string
+		logFormat       string
+		logLevels       string
+		logSinks        string
+		authKey         string
+		authKeyReusable bool
+		hostname        string
+		controlURL      string
+		daemonTimeout   string
+		loginTimeout    string
+		stateDir        string
+		socketPath      string
+		tunMode         string
+		tailscalePort   string
+		userspace       bool
+		embedded        bool
+		tailnetOnly     bool
+		allowedUsers    string
+		allowedTags     string
+		socks5Addr      string
+		httpProxyAddr   string
+		apiKey          string
+		oauthClientID   string
+		oauthSecret     string
+		tailnet         string
+		adminAPIURL     string
+		headscaleURL    string
+		headscaleKey    string
+		headscaleUser   string
+		routesFile      string
+		exitNodes       string
+		exitNodeCheck   string
+		advertiseExit   bool
+		forwarding      bool
+		netcheckEvery   string
+		probePeers      string
+		probeEvery      string
+		probeHistory    string
+		probePingType   string
+		expiryWarnings  string
+		expiryReauth    string
+		otlpEndpoint    string
+		otlpHeaders     string
+		readyGrace      string
+		bandwidthMaxAge string
+	)
+
+	opts := &options{fs: fs, getenv: getenv}
+	opts.String(&configFile, "CONFIG", "config", "", "Path to local configuration file")
+	opts.String(&remoteConfigURL, "REMOTE_CONFIG", "remoteConfig", "", "URL of the Pangolin server")
+	opts.String(&listenAddr, "LISTEN", "listen", ":3003", "Address to listen on")
+	opts.String(&logLevel, "LOG_LEVEL", "log-level", "INFO", "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+	opts.String(&logFormat, "LOG_FORMAT", "log-format", "text", "Log format (text, json)")
+	opts.String(&logSinks, "LOG_SINKS", "log-sinks", "stdout", "Comma separated log sinks: stdout, stderr, file://<path>, syslog[://<host:port>|:///<socket>], journald, each with an optional ?level=")
+	opts.String(&logLevels, "LOG_LEVELS", "log-levels", "", "Comma separated levels of the tailscale, bandwidth, http and config loggers, like tailscale=debug")
+	opts.String(&notifyURL, "NOTIFY_URL", "notify", "", "URL to notify on peer changes")
+	opts.String(&authKey, "TAILSCALE_AUTHKEY", "authkey", "", "Tailscale auth key")
+	opts.Bool(&authKeyReusable, "TAILSCALE_AUTHKEY_REUSABLE", "authkey-reusable", false, "The auth key is reusable, so it may renew the node key before it expires")
+	opts.String(&hostname, "TAILSCALE_HOSTNAME", "hostname", "", "Tailscale hostname")
+	opts.String(&controlURL, "TAILSCALE_CONTROL_URL", "control-url", "", "Tailscale control server URL")
+	opts.String(&daemonTimeout, "TAILSCALE_DAEMON_TIMEOUT", "daemon-timeout", "30s", "How long to wait for tailscaled to become ready")
+	opts.String(&loginTimeout, "TAILSCALE_LOGIN_TIMEOUT", "login-timeout", "60s", "How long to wait for Tailscale to reach the Running state after login")
+	opts.String(&stateDir, "TAILSCALED_STATE_DIR", "state-dir", "/var/lib/tailscale", "Directory for tailscaled state")
+	opts.String(&socketPath, "TAILSCALED_SOCKET", "socket", "/var/run/tailscale/tailscaled.sock", "Path of the tailscaled socket")
+	opts.String(&tunMode, "TAILSCALED_TUN", "tun", "tailscale0", "TUN device name for tailscaled, or userspace-networking")
+	opts.String(&tailscalePort, "TAILSCALED_PORT", "port", "41641", "UDP port for tailscaled to listen on (0 picks one automatically)")
+	opts.Bool(&userspace, "TAILSCALED_USERSPACE", "userspace", false, "Run tailscaled with userspace networking so no NET_ADMIN capability is needed")
+	opts.String(&socks5Addr, "TAILSCALED_SOCKS5_SERVER", "socks5-server", "", "Listen address for the tailscaled SOCKS5 proxy in userspace mode (default "+tailscale.DefaultProxyAddr+")")
+	opts.String(&httpProxyAddr, "TAILSCALED_HTTP_PROXY", "http-proxy", "", "Listen address for the tailscaled HTTP proxy in userspace mode (default "+tailscale.DefaultProxyAddr+")")
+	opts.Bool(&embedded, "TAILSCALE_EMBEDDED", "embedded", false, "Run an embedded Tailscale node instead of using tailscaled")
+	opts.Bool(&tailnetOnly, "API_TAILNET_ONLY", "tailnet-only", false, "Serve the HTTP API only on this node's Tailscale IP")
+	opts.String(&allowedUsers, "API_ALLOWED_USERS", "allowed-users", "", "Comma separated tailnet login names allowed to call the API")
+	opts.String(&allowedTags, "API_ALLOWED_TAGS", "allowed-tags", "", "Comma separated tailnet tags allowed to call the API")
+	opts.String(&apiKey, "TAILSCALE_API_KEY", "api-key", "", "Tailscale admin API key used to manage peers")
+	opts.String(&oauthClientID, "TAILSCALE_OAUTH_CLIENT_ID", "oauth-client-id", "", "Tailscale OAuth client ID used to manage peers")
+	opts.String(&oauthSecret, "TAILSCALE_OAUTH_CLIENT_SECRET", "oauth-client-secret", "", "Tailscale OAuth client secret used to manage peers")
+	opts.String(&tailnet, "TAILSCALE_TAILNET", "tailnet", "-", "Tailnet name for the admin API (- is the tailnet of the credentials)")
+	opts.String(&adminAPIURL, "TAILSCALE_API_URL", "api-url", controlplane.DefaultTailscaleAPIURL, "Base URL of the Tailscale admin API")
+	opts.String(&headscaleURL, "HEADSCALE_API_URL", "headscale-url", "", "Headscale API URL (defaults to the control URL)")
+	opts.String(&headscaleKey, "HEADSCALE_API_KEY", "headscale-api-key", "", "Headscale API key, enables Headscale integration")
+	opts.String(&headscaleUser, "HEADSCALE_USER", "headscale-user", "", "Headscale user to create this node's pre-auth keys for")
+	opts.String(&routesFile, "ROUTES_FILE", "routes-file", "", "File to persist advertised subnet routes in (default <state-dir>/gerbil-routes.json)")
+	opts.String(&exitNodes, "EXIT_NODE_FAILOVER", "exit-node-failover", "", "Comma separated exit nodes in priority order to fail over between")
+	opts.String(&exitNodeCheck, "EXIT_NODE_CHECK_INTERVAL", "exit-node-check-interval", "30s", "How often to check the active exit node when failover is enabled")
+	opts.Bool(&advertiseExit, "TAILSCALE_ADVERTISE_EXIT_NODE", "advertise-exit-node", false, "Offer this node as an exit node")
+	opts.Bool(&forwarding, "ENABLE_IP_FORWARDING", "enable-ip-forwarding", false, "Enable the IP forwarding sysctls when advertising an exit node")
+	opts.String(&netcheckEvery, "NETCHECK_INTERVAL", "netcheck-interval", "0", "How often to run netcheck for the metrics (0 disables periodic runs)")
+	opts.String(&probePeers, "PROBE_PEERS", "probe-peers", "", "Comma separated peers to probe (default all online peers)")
+	opts.String(&probeEvery, "PROBE_INTERVAL", "probe-interval", "0", "How often to ping peers for their latency history (0 disables probing)")
+	opts.String(&probeHistory, "PROBE_HISTORY", "probe-history", "120", "Number of probes to keep per peer")
+	opts.String(&probePingType, "PROBE_PING_TYPE", "probe-ping-type", tailscale.PingDisco, "Ping type for probes, disco or TSMP")
+	opts.String(&expiryWarnings, "KEY_EXPIRY_THRESHOLDS", "key-expiry-thresholds", "7d,1d", "Comma separated times before a node key expires to send notify events at")
+	opts.String(&expiryReauth, "KEY_EXPIRY_REAUTH", "key-expiry-reauth", "1d", "How long before this node's key expires to re-authenticate, with Headscale or a reusable auth key (0 disables)")
+	opts.String(&otlpEndpoint, "OTEL_EXPORTER_OTLP_ENDPOINT", "otlp-endpoint", "", "OTLP/HTTP collector URL to export request traces to, like http://localhost:4318")
+	opts.String(&otlpHeaders, "OTEL_EXPORTER_OTLP_HEADERS", "otlp-headers", "", "Comma separated name=value headers to send to the OTLP collector")
+	opts.String(&readyGrace, "READY_GRACE_PERIOD", "ready-grace-period", "30s", "How long Tailscale may be logged out or not running before /readyz fails")
+	opts.String(&bandwidthMaxAge, "BANDWIDTH_REPORT_MAX_AGE", "bandwidth-report-max-age", "1m", "How old the last successful bandwidth report may be before /readyz fails")
+	if opts.err != nil {
+		return Config{}, opts.err
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, &ConfigError{Err: err}
+	}
+
+	cfg := Config{
+		ConfigFile:      configFile,
+		RemoteConfigURL: remoteConfigURL,
+		ListenAddr:      listenAddr,
+		NotifyURL:       notifyURL,
+		LogLevels:       logLevels,
+		LogSinks:        logSinks,
+		Tailscale: TailscaleConfig{
+			AuthKey:         authKey,
+			AuthKeyReusable: authKeyReusable,
+			ControlURL:      controlURL,
+			Hostname:        hostname,
+		},
+		Embedded:          embedded,
+		TailnetOnly:       tailnetOnly,
+		AllowedUsers:      allowedUsers,
+		AllowedTags:       allowedTags,
+		APIKey:            apiKey,
+		OAuthClientID:     oauthClientID,
+		OAuthSecret:       oauthSecret,
+		Tailnet:           tailnet,
+		AdminAPIURL:       adminAPIURL,
+		HeadscaleURL:      headscaleURL,
+		HeadscaleKey:      headscaleKey,
+		HeadscaleUser:     headscaleUser,
+		RoutesFile:        routesFile,
+		ExitNodes:         splitList(exitNodes),
+		AdvertiseExitNode: advertiseExit,
+		EnableForwarding:  forwarding,
+		ProbePeers:        splitList(probePeers),
+		ProbePingType:     probePingType,
+		OTLPEndpoint:      otlpEndpoint,
+	}
+
+	var err error
+	if cfg.LogLevel, err = logger.ParseLevel(logLevel); err != nil {
+		return cfg, &ConfigError{Option: "log-level", Err: err}
+	}
+	if cfg.LogFormat, err = logger.ParseFormat(logFormat); err != nil {
+		return cfg, &ConfigError{Option: "log-format", Err: err}
+	}
+
+	if cfg.Timeouts.daemon, err = time.ParseDuration(daemonTimeout); err != nil || cfg.Timeouts.daemon <= 0 {
+		return cfg, invalidOption("daemon-timeout", daemonTimeout)
+	}
+	if cfg.Timeouts.login, err = time.ParseDuration(loginTimeout); err != nil || cfg.Timeouts.login <= 0 {
+		return cfg, invalidOption("login-timeout", loginTimeout)
+	}
+
+	if cfg.ExitNodeCheck, err = time.ParseDuration(exitNodeCheck); err != nil || cfg.ExitNodeCheck <= 0 {
+		return cfg, invalidOption("exit-node-check-interval", exitNodeCheck)
+	}
+
+	if cfg.NetcheckInterval, err = time.ParseDuration(netcheckEvery); err != nil || cfg.NetcheckInterval < 0 {
+		return cfg, invalidOption("netcheck-interval", netcheckEvery)
+	}
+
+	if cfg.ProbeInterval, err = time.ParseDuration(probeEvery); err != nil || cfg.ProbeInterval < 0 {
+		return cfg, invalidOption("probe-interval", probeEvery)
+	}
+	if cfg.ProbeHistory, err = strconv.Atoi(probeHistory); err != nil || cfg.ProbeHistory < 1 {
+		return cfg, invalidOption("probe-history", probeHistory)
+	}
+	if probePingType != tailscale.PingDisco && probePingType != tailscale.PingTSMP {
+		return cfg, &ConfigError{Option: "probe-ping-type", Err: fmt.Errorf("invalid value %q, use %s or %s", probePingType, tailscale.PingDisco, tailscale.PingTSMP)}
+	}
+
+	if cfg.KeyExpiryThresholds, err = parseThresholds(expiryWarnings); err != nil {
+		return cfg, &ConfigError{Option: "key-expiry-thresholds", Err: err}
+	}
+	if cfg.KeyExpiryReauth, err = parseDays(expiryReauth); err != nil || cfg.KeyExpiryReauth < 0 {
+		return cfg, invalidOption("key-expiry-reauth", expiryReauth)
+	}
+
+	if cfg.ReadyGracePeriod, err = time.ParseDuration(readyGrace); err != nil || cfg.ReadyGracePeriod < 0 {
+		return cfg, invalidOption("ready-grace-period", readyGrace)
+	}
+	if cfg.BandwidthMaxAge, err = time.ParseDuration(bandwidthMaxAge); err != nil || cfg.BandwidthMaxAge <= 0 {
+		return cfg, invalidOption("bandwidth-report-max-age", bandwidthMaxAge)
+	}
+
+	if cfg.RoutesFile == "" {
+		cfg.RoutesFile = filepath.Join(stateDir, "gerbil-routes.json")
+	}
+
+	// 0 lets tailscaled pick the port
+	port, err := strconv.Atoi(tailscalePort)
+	if err != nil || port < 0 || port > 65535 {
+		return cfg, invalidOption("port", tailscalePort)
+	}
+	if userspace {
+		tunMode = tailscale.TunUserspace
+	}
+	cfg.Daemon = tailscale.DaemonConfig{
+		StateDir: stateDir,
+		Socket:   socketPath,
+		Tun:      tunMode,
+		Port:     port,
+	}
+	if cfg.Daemon.Userspace() {
+		// Without a TUN device the tailnet is only reachable through these proxies
+		cfg.Daemon.Socks5Addr = socks5Addr
+		cfg.Daemon.HTTPProxyAddr = httpProxyAddr
+		if cfg.Daemon.Socks5Addr == "" {
+			cfg.Daemon.Socks5Addr = tailscale.DefaultProxyAddr
+		}
+		if cfg.Daemon.HTTPProxyAddr == "" {
+			cfg.Daemon.HTTPProxyAddr = tailscale.DefaultProxyAddr
+		}
+	}
+
+	if cfg.OTLPHeaders, err = parseHeaders(otlpHeaders); err != nil {
+		return cfg, &ConfigError{Option: "otlp-headers", Err: err}
+	}
+
+	// Clean up the remote config URL for backwards compatibility
+	cfg.RemoteConfigURL = strings.TrimSuffix(cfg.RemoteConfigURL, "/gerbil/get-config")
+	cfg.RemoteConfigURL = strings.TrimSuffix(cfg.RemoteConfigURL, "/")
+
+	// With Headscale the auth key can be created on demand
+	if cfg.ConfigFile == "" && cfg.RemoteConfigURL == "" && cfg.Tailscale.AuthKey == "" && (cfg.HeadscaleKey == "" || cfg.HeadscaleUser == "") {
+		return cfg, &ConfigError{Err: errors.New("you must provide either a config file, remote config URL, or Tailscale auth key")}
+	}
+	return cfg, nil
+}
+
+// options registers each option as an environment variable that, when set,
+// takes precedence over the command line flag of the same option
+type options struct {
+	fs     *flag.FlagSet
+	getenv func(string) string
+	// err is the first invalid environment variable
+	err error
+}
+
+// String reads p from the environment variable env, or from the flag name
+// when env is not set
+func (o *options) String(p *string, env, name, value, usage string) {
+	if *p = o.getenv(env); *p == "" {
+		o.fs.StringVar(p, name, value, usage)
+	}
+}
+
+// Bool reads p from the environment variable env, which takes the same values
+// as the flag such as 1, true or FALSE, or from the flag name when env is not set
+func (o *options) Bool(p *bool, env, name string, value bool, usage string) {
+	v := o.getenv(env)
+	if v == "" {
+		o.fs.BoolVar(p, name, value, usage)
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil && o.err == nil {
+		o.err = &ConfigError{Option: name, Err: fmt.Errorf("invalid %s %q, use true or false", env, v)}
+	}
+	*p = b
+}
+
+// parseHeaders parses a list of headers like "Authorization=Bearer x,X-Team=net"
+func parseHeaders(list string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, item := range splitList(list) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid header %q, use name=value", item)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
+// invalidOption is the error of an option value that doesn't parse or is out of range
+func invalidOption(option, value string) error {
+	return &ConfigError{Option: option, Err: fmt.Errorf("invalid value %q", value)}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(cfg Config) error
+	}{
+		{
+			name: "defaults",
+			check: func(cfg Config) error {
+				if cfg.ListenAddr != ":3003" || cfg.Daemon.Port != 41641 || cfg.ExitNodeCheck != 30*time.Second || cfg.Embedded {
+					return fmt.Errorf("got listen %q, port %d, exit node check %v and embedded %t", cfg.ListenAddr, cfg.Daemon.Port, cfg.ExitNodeCheck, cfg.Embedded)
+				}
+				return nil
+			},
+		},
+		{
+			name: "flags",
+			args: []string{"-listen", ":8080", "-port", "0", "-embedded", "-probe-history", "10"},
+			check: func(cfg Config) error {
+				if cfg.ListenAddr != ":8080" || cfg.Daemon.Port != 0 || !cfg.Embedded || cfg.ProbeHistory != 10 {
+					return fmt.Errorf("got listen %q, port %d, embedded %t and probe history %d", cfg.ListenAddr, cfg.Daemon.Port, cfg.Embedded, cfg.ProbeHistory)
+				}
+				return nil
+			},
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"LISTEN": ":9090", "TAILSCALED_PORT": "41000", "TAILSCALE_EMBEDDED": "true"},
+			check: func(cfg Config) error {
+				if cfg.ListenAddr != ":9090" || cfg.Daemon.Port != 41000 || !cfg.Embedded {
+					return fmt.Errorf("got listen %q, port %d and embedded %t", cfg.ListenAddr, cfg.Daemon.Port, cfg.Embedded)
+				}
+				return nil
+			},
+		},
+		{
+			name: "environment and flags",
+			env:  map[string]string{"LISTEN": ":9090"},
+			args: []string{"-hostname", "gerbil"},
+			check: func(cfg Config) error {
+				if cfg.ListenAddr != ":9090" || cfg.Tailscale.Hostname != "gerbil" {
+					return fmt.Errorf("got listen %q and hostname %q", cfg.ListenAddr, cfg.Tailscale.Hostname)
+				}
+				return nil
+			},
+		},
+		{
+			name: "boolean variables",
+			env:  map[string]string{"TAILSCALED_USERSPACE": "1", "API_TAILNET_ONLY": "TRUE", "TAILSCALE_EMBEDDED": "false"},
+			check: func(cfg Config) error {
+				if !cfg.Daemon.Userspace() || !cfg.TailnetOnly || cfg.Embedded {
+					return fmt.Errorf("got userspace %t, tailnet only %t and embedded %t", cfg.Daemon.Userspace(), cfg.TailnetOnly, cfg.Embedded)
+				}
+				return nil
+			},
+		},
+		{
+			name: "userspace proxies",
+			args: []string{"-userspace"},
+			check: func(cfg Config) error {
+				if !cfg.Daemon.Userspace() || cfg.Daemon.Socks5Addr == "" || cfg.Daemon.HTTPProxyAddr == "" {
+					return fmt.Errorf("got daemon %+v", cfg.Daemon)
+				}
+				return nil
+			},
+		},
+		{
+			name: "derived values",
+			env:  map[string]string{"REMOTE_CONFIG": "https://pangolin.example.com/gerbil/get-config", "TAILSCALED_STATE_DIR": "/state"},
+			check: func(cfg Config) error {
+				if cfg.RemoteConfigURL != "https://pangolin.example.com" || cfg.RoutesFile != "/state/gerbil-routes.json" {
+					return fmt.Errorf("got remote config %q and routes file %q", cfg.RemoteConfigURL, cfg.RoutesFile)
+				}
+				return nil
+			},
+		},
+		{
+			name: "headscale instead of an auth key",
+			env:  map[string]string{"TAILSCALE_AUTHKEY": "", "HEADSCALE_API_KEY": "hskey", "HEADSCALE_USER": "alice"},
+			check: func(cfg Config) error {
+				if cfg.HeadscaleKey != "hskey" || cfg.HeadscaleUser != "alice" {
+					return fmt.Errorf("got Headscale key %q and user %q", cfg.HeadscaleKey, cfg.HeadscaleUser)
+				}
+				return nil
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"TAILSCALE_AUTHKEY": "tskey-auth"}
+			for name, value := range test.env {
+				env[name] = value
+			}
+
+			cfg, err := parseConfig("gerbil", test.args, mapEnv(env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.check(cfg); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		option string
+	}{
+		{name: "no node configuration", env: map[string]string{"TAILSCALE_AUTHKEY": ""}},
+		{name: "headscale without a user", env: map[string]string{"TAILSCALE_AUTHKEY": "", "HEADSCALE_API_KEY": "hskey"}},
+		{name: "unknown flag", args: []string{"-nonsense"}},
+		// A variable that is set hides its flag
+		{name: "flag of a set variable", env: map[string]string{"LISTEN": ":9090"}, args: []string{"-listen", ":8080"}},
+		{name: "boolean variable", env: map[string]string{"TAILSCALED_USERSPACE": "yes"}, option: "userspace"},
+		{name: "log level", env: map[string]string{"LOG_LEVEL": "verbose"}, option: "log-level"},
+		{name: "log format", args: []string{"-log-format", "xml"}, option: "log-format"},
+		{name: "daemon timeout", env: map[string]string{"TAILSCALE_DAEMON_TIMEOUT": "soon"}, option: "daemon-timeout"},
+		{name: "login timeout", args: []string{"-login-timeout", "1"}, option: "login-timeout"},
+		{name: "zero daemon timeout", args: []string{"-daemon-timeout", "0s"}, option: "daemon-timeout"},
+		{name: "negative login timeout", env: map[string]string{"TAILSCALE_LOGIN_TIMEOUT": "-1m"}, option: "login-timeout"},
+		{name: "zero exit node check", args: []string{"-exit-node-check-interval", "0s"}, option: "exit-node-check-interval"},
+		{name: "negative netcheck interval", args: []string{"-netcheck-interval", "-1m"}, option: "netcheck-interval"},
+		{name: "probe interval", env: map[string]string{"PROBE_INTERVAL": "often"}, option: "probe-interval"},
+		{name: "empty probe history", args: []string{"-probe-history", "0"}, option: "probe-history"},
+		{name: "probe ping type", args: []string{"-probe-ping-type", "icmp"}, option: "probe-ping-type"},
+		{name: "key expiry thresholds", args: []string{"-key-expiry-thresholds", "soon"}, option: "key-expiry-thresholds"},
+		{name: "negative key expiry reauth", env: map[string]string{"KEY_EXPIRY_REAUTH": "-1d"}, option: "key-expiry-reauth"},
+		{name: "negative grace period", args: []string{"-ready-grace-period", "-1s"}, option: "ready-grace-period"},
+		{name: "zero bandwidth report age", args: []string{"-bandwidth-report-max-age", "0s"}, option: "bandwidth-report-max-age"},
+		{name: "port", env: map[string]string{"TAILSCALED_PORT": "tailscale"}, option: "port"},
+		{name: "port out of range", args: []string{"-port", "70000"}, option: "port"},
+		{name: "negative port", env: map[string]string{"TAILSCALED_PORT": "-1"}, option: "port"},
+		{name: "otlp headers", args: []string{"-otlp-headers", "Authorization"}, option: "otlp-headers"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"TAILSCALE_AUTHKEY": "tskey-auth"}
+			for name, value := range test.env {
+				env[name] = value
+			}
+
+			_, err := parseConfig("gerbil", test.args, mapEnv(env))
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) {
+				t.Fatalf("Got %v, want a ConfigError", err)
+			}
+			if configErr.Option != test.option {
+				t.Errorf("Got an error about %q, want %q: %v", configErr.Option, test.option, err)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{name: "success", code: exitOK},
+		{name: "help", err: &ConfigError{Err: flag.ErrHelp}, code: exitOK},
+		{name: "configuration", err: &ConfigError{Option: "port", Err: failure}, code: exitConfig},
+		{name: "tailscale", err: &TailscaleError{Err: failure}, code: exitTailscale},
+		{name: "server", err: &ServerError{Addr: ":3003", Err: failure}, code: exitServer},
+		{name: "wrapped", err: fmt.Errorf("startup: %w", &TailscaleError{Err: failure}), code: exitTailscale},
+		{name: "other", err: failure, code: exitFailure},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCode(test.err); code != test.code {
+				t.Errorf("Got exit code %d for %v, want %d", code, test.err, test.code)
+			}
+		})
+	}
+}
+
+// mapEnv looks up environment variables in env
+func mapEnv(env map[string]string) func(string) string {
+	return func(name string) string {
+		return env[name]
+	}
+}
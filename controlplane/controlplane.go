@@ -0,0 +1,35 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDeviceNotFound is returned when no device has the given node key
+var ErrDeviceNotFound = errors.New("device not found in control plane")
+
+// Manager changes devices through the admin API of the control plane.
+// Devices are identified by their node public key, as listed by /peers.
+type Manager interface {
+	// DeleteDevice removes the device from the tailnet
+	DeleteDevice(ctx context.Context, nodeKey string) error
+	// ExpireKey expires the device's node key, forcing it to re-authenticate
+	ExpireKey(ctx context.Context, nodeKey string) error
+	// SetTags replaces the device's ACL tags
+	SetTags(ctx context.Context, nodeKey string, tags []string) error
+	// AuthorizeDevice approves a device that is waiting for admin authorization
+	AuthorizeDevice(ctx context.Context, nodeKey string) error
+	// ApproveRoutes sets the subnet routes the device is allowed to serve
+	ApproveRoutes(ctx context.Context, nodeKey string, routes []string) error
+}
+
+// APIError is a non-success response from the admin API
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("control plane API returned %d: %s", e.StatusCode, e.Message)
+}
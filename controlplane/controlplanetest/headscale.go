@@ -0,0 +1,222 @@
+// Package controlplanetest provides in-memory control plane servers for tests
+package controlplanetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+)
+
+// Headscale is a fake Headscale REST API backed by in-memory state
+type Headscale struct {
+	*httptest.Server
+
+	// APIKey is the bearer token requests must carry
+	APIKey string
+
+	mu          sync.Mutex
+	users       []controlplane.HeadscaleUser
+	nodes       []controlplane.HeadscaleNode
+	preAuthKeys []string
+	nextKey     int
+	requests    int
+}
+
+// NewHeadscale starts a fake Headscale server with the given users and nodes
+func NewHeadscale(apiKey string, users []controlplane.HeadscaleUser, nodes []controlplane.HeadscaleNode) *Headscale {
+	h := &Headscale{
+		APIKey: apiKey,
+		users:  users,
+		nodes:  nodes,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/user", h.handleListUsers)
+	mux.HandleFunc("GET /api/v1/node", h.handleListNodes)
+	mux.HandleFunc("POST /api/v1/preauthkey", h.handleCreatePreAuthKey)
+	mux.HandleFunc("DELETE /api/v1/node/{id}", h.handleDeleteNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/expire", h.handleExpireNode)
+	mux.HandleFunc("POST /api/v1/node/{id}/tags", h.handleSetTags)
+	mux.HandleFunc("POST /api/v1/node/{id}/approve_routes", h.handleApproveRoutes)
+	h.Server = httptest.NewServer(h.authorize(mux))
+	return h
+}
+
+// Nodes returns a copy of the current nodes
+func (h *Headscale) Nodes() []controlplane.HeadscaleNode {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]controlplane.HeadscaleNode(nil), h.nodes...)
+}
+
+// Requests returns how many requests the server has answered
+func (h *Headscale) Requests() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
+
+// PreAuthKeys returns the keys created so far
+func (h *Headscale) PreAuthKeys() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.preAuthKeys...)
+}
+
+func (h *Headscale) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		h.requests++
+		h.mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer "+h.APIKey {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *Headscale) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	name := r.URL.Query().Get("name")
+	users := []controlplane.HeadscaleUser{}
+	for _, user := range h.users {
+		if name == "" || user.Name == name {
+			users = append(users, user)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"users": users})
+}
+
+func (h *Headscale) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeJSON(w, map[string]interface{}{"nodes": h.nodes})
+}
+
+func (h *Headscale) handleCreatePreAuthKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		User string `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	found := false
+	for _, user := range h.users {
+		found = found || user.ID == body.User
+	}
+	if !found {
+		writeError(w, http.StatusBadRequest, "user not found")
+		return
+	}
+
+	h.nextKey++
+	key := fmt.Sprintf("fake-preauthkey-%d", h.nextKey)
+	h.preAuthKeys = append(h.preAuthKeys, key)
+	writeJSON(w, map[string]interface{}{
+		"preAuthKey": map[string]string{"user": body.User, "key": key},
+	})
+}
+
+func (h *Headscale) handleDeleteNode(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, node := range h.nodes {
+		if node.ID == r.PathValue("id") {
+			h.nodes = append(h.nodes[:i], h.nodes[i+1:]...)
+			writeJSON(w, map[string]interface{}{})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "node not found")
+}
+
+func (h *Headscale) handleExpireNode(w http.ResponseWriter, r *http.Request) {
+	h.updateNode(w, r, func(node *controlplane.HeadscaleNode) error {
+		node.Expiry = node.LastSeen
+		node.Online = false
+		return nil
+	})
+}
+
+func (h *Headscale) handleSetTags(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	h.updateNode(w, r, func(node *controlplane.HeadscaleNode) error {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		for _, tag := range body.Tags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return fmt.Errorf("invalid tag %q", tag)
+			}
+		}
+		node.ForcedTags = body.Tags
+		return nil
+	})
+}
+
+func (h *Headscale) handleApproveRoutes(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Routes []string `json:"routes"`
+	}
+	h.updateNode(w, r, func(node *controlplane.HeadscaleNode) error {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return err
+		}
+		node.ApprovedRoutes = body.Routes
+		node.SubnetRoutes = nil
+		for _, route := range body.Routes {
+			for _, available := range node.AvailableRoutes {
+				if route == available {
+					node.SubnetRoutes = append(node.SubnetRoutes, route)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// updateNode applies update to the node named in the path and returns it
+func (h *Headscale) updateNode(w http.ResponseWriter, r *http.Request, update func(*controlplane.HeadscaleNode) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.nodes {
+		if h.nodes[i].ID != r.PathValue("id") {
+			continue
+		}
+		if err := update(&h.nodes[i]); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, map[string]interface{}{"node": h.nodes[i]})
+		return
+	}
+	writeError(w, http.StatusNotFound, "node not found")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": status, "message": message})
+}
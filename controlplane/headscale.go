@@ -0,0 +1,230 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotSupported is returned for actions the control plane has no equivalent for
+var ErrNotSupported = errors.New("not supported by this control plane")
+
+// HeadscaleConfig holds the connection settings for the Headscale REST API
+type HeadscaleConfig struct {
+	BaseURL string
+	APIKey  string
+}
+
+// HeadscaleNode is a node as listed by the Headscale API
+type HeadscaleNode struct {
+	ID              string        `json:"id"`
+	NodeKey         string        `json:"nodeKey"`
+	Name            string        `json:"name"`
+	GivenName       string        `json:"givenName"`
+	User            HeadscaleUser `json:"user"`
+	IPAddresses     []string      `json:"ipAddresses"`
+	Online          bool          `json:"online"`
+	LastSeen        time.Time     `json:"lastSeen"`
+	Expiry          time.Time     `json:"expiry"`
+	ForcedTags      []string      `json:"forcedTags"`
+	ApprovedRoutes  []string      `json:"approvedRoutes"`
+	AvailableRoutes []string      `json:"availableRoutes"`
+	SubnetRoutes    []string      `json:"subnetRoutes"`
+}
+
+// HeadscaleUser is a Headscale user, formerly called a namespace
+type HeadscaleUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+// PreAuthKeyOptions controls the pre-auth keys created by CreatePreAuthKey
+type PreAuthKeyOptions struct {
+	User      string
+	Reusable  bool
+	Ephemeral bool
+	Tags      []string
+	TTL       time.Duration
+}
+
+// Headscale manages nodes through the Headscale REST API
+type Headscale struct {
+	config HeadscaleConfig
+	client *http.Client
+}
+
+// NewHeadscale creates a Headscale API client with the given config
+func NewHeadscale(config HeadscaleConfig) *Headscale {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	return &Headscale{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// ListNodes returns every node known to Headscale
+func (h *Headscale) ListNodes(ctx context.Context) ([]HeadscaleNode, error) {
+	var response struct {
+		Nodes []HeadscaleNode `json:"nodes"`
+	}
+	if err := h.do(ctx, http.MethodGet, "/api/v1/node", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Nodes, nil
+}
+
+// CreatePreAuthKey creates a pre-auth key for the given user
+func (h *Headscale) CreatePreAuthKey(ctx context.Context, options PreAuthKeyOptions) (string, error) {
+	userID, err := h.userID(ctx, options.User)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := options.TTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	body := map[string]interface{}{
+		"user":       userID,
+		"reusable":   options.Reusable,
+		"ephemeral":  options.Ephemeral,
+		"aclTags":    options.Tags,
+		"expiration": time.Now().Add(ttl).UTC().Format(time.RFC3339),
+	}
+
+	var response struct {
+		PreAuthKey struct {
+			Key string `json:"key"`
+		} `json:"preAuthKey"`
+	}
+	if err := h.do(ctx, http.MethodPost, "/api/v1/preauthkey", body, &response); err != nil {
+		return "", err
+	}
+	if response.PreAuthKey.Key == "" {
+		return "", fmt.Errorf("headscale returned an empty pre-auth key")
+	}
+	return response.PreAuthKey.Key, nil
+}
+
+// DeleteDevice removes the node from Headscale
+func (h *Headscale) DeleteDevice(ctx context.Context, nodeKey string) error {
+	return h.nodeAction(ctx, http.MethodDelete, nodeKey, "", nil)
+}
+
+// ExpireKey expires the node so it has to log in again
+func (h *Headscale) ExpireKey(ctx context.Context, nodeKey string) error {
+	return h.nodeAction(ctx, http.MethodPost, nodeKey, "/expire", nil)
+}
+
+// SetTags replaces the node's forced tags
+func (h *Headscale) SetTags(ctx context.Context, nodeKey string, tags []string) error {
+	body := map[string][]string{"tags": tags}
+	return h.nodeAction(ctx, http.MethodPost, nodeKey, "/tags", body)
+}
+
+// AuthorizeDevice is not supported; Headscale nodes are authorized when they register
+func (h *Headscale) AuthorizeDevice(ctx context.Context, nodeKey string) error {
+	return ErrNotSupported
+}
+
+// ApproveRoutes sets the subnet routes approved for the node
+func (h *Headscale) ApproveRoutes(ctx context.Context, nodeKey string, routes []string) error {
+	body := map[string][]string{"routes": routes}
+	return h.nodeAction(ctx, http.MethodPost, nodeKey, "/approve_routes", body)
+}
+
+// nodeAction sends a request about the node with the given node key. A 404
+// for a node that was just listed means it was removed in between; other
+// 404s, such as for a wrong base URL, are returned as an APIError.
+func (h *Headscale) nodeAction(ctx context.Context, method, nodeKey, action string, in interface{}) error {
+	node, err := h.node(ctx, nodeKey)
+	if err != nil {
+		return err
+	}
+	err = h.do(ctx, method, "/api/v1/node/"+url.PathEscape(node.ID)+action, in, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return ErrDeviceNotFound
+	}
+	return err
+}
+
+// node finds the node with the given node key
+func (h *Headscale) node(ctx context.Context, nodeKey string) (*HeadscaleNode, error) {
+	nodes, err := h.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		if nodes[i].NodeKey == nodeKey {
+			return &nodes[i], nil
+		}
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// userID resolves a user name to its Headscale ID
+func (h *Headscale) userID(ctx context.Context, name string) (string, error) {
+	var response struct {
+		Users []HeadscaleUser `json:"users"`
+	}
+	if err := h.do(ctx, http.MethodGet, "/api/v1/user?name="+url.QueryEscape(name), nil, &response); err != nil {
+		return "", err
+	}
+	for _, user := range response.Users {
+		if user.Name == name {
+			return user.ID, nil
+		}
+	}
+	return "", fmt.Errorf("headscale user %q not found", name)
+}
+
+// do sends an authenticated JSON request and decodes the response into out
+func (h *Headscale) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.config.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+h.config.APIKey)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call headscale API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{StatusCode: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to parse headscale response: %v", err)
+		}
+	}
+	return nil
+}
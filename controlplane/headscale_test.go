@@ -0,0 +1,181 @@
+package controlplane_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/controlplane/controlplanetest"
+)
+
+var testHeadscaleUsers = []controlplane.HeadscaleUser{
+	{ID: "1", Name: "alice"},
+	{ID: "2", Name: "bob"},
+}
+
+func testHeadscaleNodes() []controlplane.HeadscaleNode {
+	lastSeen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []controlplane.HeadscaleNode{
+		{
+			ID:              "10",
+			NodeKey:         "nodekey:aaa",
+			Name:            "router",
+			User:            testHeadscaleUsers[0],
+			Online:          true,
+			LastSeen:        lastSeen,
+			Expiry:          lastSeen.AddDate(1, 0, 0),
+			AvailableRoutes: []string{"10.0.0.0/24", "10.1.0.0/24"},
+		},
+		{ID: "11", NodeKey: "nodekey:bbb", Name: "laptop", User: testHeadscaleUsers[1]},
+	}
+}
+
+func newTestHeadscale(t *testing.T) (*controlplanetest.Headscale, *controlplane.Headscale) {
+	server := controlplanetest.NewHeadscale("hskey", testHeadscaleUsers, testHeadscaleNodes())
+	t.Cleanup(server.Close)
+	return server, controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL + "/", APIKey: "hskey"})
+}
+
+func headscaleNode(t *testing.T, server *controlplanetest.Headscale, id string) controlplane.HeadscaleNode {
+	t.Helper()
+	for _, node := range server.Nodes() {
+		if node.ID == id {
+			return node
+		}
+	}
+	t.Fatalf("Node %s not found", id)
+	return controlplane.HeadscaleNode{}
+}
+
+func TestHeadscaleListNodes(t *testing.T) {
+	_, client := newTestHeadscale(t)
+
+	nodes, err := client.ListNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].NodeKey != "nodekey:aaa" || nodes[0].User.Name != "alice" || nodes[1].User.Name != "bob" {
+		t.Errorf("Got nodes %+v", nodes)
+	}
+	if !nodes[0].LastSeen.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Got last seen %v", nodes[0].LastSeen)
+	}
+}
+
+func TestHeadscaleCreatePreAuthKey(t *testing.T) {
+	server, client := newTestHeadscale(t)
+
+	key, err := client.CreatePreAuthKey(context.Background(), controlplane.PreAuthKeyOptions{User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := server.PreAuthKeys(); len(keys) != 1 || keys[0] != key {
+		t.Errorf("Got key %q, server created %q", key, keys)
+	}
+
+	// The user name is resolved to its ID before the key is created
+	_, err = client.CreatePreAuthKey(context.Background(), controlplane.PreAuthKeyOptions{User: "mallory"})
+	if err == nil || !strings.Contains(err.Error(), `"mallory" not found`) {
+		t.Errorf("Got %v for an unknown user", err)
+	}
+	if keys := server.PreAuthKeys(); len(keys) != 1 {
+		t.Errorf("Created a key for an unknown user: %q", keys)
+	}
+}
+
+func TestHeadscaleNodeActions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("expire", func(t *testing.T) {
+		server, client := newTestHeadscale(t)
+		if err := client.ExpireKey(ctx, "nodekey:aaa"); err != nil {
+			t.Fatal(err)
+		}
+		if node := headscaleNode(t, server, "10"); node.Online || !node.Expiry.Equal(node.LastSeen) {
+			t.Errorf("Node was not expired: %+v", node)
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		server, client := newTestHeadscale(t)
+		if err := client.SetTags(ctx, "nodekey:aaa", []string{"tag:router"}); err != nil {
+			t.Fatal(err)
+		}
+		if node := headscaleNode(t, server, "10"); !slices.Equal(node.ForcedTags, []string{"tag:router"}) {
+			t.Errorf("Got tags %q", node.ForcedTags)
+		}
+
+		err := client.SetTags(ctx, "nodekey:aaa", []string{"router"})
+		var apiErr *controlplane.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || !strings.Contains(apiErr.Message, "invalid tag") {
+			t.Errorf("Got %v for an invalid tag, want a 400 APIError", err)
+		}
+	})
+
+	t.Run("approve routes", func(t *testing.T) {
+		server, client := newTestHeadscale(t)
+		if err := client.ApproveRoutes(ctx, "nodekey:aaa", []string{"10.0.0.0/24", "192.168.0.0/24"}); err != nil {
+			t.Fatal(err)
+		}
+		node := headscaleNode(t, server, "10")
+		if !slices.Equal(node.ApprovedRoutes, []string{"10.0.0.0/24", "192.168.0.0/24"}) {
+			t.Errorf("Got approved routes %q", node.ApprovedRoutes)
+		}
+		// Only approved routes the node announces are served
+		if !slices.Equal(node.SubnetRoutes, []string{"10.0.0.0/24"}) {
+			t.Errorf("Got subnet routes %q", node.SubnetRoutes)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		server, client := newTestHeadscale(t)
+		if err := client.DeleteDevice(ctx, "nodekey:bbb"); err != nil {
+			t.Fatal(err)
+		}
+		if nodes := server.Nodes(); len(nodes) != 1 || nodes[0].ID != "10" {
+			t.Errorf("Got nodes %+v after delete", nodes)
+		}
+		if err := client.DeleteDevice(ctx, "nodekey:bbb"); !errors.Is(err, controlplane.ErrDeviceNotFound) {
+			t.Errorf("Got %v deleting a deleted node, want ErrDeviceNotFound", err)
+		}
+	})
+
+	t.Run("authorize", func(t *testing.T) {
+		server, client := newTestHeadscale(t)
+		if err := client.AuthorizeDevice(ctx, "nodekey:aaa"); !errors.Is(err, controlplane.ErrNotSupported) {
+			t.Errorf("Got %v, want ErrNotSupported", err)
+		}
+		if requests := server.Requests(); requests != 0 {
+			t.Errorf("Sent %d requests for an unsupported action", requests)
+		}
+	})
+}
+
+func TestHeadscaleErrors(t *testing.T) {
+	server, _ := newTestHeadscale(t)
+	ctx := context.Background()
+
+	unknownKey := controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL, APIKey: "wrong"})
+	_, err := unknownKey.ListNodes(ctx)
+	var apiErr *controlplane.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Got %v for a wrong API key, want a 401 APIError", err)
+	}
+
+	// A wrong base URL is a failed request, not a missing node
+	wrongURL := controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL + "/headscale", APIKey: "hskey"})
+	err = wrongURL.ExpireKey(ctx, "nodekey:aaa")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || errors.Is(err, controlplane.ErrDeviceNotFound) {
+		t.Errorf("Got %v for a wrong base URL, want a 404 APIError", err)
+	}
+
+	_, client := newTestHeadscale(t)
+	if err := client.ExpireKey(ctx, "nodekey:missing"); !errors.Is(err, controlplane.ErrDeviceNotFound) {
+		t.Errorf("Got %v for an unknown node key, want ErrDeviceNotFound", err)
+	}
+}
@@ -0,0 +1,273 @@
+package controlplane
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTailscaleAPIURL is the base URL of the Tailscale admin API
+const DefaultTailscaleAPIURL = "https://api.tailscale.com"
+
+// TailscaleConfig holds the credentials for the Tailscale admin API. Either
+// APIKey or an OAuth client ID and secret must be set.
+type TailscaleConfig struct {
+	BaseURL           string
+	Tailnet           string
+	APIKey            string
+	OAuthClientID     string
+	OAuthClientSecret string
+}
+
+// TailscaleAPI manages devices through the Tailscale v2 admin API
+type TailscaleAPI struct {
+	config TailscaleConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewTailscaleAPI creates an admin API client with the given config
+func NewTailscaleAPI(config TailscaleConfig) *TailscaleAPI {
+	if config.BaseURL == "" {
+		config.BaseURL = DefaultTailscaleAPIURL
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.Tailnet == "" {
+		// "-" is the tailnet the credentials belong to
+		config.Tailnet = "-"
+	}
+	return &TailscaleAPI{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// DeleteDevice removes the device from the tailnet
+func (t *TailscaleAPI) DeleteDevice(ctx context.Context, nodeKey string) error {
+	return t.device(ctx, http.MethodDelete, nodeKey, "", nil)
+}
+
+// ExpireKey expires the device's node key
+func (t *TailscaleAPI) ExpireKey(ctx context.Context, nodeKey string) error {
+	return t.device(ctx, http.MethodPost, nodeKey, "/expire", nil)
+}
+
+// SetTags replaces the device's ACL tags
+func (t *TailscaleAPI) SetTags(ctx context.Context, nodeKey string, tags []string) error {
+	body := map[string][]string{"tags": tags}
+	return t.device(ctx, http.MethodPost, nodeKey, "/tags", body)
+}
+
+// AuthorizeDevice approves a device waiting for admin authorization
+func (t *TailscaleAPI) AuthorizeDevice(ctx context.Context, nodeKey string) error {
+	body := map[string]bool{"authorized": true}
+	return t.device(ctx, http.MethodPost, nodeKey, "/authorized", body)
+}
+
+// ApproveRoutes sets the subnet routes enabled for the device
+func (t *TailscaleAPI) ApproveRoutes(ctx context.Context, nodeKey string, routes []string) error {
+	body := map[string][]string{"routes": routes}
+	return t.device(ctx, http.MethodPost, nodeKey, "/routes", body)
+}
+
+// device sends a request about the device with the given node key. A 404
+// for a device that was just listed means it was removed in between; other
+// 404s, such as for a wrong tailnet, are returned as an APIError.
+func (t *TailscaleAPI) device(ctx context.Context, method, nodeKey, action string, in interface{}) error {
+	id, err := t.deviceID(ctx, nodeKey)
+	if err != nil {
+		return err
+	}
+	_, err = t.do(ctx, method, "/api/v2/device/"+url.PathEscape(id)+action, in, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return ErrDeviceNotFound
+	}
+	return err
+}
+
+// deviceID resolves a node key to the admin API device ID, following the
+// next links of a paginated device list
+func (t *TailscaleAPI) deviceID(ctx context.Context, nodeKey string) (string, error) {
+	path := "/api/v2/tailnet/" + url.PathEscape(t.config.Tailnet) + "/devices"
+	for path != "" {
+		var response struct {
+			Devices []struct {
+				ID      string `json:"id"`
+				NodeID  string `json:"nodeId"`
+				NodeKey string `json:"nodeKey"`
+			} `json:"devices"`
+		}
+		header, err := t.do(ctx, http.MethodGet, path, nil, &response)
+		if err != nil {
+			return "", err
+		}
+
+		for _, device := range response.Devices {
+			if device.NodeKey == nodeKey {
+				if device.NodeID != "" {
+					return device.NodeID, nil
+				}
+				return device.ID, nil
+			}
+		}
+		if path, err = t.nextPage(header); err != nil {
+			return "", err
+		}
+	}
+	return "", ErrDeviceNotFound
+}
+
+// nextPage returns the path of the Link rel="next" header, or "" on the
+// last page. Links to other hosts are refused so credentials stay with the API.
+func (t *TailscaleAPI) nextPage(header http.Header) (string, error) {
+	for _, link := range header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			target, params, ok := strings.Cut(strings.TrimSpace(part), ";")
+			if !ok || !strings.Contains(strings.ReplaceAll(params, " ", ""), `rel="next"`) {
+				continue
+			}
+			next, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+			if err != nil {
+				return "", fmt.Errorf("invalid next link %q: %v", target, err)
+			}
+			base, _ := url.Parse(t.config.BaseURL)
+			if next.Host != "" && next.Host != base.Host {
+				return "", fmt.Errorf("next link %q leaves the control plane API", target)
+			}
+			return next.RequestURI(), nil
+		}
+	}
+	return "", nil
+}
+
+// do sends an authenticated JSON request, decodes the response into out and
+// returns the response headers
+func (t *TailscaleAPI) do(ctx context.Context, method, path string, in, out interface{}) (http.Header, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, t.config.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := t.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call control plane API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &APIError{StatusCode: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, fmt.Errorf("failed to parse control plane response: %v", err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// authorize adds the API key, or an OAuth access token, to the request
+func (t *TailscaleAPI) authorize(ctx context.Context, req *http.Request) error {
+	if t.config.APIKey != "" {
+		req.SetBasicAuth(t.config.APIKey, "")
+		return nil
+	}
+
+	token, err := t.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// accessToken returns a cached OAuth access token, fetching a new one with
+// the client credentials grant when it is about to expire
+func (t *TailscaleAPI) accessToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.tokenExpiry) {
+		return t.token, nil
+	}
+
+	form := url.Values{
+		"client_id":     {t.config.OAuthClientID},
+		"client_secret": {t.config.OAuthClientSecret},
+		"grant_type":    {"client_credentials"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.BaseURL+"/api/v2/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get OAuth token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &APIError{StatusCode: resp.StatusCode, Message: apiErrorMessage(data)}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", fmt.Errorf("failed to parse OAuth token: %v", err)
+	}
+
+	// Refresh a minute early so a token never expires mid-request
+	t.token = token.AccessToken
+	t.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return t.token, nil
+}
+
+// apiErrorMessage extracts the message of an admin API error body
+func apiErrorMessage(data []byte) string {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &body); err == nil && body.Message != "" {
+		return body.Message
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,314 @@
+package controlplane_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+)
+
+// fakeTailscaleAPI records the requests made to a minimal admin API
+type fakeTailscaleAPI struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	requests    []string
+	tokens      int
+	lastBody    map[string]interface{}
+	lastAuth    string
+	deletedIDs  map[string]bool
+	pageSize    int
+	devicesCode int
+}
+
+type fakeDevice struct {
+	ID      string `json:"id"`
+	NodeID  string `json:"nodeId,omitempty"`
+	NodeKey string `json:"nodeKey"`
+}
+
+var fakeDevices = []fakeDevice{
+	{ID: "1001", NodeID: "nAAA", NodeKey: "nodekey:aaa"},
+	{ID: "1002", NodeID: "nBBB", NodeKey: "nodekey:bbb"},
+	{ID: "1003", NodeKey: "nodekey:ccc"},
+}
+
+func newFakeTailscaleAPI(t *testing.T) *fakeTailscaleAPI {
+	f := &fakeTailscaleAPI{deletedIDs: make(map[string]bool)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+			http.Error(w, `{"message": "invalid client credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		f.tokens++
+		token := fmt.Sprintf("token-%d", f.tokens)
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "expires_in": 3600})
+	})
+	mux.HandleFunc("GET /api/v2/tailnet/example.com/devices", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		code, pageSize := f.devicesCode, f.pageSize
+		f.mu.Unlock()
+		if code != 0 {
+			http.Error(w, `{"message": "server error"}`, code)
+			return
+		}
+
+		devices := fakeDevices
+		if pageSize > 0 {
+			var page int
+			fmt.Sscan(r.URL.Query().Get("page"), &page)
+			start := page * pageSize
+			end := min(start+pageSize, len(devices))
+			if end < len(devices) {
+				w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=%d>; rel="next"`, f.URL, r.URL.Path, page+1))
+			}
+			devices = devices[start:end]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": devices})
+	})
+	handleDevice := func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.deletedIDs[r.PathValue("id")] {
+			http.Error(w, `{"message": "device not found"}`, http.StatusNotFound)
+			return
+		}
+		f.lastBody = nil
+		json.NewDecoder(r.Body).Decode(&f.lastBody)
+		if r.Method == http.MethodDelete {
+			f.deletedIDs[r.PathValue("id")] = true
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	mux.HandleFunc("DELETE /api/v2/device/{id}", handleDevice)
+	mux.HandleFunc("POST /api/v2/device/{id}/{action}", handleDevice)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "not found"}`, http.StatusNotFound)
+	})
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+		if r.URL.Path != "/api/v2/oauth/token" {
+			f.lastAuth = r.Header.Get("Authorization")
+		}
+		f.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeTailscaleAPI) lastRequest() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[len(f.requests)-1]
+}
+
+func TestTailscaleAPIActions(t *testing.T) {
+	tests := []struct {
+		name    string
+		nodeKey string
+		call    func(api *controlplane.TailscaleAPI, ctx context.Context, nodeKey string) error
+		request string
+		body    string
+	}{
+		{
+			name:    "delete",
+			nodeKey: "nodekey:aaa",
+			call:    (*controlplane.TailscaleAPI).DeleteDevice,
+			request: "DELETE /api/v2/device/nAAA",
+			body:    "null",
+		},
+		{
+			name:    "expire",
+			nodeKey: "nodekey:bbb",
+			call:    (*controlplane.TailscaleAPI).ExpireKey,
+			request: "POST /api/v2/device/nBBB/expire",
+			body:    "null",
+		},
+		{
+			name:    "tags",
+			nodeKey: "nodekey:aaa",
+			call: func(api *controlplane.TailscaleAPI, ctx context.Context, nodeKey string) error {
+				return api.SetTags(ctx, nodeKey, []string{"tag:server"})
+			},
+			request: "POST /api/v2/device/nAAA/tags",
+			body:    `{"tags":["tag:server"]}`,
+		},
+		{
+			name:    "authorize",
+			nodeKey: "nodekey:aaa",
+			call:    (*controlplane.TailscaleAPI).AuthorizeDevice,
+			request: "POST /api/v2/device/nAAA/authorized",
+			body:    `{"authorized":true}`,
+		},
+		{
+			name:    "approve routes",
+			nodeKey: "nodekey:aaa",
+			call: func(api *controlplane.TailscaleAPI, ctx context.Context, nodeKey string) error {
+				return api.ApproveRoutes(ctx, nodeKey, []string{"10.0.0.0/24"})
+			},
+			request: "POST /api/v2/device/nAAA/routes",
+			body:    `{"routes":["10.0.0.0/24"]}`,
+		},
+		{
+			name:    "legacy device ID without node ID",
+			nodeKey: "nodekey:ccc",
+			call:    (*controlplane.TailscaleAPI).ExpireKey,
+			request: "POST /api/v2/device/1003/expire",
+			body:    "null",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeTailscaleAPI(t)
+			api := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{
+				BaseURL: f.URL + "/",
+				Tailnet: "example.com",
+				APIKey:  "tskey-api-test",
+			})
+
+			if err := test.call(api, context.Background(), test.nodeKey); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.lastRequest(); got != test.request {
+				t.Errorf("Got request %q, want %q", got, test.request)
+			}
+			body, _ := json.Marshal(f.lastBody)
+			if string(body) != test.body {
+				t.Errorf("Got body %s, want %s", body, test.body)
+			}
+			// The API key is sent as the basic auth user name
+			if want := "Basic dHNrZXktYXBpLXRlc3Q6"; f.lastAuth != want {
+				t.Errorf("Got Authorization %q, want %q", f.lastAuth, want)
+			}
+		})
+	}
+}
+
+func TestTailscaleAPIOAuth(t *testing.T) {
+	f := newFakeTailscaleAPI(t)
+	api := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{
+		BaseURL:           f.URL,
+		Tailnet:           "example.com",
+		OAuthClientID:     "client",
+		OAuthClientSecret: "secret",
+	})
+
+	for i := 0; i < 3; i++ {
+		if err := api.ExpireKey(context.Background(), "nodekey:aaa"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.lastAuth != "Bearer token-1" {
+		t.Errorf("Got Authorization %q, want the OAuth token", f.lastAuth)
+	}
+	// The token is cached until it is about to expire
+	if f.tokens != 1 {
+		t.Errorf("Fetched %d tokens, want 1", f.tokens)
+	}
+
+	bad := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{
+		BaseURL:           f.URL,
+		Tailnet:           "example.com",
+		OAuthClientID:     "client",
+		OAuthClientSecret: "wrong",
+	})
+	err := bad.ExpireKey(context.Background(), "nodekey:aaa")
+	var apiErr *controlplane.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Message != "invalid client credentials" {
+		t.Errorf("Got %v, want a 401 APIError with the API's message", err)
+	}
+}
+
+func TestTailscaleAPIPagination(t *testing.T) {
+	f := newFakeTailscaleAPI(t)
+	f.pageSize = 1
+	api := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{BaseURL: f.URL, Tailnet: "example.com", APIKey: "key"})
+
+	if err := api.ExpireKey(context.Background(), "nodekey:ccc"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"GET /api/v2/tailnet/example.com/devices",
+		"GET /api/v2/tailnet/example.com/devices?page=1",
+		"GET /api/v2/tailnet/example.com/devices?page=2",
+		"POST /api/v2/device/1003/expire",
+	}
+	if fmt.Sprint(f.requests) != fmt.Sprint(want) {
+		t.Errorf("Got requests %q, want %q", f.requests, want)
+	}
+
+	if err := api.ExpireKey(context.Background(), "nodekey:missing"); !errors.Is(err, controlplane.ErrDeviceNotFound) {
+		t.Errorf("Got %v for a node key on no page, want ErrDeviceNotFound", err)
+	}
+}
+
+func TestTailscaleAPIErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		tailnet  string
+		nodeKey  string
+		setup    func(f *fakeTailscaleAPI)
+		notFound bool
+		status   int
+	}{
+		{name: "unknown node key", tailnet: "example.com", nodeKey: "nodekey:missing", notFound: true},
+		{name: "device removed after the lookup", tailnet: "example.com", nodeKey: "nodekey:aaa", setup: func(f *fakeTailscaleAPI) { f.deletedIDs["nAAA"] = true }, notFound: true},
+		{name: "wrong tailnet", tailnet: "other.com", nodeKey: "nodekey:aaa", status: http.StatusNotFound},
+		{name: "server error", tailnet: "example.com", nodeKey: "nodekey:aaa", setup: func(f *fakeTailscaleAPI) { f.devicesCode = http.StatusInternalServerError }, status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeTailscaleAPI(t)
+			if test.setup != nil {
+				test.setup(f)
+			}
+			api := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{BaseURL: f.URL, Tailnet: test.tailnet, APIKey: "key"})
+
+			err := api.ExpireKey(context.Background(), test.nodeKey)
+			if test.notFound {
+				if !errors.Is(err, controlplane.ErrDeviceNotFound) {
+					t.Errorf("Got %v, want ErrDeviceNotFound", err)
+				}
+				return
+			}
+			var apiErr *controlplane.APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != test.status {
+				t.Errorf("Got %v, want an APIError with status %d", err, test.status)
+			}
+			if errors.Is(err, controlplane.ErrDeviceNotFound) {
+				t.Errorf("Got ErrDeviceNotFound for a failed device list")
+			}
+		})
+	}
+}
+
+func TestTailscaleAPIRefusesForeignNextLink(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Credentials were sent to another host: %s", r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf(`<%s/devices?page=1>; rel="next"`, other.URL))
+		json.NewEncoder(w).Encode(map[string]interface{}{"devices": []fakeDevice{}})
+	}))
+	defer api.Close()
+
+	client := controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{BaseURL: api.URL, APIKey: "key"})
+	if err := client.ExpireKey(context.Background(), "nodekey:aaa"); err == nil {
+		t.Error("Followed a next link to another host")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// netcheckMaxAge is how long a netcheck report is served before running a new one
+const netcheckMaxAge = time.Minute
+
+// netcheckCache holds the latest netcheck report. Runs take a few seconds, so
+// concurrent requests wait for the run in progress instead of starting their own.
+type netcheckCache struct {
+	run sync.Mutex
+
+	mu     sync.Mutex
+	report *tailscale.NetcheckReport
+	at     time.Time
+}
+
+var netcheckResults netcheckCache
+
+// get returns the cached report, running netcheck when it is older than
+// maxAge. A failed run isn't cached, so the next call runs netcheck again,
+// and the previous report is kept for the metrics.
+func (c *netcheckCache) get(ctx context.Context, maxAge time.Duration) (*tailscale.NetcheckReport, time.Time, error) {
+	c.run.Lock()
+	defer c.run.Unlock()
+
+	c.mu.Lock()
+	fresh := !c.at.IsZero() && time.Since(c.at) <= maxAge
+	c.mu.Unlock()
+
+	if !fresh {
+		report, err := tailscaleClient(ctx).Netcheck()
+		if err != nil {
+			logger.Warn("Netcheck failed: %v", err)
+			return nil, time.Time{}, err
+		}
+
+		c.mu.Lock()
+		c.report, c.at = report, time.Now()
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.report, c.at, nil
+}
+
+// latest returns the last successful report without running netcheck
+func (c *netcheckCache) latest() (*tailscale.NetcheckReport, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.report == nil {
+		return nil, time.Time{}
+	}
+	return c.report, c.report.Time
+}
+
+var handleNetcheck = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet: handleGetNetcheck,
+})
+
+func handleGetNetcheck(w http.ResponseWriter, r *http.Request) {
+	maxAge := netcheckMaxAge
+	if refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh")); refresh {
+		maxAge = 0
+	}
+
+	report, at, err := netcheckResults.get(r.Context(), maxAge)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to run netcheck: %v", err)
+		return
+	}
+
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(at).Seconds())))
+	writeJSON(w, http.StatusOK, report)
+}
+
+// periodicNetcheck keeps the cached report fresh for the metrics
+func periodicNetcheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		netcheckResults.get(ctx, 0)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// netcheckMetrics exports the latest netcheck report without running a new one
+func netcheckMetrics() []metrics.Metric {
+	report, at := netcheckResults.latest()
+	if report == nil {
+		return nil
+	}
+
+	derpLatency := metrics.Metric{
+		Name: "gerbil_netcheck_derp_latency_seconds",
+		Help: "Latency to each DERP region measured by the last netcheck.",
+		Type: metrics.Gauge,
+	}
+	for _, region := range report.DERPLatency {
+		derpLatency.Samples = append(derpLatency.Samples, metrics.Sample{
+			Labels: map[string]string{"region_id": strconv.Itoa(region.RegionID), "region_code": region.RegionCode},
+			Value:  region.LatencyMs / 1000,
+		})
+	}
+
+	collected := []metrics.Metric{
+		derpLatency,
+		{
+			Name:    "gerbil_netcheck_timestamp_seconds",
+			Help:    "Unix time of the last netcheck.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: float64(at.Unix())}},
+		},
+		{
+			Name:    "gerbil_netcheck_udp",
+			Help:    "Whether UDP STUN round trips worked in the last netcheck.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(report.UDP)}},
+		},
+		{
+			Name: "gerbil_netcheck_ip_reachable",
+			Help: "Whether the address family worked in the last netcheck.",
+			Type: metrics.Gauge,
+			Samples: []metrics.Sample{
+				{Labels: map[string]string{"family": "ipv4"}, Value: metrics.Bool(report.IPv4)},
+				{Labels: map[string]string{"family": "ipv6"}, Value: metrics.Bool(report.IPv6)},
+			},
+		},
+		{
+			Name:    "gerbil_netcheck_nat_type",
+			Help:    "NAT type found by the last netcheck; hard NATs need DERP relays.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Labels: map[string]string{"type": report.NATType}, Value: 1}},
+		},
+	}
+	if report.MappingVariesByDestIP != nil {
+		collected = append(collected, metrics.Metric{
+			Name:    "gerbil_netcheck_mapping_varies_by_dest_ip",
+			Help:    "Whether the public mapping depends on the destination.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(*report.MappingVariesByDestIP)}},
+		})
+	}
+	if report.PreferredDERP != nil {
+		collected = append(collected, metrics.Metric{
+			Name: "gerbil_netcheck_preferred_derp",
+			Help: "The preferred DERP region of the last netcheck.",
+			Type: metrics.Gauge,
+			Samples: []metrics.Sample{{
+				Labels: map[string]string{"region_id": strconv.Itoa(report.PreferredDERP.RegionID), "region_code": report.PreferredDERP.RegionCode},
+				Value:  1,
+			}},
+		})
+	}
+	return collected
+}
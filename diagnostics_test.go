@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNetcheckCacheSkipsFailures(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	netcheck := filepath.Join(dir, "netcheck.json")
+	if err := os.Remove(netcheck); err != nil {
+		t.Fatal(err)
+	}
+
+	var cache netcheckCache
+	if _, _, err := cache.get(context.Background(), time.Hour); err == nil {
+		t.Fatal("Got a report from a failed netcheck")
+	}
+
+	// The failure isn't served for the max age, so the next call runs again
+	if err := os.WriteFile(netcheck, []byte(testNetcheckJSON), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	report, at, err := cache.get(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("Got %v, want the failure retried", err)
+	}
+	if report == nil || !report.UDP || at.IsZero() {
+		t.Errorf("Got report %+v at %v, want the new report", report, at)
+	}
+
+	// A later failure keeps the report, which is still fresh
+	if err := os.Remove(netcheck); err != nil {
+		t.Fatal(err)
+	}
+	if cached, _, err := cache.get(context.Background(), time.Hour); err != nil || cached != report {
+		t.Errorf("Got %+v and %v, want the cached report", cached, err)
+	}
+	if _, _, err := cache.get(context.Background(), 0); err == nil {
+		t.Error("Got a report from a refresh that failed")
+	}
+	if latest, _ := cache.latest(); latest != report {
+		t.Errorf("Got latest %+v, want the last successful report for the metrics", latest)
+	}
+}
@@ -2,18 +2,11 @@
 
 set -e
 
-# Start tailscaled if not already running
-if ! pgrep tailscaled > /dev/null 2>&1; then
-    echo "Starting tailscaled daemon..."
-    tailscaled --state=/var/lib/tailscale/tailscaled.state --socket=/var/run/tailscale/tailscaled.sock &
-    
-    # Wait for tailscaled to be ready
-    sleep 3
-fi
+# tailscaled is started and supervised by gerbil itself
 
 # first arg is `-f` or `--some-option`
 if [ "${1#-}" != "$1" ]; then
     set -- gerbil "$@"
 fi
 
-exec "$@"
\ No newline at end of file
+exec "$@"
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Exit codes of the process, by the kind of error run returned
+const (
+	exitOK        = 0
+	exitFailure   = 1
+	exitConfig    = 2
+	exitTailscale = 3
+	exitServer    = 4
+)
+
+// ConfigError is an invalid option or configuration
+type ConfigError struct {
+	// Option is the flag the error is about, if any
+	Option string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Option == "" {
+		return fmt.Sprintf("invalid configuration: %v", e.Err)
+	}
+	return fmt.Sprintf("invalid %s: %v", e.Option, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// TailscaleError is a failure to bring up the Tailscale node
+type TailscaleError struct {
+	Err error
+}
+
+func (e *TailscaleError) Error() string {
+	return fmt.Sprintf("failed to start Tailscale: %v", e.Err)
+}
+
+func (e *TailscaleError) Unwrap() error {
+	return e.Err
+}
+
+// ServerError is a failure to serve the HTTP API
+type ServerError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("HTTP server on %s failed: %v", e.Addr, e.Err)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+// exitCode maps an error returned by parseConfig or run to an exit code
+func exitCode(err error) int {
+	var (
+		configErr    *ConfigError
+		tailscaleErr *TailscaleError
+		serverErr    *ServerError
+	)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &configErr):
+		return exitConfig
+	case errors.As(err, &tailscaleErr):
+		return exitTailscale
+	case errors.As(err, &serverErr):
+		return exitServer
+	default:
+		return exitFailure
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// exitNodeFailureThreshold is how many failed checks in a row trigger a failover
+const exitNodeFailureThreshold = 3
+
+// exitNodeMu serializes exit node changes from the API and the failover loop
+var exitNodeMu sync.Mutex
+
+// ExitNodeInfo describes a peer that offers itself as an exit node
+type ExitNodeInfo struct {
+	PublicKey string              `json:"publicKey"`
+	Hostname  string              `json:"hostname"`
+	IP        string              `json:"ip"`
+	Online    bool                `json:"online"`
+	Active    bool                `json:"active"`
+	Location  *tailscale.Location `json:"location,omitempty"`
+}
+
+// ExitNodeState is the response of GET /exit-node
+type ExitNodeState struct {
+	Current        *ExitNodeInfo   `json:"current"`
+	AllowLANAccess bool            `json:"allowLanAccess"`
+	Available      []ExitNodeInfo  `json:"available"`
+	Failover       *FailoverStatus `json:"failover,omitempty"`
+}
+
+// ExitNodeRequest is the body of PUT /exit-node
+type ExitNodeRequest struct {
+	ExitNode       string `json:"exitNode"`
+	AllowLANAccess *bool  `json:"allowLanAccess,omitempty"`
+}
+
+// handleExitNode shows the exit node on GET, sets it on PUT or POST and
+// clears it on DELETE
+var handleExitNode = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet:    writeExitNodeState,
+	http.MethodPut:    handleSetExitNode,
+	http.MethodPost:   handleSetExitNode,
+	http.MethodDelete: handleClearExitNode,
+})
+
+func handleSetExitNode(w http.ResponseWriter, r *http.Request) {
+	var request ExitNodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid request body: %v", err)
+		return
+	}
+	if status, err := setExitNode(r.Context(), request); err != nil {
+		code := errCodeTailscale
+		switch status {
+		case http.StatusBadRequest:
+			code = errCodeBadRequest
+		case http.StatusNotFound:
+			code = errCodeNotFound
+		}
+		writeError(w, r, status, code, "%v", err)
+		return
+	}
+	writeExitNodeState(w, r)
+}
+
+func handleClearExitNode(w http.ResponseWriter, r *http.Request) {
+	exitNodeMu.Lock()
+	err := tailscaleClient(r.Context()).DisableExitNode()
+	exitNodeMu.Unlock()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "%v", err)
+		return
+	}
+	logger.Info("Exit node cleared")
+	writeExitNodeState(w, r)
+}
+
+// writeExitNodeState responds with the current and available exit nodes
+func writeExitNodeState(w http.ResponseWriter, r *http.Request) {
+	state, err := exitNodeState(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+// setExitNode applies an exit node request, returning the HTTP status to use on failure
+func setExitNode(ctx context.Context, request ExitNodeRequest) (int, error) {
+	client := tailscaleClient(ctx)
+	exitNodeMu.Lock()
+	defer exitNodeMu.Unlock()
+
+	if request.ExitNode != "" {
+		status, err := client.Status()
+		if err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to get Tailscale status: %v", err)
+		}
+		peer, ok := findPeer(status.Peers, request.ExitNode)
+		if !ok {
+			return http.StatusNotFound, fmt.Errorf("peer %s not found", request.ExitNode)
+		}
+		if !peer.ExitNodeOption {
+			return http.StatusBadRequest, fmt.Errorf("peer %s does not offer to be an exit node", request.ExitNode)
+		}
+		if err := client.EnableExitNode(peer.TailscaleIPs); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		logger.Info("Exit node set to %s (%s)", peer.Hostname, peer.TailscaleIPs)
+	}
+
+	if request.AllowLANAccess != nil {
+		if err := client.SetExitNodeAllowLANAccess(*request.AllowLANAccess); err != nil {
+			return http.StatusInternalServerError, err
+		}
+		logger.Info("Exit node LAN access set to %t", *request.AllowLANAccess)
+	}
+	return http.StatusOK, nil
+}
+
+// exitNodeState collects the current exit node, LAN access and candidates
+func exitNodeState(ctx context.Context) (*ExitNodeState, error) {
+	client := tailscaleClient(ctx)
+	status, err := client.Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Tailscale status: %v", err)
+	}
+	prefs, err := client.GetPrefs()
+	if err != nil {
+		return nil, err
+	}
+
+	state := &ExitNodeState{
+		AllowLANAccess: prefs.ExitNodeAllowLANAccess,
+		Available:      []ExitNodeInfo{},
+	}
+	for _, peer := range status.Peers {
+		if !peer.ExitNodeOption && !peer.ExitNode {
+			continue
+		}
+		info := ExitNodeInfo{
+			PublicKey: peer.PublicKey,
+			Hostname:  peer.Hostname,
+			IP:        peer.TailscaleIPs,
+			Online:    peer.Online,
+			Active:    peer.ExitNode,
+			Location:  peer.Location,
+		}
+		state.Available = append(state.Available, info)
+		if peer.ExitNode {
+			current := info
+			state.Current = &current
+		}
+	}
+	if exitFailover != nil {
+		failoverStatus := exitFailover.status()
+		state.Failover = &failoverStatus
+	}
+	return state, nil
+}
+
+// FailoverStatus reports the state of automatic exit node failover
+type FailoverStatus struct {
+	Candidates []string   `json:"candidates"`
+	Interval   string     `json:"interval"`
+	Failures   int        `json:"failures"`
+	LastCheck  *time.Time `json:"lastCheck,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+// exitNodeFailover pings the active exit node and switches to the next
+// healthy candidate in priority order when it stops answering
+type exitNodeFailover struct {
+	candidates []string
+	interval   time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+var exitFailover *exitNodeFailover
+
+func newExitNodeFailover(candidates []string, interval time.Duration) *exitNodeFailover {
+	return &exitNodeFailover{
+		candidates: candidates,
+		interval:   interval,
+	}
+}
+
+func (f *exitNodeFailover) status() FailoverStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := FailoverStatus{
+		Candidates: f.candidates,
+		Interval:   f.interval.String(),
+		Failures:   f.failures,
+		LastError:  f.lastError,
+	}
+	if !f.lastCheck.IsZero() {
+		lastCheck := f.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+func (f *exitNodeFailover) run(ctx context.Context) {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := f.check(); err != nil {
+			logger.Warn("Exit node check failed: %v", err)
+		}
+	}
+}
+
+// check pings the active exit node and fails over after repeated failures.
+// Nothing is done while no exit node is in use, so clearing it sticks. Pings
+// take seconds, so they run without exitNodeMu and the API isn't held up.
+func (f *exitNodeFailover) check() error {
+	status, err := tsClient.Status()
+	if err != nil {
+		return f.record(fmt.Errorf("failed to get Tailscale status: %v", err))
+	}
+
+	active := activeExitNode(status.Peers)
+	if active == nil {
+		return f.record(nil)
+	}
+
+	ok, err := tsClient.Ping(active.TailscaleIPs)
+	if ok {
+		return f.record(nil)
+	}
+	f.record(fmt.Errorf("exit node %s did not answer: %v", active.Hostname, err))
+	if f.failureCount() < exitNodeFailureThreshold {
+		return nil
+	}
+	logger.Warn("Exit node %s failed %d checks, failing over", active.Hostname, exitNodeFailureThreshold)
+
+	next, ok := f.healthyCandidate(status.Peers, active)
+	if !ok {
+		return fmt.Errorf("no healthy exit node to fail over to from %s", active.Hostname)
+	}
+
+	exitNodeMu.Lock()
+	defer exitNodeMu.Unlock()
+
+	// The exit node may have been changed through the API while pinging
+	status, err = tsClient.Status()
+	if err != nil {
+		return f.record(fmt.Errorf("failed to get Tailscale status: %v", err))
+	}
+	if current := activeExitNode(status.Peers); current == nil || current.PublicKey != active.PublicKey {
+		logger.Info("Exit node changed during the check, not failing over from %s", active.Hostname)
+		return f.record(nil)
+	}
+
+	if err := tsClient.EnableExitNode(next.TailscaleIPs); err != nil {
+		return f.record(err)
+	}
+	logger.Info("Exit node switched to %s (%s)", next.Hostname, next.TailscaleIPs)
+	go notifyPeerChange("exitNodeFailover", next.PublicKey)
+	return f.record(nil)
+}
+
+// activeExitNode returns the peer used as exit node, if any
+func activeExitNode(peers []tailscale.PeerInfo) *tailscale.PeerInfo {
+	for i := range peers {
+		if peers[i].ExitNode {
+			return &peers[i]
+		}
+	}
+	return nil
+}
+
+// healthyCandidate returns the first candidate in priority order that is an
+// online exit node other than the failed one and answers a ping
+func (f *exitNodeFailover) healthyCandidate(peers []tailscale.PeerInfo, failed *tailscale.PeerInfo) (tailscale.PeerInfo, bool) {
+	for _, candidate := range f.candidates {
+		peer, ok := findPeer(peers, candidate)
+		if !ok || !peer.ExitNodeOption || !peer.Online || peer.PublicKey == failed.PublicKey {
+			continue
+		}
+		if ok, _ := tsClient.Ping(peer.TailscaleIPs); ok {
+			return peer, true
+		}
+	}
+	return tailscale.PeerInfo{}, false
+}
+
+// record stores the result of a check and passes err through
+func (f *exitNodeFailover) record(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastCheck = time.Now()
+	if err == nil {
+		f.failures = 0
+		f.lastError = ""
+		return nil
+	}
+	f.failures++
+	f.lastError = err.Error()
+	return err
+}
+
+func (f *exitNodeFailover) failureCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failures
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// failoverPeers has the active exit node first, then an offline exit node,
+// a peer that isn't an exit node and two healthy exit nodes
+func failoverPeers(active string) []tailscale.PeerInfo {
+	peers := []tailscale.PeerInfo{
+		{PublicKey: "nodekey:a", Hostname: "exit-a", Online: true, ExitNodeOption: true, Addresses: []string{"100.64.0.10"}},
+		{PublicKey: "nodekey:b", Hostname: "exit-b", Online: false, ExitNodeOption: true, Addresses: []string{"100.64.0.11"}},
+		{PublicKey: "nodekey:l", Hostname: "laptop", Online: true, Addresses: []string{"100.64.0.12"}},
+		{PublicKey: "nodekey:c", Hostname: "exit-c", Online: true, ExitNodeOption: true, Addresses: []string{"100.64.0.13"}},
+		{PublicKey: "nodekey:d", Hostname: "exit-d", Online: true, ExitNodeOption: true, Addresses: []string{"100.64.0.14"}},
+	}
+	for i := range peers {
+		peers[i].ExitNode = peers[i].Hostname == active
+	}
+	return peers
+}
+
+// readLines returns the lines of a file the fake CLI appends to
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExitNodeFailover(t *testing.T) {
+	candidates := []string{"exit-a", "exit-b", "laptop", "exit-d", "exit-c"}
+	tests := []struct {
+		name string
+		// answering are the addresses that answer pings
+		answering []string
+		// switched is the exit node set after the third check, if any
+		switched string
+		err      string
+	}{
+		{name: "priority order", answering: []string{"100.64.0.13", "100.64.0.14"}, switched: "100.64.0.14"},
+		{name: "candidate not answering", answering: []string{"100.64.0.13"}, switched: "100.64.0.13"},
+		{name: "no healthy candidate", err: "no healthy exit node to fail over to from exit-a"},
+		{name: "exit node answering", answering: []string{"100.64.0.10"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := fakeTailscaleCLI(t, statusWithPeers(t, failoverPeers("exit-a")))
+			writeFile(t, filepath.Join(dir, "ping-ok"), strings.Join(test.answering, "\n")+"\n")
+			f := newExitNodeFailover(candidates, time.Minute)
+
+			var err error
+			for i := 1; i <= exitNodeFailureThreshold; i++ {
+				err = f.check()
+				if sets := readLines(t, filepath.Join(dir, "set.log")); i < exitNodeFailureThreshold && len(sets) != 0 {
+					t.Fatalf("Switched exit node with %q after %d failed checks", sets, i)
+				}
+			}
+
+			if test.err == "" && err != nil {
+				t.Errorf("Got %v, want no error", err)
+			} else if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Errorf("Got %v, want %q", err, test.err)
+			}
+			var want []string
+			if test.switched != "" {
+				want = []string{"set --exit-node=" + test.switched}
+			}
+			if sets := readLines(t, filepath.Join(dir, "set.log")); !slices.Equal(sets, want) {
+				t.Errorf("Got %q, want %q", sets, want)
+			}
+			// Offline peers and peers that aren't exit nodes are never tried
+			for _, ip := range readLines(t, filepath.Join(dir, "ping.log")) {
+				if ip == "100.64.0.11" || ip == "100.64.0.12" {
+					t.Errorf("Pinged %s, which isn't an online exit node", ip)
+				}
+			}
+			if failures := f.status().Failures; test.switched != "" && failures != 0 {
+				t.Errorf("Got %d failures after switching, want them reset", failures)
+			}
+		})
+	}
+}
+
+func TestExitNodeFailoverPingsWithoutLock(t *testing.T) {
+	dir := fakeTailscaleCLI(t, statusWithPeers(t, failoverPeers("exit-a")))
+	writeFile(t, filepath.Join(dir, "ping-ok"), "100.64.0.14\n")
+	writeFile(t, filepath.Join(dir, "ping-delay"), "0.3")
+	f := newExitNodeFailover([]string{"exit-d"}, time.Minute)
+	f.failures = exitNodeFailureThreshold - 1
+
+	done := make(chan error)
+	go func() { done <- f.check() }()
+	for len(readLines(t, filepath.Join(dir, "ping.log"))) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !exitNodeMu.TryLock() {
+		t.Fatal("exitNodeMu is held while pinging")
+	}
+	// The API switches the exit node in the meantime
+	writeFile(t, filepath.Join(dir, "status.json"), statusWithPeers(t, failoverPeers("exit-c")))
+	exitNodeMu.Unlock()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if sets := readLines(t, filepath.Join(dir, "set.log")); len(sets) != 0 {
+		t.Errorf("Got %q, want the exit node chosen through the API kept", sets)
+	}
+}
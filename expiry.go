@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+const (
+	// keyExpiryCheckInterval is how often key expiry is checked
+	keyExpiryCheckInterval = 10 * time.Minute
+	// reauthRetryInterval spaces out re-authentication attempts that failed
+	reauthRetryInterval = time.Hour
+)
+
+// keyExpiryMonitor sends notify events as node keys approach their expiry,
+// and re-authenticates this node before its own key expires
+type keyExpiryMonitor struct {
+	// thresholds are sorted from the earliest warning to the last
+	thresholds   []time.Duration
+	reauthBefore time.Duration
+	// authKey returns a key to re-authenticate with; nil when there is no auth source
+	authKey func() (string, error)
+
+	mu sync.Mutex
+	// notified holds the last threshold notified for each key and expiry,
+	// with 0 meaning the expiry itself was notified
+	notified   map[string]time.Duration
+	lastReauth time.Time
+}
+
+func newKeyExpiryMonitor(thresholds []time.Duration, reauthBefore time.Duration, authKey func() (string, error)) *keyExpiryMonitor {
+	thresholds = slices.Clone(thresholds)
+	slices.SortFunc(thresholds, func(a, b time.Duration) int {
+		return cmp.Compare(b, a)
+	})
+	return &keyExpiryMonitor{
+		thresholds:   thresholds,
+		reauthBefore: reauthBefore,
+		authKey:      authKey,
+		notified:     make(map[string]time.Duration),
+	}
+}
+
+func (m *keyExpiryMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(keyExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.check(); err != nil {
+			logger.Warn("Key expiry check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check notifies about keys that crossed a threshold and renews this node's key
+func (m *keyExpiryMonitor) check() error {
+	status, err := tsClient.Status()
+	if err != nil {
+		return fmt.Errorf("failed to get Tailscale status: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]bool)
+	if status.Self != nil {
+		m.checkPeer(*status.Self, true, seen)
+	}
+	for _, peer := range status.Peers {
+		m.checkPeer(peer, false, seen)
+	}
+	for key := range m.notified {
+		if !seen[key] {
+			delete(m.notified, key)
+		}
+	}
+
+	if status.Self != nil {
+		m.renew(*status.Self)
+	}
+	return nil
+}
+
+// checkPeer notifies once per threshold crossed. When several are crossed
+// at once, such as on startup, only the closest one is notified.
+func (m *keyExpiryMonitor) checkPeer(peer tailscale.PeerInfo, self bool, seen map[string]bool) {
+	remaining, ok := peer.KeyExpiresIn()
+	if !ok {
+		return
+	}
+	// A new expiry after re-authentication starts over
+	key := peer.PublicKey + "@" + strconv.FormatInt(peer.KeyExpiry.Unix(), 10)
+	seen[key] = true
+
+	crossed := time.Duration(-1)
+	if remaining <= 0 {
+		crossed = 0
+	} else {
+		for _, threshold := range m.thresholds {
+			if remaining <= threshold {
+				crossed = threshold
+			}
+		}
+	}
+	if crossed < 0 {
+		return
+	}
+	if last, ok := m.notified[key]; ok && last <= crossed {
+		return
+	}
+	m.notified[key] = crossed
+
+	event := map[string]interface{}{
+		"action":          "keyExpiring",
+		"publicKey":       peer.PublicKey,
+		"hostname":        peer.Hostname,
+		"self":            self,
+		"keyExpiry":       peer.KeyExpiry,
+		"daysUntilExpiry": keyExpiryDays(peer),
+		"threshold":       formatDays(crossed),
+	}
+	if crossed == 0 {
+		event["action"] = "keyExpired"
+		delete(event, "threshold")
+		logger.Warn("Node key of %s expired at %s", peer.Hostname, peer.KeyExpiry.Format(time.RFC3339))
+	} else {
+		logger.Warn("Node key of %s expires in %s, at %s", peer.Hostname, remaining.Round(time.Minute), peer.KeyExpiry.Format(time.RFC3339))
+	}
+	go notify(event)
+}
+
+// renew re-authenticates this node once its key is within reauthBefore of expiring
+func (m *keyExpiryMonitor) renew(self tailscale.PeerInfo) {
+	remaining, ok := self.KeyExpiresIn()
+	if !ok || m.authKey == nil || m.reauthBefore <= 0 || remaining > m.reauthBefore {
+		return
+	}
+	if time.Since(m.lastReauth) < reauthRetryInterval {
+		return
+	}
+	m.lastReauth = time.Now()
+
+	logger.Info("Node key expires in %s, re-authenticating", remaining.Round(time.Minute))
+	authKey, err := m.authKey()
+	if err == nil {
+		err = tsClient.Reauthenticate(authKey)
+	}
+	if err != nil {
+		logger.Error("Failed to renew node key: %v", err)
+		go notify(map[string]interface{}{
+			"action":    "keyRenewalFailed",
+			"publicKey": self.PublicKey,
+			"hostname":  self.Hostname,
+			"keyExpiry": self.KeyExpiry,
+			"error":     err.Error(),
+		})
+		return
+	}
+
+	logger.Info("Re-authenticated to renew the node key")
+	go notify(map[string]interface{}{
+		"action":    "keyRenewed",
+		"publicKey": self.PublicKey,
+		"hostname":  self.Hostname,
+	})
+}
+
+// keyExpiryDays returns the days until the peer's key expires, or nil if it doesn't
+func keyExpiryDays(peer tailscale.PeerInfo) *float64 {
+	remaining, ok := peer.KeyExpiresIn()
+	if !ok {
+		return nil
+	}
+	days := math.Round(remaining.Hours()/24*100) / 100
+	return &days
+}
+
+// parseThresholds parses a comma separated list of durations such as "7d,1d,12h"
+func parseThresholds(list string) ([]time.Duration, error) {
+	var thresholds []time.Duration
+	for _, item := range splitList(list) {
+		threshold, err := parseDays(item)
+		if err != nil {
+			return nil, err
+		}
+		if threshold <= 0 {
+			return nil, fmt.Errorf("threshold %q must be positive", item)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	return thresholds, nil
+}
+
+// parseDays parses a Go duration that may also be given in days, like "7d"
+func parseDays(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// formatDays formats whole days as "7d" and anything else as a Go duration
+func formatDays(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+// keyExpiryMetrics exports the time left until each node key expires
+func keyExpiryMetrics() []metrics.Metric {
+	status, err := tsClient.Status()
+	if err != nil {
+		logger.Debug("Failed to collect key expiry metrics: %v", err)
+		return nil
+	}
+
+	expiry := metrics.Metric{
+		Name: "gerbil_key_expiry_seconds",
+		Help: "Seconds until the node key expires, negative once expired. Keys that never expire are left out.",
+		Type: metrics.Gauge,
+	}
+	add := func(peer tailscale.PeerInfo, self bool) {
+		if remaining, ok := peer.KeyExpiresIn(); ok {
+			expiry.Samples = append(expiry.Samples, metrics.Sample{
+				Labels: map[string]string{"peer": peer.Hostname, "public_key": peer.PublicKey, "self": strconv.FormatBool(self)},
+				Value:  remaining.Seconds(),
+			})
+		}
+	}
+	if status.Self != nil {
+		add(*status.Self, true)
+	}
+	for _, peer := range status.Peers {
+		add(peer, false)
+	}
+	return []metrics.Metric{expiry}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/controlplane/controlplanetest"
+)
+
+func TestReauthKeySource(t *testing.T) {
+	tests := []struct {
+		name      string
+		tsconfig  TailscaleConfig
+		reusable  bool
+		headscale bool
+		user      string
+		key       string
+		reason    string
+	}{
+		{name: "no auth key"},
+		{name: "single-use auth key", tsconfig: TailscaleConfig{AuthKey: "tskey-auth-once"}},
+		{name: "reusable auth key from flags", tsconfig: TailscaleConfig{AuthKey: "tskey-auth-many"}, reusable: true, key: "tskey-auth-many"},
+		{name: "reusable auth key from config", tsconfig: TailscaleConfig{AuthKey: "tskey-auth-many", AuthKeyReusable: true}, key: "tskey-auth-many"},
+		{name: "headscale", tsconfig: TailscaleConfig{AuthKey: "hskey-once"}, headscale: true, user: "alice", key: "fake-preauthkey-1"},
+		{name: "headscale without auth key", headscale: true, user: "alice", key: "fake-preauthkey-1"},
+		{name: "headscale without user", tsconfig: TailscaleConfig{AuthKey: "hskey-once"}, headscale: true, reason: "HEADSCALE_USER"},
+		{name: "headscale without user or auth key", headscale: true, reason: "HEADSCALE_USER"},
+		{name: "headscale without user and reusable auth key", tsconfig: TailscaleConfig{AuthKey: "hskey-many"}, reusable: true, headscale: true, key: "hskey-many"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.headscale {
+				server := controlplanetest.NewHeadscale("hskey", []controlplane.HeadscaleUser{{ID: "1", Name: "alice"}}, nil)
+				defer server.Close()
+				headscaleClient = controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL, APIKey: "hskey"})
+				headscaleUser = test.user
+				defer func() { headscaleClient, headscaleUser = nil, "" }()
+			}
+
+			source, reason := reauthKeySource(test.tsconfig, test.reusable)
+			if test.key == "" {
+				if source != nil || reason == "" {
+					t.Errorf("Got a key source, want renewal disabled with a reason")
+				}
+				if !strings.Contains(reason, test.reason) {
+					t.Errorf("Got reason %q, want it to mention %q", reason, test.reason)
+				}
+				return
+			}
+			if source == nil {
+				t.Fatalf("Got no key source: %s", reason)
+			}
+			if key, err := source(); err != nil || key != test.key {
+				t.Errorf("Got key %q and %v, want %q", key, err, test.key)
+			}
+		})
+	}
+}
+
+func TestKeyExpiryRenewsExpiredKey(t *testing.T) {
+	// A node whose key expired is logged out, but its status is still served
+	expiry := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	fakeTailscaleCLI(t, fmt.Sprintf(`{
+		"BackendState": "NeedsLogin",
+		"Self": {"HostName": "gerbil", "PublicKey": "nodekey:self", "TailscaleIPs": ["100.64.0.1"], "KeyExpiry": %q}
+	}`, expiry))
+
+	events := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	notifyURL = server.URL
+	defer func() { notifyURL = "" }()
+
+	var requested int
+	monitor := newKeyExpiryMonitor([]time.Duration{24 * time.Hour}, 24*time.Hour, func() (string, error) {
+		requested++
+		return "", errors.New("no key today")
+	})
+	if err := monitor.check(); err != nil {
+		t.Fatal(err)
+	}
+	if requested != 1 {
+		t.Fatalf("Requested %d auth keys for an expired node key, want 1", requested)
+	}
+
+	actions := make(map[interface{}]bool)
+	for len(actions) < 2 {
+		select {
+		case event := <-events:
+			actions[event["action"]] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got events %v, want keyExpired and keyRenewalFailed", actions)
+		}
+	}
+	if !actions["keyExpired"] || !actions["keyRenewalFailed"] {
+		t.Errorf("Got events %v, want keyExpired and keyRenewalFailed", actions)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/logger"
+	"golang.org/x/sync/singleflight"
+)
+
+// headscaleUserCacheTTL is how long the node to user mapping is reused
+const headscaleUserCacheTTL = 30 * time.Second
+
+var (
+	headscaleClient *controlplane.Headscale
+	headscaleUser   string
+
+	// headscaleRefresh makes concurrent lookups share one node listing
+	headscaleRefresh singleflight.Group
+
+	headscaleCacheMu sync.Mutex
+	headscaleUsers   map[string]string
+	headscaleFetched time.Time
+)
+
+// headscaleUserFor returns the Headscale user owning the node with the given
+// key, or an empty string when Headscale is not configured or does not know it
+func headscaleUserFor(nodeKey string) string {
+	if headscaleClient == nil {
+		return ""
+	}
+
+	headscaleCacheMu.Lock()
+	stale := time.Since(headscaleFetched) > headscaleUserCacheTTL
+	users := headscaleUsers
+	headscaleCacheMu.Unlock()
+
+	if stale {
+		refreshed, _, _ := headscaleRefresh.Do("nodes", func() (interface{}, error) {
+			return refreshHeadscaleUsers(), nil
+		})
+		users = refreshed.(map[string]string)
+	}
+	return users[nodeKey]
+}
+
+// refreshHeadscaleUsers lists the Headscale nodes without holding the cache
+// lock, then swaps in the new node to user mapping. The old mapping is kept
+// when the listing fails.
+func refreshHeadscaleUsers() map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	nodes, err := headscaleClient.ListNodes(ctx)
+	cancel()
+
+	headscaleCacheMu.Lock()
+	defer headscaleCacheMu.Unlock()
+	if err != nil {
+		logger.Warn("Failed to list Headscale nodes: %v", err)
+	} else {
+		headscaleUsers = make(map[string]string, len(nodes))
+		for _, node := range nodes {
+			headscaleUsers[node.NodeKey] = node.User.Name
+		}
+	}
+	// Also back off after failures so a down Headscale is not hit per peer
+	headscaleFetched = time.Now()
+	return headscaleUsers
+}
+
+// headscaleAuthKey creates a single-use pre-auth key for this node
+func headscaleAuthKey() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	key, err := headscaleClient.CreatePreAuthKey(ctx, controlplane.PreAuthKeyOptions{
+		User: headscaleUser,
+		TTL:  time.Hour,
+	})
+	if err != nil {
+		return "", err
+	}
+	logger.Info("Created Headscale pre-auth key for user %s", headscaleUser)
+	return key, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/controlplane/controlplanetest"
+)
+
+func TestHeadscaleUserFor(t *testing.T) {
+	server := controlplanetest.NewHeadscale("hskey",
+		[]controlplane.HeadscaleUser{{ID: "1", Name: "alice"}},
+		[]controlplane.HeadscaleNode{{ID: "10", NodeKey: "nodekey:aaa", User: controlplane.HeadscaleUser{ID: "1", Name: "alice"}}},
+	)
+	defer server.Close()
+
+	headscaleClient = controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL, APIKey: "hskey"})
+	headscaleUsers, headscaleFetched = nil, time.Time{}
+	defer func() {
+		headscaleClient = nil
+		headscaleUsers, headscaleFetched = nil, time.Time{}
+	}()
+
+	if user := headscaleUserFor("nodekey:aaa"); user != "alice" {
+		t.Errorf("Got user %q, want alice", user)
+	}
+	if user := headscaleUserFor("nodekey:unknown"); user != "" {
+		t.Errorf("Got user %q for an unknown node", user)
+	}
+	if requests := server.Requests(); requests != 1 {
+		t.Errorf("Listed nodes %d times, want the cached listing reused", requests)
+	}
+
+	// Lookups racing an expired cache all get an answer
+	headscaleCacheMu.Lock()
+	headscaleFetched = time.Time{}
+	headscaleCacheMu.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if user := headscaleUserFor("nodekey:aaa"); user != "alice" {
+				t.Errorf("Got user %q, want alice", user)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests := server.Requests(); requests > 3 {
+		t.Errorf("Listed nodes %d times for one expired cache", requests-1)
+	}
+}
+
+func TestHeadscaleUserForKeepsUsersWhenListingFails(t *testing.T) {
+	server := controlplanetest.NewHeadscale("hskey", nil,
+		[]controlplane.HeadscaleNode{{ID: "10", NodeKey: "nodekey:aaa", User: controlplane.HeadscaleUser{ID: "1", Name: "alice"}}},
+	)
+	defer server.Close()
+
+	headscaleClient = controlplane.NewHeadscale(controlplane.HeadscaleConfig{BaseURL: server.URL, APIKey: "hskey"})
+	headscaleUsers, headscaleFetched = nil, time.Time{}
+	defer func() {
+		headscaleClient = nil
+		headscaleUsers, headscaleFetched = nil, time.Time{}
+	}()
+
+	headscaleUserFor("nodekey:aaa")
+	server.Close()
+	headscaleFetched = time.Time{}
+	if user := headscaleUserFor("nodekey:aaa"); user != "alice" {
+		t.Errorf("Got user %q after a failed listing, want the cached alice", user)
+	}
+}
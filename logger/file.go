@@ -0,0 +1,274 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp added to the name of rotated files
+const backupTimeFormat = "20060102T150405.000"
+
+// FileConfig configures a file sink
+type FileConfig struct {
+	Path string
+	// MaxSize rotates the file before it grows past this many bytes; 0 disables
+	MaxSize int64
+	// MaxAge rotates the file once it has been written to for this long; 0 disables
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files to keep; 0 keeps all of them
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// fileSink writes lines to a file and rotates it by size and age
+type fileSink struct {
+	config FileConfig
+	// now is the clock and rename moves files, both replaceable for tests
+	now    func() time.Time
+	rename func(oldpath, newpath string) error
+
+	mu      sync.Mutex
+	file    *os.File
+	closed  bool
+	size    int64
+	opened  time.Time
+	pending sync.WaitGroup
+	// cleanup runs compression and removal of old files one at a time
+	cleanup sync.Mutex
+}
+
+// NewFileSink opens the file, appending to it if it exists
+func NewFileSink(config FileConfig) (Sink, error) {
+	return newFileSink(config, time.Now)
+}
+
+func newFileSink(config FileConfig, now func() time.Time) (*fileSink, error) {
+	s := &fileSink{config: config, now: now, rename: os.Rename}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+	s.file = file
+	s.size = info.Size()
+	// An existing file keeps its age across restarts
+	s.opened = s.now()
+	if s.size > 0 && info.ModTime().Before(s.opened) {
+		s.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (s *fileSink) Write(e Entry) error {
+	line := e.Line() + "\n"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("log file %s is closed", s.config.Path)
+	}
+	if s.file == nil {
+		// A failed rotation couldn't reopen the file
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var rotateErr error
+	if s.needsRotation(int64(len(line))) {
+		if rotateErr = s.rotate(); s.file == nil {
+			return rotateErr
+		}
+		// The line still goes to the current file, and the rotation is
+		// retried with the next one
+	}
+	n, err := io.WriteString(s.file, line)
+	s.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+func (s *fileSink) needsRotation(next int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.config.MaxSize > 0 && s.size+next > s.config.MaxSize {
+		return true
+	}
+	return s.config.MaxAge > 0 && s.now().Sub(s.opened) >= s.config.MaxAge
+}
+
+// rotate renames the current file with a timestamp and starts a new one.
+// Compression and cleanup of old files happen in the background. When the
+// rename fails, the current file is reopened to keep appending to it.
+func (s *fileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to close log file: %v", err)
+	}
+
+	backup := s.backupName(s.now())
+	if err := s.rename(s.config.Path, backup); err != nil {
+		if openErr := s.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate log file: %v", err)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.cleanup.Lock()
+		defer s.cleanup.Unlock()
+		if s.config.Compress {
+			// A later cleanup may already have removed it
+			if err := compressFile(backup); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Failed to compress log file %s: %v\n", backup, err)
+			}
+		}
+		if err := s.removeOldBackups(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to remove old log files: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// backupName names a rotated file after t, moving on to the next millisecond
+// while the name is taken so names keep sorting in time order
+func (s *fileSink) backupName(t time.Time) string {
+	for {
+		backup := s.config.Path + "." + t.Format(backupTimeFormat)
+		if !exists(backup) && !exists(backup+".gz") {
+			return backup
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// backups returns the rotated files, newest first. Only names this sink
+// gives its backups count, so other files next to the log are left alone.
+func (s *fileSink) backups() ([]string, error) {
+	dir, base := filepath.Split(s.config.Path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, entry := range entries {
+		if isBackup(entry.Name(), base) {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+	// The timestamps sort in time order
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups, nil
+}
+
+// isBackup reports whether name is a rotated, and possibly compressed, copy
+// of the log file base. Files still being compressed don't count.
+func isBackup(name, base string) bool {
+	stamp, ok := strings.CutPrefix(name, base+".")
+	if !ok {
+		return false
+	}
+	stamp = strings.TrimSuffix(stamp, ".gz")
+	_, err := time.Parse(backupTimeFormat, stamp)
+	return err == nil
+}
+
+func (s *fileSink) removeOldBackups() error {
+	if s.config.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+	for i := s.config.MaxBackups; i < len(backups); i++ {
+		if err := os.Remove(backups[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressFile gzips path to path.gz and removes the original
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the file after background compression finishes
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	file := s.file
+	s.file = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	s.pending.Wait()
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
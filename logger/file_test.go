@@ -0,0 +1,349 @@
+package logger
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for file sinks that only moves when told to
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func testEntry(message string) Entry {
+	return Entry{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Level: INFO, Message: message}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	// Lines are 30 to 32 bytes, so each file takes two
+	s, err := newFileSink(FileConfig{Path: path, MaxSize: 64}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"one", "two", "three", "four", "five"} {
+		clock.Add(time.Second)
+		if err := s.Write(testEntry(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := s.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Got backups %q, want 2", backups)
+	}
+	// Newest first, named after the time of rotation
+	if want := path + ".20240101T000005.000"; backups[0] != want {
+		t.Errorf("Got newest backup %s, want %s", backups[0], want)
+	}
+	for i, want := range []string{"four\n", "two\n"} {
+		if content := readFile(t, backups[i]); !strings.HasSuffix(content, want) || strings.Count(content, "\n") != 2 {
+			t.Errorf("Got backup %s with %q, want two lines ending in %q", backups[i], content, want)
+		}
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, "five\n") || strings.Count(content, "\n") != 1 {
+		t.Errorf("Got current file with %q, want the last line", content)
+	}
+}
+
+func TestFileSinkRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, err := newFileSink(FileConfig{Path: path, MaxAge: time.Hour}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write(testEntry("one"))
+	clock.Add(59 * time.Minute)
+	s.Write(testEntry("two"))
+	if backups, _ := s.backups(); len(backups) != 0 {
+		t.Fatalf("Rotated a file younger than its max age: %q", backups)
+	}
+	clock.Add(time.Minute)
+	s.Write(testEntry("three"))
+	if backups, _ := s.backups(); len(backups) != 1 {
+		t.Fatalf("Got backups %q, want one after the max age", backups)
+	}
+	// The age starts over with the new file
+	clock.Add(59 * time.Minute)
+	s.Write(testEntry("four"))
+	if backups, _ := s.backups(); len(backups) != 1 {
+		t.Errorf("Got backups %q, want the new file kept", backups)
+	}
+}
+
+func TestFileSinkCompressesAndRemovesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, err := newFileSink(FileConfig{Path: path, MaxSize: 1, MaxBackups: 2, Compress: true}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"one", "two", "three", "four", "five"} {
+		clock.Add(time.Second)
+		if err := s.Write(testEntry(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Close waits for compression and cleanup
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := s.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Got backups %q, want 2", backups)
+	}
+	for i, want := range []string{"four\n", "three\n"} {
+		if !strings.HasSuffix(backups[i], ".gz") {
+			t.Errorf("Backup %s is not compressed", backups[i])
+			continue
+		}
+		if content := readGzip(t, backups[i]); !strings.HasSuffix(content, want) {
+			t.Errorf("Got backup %s with %q, want %q", backups[i], content, want)
+		}
+	}
+	if temp, _ := filepath.Glob(path + ".*.tmp"); len(temp) != 0 {
+		t.Errorf("Left temporary files %q", temp)
+	}
+}
+
+func TestFileSinkKeepsUnrelatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gerbil.log")
+	unrelated := []string{path + ".keep", path + ".bak", path + ".20240101T000000.gz.tmp", path + ".20240101T000000.000.old"}
+	for _, name := range unrelated {
+		if err := os.WriteFile(name, []byte("keep\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, err := newFileSink(FileConfig{Path: path, MaxSize: 1, MaxBackups: 1}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"one", "two", "three"} {
+		clock.Add(time.Second)
+		if err := s.Write(testEntry(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := s.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("Got backups %q, want 1", backups)
+	}
+	for _, name := range unrelated {
+		if !exists(name) {
+			t.Errorf("Rotation removed %s", name)
+		}
+	}
+}
+
+func TestIsBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "gerbil.log.20240101T000000.000", want: true},
+		{name: "gerbil.log.20240101T000000.000.gz", want: true},
+		{name: "gerbil.log.20240101T000000.000.gz.tmp"},
+		{name: "gerbil.log.keep"},
+		{name: "gerbil.log.lock"},
+		{name: "gerbil.log"},
+		{name: "other.log.20240101T000000.000"},
+	}
+	for _, test := range tests {
+		if got := isBackup(test.name, "gerbil.log"); got != test.want {
+			t.Errorf("isBackup(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFileSinkReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	config := FileConfig{Path: path, MaxSize: 64}
+
+	s, err := newFileSink(config, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(testEntry("one"))
+	s.Close()
+	if err := s.Write(testEntry("closed")); err == nil {
+		t.Error("Wrote to a closed sink")
+	}
+
+	// A restart appends and counts the existing lines towards the size
+	s, err = newFileSink(config, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(testEntry("two"))
+	if content := readFile(t, path); !strings.Contains(content, "one\n") || !strings.HasSuffix(content, "two\n") {
+		t.Errorf("Got %q, want both lines appended", content)
+	}
+	s.Write(testEntry("three"))
+	if backups, _ := s.backups(); len(backups) != 1 {
+		t.Errorf("Got backups %q, want a rotation counting the lines from before the restart", backups)
+	}
+}
+
+func TestFileSinkReopenKeepsAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileSink(FileConfig{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(testEntry("new"))
+	if content := readFile(t, path); content != "INFO: 2024/01/01 00:00:00 new\n" {
+		t.Errorf("Got %q, want the file older than max age rotated before writing", content)
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, err := newFileSink(FileConfig{Path: path, MaxSize: 1}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.rename = func(oldpath, newpath string) error {
+		return errors.New("read-only directory")
+	}
+
+	s.Write(testEntry("one"))
+	clock.Add(time.Second)
+	if err := s.Write(testEntry("two")); err == nil || !strings.Contains(err.Error(), "read-only directory") {
+		t.Errorf("Got %v, want the rename error", err)
+	}
+	// The sink keeps appending to the current file
+	if content := readFile(t, path); !strings.Contains(content, "one\n") || !strings.HasSuffix(content, "two\n") {
+		t.Errorf("Got %q, want both lines in the current file", content)
+	}
+
+	// Once renames work again, the next line rotates
+	s.rename = os.Rename
+	clock.Add(time.Second)
+	if err := s.Write(testEntry("three")); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := s.backups(); len(backups) != 1 {
+		t.Fatalf("Got backups %q, want one", backups)
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, "three\n") || strings.Count(content, "\n") != 1 {
+		t.Errorf("Got current file with %q, want the last line", content)
+	}
+}
+
+func TestFileSinkReopenFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gerbil.log")
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, err := newFileSink(FileConfig{Path: path, MaxSize: 1}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// A directory in the file's place can't be opened
+	s.rename = func(oldpath, newpath string) error {
+		if err := os.Rename(oldpath, newpath); err != nil {
+			return err
+		}
+		return os.Mkdir(oldpath, 0o755)
+	}
+
+	s.Write(testEntry("one"))
+	clock.Add(time.Second)
+	if err := s.Write(testEntry("lost")); err == nil {
+		t.Error("Wrote without a file to write to")
+	}
+
+	// The next line opens the file again
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(testEntry("two")); err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, path); !strings.HasSuffix(content, "two\n") || strings.Count(content, "\n") != 1 {
+		t.Errorf("Got %q, want the line written after the failure", content)
+	}
+}
@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the output format of log lines
+type Format int
+
+const (
+	// FormatText writes "LEVEL: timestamp message key=value" lines
+	FormatText Format = iota
+	// FormatJSON writes one JSON object per line
+	FormatJSON
+)
+
+// badKey is the key of a trailing field value without a key
+const badKey = "!BADKEY"
+
+// ParseFormat parses a LOG_FORMAT value, "text" or "json"
+func ParseFormat(format string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	default:
+		return FormatText, fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+}
+
+// String returns the name of the format
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "text"
+}
+
+// fieldPairs splits key/value arguments into keys and values
+func fieldPairs(fields []interface{}) ([]string, []interface{}) {
+	var keys []string
+	var values []interface{}
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 == len(fields) {
+			keys = append(keys, badKey)
+			values = append(values, fields[i])
+			break
+		}
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		keys = append(keys, key)
+		values = append(values, fields[i+1])
+	}
+	return keys, values
+}
+
+// formatFields renders fields as " key=value" pairs, quoting values with spaces
+func formatFields(fields []interface{}) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	keys, values := fieldPairs(fields)
+	for i, key := range keys {
+		value := fmt.Sprint(values[i])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	return b.String()
+}
+
+// formatJSON renders a log line as a JSON object with the fields after the
+// time, level, logger name, message and caller
+func formatJSON(t time.Time, level LogLevel, name, message, caller string, fields []interface{}) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	writeJSONField(&b, "time", t.Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	writeJSONField(&b, "level", level.String())
+	b.WriteByte(',')
+	if name != "" {
+		writeJSONField(&b, "logger", name)
+		b.WriteByte(',')
+	}
+	writeJSONField(&b, "msg", message)
+	if caller != "" {
+		b.WriteByte(',')
+		writeJSONField(&b, "caller", caller)
+	}
+	keys, values := fieldPairs(fields)
+	for i, key := range keys {
+		b.WriteByte(',')
+		writeJSONField(&b, key, values[i])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+
+	// Errors and Stringers marshal to {} or worse, so log their text instead
+	switch v := value.(type) {
+	case json.Marshaler:
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(data)
+}
+
+// shortFile trims a source path to its package directory and file name
+func shortFile(file string) string {
+	return filepath.Join(filepath.Base(filepath.Dir(file)), filepath.Base(file))
+}
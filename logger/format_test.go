@@ -0,0 +1,87 @@
+package logger
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFieldPairs(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields []interface{}
+		keys   []string
+		values []interface{}
+	}{
+		{name: "none"},
+		{name: "pairs", fields: []interface{}{"peer", "nyc-1", "online", true}, keys: []string{"peer", "online"}, values: []interface{}{"nyc-1", true}},
+		{name: "key that is not a string", fields: []interface{}{42, "answer"}, keys: []string{"42"}, values: []interface{}{"answer"}},
+		{name: "value without a key", fields: []interface{}{"peer", "nyc-1", "orphan"}, keys: []string{"peer", badKey}, values: []interface{}{"nyc-1", "orphan"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keys, values := fieldPairs(test.fields)
+			if !reflect.DeepEqual(keys, test.keys) || !reflect.DeepEqual(values, test.values) {
+				t.Errorf("Got %v and %v, want %v and %v", keys, values, test.keys, test.values)
+			}
+		})
+	}
+}
+
+type stringer struct{}
+
+func (stringer) String() string { return "stringer" }
+
+func TestFormatJSON(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC)
+	tests := []struct {
+		name   string
+		logger string
+		caller string
+		fields []interface{}
+		want   string
+	}{
+		{
+			name: "message only",
+			want: `{"time":"2024-01-02T03:04:05.6Z","level":"WARN","msg":"slow \"request\""}`,
+		},
+		{
+			name:   "logger, caller and fields in order",
+			logger: "http",
+			caller: "gerbil/api.go:42",
+			fields: []interface{}{"status", 503, "took", 1.5},
+			want:   `{"time":"2024-01-02T03:04:05.6Z","level":"WARN","logger":"http","msg":"slow \"request\"","caller":"gerbil/api.go:42","status":503,"took":1.5}`,
+		},
+		{
+			name:   "errors and stringers as text",
+			fields: []interface{}{"err", errors.New("boom"), "value", stringer{}},
+			want:   `{"time":"2024-01-02T03:04:05.6Z","level":"WARN","msg":"slow \"request\"","err":"boom","value":"stringer"}`,
+		},
+		{
+			name:   "unmarshalable values as text",
+			fields: []interface{}{"ch", (chan int)(nil), "orphan"},
+			want:   `{"time":"2024-01-02T03:04:05.6Z","level":"WARN","msg":"slow \"request\"","ch":"\u003cnil\u003e","!BADKEY":"orphan"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line := formatJSON(at, WARN, test.logger, `slow "request"`, test.caller, test.fields)
+			if line != test.want {
+				t.Errorf("Got %s, want %s", line, test.want)
+			}
+			if !json.Valid([]byte(line)) {
+				t.Errorf("Got invalid JSON %s", line)
+			}
+		})
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	got := formatFields([]interface{}{"path", "/status", "took", "2 s", "empty", "", "quote", `a"b`})
+	want := ` path=/status took="2 s" empty="" quote="a\"b"`
+	if got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultJournalSocket is where journald listens for the native protocol
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+// JournaldConfig configures a journald sink
+type JournaldConfig struct {
+	// Socket is the journald socket; empty uses the default
+	Socket string
+	// Identifier is the SYSLOG_IDENTIFIER; empty uses the program name
+	Identifier string
+}
+
+// journalMessage encodes an entry in the journald native protocol. Fields
+// become upper case journal fields, next to MESSAGE, PRIORITY and the logger
+// name in LOGGER.
+func journalMessage(e Entry, identifier string) []byte {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", e.Message)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(syslogSeverity(e.Level)))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", identifier)
+	if e.Logger != "" {
+		writeJournalField(&b, "LOGGER", e.Logger)
+	}
+	if file, line, ok := strings.Cut(e.Caller, ":"); ok {
+		writeJournalField(&b, "CODE_FILE", file)
+		writeJournalField(&b, "CODE_LINE", line)
+	}
+	keys, values := fieldPairs(e.Fields)
+	for i, key := range keys {
+		writeJournalField(&b, journalFieldName(key), fmt.Sprint(values[i]))
+	}
+	return b.Bytes()
+}
+
+// writeJournalField writes KEY=value, or the length prefixed binary form
+// for values that span lines
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	b.WriteString(key)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName turns a field key into a valid journal field name: upper
+// case letters, digits and underscores, not starting with a digit or underscore
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "" || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		name = "FIELD_" + strings.TrimLeft(name, "_")
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func journalIdentifier(config JournaldConfig) string {
+	if config.Identifier != "" {
+		return config.Identifier
+	}
+	return filepath.Base(os.Args[0])
+}
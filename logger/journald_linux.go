@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// journaldSink writes to journald with its native protocol
+type journaldSink struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+// NewJournaldSink connects to the journald socket
+func NewJournaldSink(config JournaldConfig) (Sink, error) {
+	socket := config.Socket
+	if socket == "" {
+		socket = defaultJournalSocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %v", err)
+	}
+	return &journaldSink{conn: conn, identifier: journalIdentifier(config)}, nil
+}
+
+func (s *journaldSink) Write(e Entry) error {
+	message := journalMessage(e, s.identifier)
+	_, err := s.conn.Write(message)
+	if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+		return s.writeFile(message)
+	}
+	return err
+}
+
+// writeFile passes messages too large for a datagram in a deleted file
+// in /dev/shm, as the native protocol allows
+func (s *journaldSink) writeFile(message []byte) error {
+	file, err := os.CreateTemp("/dev/shm", "gerbil-journal-")
+	if err != nil {
+		return fmt.Errorf("failed to create journal message file: %v", err)
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+
+	if _, err := file.Write(message); err != nil {
+		return fmt.Errorf("failed to write journal message file: %v", err)
+	}
+	// WriteMsgUnix refuses connected datagram sockets, so send on the
+	// descriptor directly
+	raw, err := s.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = raw.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendmsg(int(fd), nil, syscall.UnixRights(int(file.Fd())), nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenJournal listens on a unixgram socket in place of journald
+func listenJournal(t *testing.T) (*net.UnixConn, string) {
+	socket := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, socket
+}
+
+// parseJournalMessage decodes the native protocol into its fields
+func parseJournalMessage(t *testing.T, message []byte) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for len(message) > 0 {
+		end := bytes.IndexByte(message, '\n')
+		if end < 0 {
+			t.Fatalf("Got an unterminated field %q", message)
+		}
+		line := string(message[:end])
+		message = message[end+1:]
+		if key, value, ok := strings.Cut(line, "="); ok {
+			fields[key] = value
+			continue
+		}
+		// KEY\n, a little endian length, the value and a newline
+		if len(message) < 8 {
+			t.Fatalf("Got field %s without a length", line)
+		}
+		size := binary.LittleEndian.Uint64(message)
+		message = message[8:]
+		if uint64(len(message)) < size+1 || message[size] != '\n' {
+			t.Fatalf("Got field %s with a length of %d that doesn't match", line, size)
+		}
+		fields[line] = string(message[:size])
+		message = message[size+1:]
+	}
+	return fields
+}
+
+func TestJournaldSink(t *testing.T) {
+	conn, socket := listenJournal(t)
+	sink, err := NewJournaldSink(JournaldConfig{Socket: socket, Identifier: "gerbil"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	err = sink.Write(Entry{
+		Time:    time.Now(),
+		Level:   WARN,
+		Logger:  "tailscale",
+		Message: "first\nsecond",
+		Caller:  "daemon.go:42",
+		Fields:  []interface{}{"peer-count", 3, "2fa", true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := parseJournalMessage(t, buf[:n])
+	want := map[string]string{
+		// Multiline values use the binary form
+		"MESSAGE":           "first\nsecond",
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "gerbil",
+		"LOGGER":            "tailscale",
+		"CODE_FILE":         "daemon.go",
+		"CODE_LINE":         "42",
+		"PEER_COUNT":        "3",
+		"FIELD_2FA":         "true",
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("Got %s=%q, want %q", key, fields[key], value)
+		}
+	}
+	if len(fields) != len(want) {
+		t.Errorf("Got fields %v, want %v", fields, want)
+	}
+}
+
+func TestJournaldSinkLargeMessage(t *testing.T) {
+	conn, socket := listenJournal(t)
+	sink, err := NewJournaldSink(JournaldConfig{Socket: socket, Identifier: "gerbil"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	// Too large for a datagram, so it is passed in a file
+	message := strings.Repeat("x", 1<<20)
+	if err := sink.Write(Entry{Time: time.Now(), Level: INFO, Message: message}); err != nil {
+		t.Fatal(err)
+	}
+	oob := make([]byte, syscall.CmsgSpace(4))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, oobn, _, _, err := conn.ReadMsgUnix(nil, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Got %d bytes in the datagram, want only the file", n)
+	}
+	control, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(control) != 1 {
+		t.Fatalf("Got control messages %v and %v, want one", control, err)
+	}
+	fds, err := syscall.ParseUnixRights(&control[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("Got descriptors %v and %v, want one", fds, err)
+	}
+	file := os.NewFile(uintptr(fds[0]), "journal message")
+	defer file.Close()
+
+	data := make([]byte, 2<<20)
+	n, err = file.ReadAt(data, 0)
+	if n == 0 {
+		t.Fatal(err)
+	}
+	if fields := parseJournalMessage(t, data[:n]); fields["MESSAGE"] != message {
+		t.Errorf("Got a message of %d bytes, want %d", len(fields["MESSAGE"]), len(message))
+	}
+}
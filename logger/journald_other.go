@@ -0,0 +1,10 @@
+//go:build !linux
+
+package logger
+
+import "errors"
+
+// NewJournaldSink fails outside Linux, where there is no journald
+func NewJournaldSink(config JournaldConfig) (Sink, error) {
+	return nil, errors.New("journald is only available on Linux")
+}
@@ -1,5 +1,10 @@
 package logger
 
+import (
+	"fmt"
+	"strings"
+)
+
 type LogLevel int
 
 const (
@@ -25,3 +30,28 @@ func (l LogLevel) String() string {
 	}
 	return "UNKNOWN"
 }
+
+// ParseLevel parses a level name such as "debug" or "WARN"
+func ParseLevel(level string) (LogLevel, error) {
+	for l, s := range levelStrings {
+		if strings.EqualFold(level, s) {
+			return l, nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level %q, use DEBUG, INFO, WARN, ERROR or FATAL", level)
+}
+
+// MarshalText encodes the level as its name, so it reads well in JSON
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText decodes a level name
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := ParseLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
@@ -2,29 +2,67 @@ package logger
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Logger struct holds the logger instance
+// inheritLevel marks a named logger that uses its parent's level
+const inheritLevel = -1
+
+// Logger struct holds the logger instance. Named loggers share the outputs
+// and format of their parent and can have a level of their own.
 type Logger struct {
-	logger *log.Logger
-	level  LogLevel
+	outputs atomic.Pointer[[]Output]
+	level   atomic.Int32
+	format  atomic.Int32
+
+	name   string
+	parent *Logger
+
+	// Only used on the root logger
+	debug   atomic.Bool
+	mu      sync.Mutex
+	named   map[string]*Logger
+	restore *time.Timer
 }
 
 var (
 	defaultLogger *Logger
 	once          sync.Once
+
+	exitMu sync.Mutex
+	exit   = os.Exit
 )
 
+// SetExitFunc replaces the function Fatal calls to end the process, which is
+// os.Exit by default, and returns the previous one. Tests use it to catch
+// fatal errors instead of exiting.
+func SetExitFunc(f func(code int)) func(code int) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	previous := exit
+	exit = f
+	return previous
+}
+
+func exitProcess(code int) {
+	exitMu.Lock()
+	f := exit
+	exitMu.Unlock()
+	f(code)
+}
+
 // NewLogger creates a new logger instance
 func NewLogger() *Logger {
-	return &Logger{
-		logger: log.New(os.Stdout, "", 0),
-		level:  DEBUG,
-	}
+	l := &Logger{named: make(map[string]*Logger)}
+	l.outputs.Store(&[]Output{{Sink: NewWriterSink(os.Stdout), Level: DEBUG, Spec: "stdout"}})
+	l.level.Store(int32(DEBUG))
+	l.format.Store(int32(FormatText))
+	return l
 }
 
 // Init initializes the default logger
@@ -37,25 +75,221 @@ func Init() *Logger {
 
 // GetLogger returns the default logger instance
 func GetLogger() *Logger {
-	if defaultLogger == nil {
-		Init()
+	return Init()
+}
+
+// Named returns the default logger's sub-logger for a subsystem
+func Named(name string) *Logger {
+	return GetLogger().Named(name)
+}
+
+// Named returns the sub-logger with the given name, creating it on first
+// use. It inherits the root logger's level until one is set.
+func (l *Logger) Named(name string) *Logger {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if named, ok := root.named[name]; ok {
+		return named
 	}
-	return defaultLogger
+	named := &Logger{name: name, parent: root}
+	named.level.Store(inheritLevel)
+	root.named[name] = named
+	return named
+}
+
+// Name returns the subsystem name, empty for the root logger
+func (l *Logger) Name() string {
+	return l.name
 }
 
 // SetLevel sets the minimum logging level
 func (l *Logger) SetLevel(level LogLevel) {
-	l.level = level
+	l.level.Store(int32(level))
 }
 
-// log handles the actual logging
+// ResetLevel makes a named logger inherit the root logger's level again
+func (l *Logger) ResetLevel() {
+	if l.parent != nil {
+		l.level.Store(inheritLevel)
+	}
+}
+
+// Level returns the minimum level written, taking the debug override into account
+func (l *Logger) Level() LogLevel {
+	root := l.root()
+	if root.debug.Load() {
+		return DEBUG
+	}
+	if level := l.level.Load(); level != inheritLevel {
+		return LogLevel(level)
+	}
+	return LogLevel(root.level.Load())
+}
+
+// Levels returns the configured level of each named logger; nil means the
+// logger inherits the root level
+func (l *Logger) Levels() map[string]*LogLevel {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	levels := make(map[string]*LogLevel, len(root.named))
+	for name, named := range root.named {
+		levels[name] = nil
+		if level := named.level.Load(); level != inheritLevel {
+			l := LogLevel(level)
+			levels[name] = &l
+		}
+	}
+	return levels
+}
+
+// Names returns the names of the sub-loggers in use, sorted
+func (l *Logger) Names() []string {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	names := make([]string, 0, len(root.named))
+	for name := range root.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetDebug logs everything at DEBUG for d, whatever the configured levels,
+// or until it is turned off. A d of zero keeps it on until turned off.
+func (l *Logger) SetDebug(on bool, d time.Duration) {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	if root.restore != nil {
+		root.restore.Stop()
+		root.restore = nil
+	}
+	root.debug.Store(on)
+	if on && d > 0 {
+		root.restore = time.AfterFunc(d, func() {
+			root.debug.Store(false)
+			root.Info("Debug logging override expired")
+		})
+	}
+}
+
+// Debugging reports whether the debug override is on
+func (l *Logger) Debugging() bool {
+	return l.root().debug.Load()
+}
+
+// SetOutputs replaces the sinks log lines are written to and closes the
+// previous ones
+func (l *Logger) SetOutputs(outputs ...Output) {
+	root := l.root()
+	previous := root.outputs.Swap(&outputs)
+	for _, output := range *previous {
+		output.Sink.Close()
+	}
+}
+
+// Outputs returns the sinks log lines are written to
+func (l *Logger) Outputs() []Output {
+	return *l.root().outputs.Load()
+}
+
+// Close closes the sinks, flushing files being compressed. Lines logged
+// afterwards are dropped.
+func (l *Logger) Close() error {
+	root := l.root()
+	var first error
+	for _, output := range *root.outputs.Swap(&[]Output{}) {
+		if err := output.Sink.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// SetFormat sets the output format
+func (l *Logger) SetFormat(format Format) {
+	l.root().format.Store(int32(format))
+}
+
+// Format returns the output format
+func (l *Logger) Format() Format {
+	return Format(l.root().format.Load())
+}
+
+func (l *Logger) root() *Logger {
+	if l.parent != nil {
+		return l.parent
+	}
+	return l
+}
+
+// log handles printf style logging. It must be called directly by the
+// exported logging functions so the caller is found at a fixed depth.
 func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
-	if level < l.level {
+	if level < l.Level() {
 		return
 	}
-	timestamp := time.Now().Format("2006/01/02 15:04:05")
-	message := fmt.Sprintf(format, args...)
-	l.logger.Printf("%s: %s %s", level.String(), timestamp, message)
+	l.entry(level, fmt.Sprintf(format, args...), nil)
+}
+
+// logw handles structured logging of a message with key/value fields. Like
+// log, it must be called directly by the exported logging functions.
+func (l *Logger) logw(level LogLevel, message string, fields []interface{}) {
+	if level < l.Level() {
+		return
+	}
+	l.entry(level, message, fields)
+}
+
+// entry writes a log line for log and logw, looking up their caller
+func (l *Logger) entry(level LogLevel, message string, fields []interface{}) {
+	now := time.Now()
+	caller := ""
+	if l.Format() == FormatJSON {
+		if _, file, line, ok := runtime.Caller(3); ok {
+			caller = fmt.Sprintf("%s:%d", shortFile(file), line)
+		}
+	}
+	l.output(level, now, message, caller, fields)
+}
+
+// output writes a log line to every sink that takes its level. A sink that
+// fails is reported on stderr, as there is nowhere else to log it.
+func (l *Logger) output(level LogLevel, t time.Time, message, caller string, fields []interface{}) {
+	entry := Entry{
+		Time:    t,
+		Level:   level,
+		Logger:  l.name,
+		Message: message,
+		Caller:  caller,
+		Fields:  fields,
+		Format:  l.Format(),
+	}
+	for _, output := range l.Outputs() {
+		if level < output.Level {
+			continue
+		}
+		if err := output.Sink.Write(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write log line to %s: %v\n", output.Spec, err)
+		}
+	}
+}
+
+// Log logs a message at the given level
+func (l *Logger) Log(level LogLevel, format string, args ...interface{}) {
+	l.log(level, format, args...)
+}
+
+// Logw logs a message with key/value fields at the given level
+func (l *Logger) Logw(level LogLevel, message string, fields ...interface{}) {
+	l.logw(level, message, fields)
 }
 
 // Debug logs debug level messages
@@ -78,29 +312,66 @@ func (l *Logger) Error(format string, args ...interface{}) {
 	l.log(ERROR, format, args...)
 }
 
-// Fatal logs fatal level messages and exits
+// Debugw logs a debug level message with key/value fields
+func (l *Logger) Debugw(message string, fields ...interface{}) {
+	l.logw(DEBUG, message, fields)
+}
+
+// Infow logs an info level message with key/value fields
+func (l *Logger) Infow(message string, fields ...interface{}) {
+	l.logw(INFO, message, fields)
+}
+
+// Warnw logs a warning level message with key/value fields
+func (l *Logger) Warnw(message string, fields ...interface{}) {
+	l.logw(WARN, message, fields)
+}
+
+// Errorw logs an error level message with key/value fields
+func (l *Logger) Errorw(message string, fields ...interface{}) {
+	l.logw(ERROR, message, fields)
+}
+
+// Fatal logs fatal level messages and exits through the exit function
 func (l *Logger) Fatal(format string, args ...interface{}) {
 	l.log(FATAL, format, args...)
-	os.Exit(1)
+	exitProcess(1)
 }
 
 // Global helper functions
 func Debug(format string, args ...interface{}) {
-	GetLogger().Debug(format, args...)
+	GetLogger().log(DEBUG, format, args...)
 }
 
 func Info(format string, args ...interface{}) {
-	GetLogger().Info(format, args...)
+	GetLogger().log(INFO, format, args...)
 }
 
 func Warn(format string, args ...interface{}) {
-	GetLogger().Warn(format, args...)
+	GetLogger().log(WARN, format, args...)
 }
 
 func Error(format string, args ...interface{}) {
-	GetLogger().Error(format, args...)
+	GetLogger().log(ERROR, format, args...)
 }
 
 func Fatal(format string, args ...interface{}) {
-	GetLogger().Fatal(format, args...)
+	GetLogger().log(FATAL, format, args...)
+	exitProcess(1)
+}
+
+func Debugw(message string, fields ...interface{}) {
+	GetLogger().logw(DEBUG, message, fields)
+}
+
+func Infow(message string, fields ...interface{}) {
+	GetLogger().logw(INFO, message, fields)
+}
+
+func Warnw(message string, fields ...interface{}) {
+	GetLogger().logw(WARN, message, fields)
+}
+
+func Errorw(message string, fields ...interface{}) {
+	GetLogger().logw(ERROR, message, fields)
 }
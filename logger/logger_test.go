@@ -0,0 +1,168 @@
+package logger
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySink keeps the entries written to it
+type memorySink struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (s *memorySink) Write(e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func (s *memorySink) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Entry(nil), s.entries...)
+}
+
+func newTestLogger() (*Logger, *memorySink) {
+	sink := &memorySink{}
+	l := NewLogger()
+	l.SetOutputs(Output{Sink: sink, Level: DEBUG, Spec: "memory"})
+	return l, sink
+}
+
+func TestLoggerPrintfAndFields(t *testing.T) {
+	l, sink := newTestLogger()
+	l.SetFormat(FormatJSON)
+
+	l.Info("Peer %[1]s is %[2]s, %[1]s again", "nyc-1", "online")
+	l.Warnw("Peer offline", "peer", "nyc-1", "since", 3)
+	l.Named("http").Logw(ERROR, "GET /status", "status", 500)
+
+	entries := sink.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("Got %d entries, want 3", len(entries))
+	}
+	if entries[0].Message != "Peer nyc-1 is online, nyc-1 again" || entries[0].Fields != nil {
+		t.Errorf("Got %q with fields %v, want the formatted message alone", entries[0].Message, entries[0].Fields)
+	}
+	if entries[1].Message != "Peer offline" || !reflect.DeepEqual(entries[1].Fields, []interface{}{"peer", "nyc-1", "since", 3}) {
+		t.Errorf("Got %q with fields %v", entries[1].Message, entries[1].Fields)
+	}
+	if entries[2].Level != ERROR || entries[2].Logger != "http" || !reflect.DeepEqual(entries[2].Fields, []interface{}{"status", 500}) {
+		t.Errorf("Got %+v", entries[2])
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Caller, "logger/logger_test.go:") {
+			t.Errorf("Got caller %q, want this test", entry.Caller)
+		}
+	}
+}
+
+func TestLoggerStructuredMessageIsNotFormatted(t *testing.T) {
+	l, sink := newTestLogger()
+	l.Infow("100% done", "ratio", "1/1")
+	if entries := sink.Entries(); len(entries) != 1 || entries[0].Message != "100% done" {
+		t.Errorf("Got %+v, want the message unchanged", entries)
+	}
+}
+
+func TestNamedLoggerLevels(t *testing.T) {
+	l, sink := newTestLogger()
+	l.SetLevel(INFO)
+	http := l.Named("http")
+	tailscale := l.Named("tailscale")
+	if l.Named("http") != http {
+		t.Errorf("Got a new logger for a known name")
+	}
+
+	// Named loggers use the root level until given their own
+	http.SetLevel(WARN)
+	tailscale.SetLevel(DEBUG)
+	http.Info("dropped")
+	http.Warn("kept")
+	tailscale.Debug("kept")
+	l.Debug("dropped")
+
+	l.SetLevel(ERROR)
+	if http.Level() != WARN || tailscale.Level() != DEBUG {
+		t.Errorf("Got levels %s and %s, want their own after changing the root level", http.Level(), tailscale.Level())
+	}
+	http.ResetLevel()
+	if http.Level() != ERROR {
+		t.Errorf("Got %s after a reset, want the root level", http.Level())
+	}
+	http.Warn("dropped")
+
+	var got []string
+	for _, entry := range sink.Entries() {
+		got = append(got, entry.Logger+":"+entry.Message)
+	}
+	if want := []string{"http:kept", "tailscale:kept"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	levels := l.Levels()
+	if len(levels) != 2 || levels["http"] != nil || levels["tailscale"] == nil || *levels["tailscale"] != DEBUG {
+		t.Errorf("Got levels %v", levels)
+	}
+	if names := l.Names(); !reflect.DeepEqual(names, []string{"http", "tailscale"}) {
+		t.Errorf("Got names %q", names)
+	}
+}
+
+func TestDebugOverride(t *testing.T) {
+	l, sink := newTestLogger()
+	l.SetLevel(ERROR)
+	http := l.Named("http")
+	http.SetLevel(WARN)
+
+	l.SetDebug(true, 0)
+	if !l.Debugging() || l.Level() != DEBUG || http.Level() != DEBUG {
+		t.Errorf("Got levels %s and %s, want DEBUG everywhere", l.Level(), http.Level())
+	}
+	http.Debug("kept")
+	l.SetDebug(false, 0)
+	if l.Debugging() || l.Level() != ERROR || http.Level() != WARN {
+		t.Errorf("Got levels %s and %s, want the configured ones back", l.Level(), http.Level())
+	}
+	http.Debug("dropped")
+	if entries := sink.Entries(); len(entries) != 1 || entries[0].Message != "kept" {
+		t.Errorf("Got %+v", entries)
+	}
+}
+
+func TestDebugOverrideExpires(t *testing.T) {
+	l, _ := newTestLogger()
+	l.SetLevel(WARN)
+
+	l.SetDebug(true, 20*time.Millisecond)
+	if l.Level() != DEBUG {
+		t.Fatalf("Got %s, want DEBUG", l.Level())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Debugging() {
+		if time.Now().After(deadline) {
+			t.Fatal("Debug override didn't expire")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if l.Level() != WARN {
+		t.Errorf("Got %s after expiry, want WARN", l.Level())
+	}
+
+	// Turning it on again replaces the pending expiry
+	l.SetDebug(true, 20*time.Millisecond)
+	l.SetDebug(true, 0)
+	time.Sleep(50 * time.Millisecond)
+	if !l.Debugging() {
+		t.Errorf("Got the override expired by a replaced timer")
+	}
+}
@@ -0,0 +1,227 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is one log line on its way to the sinks
+type Entry struct {
+	Time    time.Time
+	Level   LogLevel
+	Logger  string
+	Message string
+	// Caller is the source file and line, set in JSON format
+	Caller string
+	// Fields are key/value pairs
+	Fields []interface{}
+	// Format is the logger's output format, used by sinks that write lines
+	Format Format
+}
+
+// Line renders the entry in its format, without a trailing newline
+func (e Entry) Line() string {
+	if e.Format == FormatJSON {
+		return formatJSON(e.Time, e.Level, e.Logger, e.Message, e.Caller, e.Fields)
+	}
+	message := e.Message
+	if e.Logger != "" {
+		message = "[" + e.Logger + "] " + message
+	}
+	return fmt.Sprintf("%s: %s %s%s", e.Level.String(), e.Time.Format("2006/01/02 15:04:05"), message, formatFields(e.Fields))
+}
+
+// Sink is a destination for log entries
+type Sink interface {
+	Write(e Entry) error
+	Close() error
+}
+
+// Output is a sink with the minimum level it receives. Entries are first
+// filtered by the logger's level, so an output can only narrow it down.
+type Output struct {
+	Sink  Sink
+	Level LogLevel
+	// Spec is the sink specification the output was opened from
+	Spec string
+}
+
+// writerSink writes lines to a stream such as stdout
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink writing one line per entry to w. Closing it
+// leaves w open.
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(e Entry) error {
+	line := e.Line() + "\n"
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.w, line)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// ParseOutputs opens a comma separated list of sink specifications
+func ParseOutputs(specs string) ([]Output, error) {
+	var outputs []Output
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		output, err := OpenOutput(spec)
+		if err != nil {
+			for _, o := range outputs {
+				o.Sink.Close()
+			}
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// OpenOutput opens a sink from a specification such as
+//
+//	stdout
+//	stderr
+//	file:///var/log/gerbil.log?max-size=100MB&max-age=24h&max-backups=7&compress=true
+//	syslog                          (local syslog on /dev/log)
+//	syslog:///dev/log?facility=local0&tag=gerbil
+//	syslog://127.0.0.1:514          (UDP)
+//	journald
+//
+// Every sink takes a level parameter, such as ?level=warn.
+func OpenOutput(spec string) (Output, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return Output{}, fmt.Errorf("invalid log sink %q: %v", spec, err)
+	}
+	query := u.Query()
+	output := Output{Level: DEBUG, Spec: spec}
+	if level := query.Get("level"); level != "" {
+		if output.Level, err = ParseLevel(level); err != nil {
+			return Output{}, fmt.Errorf("invalid log sink %q: %v", spec, err)
+		}
+	}
+
+	// A bare name like "journald" parses as a path
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme, u.Path = u.Path, ""
+	}
+	switch scheme {
+	case "stdout":
+		output.Sink = NewWriterSink(os.Stdout)
+	case "stderr":
+		output.Sink = NewWriterSink(os.Stderr)
+	case "file":
+		var config FileConfig
+		if config, err = parseFileConfig(u.Path, query); err == nil {
+			output.Sink, err = NewFileSink(config)
+		}
+	case "syslog":
+		var config SyslogConfig
+		if config, err = parseSyslogConfig(u, query); err == nil {
+			output.Sink, err = NewSyslogSink(config)
+		}
+	case "journald":
+		output.Sink, err = NewJournaldSink(JournaldConfig{
+			Socket:     u.Path,
+			Identifier: query.Get("tag"),
+		})
+	default:
+		err = fmt.Errorf("unknown sink type, use stdout, stderr, file, syslog or journald")
+	}
+	if err != nil {
+		return Output{}, fmt.Errorf("invalid log sink %q: %v", spec, err)
+	}
+	return output, nil
+}
+
+func parseFileConfig(path string, query url.Values) (FileConfig, error) {
+	config := FileConfig{Path: path}
+	if config.Path == "" {
+		return config, fmt.Errorf("file path is required")
+	}
+	var err error
+	if size := query.Get("max-size"); size != "" {
+		if config.MaxSize, err = parseSize(size); err != nil {
+			return config, err
+		}
+	}
+	if age := query.Get("max-age"); age != "" {
+		if config.MaxAge, err = time.ParseDuration(age); err != nil {
+			return config, fmt.Errorf("invalid max-age %q", age)
+		}
+	}
+	if backups := query.Get("max-backups"); backups != "" {
+		if config.MaxBackups, err = strconv.Atoi(backups); err != nil || config.MaxBackups < 0 {
+			return config, fmt.Errorf("invalid max-backups %q", backups)
+		}
+	}
+	if compress := query.Get("compress"); compress != "" {
+		config.Compress = compress == "true"
+	}
+	return config, nil
+}
+
+func parseSyslogConfig(u *url.URL, query url.Values) (SyslogConfig, error) {
+	config := SyslogConfig{Tag: query.Get("tag")}
+	switch {
+	case u.Host != "":
+		config.Network = "udp"
+		config.Address = u.Host
+		if u.Port() == "" {
+			config.Address += ":514"
+		}
+	case u.Path != "":
+		config.Network = "unix"
+		config.Address = u.Path
+	}
+	if facility := query.Get("facility"); facility != "" {
+		var ok bool
+		if config.Facility, ok = facilities[strings.ToLower(facility)]; !ok {
+			return config, fmt.Errorf("unknown syslog facility %q", facility)
+		}
+	} else {
+		config.Facility = facilities["daemon"]
+	}
+	return config, nil
+}
+
+// parseSize parses a byte size with an optional KB, MB or GB suffix
+func parseSize(size string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	value := strings.ToUpper(strings.TrimSpace(size))
+	factor := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, factor = strings.TrimSpace(number), unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * factor, nil
+}
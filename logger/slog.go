@@ -0,0 +1,146 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime"
+	"strings"
+)
+
+// Handler is a slog.Handler that writes through a Logger, so records from
+// libraries using log/slog share its level and format
+type Handler struct {
+	logger *Logger
+	fields []interface{}
+	group  string
+}
+
+// NewHandler returns a slog.Handler that writes to l
+func NewHandler(l *Logger) *Handler {
+	return &Handler{logger: l}
+}
+
+// Slog returns a slog.Logger backed by the default logger
+func Slog() *slog.Logger {
+	return slog.New(NewHandler(GetLogger()))
+}
+
+// StdLogger returns a standard library logger that writes each line at the
+// given level, for APIs such as http.Server.ErrorLog
+func StdLogger(level LogLevel) *log.Logger {
+	return GetLogger().StdLogger(level)
+}
+
+// StdLogger returns a standard library logger that writes each line to l at
+// the given level
+func (l *Logger) StdLogger(level LogLevel) *log.Logger {
+	return slog.NewLogLogger(NewHandler(l), slogLevel(level))
+}
+
+// RedirectStdLog sends the output of the standard log package, and of
+// slog's default logger, through the default logger
+func RedirectStdLog() {
+	// The handler adds its own timestamp
+	log.SetFlags(0)
+	slog.SetDefault(Slog())
+}
+
+// Enabled reports whether records at level are written
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return logLevel(level) >= h.logger.Level()
+}
+
+// Handle writes a record
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	caller := ""
+	if h.logger.Format() == FormatJSON && record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		if frame.File != "" {
+			caller = fmt.Sprintf("%s:%d", shortFile(frame.File), frame.Line)
+		}
+	}
+
+	fields := append([]interface{}{}, h.fields...)
+	record.Attrs(func(attr slog.Attr) bool {
+		fields = appendAttr(fields, h.group, attr)
+		return true
+	})
+	h.logger.output(logLevel(record.Level), record.Time, record.Message, caller, fields)
+	return nil
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.fields = append([]interface{}{}, h.fields...)
+	for _, attr := range attrs {
+		clone.fields = appendAttr(clone.fields, h.group, attr)
+	}
+	return &clone
+}
+
+// WithGroup returns a handler that prefixes the keys of later attrs with name
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	clone := *h
+	clone.group = joinKey(h.group, name)
+	return &clone
+}
+
+// appendAttr flattens attr into key/value fields, joining group keys with dots
+func appendAttr(fields []interface{}, group string, attr slog.Attr) []interface{} {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return fields
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		prefix := joinKey(group, attr.Key)
+		for _, member := range attr.Value.Group() {
+			fields = appendAttr(fields, prefix, member)
+		}
+		return fields
+	}
+	return append(fields, joinKey(group, attr.Key), attr.Value.Any())
+}
+
+func joinKey(group, key string) string {
+	if group == "" {
+		return key
+	}
+	if key == "" {
+		return group
+	}
+	return strings.Join([]string{group, key}, ".")
+}
+
+// logLevel maps a slog level to the nearest level at or below it
+func logLevel(level slog.Level) LogLevel {
+	switch {
+	case level < slog.LevelInfo:
+		return DEBUG
+	case level < slog.LevelWarn:
+		return INFO
+	case level < slog.LevelError:
+		return WARN
+	default:
+		return ERROR
+	}
+}
+
+// slogLevel maps a level to slog; FATAL has no slog equivalent and maps to error
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case DEBUG:
+		return slog.LevelDebug
+	case INFO:
+		return slog.LevelInfo
+	case WARN:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
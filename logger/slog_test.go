@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandlerAttrsAndGroups(t *testing.T) {
+	l, sink := newTestLogger()
+	log := slog.New(NewHandler(l))
+
+	log.With("component", "derp").
+		WithGroup("peer").
+		With("name", "nyc-1").
+		Info("connected", "latency", 12, slog.Group("addr", "ip", "100.64.0.2", "port", 41641), slog.Group("empty"))
+	// Groups apply to later attrs only, and the original logger is unchanged
+	log.Warn("plain", slog.Attr{}, "key", "value")
+
+	entries := sink.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Got %d entries, want 2", len(entries))
+	}
+	want := []interface{}{"component", "derp", "peer.name", "nyc-1", "peer.latency", int64(12), "peer.addr.ip", "100.64.0.2", "peer.addr.port", int64(41641)}
+	if entries[0].Message != "connected" || !reflect.DeepEqual(entries[0].Fields, want) {
+		t.Errorf("Got %q with %v, want %v", entries[0].Message, entries[0].Fields, want)
+	}
+	if want := []interface{}{"key", "value"}; !reflect.DeepEqual(entries[1].Fields, want) {
+		t.Errorf("Got %v, want %v", entries[1].Fields, want)
+	}
+}
+
+func TestHandlerLevels(t *testing.T) {
+	tests := []struct {
+		slog slog.Level
+		want LogLevel
+	}{
+		{slog.LevelDebug - 4, DEBUG},
+		{slog.LevelDebug, DEBUG},
+		{slog.LevelInfo, INFO},
+		{slog.LevelInfo + 2, INFO},
+		{slog.LevelWarn, WARN},
+		{slog.LevelError, ERROR},
+		{slog.LevelError + 4, ERROR},
+	}
+	for _, test := range tests {
+		if got := logLevel(test.slog); got != test.want {
+			t.Errorf("Got %s for %s, want %s", got, test.slog, test.want)
+		}
+	}
+	for _, level := range []LogLevel{DEBUG, INFO, WARN, ERROR} {
+		if got := logLevel(slogLevel(level)); got != level {
+			t.Errorf("Got %s after mapping %s to slog and back", got, level)
+		}
+	}
+	if slogLevel(FATAL) != slog.LevelError {
+		t.Errorf("Got %s for FATAL, want ERROR", slogLevel(FATAL))
+	}
+}
+
+func TestHandlerEnabledFollowsNamedLogger(t *testing.T) {
+	l, sink := newTestLogger()
+	l.SetLevel(ERROR)
+	named := l.Named("http")
+	handler := NewHandler(named)
+	ctx := context.Background()
+
+	// The named logger inherits ERROR until it has a level of its own
+	if handler.Enabled(ctx, slog.LevelWarn) || !handler.Enabled(ctx, slog.LevelError) {
+		t.Errorf("Got WARN enabled or ERROR disabled at the root level ERROR")
+	}
+	named.SetLevel(DEBUG)
+	if !handler.Enabled(ctx, slog.LevelDebug) {
+		t.Errorf("Got DEBUG disabled on a DEBUG logger")
+	}
+	named.SetLevel(WARN)
+	log := slog.New(handler)
+	log.Info("dropped")
+	log.Warn("kept")
+	if entries := sink.Entries(); len(entries) != 1 || entries[0].Message != "kept" || entries[0].Logger != "http" {
+		t.Errorf("Got %+v, want the warning from the http logger", entries)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	l, sink := newTestLogger()
+	l.SetFormat(FormatJSON)
+	l.SetLevel(WARN)
+
+	l.StdLogger(INFO).Printf("dropped")
+	l.Named("http").StdLogger(ERROR).Printf("http: TLS handshake error from %s", "10.0.0.1:1234")
+
+	entries := sink.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Got %d entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Level != ERROR || entry.Logger != "http" || entry.Message != "http: TLS handshake error from 10.0.0.1:1234" {
+		t.Errorf("Got %+v", entry)
+	}
+	if !strings.HasPrefix(entry.Caller, "logger/slog_test.go:") {
+		t.Errorf("Got caller %q, want this test", entry.Caller)
+	}
+}
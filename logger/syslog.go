@@ -0,0 +1,183 @@
+package logger
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// facilities maps syslog facility names to their codes
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// localSyslogSockets are tried in order when no address is given
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogConfig configures a syslog sink
+type SyslogConfig struct {
+	// Network is "unix" or "udp"; empty uses the local syslog socket
+	Network string
+	Address string
+	// Facility is the syslog facility code, such as 3 for daemon
+	Facility int
+	// Tag is the APP-NAME; empty uses the program name
+	Tag string
+}
+
+// syslogSink sends RFC 5424 messages to a syslog server
+type syslogSink struct {
+	config   SyslogConfig
+	hostname string
+
+	mu   sync.Mutex
+	conn net.Conn
+	// stream is set for unix stream sockets, which need newline framing
+	stream bool
+}
+
+// NewSyslogSink connects to syslog. Unix sockets may be datagram or stream
+// sockets; both are supported.
+func NewSyslogSink(config SyslogConfig) (Sink, error) {
+	if config.Tag == "" {
+		config.Tag = filepath.Base(os.Args[0])
+	}
+	s := &syslogSink{config: config}
+	if hostname, err := os.Hostname(); err == nil {
+		s.hostname = hostname
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *syslogSink) connect() error {
+	switch s.config.Network {
+	case "":
+		for _, socket := range localSyslogSockets {
+			if err := s.dialUnix(socket); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no local syslog socket found in %s", strings.Join(localSyslogSockets, ", "))
+	case "unix":
+		return s.dialUnix(s.config.Address)
+	default:
+		conn, err := net.Dial(s.config.Network, s.config.Address)
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %v", err)
+		}
+		s.conn, s.stream = conn, false
+		return nil
+	}
+}
+
+func (s *syslogSink) dialUnix(path string) error {
+	conn, err := net.Dial("unixgram", path)
+	if err == nil {
+		s.conn, s.stream = conn, false
+		return nil
+	}
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	s.conn, s.stream = conn, true
+	return nil
+}
+
+func (s *syslogSink) Write(e Entry) error {
+	message := s.format(e)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.conn.Write(message); err != nil {
+		// The syslog daemon may have restarted; reconnect and retry once
+		s.conn.Close()
+		s.conn = nil
+		if err := s.connect(); err != nil {
+			return err
+		}
+		_, err = s.conn.Write(message)
+		return err
+	}
+	return nil
+}
+
+// format renders an RFC 5424 message:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+//
+// The logger name is the MSGID and the fields follow the message as key=value.
+func (s *syslogSink) format(e Entry) []byte {
+	message := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s%s",
+		s.config.Facility*8+syslogSeverity(e.Level),
+		e.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogField(s.hostname, 255),
+		syslogField(s.config.Tag, 48),
+		os.Getpid(),
+		syslogField(e.Logger, 32),
+		e.Message,
+		formatFields(e.Fields),
+	)
+	if s.stream {
+		message = strings.ReplaceAll(message, "\n", " ") + "\n"
+	}
+	return []byte(message)
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogSeverity maps a level to a syslog severity
+func syslogSeverity(level LogLevel) int {
+	switch level {
+	case DEBUG:
+		return 7
+	case INFO:
+		return 6
+	case WARN:
+		return 4
+	case ERROR:
+		return 3
+	default:
+		return 2
+	}
+}
+
+// syslogField makes a header field printable ASCII without spaces, or "-" if empty
+func syslogField(value string, maxLen int) string {
+	field := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
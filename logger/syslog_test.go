@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogHeader matches the RFC 5424 header up to the structured data
+var syslogHeader = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) (\S+) - `)
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	output, err := OpenOutput("syslog://" + conn.LocalAddr().String() + "?facility=local0&tag=gerbil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer output.Sink.Close()
+
+	entries := []Entry{
+		{Time: time.Date(2024, 1, 2, 3, 4, 5, 600000000, time.UTC), Level: WARN, Logger: "http", Message: "slow request", Fields: []interface{}{"path", "/status", "took", "2 s"}},
+		// Datagrams frame the message, so newlines are kept
+		{Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Level: DEBUG, Message: "first\nsecond"},
+	}
+	want := []struct {
+		pri, msgid, message string
+	}{
+		// local0 is facility 16 and warnings are severity 4
+		{pri: "132", msgid: "http", message: `slow request path=/status took="2 s"`},
+		{pri: "135", msgid: "-", message: "first\nsecond"},
+	}
+	buf := make([]byte, 2048)
+	for i, entry := range entries {
+		if err := output.Sink.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := string(buf[:n])
+
+		header := syslogHeader.FindStringSubmatch(message)
+		if header == nil {
+			t.Fatalf("Got %q, want an RFC 5424 message", message)
+		}
+		if header[1] != want[i].pri || header[4] != "gerbil" || header[5] != fmt.Sprint(os.Getpid()) || header[6] != want[i].msgid {
+			t.Errorf("Got header %q, want priority %s, tag gerbil and message ID %s", header[0], want[i].pri, want[i].msgid)
+		}
+		if timestamp := entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"); header[2] != timestamp {
+			t.Errorf("Got timestamp %s, want %s", header[2], timestamp)
+		}
+		if body := message[len(header[0]):]; body != want[i].message {
+			t.Errorf("Got message %q, want %q", body, want[i].message)
+		}
+	}
+}
+
+func TestSyslogSinkUnixStream(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix stream sockets")
+	}
+	socket := filepath.Join(t.TempDir(), "log")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	sink, err := NewSyslogSink(SyslogConfig{Network: "unix", Address: socket, Facility: facilities["daemon"], Tag: "gerbil"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Streams are framed by newlines, so newlines in a message are replaced
+	sink.Write(Entry{Time: time.Now(), Level: ERROR, Message: "first\nsecond"})
+	sink.Write(Entry{Time: time.Now(), Level: INFO, Logger: "tailscale", Message: "third"})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"<27>1 .* - first second", "<30>1 .* tailscale - third"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile("^" + want + "\n$").MatchString(line) {
+			t.Errorf("Got %q, want a line matching %q", line, want)
+		}
+	}
+}
+
+func TestSyslogField(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: "-"},
+		{value: "gerbil", want: "gerbil"},
+		{value: "my host", want: "my_host"},
+		{value: "grüße", want: "gr__e"},
+		{value: strings.Repeat("a", 40), want: strings.Repeat("a", 32)},
+	}
+	for _, test := range tests {
+		if field := syslogField(test.value, 32); field != test.want {
+			t.Errorf("Got %q for %q, want %q", field, test.value, test.want)
+		}
+	}
+}
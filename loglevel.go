@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+// debugToggleDuration is how long SIGUSR1 switches logging to DEBUG for
+const debugToggleDuration = 15 * time.Minute
+
+// Sub-loggers of the subsystems, so their levels can be set on their own
+var (
+	tsLog        = logger.Named("tailscale")
+	bandwidthLog = logger.Named("bandwidth")
+	httpLog      = logger.Named("http")
+	configLog    = logger.Named("config")
+)
+
+// LogLevels is the body of GET /admin/log-level
+type LogLevels struct {
+	Level logger.LogLevel `json:"level"`
+	// Loggers holds each sub-logger's own level; null means it uses Level
+	Loggers map[string]*logger.LogLevel `json:"loggers"`
+	// Debug is set while logging is switched to DEBUG temporarily
+	Debug bool `json:"debug"`
+}
+
+// LogLevelRequest changes the level of the root logger, or of a sub-logger
+// when Logger is set. An empty level makes a sub-logger use the root level again.
+type LogLevelRequest struct {
+	Logger string `json:"logger,omitempty"`
+	Level  string `json:"level"`
+	// Debug switches every logger to DEBUG, for Duration if set
+	Debug    *bool  `json:"debug,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// applyLogLevels sets sub-logger levels from a list like "tailscale=debug,http=warn"
+func applyLogLevels(list string) error {
+	for _, item := range splitList(list) {
+		name, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid log level %q, use name=level", item)
+		}
+		l, err := subLogger(strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		level, err := logger.ParseLevel(strings.TrimSpace(value))
+		if err != nil {
+			return err
+		}
+		l.SetLevel(level)
+	}
+	return nil
+}
+
+// subLogger returns a known sub-logger, so typos don't create new ones
+func subLogger(name string) (*logger.Logger, error) {
+	for _, known := range logger.GetLogger().Names() {
+		if name == known {
+			return logger.Named(name), nil
+		}
+	}
+	return nil, fmt.Errorf("unknown logger %q, use one of %s", name, strings.Join(logger.GetLogger().Names(), ", "))
+}
+
+func logLevels() LogLevels {
+	root := logger.GetLogger()
+	return LogLevels{
+		Level:   root.Level(),
+		Loggers: root.Levels(),
+		Debug:   root.Debugging(),
+	}
+}
+
+// handleLogLevel shows the log levels on GET and changes them on PUT
+var handleLogLevel = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet: handleGetLogLevel,
+	http.MethodPut: handleSetLogLevel,
+})
+
+func handleGetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevels())
+}
+
+func handleSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid request body: %v", err)
+		return
+	}
+	if err := setLogLevel(req); err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "%v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevels())
+}
+
+func setLogLevel(req LogLevelRequest) error {
+	var duration time.Duration
+	if req.Duration != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.Duration); err != nil || duration < 0 {
+			return fmt.Errorf("invalid duration %q", req.Duration)
+		}
+	}
+
+	l := logger.GetLogger()
+	if req.Logger != "" {
+		var err error
+		if l, err = subLogger(req.Logger); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case req.Level != "":
+		level, err := logger.ParseLevel(req.Level)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(level)
+		logger.Info("Log level of %s set to %s", loggerName(req.Logger), level)
+	case req.Logger != "" && req.Debug == nil:
+		l.ResetLevel()
+		logger.Info("Log level of %s reset to the root level", req.Logger)
+	case req.Debug == nil:
+		return fmt.Errorf("level is required")
+	}
+
+	if req.Debug != nil {
+		logger.GetLogger().SetDebug(*req.Debug, duration)
+		if *req.Debug {
+			logger.Info("Debug logging enabled%s", forDuration(duration))
+		} else {
+			logger.Info("Debug logging disabled")
+		}
+	}
+	return nil
+}
+
+func loggerName(name string) string {
+	if name == "" {
+		return "the root logger"
+	}
+	return name
+}
+
+func forDuration(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return " for " + d.String()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+// saveLogLevels restores the levels and debug override of the default
+// logger once the test is done
+func saveLogLevels(t *testing.T) {
+	t.Helper()
+	root := logger.GetLogger()
+	level, levels, debugging := root.Level(), root.Levels(), root.Debugging()
+	t.Cleanup(func() {
+		root.SetDebug(debugging, 0)
+		root.SetLevel(level)
+		for name, l := range levels {
+			if l == nil {
+				logger.Named(name).ResetLevel()
+			} else {
+				logger.Named(name).SetLevel(*l)
+			}
+		}
+	})
+	root.SetDebug(false, 0)
+}
+
+func TestApplyLogLevels(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want map[string]logger.LogLevel
+		err  string
+	}{
+		{name: "empty"},
+		{name: "levels", list: "tailscale=debug, http = warn", want: map[string]logger.LogLevel{"tailscale": logger.DEBUG, "http": logger.WARN}},
+		{name: "missing level", list: "tailscale", err: "use name=level"},
+		{name: "unknown logger", list: "tailscael=debug", err: `unknown logger "tailscael"`},
+		{name: "unknown level", list: "http=loud", err: `unknown log level "loud"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saveLogLevels(t)
+			err := applyLogLevels(test.list)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Got %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, level := range test.want {
+				if got := logger.Named(name).Level(); got != level {
+					t.Errorf("Got %s for %s, want %s", got, name, level)
+				}
+			}
+		})
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		// level and httpLevel are the levels of the root and http loggers
+		// after the request; a nil httpLevel means it uses the root level
+		level     logger.LogLevel
+		httpLevel *logger.LogLevel
+		debug     bool
+		err       string
+	}{
+		{name: "root level", body: `{"level": "warn"}`, status: 200, level: logger.WARN, httpLevel: levelPtr(logger.WARN)},
+		{name: "sub-logger level", body: `{"logger": "http", "level": "ERROR"}`, status: 200, level: logger.INFO, httpLevel: levelPtr(logger.ERROR)},
+		{name: "reset sub-logger", body: `{"logger": "http"}`, status: 200, level: logger.INFO},
+		// The override doesn't change the configured levels
+		{name: "debug override", body: `{"debug": true, "duration": "10m"}`, status: 200, level: logger.DEBUG, httpLevel: levelPtr(logger.WARN), debug: true},
+		{name: "level and debug override", body: `{"level": "error", "debug": true}`, status: 200, level: logger.DEBUG, httpLevel: levelPtr(logger.WARN), debug: true},
+		{name: "no level", body: `{}`, status: 400, level: logger.INFO, err: "level is required"},
+		{name: "unknown level", body: `{"level": "loud"}`, status: 400, level: logger.INFO, err: "unknown log level"},
+		{name: "unknown logger", body: `{"logger": "nonsense", "level": "debug"}`, status: 400, level: logger.INFO, err: "unknown logger"},
+		{name: "bad duration", body: `{"debug": true, "duration": "soon"}`, status: 400, level: logger.INFO, err: "invalid duration"},
+		{name: "negative duration", body: `{"debug": true, "duration": "-1m"}`, status: 400, level: logger.INFO, err: "invalid duration"},
+		{name: "bad body", body: `{"level": 3}`, status: 400, level: logger.INFO, err: "Invalid request body"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			saveLogLevels(t)
+			logger.GetLogger().SetLevel(logger.INFO)
+			httpLog.SetLevel(logger.WARN)
+
+			recorder := httptest.NewRecorder()
+			handleLogLevel(recorder, httptest.NewRequest("PUT", "/admin/log-level", strings.NewReader(test.body)))
+			if recorder.Code != test.status {
+				t.Fatalf("Got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if test.status != http.StatusOK {
+				var response ErrorResponse
+				if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if response.Error.Code != errCodeBadRequest || !strings.Contains(response.Error.Message, test.err) {
+					t.Errorf("Got %+v, want %s containing %q", response.Error, errCodeBadRequest, test.err)
+				}
+				if levels := logLevels(); levels.Level != logger.INFO || *levels.Loggers["http"] != logger.WARN {
+					t.Errorf("Got levels changed by a rejected request: %+v", levels)
+				}
+				return
+			}
+
+			var levels LogLevels
+			if err := json.Unmarshal(recorder.Body.Bytes(), &levels); err != nil {
+				t.Fatal(err)
+			}
+			if levels.Level != test.level || levels.Debug != test.debug {
+				t.Errorf("Got level %s and debug %v, want %s and %v", levels.Level, levels.Debug, test.level, test.debug)
+			}
+			got := levels.Loggers["http"]
+			if (got == nil) != (test.httpLevel == nil) || got != nil && *got != *test.httpLevel {
+				t.Errorf("Got http level %v, want %v", got, test.httpLevel)
+			}
+		})
+	}
+}
+
+func levelPtr(level logger.LogLevel) *logger.LogLevel {
+	return &level
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+// watchDebugSignal toggles temporary DEBUG logging on SIGUSR1
+func watchDebugSignal(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+		}
+		root := logger.GetLogger()
+		if root.Debugging() {
+			root.SetDebug(false, 0)
+			logger.Info("Debug logging disabled by SIGUSR1")
+		} else {
+			root.SetDebug(true, debugToggleDuration)
+			logger.Info("Debug logging enabled by SIGUSR1%s", forDuration(debugToggleDuration))
+		}
+	}
+}
@@ -0,0 +1,62 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+func TestDebugSignalToggles(t *testing.T) {
+	saveLogLevels(t)
+	// Without a handler SIGUSR1 would end the test process, so catch it
+	// before the watcher has installed its own
+	caught := make(chan os.Signal, 16)
+	signal.Notify(caught, syscall.SIGUSR1)
+	defer signal.Stop(caught)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchDebugSignal(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	root := logger.GetLogger()
+	waitForDebugging := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for root.Debugging() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Got debugging %v, want %v", !want, want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The watcher may not be listening yet, so signal until it toggles
+	deadline := time.Now().Add(5 * time.Second)
+	for !root.Debugging() {
+		if time.Now().After(deadline) {
+			t.Fatal("SIGUSR1 didn't switch to debug logging")
+		}
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+		time.Sleep(20 * time.Millisecond)
+	}
+	if root.Level() != logger.DEBUG {
+		t.Errorf("Got %s, want DEBUG", root.Level())
+	}
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	waitForDebugging(false)
+}
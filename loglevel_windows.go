@@ -0,0 +1,6 @@
+package main
+
+import "context"
+
+// watchDebugSignal does nothing on Windows, which has no SIGUSR1
+func watchDebugSignal(ctx context.Context) {}
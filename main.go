@@ -2,37 +2,53 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/hhftechnology/gerbil/controlplane"
 	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
 	"github.com/hhftechnology/gerbil/tailscale"
+	"github.com/hhftechnology/gerbil/tracing"
 )
 
 var (
-	listenAddr   string
-	lastReadings = make(map[string]PeerReading)
-	mu           sync.Mutex
-	notifyURL    string
-	tsClient     *tailscale.Client
+	lastReadings   = make(map[string]PeerReading)
+	lastBandwidths = make(map[string]PeerBandwidth)
+	mu             sync.Mutex
+	notifyURL      string
+	tsClient       *tailscale.Client
+	tsDaemon       *tailscale.Daemon
+	tsEmbedded     *tailscale.Embedded
+	daemonConfig   tailscale.DaemonConfig
+	peerManager    controlplane.Manager
+	// registerMetrics adds the collectors on the first run only
+	registerMetrics sync.Once
 )
 
 type TailscaleConfig struct {
 	AuthKey     string `json:"authKey"`
+	// AuthKeyReusable allows renewing the node key with AuthKey
+	AuthKeyReusable bool `json:"authKeyReusable,omitempty"`
 	ControlURL  string `json:"controlUrl,omitempty"`
 	Hostname    string `json:"hostname,omitempty"`
 	ExitNode    string `json:"exitNode,omitempty"`
 	AcceptRoutes bool   `json:"acceptRoutes,omitempty"`
+	AdvertiseExitNode bool `json:"advertiseExitNode,omitempty"`
 }
 
 type PeerBandwidth struct {
@@ -47,161 +63,400 @@ type PeerReading struct {
 	LastChecked      time.Time
 }
 
+// startupTimeouts bounds how long ensureTailscale waits for each phase
+type startupTimeouts struct {
+	daemon time.Duration
+	login  time.Duration
+}
+
+
 type PeerInfo struct {
-	PublicKey  string   `json:"publicKey"`
-	Hostname   string   `json:"hostname"`
-	IP         string   `json:"ip"`
-	AllowedIPs []string `json:"allowedIps"`
-	Connected  bool     `json:"connected"`
+	PublicKey     string     `json:"publicKey"`
+	Hostname      string     `json:"hostname"`
+	IP            string     `json:"ip"`
+	AllowedIPs    []string   `json:"allowedIps"`
+	Connected     bool       `json:"connected"`
+	User          string     `json:"user,omitempty"`
+	KeyExpiry     *time.Time `json:"keyExpiry,omitempty"`
+	KeyExpiryDays *float64   `json:"keyExpiryDays,omitempty"`
 }
 
-func parseLogLevel(level string) logger.LogLevel {
-	switch strings.ToUpper(level) {
-	case "DEBUG":
-		return logger.DEBUG
-	case "INFO":
-		return logger.INFO
-	case "WARN":
-		return logger.WARN
-	case "ERROR":
-		return logger.ERROR
-	case "FATAL":
-		return logger.FATAL
-	default:
-		return logger.INFO
+func main() {
+	cfg, err := parseConfig(os.Args[0], os.Args[1:], os.Getenv)
+	if err == nil {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		err = run(ctx, cfg)
+		stop()
 	}
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		logger.Error("%v", err)
+	}
+	logger.GetLogger().Close()
+	os.Exit(exitCode(err))
 }
 
-func main() {
-	var (
-		err             error
-		tsconfig        TailscaleConfig
-		configFile      string
-		remoteConfigURL string
-		logLevel        string
-		authKey         string
-		hostname        string
-		controlURL      string
-	)
-
-	// Environment variables
-	configFile = os.Getenv("CONFIG")
-	remoteConfigURL = os.Getenv("REMOTE_CONFIG")
-	listenAddr = os.Getenv("LISTEN")
-	logLevel = os.Getenv("LOG_LEVEL")
-	notifyURL = os.Getenv("NOTIFY_URL")
-	authKey = os.Getenv("TAILSCALE_AUTHKEY")
-	hostname = os.Getenv("TAILSCALE_HOSTNAME")
-	controlURL = os.Getenv("TAILSCALE_CONTROL_URL")
-
-	// Command line flags
-	if configFile == "" {
-		flag.StringVar(&configFile, "config", "", "Path to local configuration file")
-	}
-	if remoteConfigURL == "" {
-		flag.StringVar(&remoteConfigURL, "remoteConfig", "", "URL of the Pangolin server")
-	}
-	if listenAddr == "" {
-		flag.StringVar(&listenAddr, "listen", ":3003", "Address to listen on")
-	}
-	if logLevel == "" {
-		flag.StringVar(&logLevel, "log-level", "INFO", "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+// setupLogging applies the log level, format and sinks
+func setupLogging(ctx context.Context, cfg Config) error {
+	log := logger.GetLogger()
+	log.SetLevel(cfg.LogLevel)
+	log.SetFormat(cfg.LogFormat)
+	outputs, err := logger.ParseOutputs(cfg.LogSinks)
+	if err != nil {
+		return &ConfigError{Option: "log-sinks", Err: err}
 	}
-	if notifyURL == "" {
-		flag.StringVar(&notifyURL, "notify", "", "URL to notify on peer changes")
+	if len(outputs) > 0 {
+		log.SetOutputs(outputs...)
 	}
-	if authKey == "" {
-		flag.StringVar(&authKey, "authkey", "", "Tailscale auth key")
+	if err := applyLogLevels(cfg.LogLevels); err != nil {
+		return &ConfigError{Option: "log-levels", Err: err}
 	}
-	if hostname == "" {
-		flag.StringVar(&hostname, "hostname", "", "Tailscale hostname")
+	go watchDebugSignal(ctx)
+	// Libraries logging through log or log/slog get the same level and format
+	logger.RedirectStdLog()
+	return nil
+}
+
+// run starts Tailscale and serves the API until ctx is done
+func run(ctx context.Context, cfg Config) error {
+	if err := setupLogging(ctx, cfg); err != nil {
+		return err
 	}
-	if controlURL == "" {
-		flag.StringVar(&controlURL, "control-url", "", "Tailscale control server URL")
+	logger.Info("Starting Gerbil %s", buildVersion())
+
+	notifyURL = cfg.NotifyURL
+	headscaleUser = cfg.HeadscaleUser
+	routesFile = cfg.RoutesFile
+	enableForwarding = cfg.EnableForwarding
+	daemonConfig = cfg.Daemon
+	if daemonConfig.Userspace() {
+		logger.Info("Using userspace networking with SOCKS5 proxy on %s and HTTP proxy on %s", daemonConfig.Socks5Addr, daemonConfig.HTTPProxyAddr)
 	}
-	flag.Parse()
 
-	logger.Init()
-	logger.GetLogger().SetLevel(parseLogLevel(logLevel))
+	tsconfig, err := loadTailscaleConfig(ctx, cfg)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Stopped while waiting for the remote config
+			return nil
+		}
+		return err
+	}
 
-	// Clean up the remote config URL for backwards compatibility
-	remoteConfigURL = strings.TrimSuffix(remoteConfigURL, "/gerbil/get-config")
-	remoteConfigURL = strings.TrimSuffix(remoteConfigURL, "/")
+	if cfg.HeadscaleKey != "" {
+		headscaleURL := cfg.HeadscaleURL
+		if headscaleURL == "" {
+			headscaleURL = tsconfig.ControlURL
+		}
+		if headscaleURL == "" {
+			return &ConfigError{Option: "headscale-url", Err: errors.New("Headscale integration needs a Headscale URL or control URL")}
+		}
+		if tsconfig.ControlURL == "" {
+			tsconfig.ControlURL = headscaleURL
+		}
+		headscaleClient = controlplane.NewHeadscale(controlplane.HeadscaleConfig{
+			BaseURL: headscaleURL,
+			APIKey:  cfg.HeadscaleKey,
+		})
+		logger.Info("Headscale integration enabled with %s", headscaleURL)
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		shutdown, err := tracing.Setup(ctx, tracing.Config{
+			Endpoint: cfg.OTLPEndpoint,
+			Headers:  cfg.OTLPHeaders,
+			OnError: func(err error) {
+				httpLog.Warn("Trace export failed: %v", err)
+			},
+		})
+		if err != nil {
+			return &ConfigError{Option: "otlp-endpoint", Err: err}
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				httpLog.Warn("Failed to flush traces: %v", err)
+			}
+		}()
+		logger.Info("Exporting request traces to %s", cfg.OTLPEndpoint)
+	}
+
+	// Stop tailscaled if we started it, even when startup fails
+	defer stopTailscale()
+	if err := startTailscale(ctx, cfg, tsconfig); err != nil {
+		return &TailscaleError{Err: err}
+	}
+
+	// Advertise the subnet routes configured through the API before the restart
+	if err := restoreRoutes(); err != nil {
+		logger.Error("Failed to restore advertised routes: %v", err)
+	}
 
-	// Load configuration based on provided argument
-	if configFile != "" {
-		tsconfig, err = loadConfig(configFile)
+	if cfg.AdvertiseExitNode || tsconfig.AdvertiseExitNode {
+		if err := advertiseExitNode(ctx, true); err != nil {
+			logger.Error("Failed to advertise exit node: %v", err)
+		}
+	}
+	registerMetrics.Do(func() {
+		metrics.Register(tailscaleStatusMetrics)
+		metrics.Register(exitNodeMetrics)
+		metrics.Register(hostTrafficMetrics)
+		metrics.Register(netcheckMetrics)
+		metrics.Register(proberMetrics)
+		metrics.Register(keyExpiryMetrics)
+	})
+	if cfg.NetcheckInterval > 0 {
+		go periodicNetcheck(ctx, cfg.NetcheckInterval)
+	}
+
+	reauthKey, reason := reauthKeySource(tsconfig, cfg.Tailscale.AuthKeyReusable)
+	if reauthKey == nil && cfg.KeyExpiryReauth > 0 {
+		logger.Info("Node key renewal is disabled: %s", reason)
+	}
+	go newKeyExpiryMonitor(cfg.KeyExpiryThresholds, cfg.KeyExpiryReauth, reauthKey).run(ctx)
+	if cfg.ProbeInterval > 0 {
+		prober = newPeerProber(cfg.ProbePeers, cfg.ProbeInterval, cfg.ProbePingType, cfg.ProbeHistory)
+		go prober.run(ctx)
+		logger.Info("Probing peers every %s", cfg.ProbeInterval)
+	}
+
+	// Health check the active exit node and switch to the next candidate when it goes down
+	if len(cfg.ExitNodes) > 0 {
+		exitFailover = newExitNodeFailover(cfg.ExitNodes, cfg.ExitNodeCheck)
+		go exitFailover.run(ctx)
+		logger.Info("Exit node failover enabled for %v every %s", cfg.ExitNodes, cfg.ExitNodeCheck)
+	}
+
+	// Peers can only be changed with admin API credentials
+	if headscaleClient != nil {
+		peerManager = headscaleClient
+	} else if cfg.APIKey != "" || (cfg.OAuthClientID != "" && cfg.OAuthSecret != "") {
+		peerManager = controlplane.NewTailscaleAPI(controlplane.TailscaleConfig{
+			BaseURL:           cfg.AdminAPIURL,
+			Tailnet:           cfg.Tailnet,
+			APIKey:            cfg.APIKey,
+			OAuthClientID:     cfg.OAuthClientID,
+			OAuthClientSecret: cfg.OAuthSecret,
+		})
+		logger.Info("Peer management enabled through the admin API at %s", cfg.AdminAPIURL)
+	}
+
+	// Start periodic bandwidth check
+	if cfg.RemoteConfigURL != "" {
+		go periodicBandwidthCheck(ctx, cfg.RemoteConfigURL + "/gerbil/receive-bandwidth")
+	}
+
+	if err := serve(ctx, cfg); err != nil {
+		return err
+	}
+	logger.Info("Shutting down...")
+
+	// Logout from Tailscale
+	if err := tsClient.Logout(); err != nil {
+		logger.Error("Failed to logout from Tailscale: %v", err)
+	}
+	return nil
+}
+
+// reauthKeySource returns where the auth keys to renew the node key with
+// come from, or nil and the reason when there is none. Auth keys are usually
+// single-use, so the configured one is only reused when marked reusable.
+func reauthKeySource(tsconfig TailscaleConfig, reusable bool) (func() (string, error), string) {
+	switch {
+	case headscaleClient != nil && headscaleUser != "":
+		return headscaleAuthKey, ""
+	case headscaleClient != nil && (tsconfig.AuthKey == "" || !tsconfig.AuthKeyReusable && !reusable):
+		// Pre-auth keys are created for a user, so without one the
+		// Headscale API key alone cannot renew the node key
+		return nil, "no Headscale user is configured, set HEADSCALE_USER to renew through Headscale"
+	case tsconfig.AuthKey == "":
+		return nil, "no auth key or Headscale API key is configured"
+	case !tsconfig.AuthKeyReusable && !reusable:
+		return nil, "the auth key is not marked reusable, set authkey-reusable if it is"
+	}
+	key := tsconfig.AuthKey
+	return func() (string, error) { return key, nil }, ""
+}
+
+// loadTailscaleConfig loads the node settings from the config file or the
+// remote server, or takes them from the flags
+func loadTailscaleConfig(ctx context.Context, cfg Config) (TailscaleConfig, error) {
+	switch {
+	case cfg.ConfigFile != "":
+		tsconfig, err := loadConfig(cfg.ConfigFile)
 		if err != nil {
-			logger.Fatal("Failed to load configuration: %v", err)
+			return tsconfig, &ConfigError{Option: "config", Err: err}
 		}
-	} else if remoteConfigURL != "" {
+		return tsconfig, nil
+	case cfg.RemoteConfigURL != "":
 		// Loop until we get the config
+		var tsconfig TailscaleConfig
 		for tsconfig.AuthKey == "" {
-			logger.Info("Fetching remote config from %s", remoteConfigURL+"/gerbil/get-tailscale-config")
-			tsconfig, err = loadRemoteConfig(remoteConfigURL + "/gerbil/get-tailscale-config")
+			url := cfg.RemoteConfigURL + "/gerbil/get-tailscale-config"
+			configLog.Info("Fetching remote config from %s", url)
+			var err error
+			tsconfig, err = loadRemoteConfig(url)
+			remoteConfigStatus.record(err)
 			if err != nil {
-				logger.Error("Failed to load configuration: %v", err)
-				time.Sleep(5 * time.Second)
-				continue
+				configLog.Error("Failed to load configuration: %v", err)
+				select {
+				case <-ctx.Done():
+					return tsconfig, ctx.Err()
+				case <-time.After(5 * time.Second):
+				}
 			}
 		}
-	} else {
-		// Use environment variables or flags
-		tsconfig = TailscaleConfig{
-			AuthKey:    authKey,
-			ControlURL: controlURL,
-			Hostname:   hostname,
-		}
-		
-		if tsconfig.AuthKey == "" {
-			logger.Fatal("You must provide either a config file, remote config URL, or Tailscale auth key")
+		return tsconfig, nil
+	default:
+		return cfg.Tailscale, nil
+	}
+}
+
+// startTailscale starts the embedded node, or makes sure tailscaled is
+// running and logged in
+func startTailscale(ctx context.Context, cfg Config, tsconfig TailscaleConfig) error {
+	if !cfg.Embedded {
+		// Initialize Tailscale client
+		tsClient = tailscale.NewClient()
+		tsClient.Socket = cfg.Daemon.Socket
+
+		// Ensure Tailscale is running and configured
+		return ensureTailscale(ctx, tsconfig, cfg.Timeouts)
+	}
+
+	if tsconfig.AuthKey == "" && headscaleClient != nil {
+		var err error
+		if tsconfig.AuthKey, err = headscaleAuthKey(); err != nil {
+			return fmt.Errorf("failed to create Headscale pre-auth key: %v", err)
 		}
 	}
 
-	// Initialize Tailscale client
-	tsClient = tailscale.NewClient()
+	// Run the node in-process; no tailscale or tailscaled binaries are needed
+	tsEmbedded = tailscale.NewEmbedded(tailscale.EmbeddedConfig{
+		StateDir:     cfg.Daemon.StateDir,
+		Hostname:     tsconfig.Hostname,
+		AuthKey:      tsconfig.AuthKey,
+		ControlURL:   tsconfig.ControlURL,
+		Port:         uint16(cfg.Daemon.Port),
+		AcceptRoutes: tsconfig.AcceptRoutes,
+		ExitNode:     tsconfig.ExitNode,
+	})
+	tsLog.Info("Starting embedded Tailscale node...")
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeouts.daemon+cfg.Timeouts.login)
+	defer cancel()
+	client, err := tsEmbedded.Up(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start embedded Tailscale node: %v", err)
+	}
+	tsClient = client
+	return nil
+}
 
-	// Ensure Tailscale is running and configured
-	if err := ensureTailscale(tsconfig); err != nil {
-		logger.Fatal("Failed to ensure Tailscale: %v", err)
+// stopTailscale stops the tailscaled we started or the embedded node
+func stopTailscale() {
+	if tsDaemon != nil {
+		if err := tsDaemon.Stop(10 * time.Second); err != nil {
+			tsLog.Error("Failed to stop tailscaled: %v", err)
+		}
+	}
+	if tsEmbedded != nil {
+		if err := tsEmbedded.Close(); err != nil {
+			tsLog.Error("Failed to stop embedded Tailscale node: %v", err)
+		}
 	}
+}
 
-	// Start periodic bandwidth check
-	if remoteConfigURL != "" {
-		go periodicBandwidthCheck(remoteConfigURL + "/gerbil/receive-bandwidth")
+// serve runs the HTTP API until ctx is done
+func serve(ctx context.Context, cfg Config) error {
+	// A mux of its own, so serve can run again in the same process
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peer", handlePeer)
+	mux.HandleFunc("/peers", handleGetPeers)
+	mux.HandleFunc("GET /peers/{id}", handleGetPeer)
+	mux.HandleFunc("GET /peers/{id}/latency", handlePeerLatency)
+	mux.HandleFunc("/routes", handleRoutes)
+	mux.HandleFunc("/exit-node", handleExitNode)
+	mux.HandleFunc("/exit-node/advertise", handleAdvertiseExitNode)
+	mux.HandleFunc("/diagnostics/netcheck", handleNetcheck)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/health", handleLegacyHealth)
+	mux.HandleFunc("/admin/log-level", handleLogLevel)
+	registerAPI(mux)
+	mux.Handle("GET /livez", livenessProbe())
+	mux.Handle("GET /readyz", readinessProbe(cfg))
+
+	// Only tailnet identities on the access list may call the API when one is configured
+	var handler http.Handler = mux
+	if access := newAPIAccess(cfg.AllowedUsers, cfg.AllowedTags); access.enabled() {
+		handler = access.middleware(handler)
+		logger.Info("API access restricted to tailnet users %q and tags %q", cfg.AllowedUsers, cfg.AllowedTags)
+	} else if tsEmbedded != nil || cfg.TailnetOnly {
+		// Every caller is on the tailnet, so their identity can still be logged
+		handler = newIdentityRecorder().middleware(handler)
+	}
+	// Every request, including rejected ones, gets an ID, a span and a log line
+	handler = requestMiddleware(handler)
+
+	// An embedded node serves the API on its tailnet address only
+	addr := cfg.ListenAddr
+	var listener net.Listener
+	var err error
+	if tsEmbedded != nil {
+		listener, err = tsEmbedded.Listen(addr)
+	} else {
+		if cfg.TailnetOnly {
+			if addr, err = tailnetListenAddr(addr); err != nil {
+				return &ServerError{Addr: addr, Err: fmt.Errorf("failed to resolve tailnet listen address: %v", err)}
+			}
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return &ServerError{Addr: addr, Err: err}
 	}
 
-	// Set up HTTP server
-	http.HandleFunc("/peer", handlePeer)
-	http.HandleFunc("/peers", handleGetPeers)
-	http.HandleFunc("/status", handleStatus)
-	http.HandleFunc("/health", handleHealth)
-	
-	logger.Info("Starting HTTP server on %s", listenAddr)
+	httpLog.Info("Starting HTTP server on %s", addr)
 
-	// Run HTTP server in a goroutine
+	server := &http.Server{
+		Handler:  handler,
+		ErrorLog: httpLog.StdLogger(logger.ERROR),
+	}
+	serveErr := make(chan error, 1)
 	go func() {
-		if err := http.ListenAndServe(listenAddr, nil); err != nil {
-			logger.Error("HTTP server failed: %v", err)
-		}
+		serveErr <- server.Serve(listener)
 	}()
 
-	// Keep the main goroutine running
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-	logger.Info("Shutting down...")
-	
-	// Logout from Tailscale
-	if err := tsClient.Logout(); err != nil {
-		logger.Error("Failed to logout from Tailscale: %v", err)
+	select {
+	case err := <-serveErr:
+		return &ServerError{Addr: addr, Err: err}
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		httpLog.Error("Failed to shut down HTTP server: %v", err)
 	}
+	return nil
+}
+
+// tailnetListenAddr rebinds addr to this node's Tailscale IP, keeping the port
+func tailnetListenAddr(addr string) (string, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip, err := tsClient.GetIP()
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip, port), nil
 }
 
 func loadRemoteConfig(url string) (TailscaleConfig, error) {
 	resp, err := http.Get(url)
 	if err != nil {
-		logger.Error("Error fetching remote config %s: %v", url, err)
+		configLog.Error("Error fetching remote config %s: %v", url, err)
 		return TailscaleConfig{}, err
 	}
 	defer resp.Body.Close()
@@ -219,48 +474,80 @@ func loadRemoteConfig(url string) (TailscaleConfig, error) {
 func loadConfig(filename string) (TailscaleConfig, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		logger.Error("Error opening file %s: %v", filename, err)
+		configLog.Error("Error opening file %s: %v", filename, err)
 		return TailscaleConfig{}, err
 	}
 	defer file.Close()
 
 	byteValue, err := io.ReadAll(file)
 	if err != nil {
-		logger.Error("Error reading file %s: %v", filename, err)
+		configLog.Error("Error reading file %s: %v", filename, err)
 		return TailscaleConfig{}, err
 	}
 
 	var tsconfig TailscaleConfig
 	err = json.Unmarshal(byteValue, &tsconfig)
 	if err != nil {
-		logger.Error("Error unmarshaling JSON data: %v", err)
+		configLog.Error("Error unmarshaling JSON data: %v", err)
 		return TailscaleConfig{}, err
 	}
 
 	return tsconfig, nil
 }
 
-func ensureTailscale(config TailscaleConfig) error {
+// ensureTailscale waits for tailscaled, starting it when needed, and logs in.
+// Every wait ends early when ctx is cancelled by a shutdown signal.
+func ensureTailscale(ctx context.Context, config TailscaleConfig, timeouts startupTimeouts) error {
 	// Check if tailscaled is running
 	if !isTailscaleDaemonRunning() {
-		logger.Info("Starting tailscaled daemon...")
-		if err := startTailscaleDaemon(); err != nil {
+		tsLog.Info("Starting tailscaled daemon...")
+		if err := startTailscaleDaemon(daemonConfig); err != nil {
 			return fmt.Errorf("failed to start tailscaled: %v", err)
 		}
-		// Wait for daemon to be ready
-		time.Sleep(3 * time.Second)
 	}
 
-	// Check current status
-	status, err := tsClient.Status()
+	// Wait for the daemon to answer and load its prefs
+	daemonCtx, cancel := context.WithTimeout(ctx, timeouts.daemon)
+	state, err := tsClient.WaitForDaemon(daemonCtx)
+	cancel()
 	if err != nil {
-		return fmt.Errorf("failed to get Tailscale status: %v", err)
+		return err
 	}
 
-	// If not logged in, use the auth key to join the network
-	if !status.LoggedIn {
-		logger.Info("Logging into Tailscale...")
+	// A persisted node may still be connecting; let it settle before deciding to log in
+	if state == tailscale.StateStarting {
+		startCtx, cancel := context.WithTimeout(ctx, timeouts.login)
+		state, err = tsClient.WaitForState(startCtx, tailscale.StateRunning, tailscale.StateNeedsLogin)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("tailscale did not finish starting: %w", err)
+		}
+	}
+	tsLog.Debug("Tailscale backend state: %s", state)
+
+	switch state {
+	case tailscale.StateRunning:
+		tsLog.Info("Already logged into Tailscale")
+
+		// The exit node from the config otherwise only applies on first login
+		if config.ExitNode != "" {
+			if err := tsClient.EnableExitNode(config.ExitNode); err != nil {
+				return fmt.Errorf("failed to set exit node %s: %v", config.ExitNode, err)
+			}
+		}
+	case tailscale.StateNeedsMachineAuth:
+		return fmt.Errorf("tailscale node is logged in but not authorized: %w", tailscale.ErrNeedsMachineAuth)
+	default:
+		tsLog.Info("Logging into Tailscale...")
 		
+		if config.AuthKey == "" && headscaleClient != nil {
+			authKey, err := headscaleAuthKey()
+			if err != nil {
+				return fmt.Errorf("failed to create Headscale pre-auth key: %v", err)
+			}
+			config.AuthKey = authKey
+		}
+
 		args := []string{"up", "--authkey", config.AuthKey}
 		
 		if config.Hostname != "" {
@@ -279,124 +566,133 @@ func ensureTailscale(config TailscaleConfig) error {
 			args = append(args, "--exit-node", config.ExitNode)
 		}
 		
-		cmd := exec.Command("tailscale", args...)
+		cmd := tsClient.Command(args...)
 		output, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("failed to login to Tailscale: %v, output: %s", err, string(output))
 		}
 		
-		logger.Info("Successfully logged into Tailscale")
-		
-		// Wait for connection to establish
-		time.Sleep(5 * time.Second)
-	} else {
-		logger.Info("Already logged into Tailscale")
+		// Wait for the connection to establish
+		loginCtx, cancel := context.WithTimeout(ctx, timeouts.login)
+		_, err = tsClient.WaitForState(loginCtx, tailscale.StateRunning)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("tailscale did not reach Running after login: %w", err)
+		}
+
+		tsLog.Info("Successfully logged into Tailscale")
 	}
 
 	// Verify we're connected
-	status, err = tsClient.Status()
+	status, err := tsClient.Status()
 	if err != nil {
 		return fmt.Errorf("failed to verify Tailscale status: %v", err)
 	}
 
 	if status.Self != nil {
-		logger.Info("Tailscale connected as %s with IP %s", status.Self.Hostname, status.Self.TailscaleIPs)
+		tsLog.Info("Tailscale connected as %s with IP %s", status.Self.Hostname, status.Self.TailscaleIPs)
 	}
 
 	return nil
 }
 
 func isTailscaleDaemonRunning() bool {
-	cmd := exec.Command("tailscale", "status", "--json")
-	err := cmd.Run()
-	return err == nil
+	// A daemon that answers is running, whether or not it is logged in
+	_, err := tsClient.Status()
+	return !errors.Is(err, tailscale.ErrDaemonUnavailable)
 }
 
-func startTailscaleDaemon() error {
-	// Try to start tailscaled in the background
-	cmd := exec.Command("tailscaled", "--state=/var/lib/tailscale/tailscaled.state", "--socket=/var/run/tailscale/tailscaled.sock")
-	if err := cmd.Start(); err != nil {
-		// If that fails, try using systemctl
-		cmd = exec.Command("systemctl", "start", "tailscaled")
-		if err := cmd.Run(); err != nil {
-			// If that also fails, try service command
-			cmd = exec.Command("service", "tailscaled", "start")
-			return cmd.Run()
-		}
+func startTailscaleDaemon(config tailscale.DaemonConfig) error {
+	// Supervise tailscaled ourselves when the binary is available
+	if _, err := exec.LookPath("tailscaled"); err == nil {
+		tsDaemon = tailscale.NewDaemon(config)
+		tsLog.Debug("Running tailscaled %s", strings.Join(tsDaemon.Args(), " "))
+		return tsDaemon.Start()
 	}
-	return nil
-}
 
-func handlePeer(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		handleGetPeers(w, r)
-	case http.MethodPost:
-		// Tailscale peers are managed by the control plane
-		// We can't add peers directly
-		http.Error(w, "Peers are managed by Tailscale control plane", http.StatusNotImplemented)
-	case http.MethodDelete:
-		// Tailscale peers are managed by the control plane
-		// We can't remove peers directly
-		http.Error(w, "Peers are managed by Tailscale control plane", http.StatusNotImplemented)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	// Otherwise fall back to the system service manager
+	cmd := exec.Command("systemctl", "start", "tailscaled")
+	if err := cmd.Run(); err != nil {
+		// If that also fails, try service command
+		cmd = exec.Command("service", "tailscaled", "start")
+		return cmd.Run()
 	}
+	return nil
 }
 
+// handlePeer lists peers on GET. Tailscale peers are managed by the control
+// plane, so changes go through its admin API.
+var handlePeer = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet:    handleGetPeers,
+	http.MethodPost:   handleChangePeer,
+	http.MethodPatch:  handleChangePeer,
+	http.MethodDelete: handleChangePeer,
+})
+
 func handleGetPeers(w http.ResponseWriter, r *http.Request) {
-	status, err := tsClient.Status()
+	query, err := parsePeerQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get Tailscale status: %v", err), http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "%v", err)
 		return
 	}
 
-	var peers []PeerInfo
-	for _, peer := range status.Peers {
+	status, err := tailscaleClient(r.Context()).Status()
+	if err != nil {
+		writeStatusError(w, r, err)
+		return
+	}
+
+	// Paging metadata goes in headers so the body stays a plain array
+	page, total, next := query.apply(status.Peers)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+
+	peers := []PeerInfo{}
+	for _, peer := range page {
 		peerInfo := PeerInfo{
-			PublicKey:  peer.PublicKey,
-			Hostname:   peer.Hostname,
-			IP:         peer.TailscaleIPs,
-			AllowedIPs: peer.AllowedIPs,
-			Connected:  peer.Online,
+			PublicKey:     peer.PublicKey,
+			Hostname:      peer.Hostname,
+			IP:            peer.TailscaleIPs,
+			AllowedIPs:    peer.AllowedIPs,
+			Connected:     peer.Online,
+			User:          headscaleUserFor(peer.PublicKey),
+			KeyExpiry:     peer.KeyExpiry,
+			KeyExpiryDays: keyExpiryDays(peer),
 		}
 		peers = append(peers, peerInfo)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(peers)
+	writeJSON(w, http.StatusOK, peers)
 }
 
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	status, err := tsClient.Status()
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	status, err := tailscaleClient(r.Context()).Status()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get Tailscale status: %v", err), http.StatusInternalServerError)
+		writeStatusError(w, r, err)
 		return
 	}
 
-	response := map[string]interface{}{
-		"loggedIn": status.LoggedIn,
-		"self": map[string]interface{}{
-			"hostname":      status.Self.Hostname,
-			"tailscaleIPs":  status.Self.TailscaleIPs,
-			"publicKey":     status.Self.PublicKey,
-			"online":        status.Self.Online,
-		},
-		"peerCount": len(status.Peers),
+	if err := status.CheckLoggedIn(); err != nil {
+		writeStatusError(w, r, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ok", LoggedIn: true})
 }
 
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	status, err := tsClient.Status()
+// handleLegacyHealth keeps the plain text answers of the unversioned /health
+// for the load balancers and scripts that match on them. Every failure to
+// query tailscaled is "Unhealthy"; /api/v1/health tells the reasons apart.
+func handleLegacyHealth(w http.ResponseWriter, r *http.Request) {
+	status, err := tailscaleClient(r.Context()).Status()
 	if err != nil {
 		http.Error(w, "Unhealthy", http.StatusServiceUnavailable)
 		return
 	}
 
-	if !status.LoggedIn {
+	if status.CheckLoggedIn() != nil {
 		http.Error(w, "Not logged in", http.StatusServiceUnavailable)
 		return
 	}
@@ -405,13 +701,20 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func periodicBandwidthCheck(endpoint string) {
+func periodicBandwidthCheck(ctx context.Context, endpoint string) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := reportPeerBandwidth(endpoint); err != nil {
-			logger.Info("Failed to report peer bandwidth: %v", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := reportPeerBandwidth(endpoint)
+		bandwidthReportStatus.record(err)
+		if err != nil {
+			bandwidthLog.Info("Failed to report peer bandwidth: %v", err)
 		}
 	}
 }
@@ -462,11 +765,13 @@ func calculatePeerBandwidth() ([]PeerBandwidth, error) {
 				bytesInMB := bytesInDiff / (1024 * 1024)
 				bytesOutMB := bytesOutDiff / (1024 * 1024)
 
-				peerBandwidths = append(peerBandwidths, PeerBandwidth{
+				bandwidth := PeerBandwidth{
 					PublicKey: publicKey,
 					BytesIn:   bytesInMB,
 					BytesOut:  bytesOutMB,
-				})
+				}
+				peerBandwidths = append(peerBandwidths, bandwidth)
+				lastBandwidths[publicKey] = bandwidth
 			}
 		} else {
 			// First reading of a peer
@@ -490,6 +795,7 @@ func calculatePeerBandwidth() ([]PeerBandwidth, error) {
 	for publicKey := range lastReadings {
 		if !currentPeerKeys[publicKey] {
 			delete(lastReadings, publicKey)
+			delete(lastBandwidths, publicKey)
 		}
 	}
 
@@ -522,13 +828,16 @@ func reportPeerBandwidth(apiURL string) error {
 
 // notifyPeerChange sends a notification about peer changes
 func notifyPeerChange(action, publicKey string) {
-	if notifyURL == "" {
-		return
-	}
-	
-	payload := map[string]string{
+	notify(map[string]interface{}{
 		"action":    action,
 		"publicKey": publicKey,
+	})
+}
+
+// notify posts an event to the notify URL, if one is configured
+func notify(payload map[string]interface{}) {
+	if notifyURL == "" {
+		return
 	}
 	
 	data, err := json.Marshal(payload)
@@ -539,7 +848,7 @@ func notifyPeerChange(action, publicKey string) {
 	
 	resp, err := http.Post(notifyURL, "application/json", bytes.NewBuffer(data))
 	if err != nil {
-		logger.Warn("Failed to notify peer change: %v", err)
+		logger.Warn("Failed to notify %s: %v", payload["action"], err)
 		return
 	}
 	defer resp.Body.Close()
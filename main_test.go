@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// testRunConfig is a configuration run can start from without touching the host
+func testRunConfig(t *testing.T, env map[string]string) Config {
+	t.Helper()
+	vars := map[string]string{
+		"TAILSCALE_AUTHKEY":        "tskey-auth",
+		"TAILSCALED_STATE_DIR":     t.TempDir(),
+		"LISTEN":                   "127.0.0.1:0",
+		"TAILSCALE_DAEMON_TIMEOUT": "2s",
+		"TAILSCALE_LOGIN_TIMEOUT":  "1s",
+	}
+	for name, value := range env {
+		vars[name] = value
+	}
+	cfg, err := parseConfig("gerbil", nil, mapEnv(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fatal must not end the test binary
+	previous := logger.SetExitFunc(func(code int) {
+		t.Errorf("run exited with code %d", code)
+	})
+	config := daemonConfig
+	t.Cleanup(func() {
+		logger.SetExitFunc(previous)
+		daemonConfig = config
+	})
+	return cfg
+}
+
+func TestRunErrors(t *testing.T) {
+	badConfig := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(badConfig, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status string
+		code   int
+		// option is the option a ConfigError is about and is the error a
+		// TailscaleError wraps
+		option string
+		is     error
+	}{
+		{name: "unreadable config file", env: map[string]string{"CONFIG": badConfig}, code: exitConfig, option: "config"},
+		{name: "missing config file", env: map[string]string{"CONFIG": badConfig + ".missing"}, code: exitConfig, option: "config"},
+		{name: "bad log sink", env: map[string]string{"LOG_SINKS": "carrier-pigeon"}, code: exitConfig, option: "log-sinks"},
+		{name: "node not authorized", status: `{"BackendState": "NeedsMachineAuth"}`, code: exitTailscale, is: tailscale.ErrNeedsMachineAuth},
+		// The fake CLI fails `tailscale up`
+		{name: "login fails", status: `{"BackendState": "NeedsLogin"}`, code: exitTailscale},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := test.status
+			if status == "" {
+				status = testStatusJSON
+			}
+			fakeTailscaleCLI(t, status)
+			cfg := testRunConfig(t, test.env)
+
+			err := run(context.Background(), cfg)
+			if code := exitCode(err); code != test.code {
+				t.Fatalf("Got %v with exit code %d, want %d", err, code, test.code)
+			}
+			var configErr *ConfigError
+			if test.option != "" && (!errors.As(err, &configErr) || configErr.Option != test.option) {
+				t.Errorf("Got %v, want an error about %s", err, test.option)
+			}
+			var tailscaleErr *TailscaleError
+			if test.code == exitTailscale && !errors.As(err, &tailscaleErr) {
+				t.Errorf("Got %v, want a TailscaleError", err)
+			}
+			if test.is != nil && !errors.Is(err, test.is) {
+				t.Errorf("Got %v, want it to wrap %v", err, test.is)
+			}
+		})
+	}
+}
+
+func TestRunStopsWaitingOnShutdown(t *testing.T) {
+	// A node that never finishes starting keeps startup waiting
+	fakeTailscaleCLI(t, `{"BackendState": "Starting"}`)
+	cfg := testRunConfig(t, map[string]string{"TAILSCALE_DAEMON_TIMEOUT": "1m", "TAILSCALE_LOGIN_TIMEOUT": "1m"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := run(ctx, cfg)
+	if err == nil {
+		t.Fatal("Got no error from a startup that was stopped")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Startup stopped after %v, want it to stop with the shutdown signal", elapsed)
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	fakeTailscaleCLI(t, testStatusJSON)
+	cfg := testRunConfig(t, nil)
+
+	// Serving registers its routes again, which must not clash
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		err := run(ctx, cfg)
+		cancel()
+		if err != nil {
+			t.Fatalf("Run %d failed: %v", i+1, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the Prometheus text format
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Sample is one value of a metric with its labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Metric is a named metric family with its samples
+type Metric struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector returns the current value of a group of metrics. Collectors are
+// called on every scrape, so they should be cheap or read cached values.
+type Collector func() []Metric
+
+var (
+	mu         sync.Mutex
+	collectors []Collector
+)
+
+// Register adds a collector to the metrics served by Handler
+func Register(collector Collector) {
+	mu.Lock()
+	defer mu.Unlock()
+	collectors = append(collectors, collector)
+}
+
+// Gather calls every registered collector and returns their metrics sorted by name
+func Gather() []Metric {
+	mu.Lock()
+	registered := append([]Collector{}, collectors...)
+	mu.Unlock()
+
+	var all []Metric
+	for _, collector := range registered {
+		all = append(all, collector()...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// Handler serves the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w, Gather())
+	})
+}
+
+// Write renders metrics in the Prometheus text format
+func Write(w io.Writer, metrics []Metric) error {
+	out := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		if metric.Help != "" {
+			fmt.Fprintf(out, "# HELP %s %s\n", metric.Name, escapeHelp(metric.Help))
+		}
+		if metric.Type != "" {
+			fmt.Fprintf(out, "# TYPE %s %s\n", metric.Name, metric.Type)
+		}
+		for _, sample := range metric.Samples {
+			fmt.Fprintf(out, "%s%s %s\n", metric.Name, formatLabels(sample.Labels), formatValue(sample.Value))
+		}
+	}
+	return out.Flush()
+}
+
+// Bool converts a boolean to the 0 or 1 value of a gauge
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(labels[name])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+	"github.com/hhftechnology/gerbil/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestIDHeader carries the ID that ties a request to its log lines
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs taken from clients
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+type identityKey struct{}
+
+// callerIdentity holds the caller's tailnet identity once the access check
+// or the identity recorder looked it up, so the request's log line can name the caller
+type callerIdentity struct {
+	identity *tailscale.Identity
+}
+
+// statusRecorder remembers the status code a handler wrote
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestMiddleware gives every request an ID, traces it, recovers from
+// panics in the handler and logs the outcome
+func requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		caller := &callerIdentity{}
+		ctx = context.WithValue(ctx, identityKey{}, caller)
+		// A traceparent header makes the span part of the caller's trace
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", r.RemoteAddr),
+				attribute.String("http.request.id", id),
+			),
+		)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		req := r.WithContext(ctx)
+		defer func() {
+			abort := false
+			if err := recover(); err != nil {
+				// The server aborts the response without logging for this one
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				httpLog.Errorw(fmt.Sprintf("Panic serving %s %s: %v", r.Method, r.URL.Path, err), "request_id", id, "stack", string(debug.Stack()))
+				span.SetStatus(codes.Error, fmt.Sprintf("panic: %v", err))
+				if recorder.status == 0 {
+					writeError(recorder, req, http.StatusInternalServerError, errCodeInternal, "Internal Server Error")
+				} else {
+					// Too late to send an error, so break the connection instead
+					// of letting the partial response look complete
+					recorder.status = http.StatusInternalServerError
+					abort = true
+				}
+			}
+
+			// Name the span after the matched route, known once the mux ran
+			if req.Pattern != "" {
+				route := req.Pattern
+				if _, path, ok := strings.Cut(route, " "); ok {
+					route = path
+				}
+				span.SetName(r.Method + " " + route)
+				span.SetAttributes(attribute.String("http.route", route))
+			}
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= 500 {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+			span.End()
+
+			duration := time.Since(start)
+			fields := []interface{}{
+				"status", status,
+				"duration", duration.Round(time.Microsecond),
+				"bytes", recorder.bytes,
+				"remote", r.RemoteAddr,
+				"request_id", id,
+			}
+			if caller.identity != nil {
+				fields = append(fields, "identity", caller.identity.String())
+			}
+			if span.IsRecording() {
+				fields = append(fields, "trace_id", span.SpanContext().TraceID().String())
+			}
+			level := logger.INFO
+			if status >= 500 {
+				level = logger.ERROR
+			}
+			httpLog.Logw(level, r.Method+" "+r.URL.RequestURI(), fields...)
+
+			if abort {
+				panic(http.ErrAbortHandler)
+			}
+		}()
+
+		next.ServeHTTP(recorder, req)
+	})
+}
+
+// requestID returns the ID of the request being served in ctx
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// setRequestIdentity records the caller's tailnet identity for the request
+// being served in ctx
+func setRequestIdentity(ctx context.Context, identity *tailscale.Identity) {
+	if caller, ok := ctx.Value(identityKey{}).(*callerIdentity); ok {
+		caller.identity = identity
+	}
+}
+
+// requestIdentity returns the caller's tailnet identity, or nil when the
+// caller wasn't looked up on the tailnet
+func requestIdentity(ctx context.Context) *tailscale.Identity {
+	caller, _ := ctx.Value(identityKey{}).(*callerIdentity)
+	if caller == nil {
+		return nil
+	}
+	return caller.identity
+}
+
+// tailscaleClient returns the Tailscale client with its calls traced under
+// the request in ctx
+func tailscaleClient(ctx context.Context) *tailscale.Client {
+	return tsClient.WithContext(ctx)
+}
+
+// validRequestID accepts IDs of visible ASCII characters, so a client can't
+// inject anything into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hhftechnology/gerbil/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// testCollector is an OTLP/HTTP collector that keeps the spans it receives
+type testCollector struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	spans   []*tracepb.Span
+	headers http.Header
+}
+
+func newTestCollector(t *testing.T) *testCollector {
+	c := &testCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = r.Header.Clone()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				c.spans = append(c.spans, scopeSpans.Spans...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		response, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+		w.Write(response)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// setupTracing exports spans to the collector until the returned function
+// flushes them
+func setupTracing(t *testing.T, collector *testCollector) func() {
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+		Endpoint: collector.URL,
+		Headers:  map[string]string{"Authorization": "Bearer collector"},
+		OnError: func(err error) {
+			t.Errorf("Trace export failed: %v", err)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+	return func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func spanAttribute(span *tracepb.Span, key string) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestRequestTracing(t *testing.T) {
+	fakeTailscaleCLI(t, testStatusJSON)
+	collector := newTestCollector(t)
+	flush := setupTracing(t, collector)
+
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	server := httptest.NewServer(requestMiddleware(mux))
+	defer server.Close()
+
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	req, _ := http.NewRequest(http.MethodGet, server.URL+apiPrefix+"/status", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+spanID+"-01")
+	req.Header.Set(requestIDHeader, "req-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(requestIDHeader); id != "req-1" {
+		t.Errorf("Got request ID %q, want the one sent", id)
+	}
+	flush()
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	if auth := collector.headers.Get("Authorization"); auth != "Bearer collector" {
+		t.Errorf("Got Authorization %q, want the configured header", auth)
+	}
+	var serverSpan *tracepb.Span
+	for _, span := range collector.spans {
+		if span.Kind == tracepb.Span_SPAN_KIND_SERVER {
+			serverSpan = span
+		}
+	}
+	if serverSpan == nil {
+		t.Fatalf("Got spans %v, want a server span", collector.spans)
+	}
+	if serverSpan.Name != "GET "+apiPrefix+"/status" {
+		t.Errorf("Got server span %q, want it named after the route", serverSpan.Name)
+	}
+	if hex.EncodeToString(serverSpan.TraceId) != traceID || hex.EncodeToString(serverSpan.ParentSpanId) != spanID {
+		t.Errorf("Got trace %x and parent %x, want the caller's trace %s and span %s", serverSpan.TraceId, serverSpan.ParentSpanId, traceID, spanID)
+	}
+	if id := spanAttribute(serverSpan, "http.request.id"); id != "req-1" {
+		t.Errorf("Got http.request.id %q, want the X-Request-ID", id)
+	}
+
+	// Every Tailscale call is a child of the request
+	children := 0
+	for _, span := range collector.spans {
+		if span == serverSpan {
+			continue
+		}
+		children++
+		if span.Kind != tracepb.Span_SPAN_KIND_CLIENT || !strings.HasPrefix(span.Name, "tailscale.") {
+			t.Errorf("Got span %q of kind %v, want Tailscale client spans", span.Name, span.Kind)
+		}
+		if string(span.TraceId) != string(serverSpan.TraceId) || string(span.ParentSpanId) != string(serverSpan.SpanId) {
+			t.Errorf("Span %q has trace %x and parent %x, want trace %x and parent %x", span.Name, span.TraceId, span.ParentSpanId, serverSpan.TraceId, serverSpan.SpanId)
+		}
+	}
+	if children == 0 {
+		t.Error("Got no spans for the Tailscale calls")
+	}
+}
+
+func TestRequestMiddlewareRecovers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/before", func(w http.ResponseWriter, r *http.Request) {
+		panic("before writing")
+	})
+	mux.HandleFunc("/after", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"partial":`))
+		http.NewResponseController(w).Flush()
+		panic("after writing")
+	})
+	server := httptest.NewServer(requestMiddleware(mux))
+	defer server.Close()
+
+	t.Run("before writing", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/before")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusInternalServerError || body.Error.Code != errCodeInternal {
+			t.Errorf("Got %d %+v, want a 500 %s error", resp.StatusCode, body, errCodeInternal)
+		}
+		if id := resp.Header.Get(requestIDHeader); id == "" || body.Error.RequestID != id {
+			t.Errorf("Got request ID %q in the header and %q in the body", id, body.Error.RequestID)
+		}
+	})
+
+	t.Run("after writing", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/after")
+		if err != nil {
+			// The connection may break before the headers arrive
+			return
+		}
+		defer resp.Body.Close()
+		if body, err := io.ReadAll(resp.Body); err == nil {
+			t.Errorf("Got a complete response %q, want the connection broken", body)
+		}
+	})
+
+	// The server still serves after both panics
+	if resp, err := http.Get(server.URL + "/before"); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+}
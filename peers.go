@@ -0,0 +1,467 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// PeerDetail is the full view of a single peer served by GET /peers/{id}
+type PeerDetail struct {
+	tailscale.PeerInfo
+	User        string           `json:"user,omitempty"`
+	Traffic     PeerTraffic      `json:"traffic"`
+	Latency     *PeerLatency     `json:"latency,omitempty"`
+	Diagnostics *PeerDiagnostics `json:"diagnostics,omitempty"`
+}
+
+// PeerTraffic holds the live counters and the last reported bandwidth delta
+type PeerTraffic struct {
+	RxBytes     int64          `json:"rxBytes"`
+	TxBytes     int64          `json:"txBytes"`
+	LastDelta   *PeerBandwidth `json:"lastDelta,omitempty"`
+	LastChecked *time.Time     `json:"lastChecked,omitempty"`
+}
+
+// PeerDiagnostics is computed on demand with ?diagnostics=true
+type PeerDiagnostics struct {
+	Ping          *tailscale.PingResult `json:"ping"`
+	Endpoint      string                `json:"endpoint,omitempty"`
+	Relay         string                `json:"relay,omitempty"`
+	LastHandshake *time.Time            `json:"lastHandshake,omitempty"`
+}
+
+// findPeer looks a peer up by public key, hostname, MagicDNS name or Tailscale IP
+func findPeer(peers []tailscale.PeerInfo, id string) (tailscale.PeerInfo, bool) {
+	for _, peer := range peers {
+		if peer.PublicKey == id {
+			return peer, true
+		}
+	}
+	for _, peer := range peers {
+		for _, ip := range peer.Addresses {
+			if ip == id {
+				return peer, true
+			}
+		}
+	}
+	for _, peer := range peers {
+		dnsName := strings.TrimSuffix(peer.DNSName, ".")
+		if strings.EqualFold(peer.Hostname, id) || strings.EqualFold(dnsName, id) ||
+			strings.EqualFold(strings.Split(dnsName, ".")[0], id) {
+			return peer, true
+		}
+	}
+	return tailscale.PeerInfo{}, false
+}
+
+func handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	status, err := tailscaleClient(r.Context()).Status()
+	if err != nil {
+		writeStatusError(w, r, err)
+		return
+	}
+
+	peer, ok := findPeer(status.Peers, r.PathValue("id"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Peer not found")
+		return
+	}
+
+	detail := PeerDetail{
+		PeerInfo: peer,
+		User:     headscaleUserFor(peer.PublicKey),
+		Traffic: PeerTraffic{
+			RxBytes: peer.RxBytes,
+			TxBytes: peer.TxBytes,
+		},
+	}
+
+	mu.Lock()
+	if bandwidth, ok := lastBandwidths[peer.PublicKey]; ok {
+		detail.Traffic.LastDelta = &bandwidth
+	}
+	if reading, ok := lastReadings[peer.PublicKey]; ok {
+		lastChecked := reading.LastChecked
+		detail.Traffic.LastChecked = &lastChecked
+	}
+	mu.Unlock()
+
+	if prober != nil {
+		if latency, ok := prober.latency(peer.PublicKey, false); ok {
+			detail.Latency = latency
+		}
+	}
+
+	if diagnose, _ := strconv.ParseBool(r.URL.Query().Get("diagnostics")); diagnose {
+		diagnostics, err := diagnosePeer(r.Context(), peer)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to diagnose peer: %v", err)
+			return
+		}
+		detail.Diagnostics = diagnostics
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// diagnosePeer pings the peer and reports the path currently in use
+func diagnosePeer(ctx context.Context, peer tailscale.PeerInfo) (*PeerDiagnostics, error) {
+	if peer.TailscaleIPs == "" {
+		return nil, fmt.Errorf("peer %s has no Tailscale IP", peer.Hostname)
+	}
+
+	ping, err := tailscaleClient(ctx).PingDetail(peer.TailscaleIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	diagnostics := &PeerDiagnostics{
+		Ping:     ping,
+		Endpoint: peer.CurAddr,
+		Relay:    peer.Relay,
+	}
+	if ping.Endpoint != "" {
+		diagnostics.Endpoint = ping.Endpoint
+	}
+	if !peer.LastHandshake.IsZero() {
+		lastHandshake := peer.LastHandshake
+		diagnostics.LastHandshake = &lastHandshake
+	}
+	return diagnostics, nil
+}
+
+// maxPageSize caps the limit parameter of /peers
+const maxPageSize = 1000
+
+// peerQuery holds the filtering, sorting and paging parameters of /peers
+type peerQuery struct {
+	online   *bool
+	tags     []string
+	os       string
+	hostname string
+	cidr     *netip.Prefix
+	sort     string
+	desc     bool
+	limit    int
+	cursor   *peerCursor
+}
+
+// peerCursor marks the last peer of a page; the next page starts after it
+type peerCursor struct {
+	PublicKey string    `json:"k"`
+	Hostname  string    `json:"h,omitempty"`
+	IP        string    `json:"i,omitempty"`
+	Traffic   int64     `json:"t,omitempty"`
+	LastSeen  time.Time `json:"s,omitempty"`
+}
+
+// parsePeerQuery validates the query parameters of /peers
+func parsePeerQuery(values url.Values) (*peerQuery, error) {
+	query := &peerQuery{
+		tags:     values["tag"],
+		os:       values.Get("os"),
+		hostname: values.Get("hostname"),
+		sort:     values.Get("sort"),
+	}
+
+	if online := values.Get("online"); online != "" {
+		value, err := strconv.ParseBool(online)
+		if err != nil {
+			return nil, fmt.Errorf("invalid online value %q", online)
+		}
+		query.online = &value
+	}
+
+	if query.hostname != "" {
+		if _, err := path.Match(query.hostname, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname pattern %q", query.hostname)
+		}
+	}
+
+	if cidr := values.Get("cidr"); cidr != "" {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", cidr)
+		}
+		prefix = prefix.Masked()
+		query.cidr = &prefix
+	}
+
+	switch query.sort {
+	case "":
+		query.sort = "hostname"
+	case "hostname", "ip", "traffic", "lastSeen":
+	default:
+		return nil, fmt.Errorf("invalid sort field %q, expected hostname, ip, traffic or lastSeen", query.sort)
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		query.desc = true
+	default:
+		return nil, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxPageSize {
+			return nil, fmt.Errorf("invalid limit %q, expected 1 to %d", limit, maxPageSize)
+		}
+		query.limit = value
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		query.cursor = &peerCursor{}
+		if err := json.Unmarshal(data, query.cursor); err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return query, nil
+}
+
+// matches reports whether a peer passes all filters
+func (q *peerQuery) matches(peer tailscale.PeerInfo) bool {
+	if q.online != nil && peer.Online != *q.online {
+		return false
+	}
+	if q.os != "" && !strings.EqualFold(peer.OS, q.os) {
+		return false
+	}
+	if q.hostname != "" {
+		if ok, _ := path.Match(q.hostname, peer.Hostname); !ok {
+			return false
+		}
+	}
+	for _, tag := range q.tags {
+		if !slices.Contains(peer.Tags, tag) {
+			return false
+		}
+	}
+	if q.cidr != nil {
+		contained := false
+		for _, address := range peer.Addresses {
+			if ip, err := netip.ParseAddr(address); err == nil && q.cidr.Contains(ip) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			return false
+		}
+	}
+	return true
+}
+
+// cursorFor returns the cursor position of a peer
+func cursorFor(peer tailscale.PeerInfo) peerCursor {
+	return peerCursor{
+		PublicKey: peer.PublicKey,
+		Hostname:  peer.Hostname,
+		IP:        peer.TailscaleIPs,
+		Traffic:   peer.RxBytes + peer.TxBytes,
+		LastSeen:  peer.LastSeen,
+	}
+}
+
+// compare orders two cursor positions by the sort field, then by public key
+// so that every peer has a unique, stable position
+func (q *peerQuery) compare(a, b peerCursor) int {
+	var c int
+	switch q.sort {
+	case "hostname":
+		c = strings.Compare(strings.ToLower(a.Hostname), strings.ToLower(b.Hostname))
+	case "ip":
+		ipA, _ := netip.ParseAddr(a.IP)
+		ipB, _ := netip.ParseAddr(b.IP)
+		c = ipA.Compare(ipB)
+	case "traffic":
+		c = cmp.Compare(a.Traffic, b.Traffic)
+	case "lastSeen":
+		c = a.LastSeen.Compare(b.LastSeen)
+	}
+	if c == 0 {
+		c = strings.Compare(a.PublicKey, b.PublicKey)
+	}
+	if q.desc {
+		c = -c
+	}
+	return c
+}
+
+// apply filters and sorts the peers and cuts out the requested page. It
+// returns the page, the number of peers matching the filters and the cursor
+// for the next page, which is empty on the last page.
+func (q *peerQuery) apply(peers []tailscale.PeerInfo) ([]tailscale.PeerInfo, int, string) {
+	var matched []tailscale.PeerInfo
+	for _, peer := range peers {
+		if q.matches(peer) {
+			matched = append(matched, peer)
+		}
+	}
+	slices.SortFunc(matched, func(a, b tailscale.PeerInfo) int {
+		return q.compare(cursorFor(a), cursorFor(b))
+	})
+	total := len(matched)
+
+	page := matched
+	if q.cursor != nil {
+		start := len(page)
+		for i, peer := range page {
+			if q.compare(cursorFor(peer), *q.cursor) > 0 {
+				start = i
+				break
+			}
+		}
+		page = page[start:]
+	}
+
+	var next string
+	if q.limit > 0 && len(page) > q.limit {
+		page = page[:q.limit]
+		data, _ := json.Marshal(cursorFor(page[len(page)-1]))
+		next = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return page, total, next
+}
+
+// PeerChange is the body of POST, PATCH and DELETE requests on /peer
+type PeerChange struct {
+	PublicKey string   `json:"publicKey"`
+	Action    string   `json:"action,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+}
+
+// Actions accepted by POST /peer
+const (
+	actionAuthorize     = "authorize"
+	actionExpire        = "expire"
+	actionSetTags       = "setTags"
+	actionApproveRoutes = "approveRoutes"
+	actionDelete        = "delete"
+)
+
+// handleChangePeer applies a device change through the control plane admin API
+func handleChangePeer(w http.ResponseWriter, r *http.Request) {
+	if peerManager == nil {
+		writeError(w, r, http.StatusNotImplemented, errCodeNotImplemented, "Peers are managed by Tailscale control plane; configure an admin API key to manage them here")
+		return
+	}
+
+	var change PeerChange
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid request body: %v", err)
+			return
+		}
+	}
+	if change.PublicKey == "" {
+		change.PublicKey = r.URL.Query().Get("publicKey")
+	}
+	if change.PublicKey == "" {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "publicKey is required")
+		return
+	}
+
+	var actions []string
+	switch r.Method {
+	case http.MethodDelete:
+		actions = []string{actionDelete}
+	case http.MethodPatch:
+		// PATCH updates whichever fields are present
+		if change.Tags != nil {
+			actions = append(actions, actionSetTags)
+		}
+		if change.Routes != nil {
+			actions = append(actions, actionApproveRoutes)
+		}
+		if len(actions) == 0 {
+			writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Nothing to update, expected tags or routes")
+			return
+		}
+	case http.MethodPost:
+		switch change.Action {
+		case actionAuthorize, actionExpire, actionSetTags, actionApproveRoutes:
+			actions = []string{change.Action}
+		default:
+			writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Unknown action %q, expected authorize, expire, setTags or approveRoutes", change.Action)
+			return
+		}
+	}
+
+	// Validate everything first, so a bad field doesn't leave a PATCH half done
+	if slices.Contains(actions, actionApproveRoutes) {
+		for _, route := range change.Routes {
+			if _, err := netip.ParsePrefix(route); err != nil {
+				writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid route %q", route)
+				return
+			}
+		}
+	}
+
+	for i, action := range actions {
+		if err := applyPeerChange(r.Context(), action, change); err != nil {
+			logger.Error("Failed to %s peer %s: %v", action, change.PublicKey, err)
+			// The control plane has no transactions, so say what was changed
+			applied := ""
+			if i > 0 {
+				applied = fmt.Sprintf(" (%s already applied)", strings.Join(actions[:i], ", "))
+			}
+			var apiErr *controlplane.APIError
+			switch {
+			case errors.Is(err, controlplane.ErrDeviceNotFound):
+				writeError(w, r, http.StatusNotFound, errCodeNotFound, "Peer not found in control plane%s", applied)
+			case errors.Is(err, controlplane.ErrNotSupported):
+				writeError(w, r, http.StatusNotImplemented, errCodeNotImplemented, "The control plane does not support %s%s", action, applied)
+			case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest:
+				writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "%s%s", apiErr.Message, applied)
+			default:
+				writeError(w, r, http.StatusBadGateway, errCodeControlPlane, "Failed to %s peer: %v%s", action, err, applied)
+			}
+			return
+		}
+		logger.Info("Peer %s: %s done", change.PublicKey, action)
+		go notifyPeerChange(action, change.PublicKey)
+	}
+
+	writeJSON(w, http.StatusOK, PeerChangeResponse{PublicKey: change.PublicKey, Actions: actions})
+}
+
+// applyPeerChange runs a single action against the control plane
+func applyPeerChange(ctx context.Context, action string, change PeerChange) error {
+	switch action {
+	case actionDelete:
+		return peerManager.DeleteDevice(ctx, change.PublicKey)
+	case actionExpire:
+		return peerManager.ExpireKey(ctx, change.PublicKey)
+	case actionAuthorize:
+		return peerManager.AuthorizeDevice(ctx, change.PublicKey)
+	case actionSetTags:
+		return peerManager.SetTags(ctx, change.PublicKey, change.Tags)
+	case actionApproveRoutes:
+		return peerManager.ApproveRoutes(ctx, change.PublicKey, change.Routes)
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
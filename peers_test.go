@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/controlplane"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// testPeers covers each filter and has ties on every sort field, which the
+// public key breaks
+var testPeers = []tailscale.PeerInfo{
+	{PublicKey: "nodekey:a", Hostname: "web-1", OS: "linux", Online: true, Tags: []string{"tag:web", "tag:prod"}, Addresses: []string{"100.64.1.10", "fd7a:115c:a1e0::10"}, RxBytes: 500, TxBytes: 500, LastSeen: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	{PublicKey: "nodekey:b", Hostname: "web-2", OS: "linux", Online: false, Tags: []string{"tag:web"}, Addresses: []string{"100.64.1.2", "fd7a:115c:a1e0::2"}, RxBytes: 100, TxBytes: 50, LastSeen: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{PublicKey: "nodekey:c", Hostname: "Laptop", OS: "macOS", Online: true, Addresses: []string{"100.64.2.1", "fd7a:115c:a1e0::21"}, RxBytes: 1000, LastSeen: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+	{PublicKey: "nodekey:d", Hostname: "db", OS: "linux", Online: true, Tags: []string{"tag:prod"}, Addresses: []string{"100.64.0.5"}, RxBytes: 150, LastSeen: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+	{PublicKey: "nodekey:e", Hostname: "web-10", OS: "windows", Online: true, Addresses: []string{"100.64.1.100"}, TxBytes: 1000, LastSeen: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+func init() {
+	for i := range testPeers {
+		testPeers[i].TailscaleIPs = testPeers[i].Addresses[0]
+	}
+}
+
+func peerKeys(peers []tailscale.PeerInfo) string {
+	var keys []string
+	for _, peer := range peers {
+		keys = append(keys, strings.TrimPrefix(peer.PublicKey, "nodekey:"))
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestParsePeerQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		"online=maybe",
+		"hostname=web-[",
+		"cidr=100.64.0.0",
+		"cidr=100.64.0.0/33",
+		"sort=os",
+		"order=up",
+		"limit=0",
+		"limit=1001",
+		"limit=ten",
+		"cursor=!!!",
+		"cursor=bm90IGpzb24",
+	} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parsePeerQuery(values); err == nil {
+			t.Errorf("Parsed %q, want an error", query)
+		}
+	}
+}
+
+func TestPeerQueryFilters(t *testing.T) {
+	tests := []struct {
+		query string
+		// want are the matching peers in hostname order
+		want string
+	}{
+		{query: "", want: "d c a e b"},
+		{query: "hostname=web-*", want: "a e b"},
+		{query: "hostname=web-?", want: "a b"},
+		// Globs are case sensitive, unlike the os filter
+		{query: "hostname=laptop", want: ""},
+		{query: "os=LINUX", want: "d a b"},
+		{query: "online=false", want: "b"},
+		{query: "tag=tag:web&tag=tag:prod", want: "a"},
+		{query: "tag=tag:prod", want: "d a"},
+		{query: "cidr=100.64.1.0/24", want: "a e b"},
+		// Host bits are masked off
+		{query: "cidr=100.64.1.77/24", want: "a e b"},
+		{query: "cidr=100.64.1.10/32", want: "a"},
+		// Any address of the peer counts
+		{query: "cidr=fd7a:115c:a1e0::20/124", want: "c"},
+		{query: "cidr=100.64.1.0/24&online=true&hostname=web-1*", want: "a e"},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		query, err := parsePeerQuery(values)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", test.query, err)
+			continue
+		}
+		page, total, next := query.apply(testPeers)
+		if keys := peerKeys(page); keys != test.want {
+			t.Errorf("Got peers %q for %q, want %q", keys, test.query, test.want)
+		}
+		if total != len(page) || next != "" {
+			t.Errorf("Got total %d and next cursor %q for %q, want one page", total, next, test.query)
+		}
+	}
+}
+
+func TestPeerQuerySort(t *testing.T) {
+	tests := []struct {
+		sort string
+		asc  string
+	}{
+		// Hostnames sort as strings without case, so web-10 comes before web-2
+		{sort: "hostname", asc: "d c a e b"},
+		// Addresses sort numerically, not as strings
+		{sort: "ip", asc: "d b a e c"},
+		// Traffic is received and sent bytes; b and d tie at 150, and a, c
+		// and e at 1000
+		{sort: "traffic", asc: "b d a c e"},
+		{sort: "lastSeen", asc: "b e d a c"},
+	}
+	for _, test := range tests {
+		for _, order := range []string{"asc", "desc"} {
+			query, err := parsePeerQuery(url.Values{"sort": {test.sort}, "order": {order}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.asc
+			if order == "desc" {
+				keys := strings.Fields(want)
+				for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+					keys[i], keys[j] = keys[j], keys[i]
+				}
+				want = strings.Join(keys, " ")
+			}
+			page, _, _ := query.apply(testPeers)
+			if keys := peerKeys(page); keys != want {
+				t.Errorf("Got %q sorting by %s %s, want %q", keys, test.sort, order, want)
+			}
+		}
+	}
+}
+
+// statusWithPeers renders peers as `tailscale status --json`
+func statusWithPeers(t *testing.T, peers []tailscale.PeerInfo) string {
+	t.Helper()
+	rawPeers := make(map[string]interface{})
+	for _, peer := range peers {
+		rawPeers[peer.PublicKey] = map[string]interface{}{
+			"PublicKey":      peer.PublicKey,
+			"HostName":       peer.Hostname,
+			"OS":             peer.OS,
+			"Online":         peer.Online,
+			"Tags":           peer.Tags,
+			"TailscaleIPs":   peer.Addresses,
+			"RxBytes":        peer.RxBytes,
+			"TxBytes":        peer.TxBytes,
+			"LastSeen":       peer.LastSeen,
+			"ExitNode":       peer.ExitNode,
+			"ExitNodeOption": peer.ExitNodeOption,
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"BackendState": "Running",
+		"Self":         map[string]interface{}{"HostName": "gerbil", "TailscaleIPs": []string{"100.64.0.1"}},
+		"Peer":         rawPeers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPeersCursorWalk(t *testing.T) {
+	fakeTailscaleCLI(t, statusWithPeers(t, testPeers))
+
+	for _, order := range []string{"asc", "desc"} {
+		// Traffic has ties, so the walk relies on the public key to break them
+		all, _ := parsePeerQuery(url.Values{"sort": {"traffic"}, "order": {order}})
+		want, _, _ := all.apply(testPeers)
+
+		var walked []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(testPeers) {
+				t.Fatalf("Still walking after %d pages", pages)
+			}
+			target := apiPrefix + "/peers?sort=traffic&limit=2&order=" + order
+			if cursor != "" {
+				target += "&cursor=" + cursor
+			}
+			w := httptest.NewRecorder()
+			handleGetPeers(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("Got %d %s for %s", w.Code, w.Body, target)
+			}
+			if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(len(testPeers)) {
+				t.Errorf("Got X-Total-Count %q, want %d on every page", total, len(testPeers))
+			}
+			var page []PeerInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+			for _, peer := range page {
+				walked = append(walked, strings.TrimPrefix(peer.PublicKey, "nodekey:"))
+			}
+
+			cursor = w.Header().Get("X-Next-Cursor")
+			if cursor == "" {
+				break
+			}
+			if len(page) != 2 {
+				t.Errorf("Got a page of %d peers before the last, want 2", len(page))
+			}
+		}
+		if got := strings.Join(walked, " "); got != peerKeys(want) {
+			t.Errorf("Walked %q in %s order, want every peer once: %q", got, order, peerKeys(want))
+		}
+	}
+}
+
+// peerDetailStatus has a peer with a MagicDNS name and a relay, and one
+// whose short MagicDNS name differs from its hostname
+const peerDetailStatus = `{
+	"BackendState": "Running",
+	"Self": {"HostName": "gerbil", "PublicKey": "nodekey:self", "TailscaleIPs": ["100.64.0.1"]},
+	"Peer": {
+		"nodekey:exit": {
+			"HostName": "exit",
+			"DNSName": "exit.tail1234.ts.net.",
+			"PublicKey": "nodekey:exit",
+			"Online": true,
+			"TailscaleIPs": ["100.64.0.2", "fd7a:115c:a1e0::2"],
+			"CurAddr": "203.0.113.5:41641",
+			"Relay": "fra",
+			"LastHandshake": "2024-01-01T00:00:00Z",
+			"RxBytes": 10,
+			"TxBytes": 20
+		},
+		"nodekey:laptop": {
+			"HostName": "Johns-MacBook",
+			"DNSName": "laptop.tail1234.ts.net.",
+			"PublicKey": "nodekey:laptop",
+			"Online": true,
+			"TailscaleIPs": ["100.64.0.3"]
+		}
+	}
+}`
+
+func TestGetPeer(t *testing.T) {
+	fakeTailscaleCLI(t, peerDetailStatus)
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: "nodekey:exit", want: "nodekey:exit"},
+		{id: "100.64.0.2", want: "nodekey:exit"},
+		{id: "fd7a:115c:a1e0::2", want: "nodekey:exit"},
+		{id: "EXIT", want: "nodekey:exit"},
+		{id: "exit.tail1234.ts.net", want: "nodekey:exit"},
+		{id: "johns-macbook", want: "nodekey:laptop"},
+		{id: "laptop", want: "nodekey:laptop"},
+		{id: "laptop.tail1234.ts.net", want: "nodekey:laptop"},
+		{id: "nobody"},
+		{id: "100.64.0.9"},
+		{id: "nodekey:self"},
+	}
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/peers/x", nil)
+			request.SetPathValue("id", test.id)
+			recorder := httptest.NewRecorder()
+			handleGetPeer(recorder, request)
+
+			if test.want == "" {
+				if recorder.Code != http.StatusNotFound {
+					t.Errorf("Got status %d, want 404: %s", recorder.Code, recorder.Body)
+				}
+				return
+			}
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("Got status %d: %s", recorder.Code, recorder.Body)
+			}
+			var detail PeerDetail
+			if err := json.Unmarshal(recorder.Body.Bytes(), &detail); err != nil {
+				t.Fatal(err)
+			}
+			if detail.PublicKey != test.want {
+				t.Errorf("Got %s, want %s", detail.PublicKey, test.want)
+			}
+			if detail.Diagnostics != nil {
+				t.Errorf("Got diagnostics without asking for them")
+			}
+		})
+	}
+}
+
+func TestGetPeerDiagnostics(t *testing.T) {
+	dir := fakeTailscaleCLI(t, peerDetailStatus)
+	writeFile(t, filepath.Join(dir, "ping-ok"), "100.64.0.2\n")
+
+	get := func(id, query string) (int, PeerDetail) {
+		t.Helper()
+		request := httptest.NewRequest("GET", "/peers/x?"+query, nil)
+		request.SetPathValue("id", id)
+		recorder := httptest.NewRecorder()
+		handleGetPeer(recorder, request)
+		var detail PeerDetail
+		if recorder.Code == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &detail); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Code, detail
+	}
+
+	for _, query := range []string{"diagnostics=true", "diagnostics=1", "diagnostics=TRUE"} {
+		code, detail := get("exit", query)
+		if code != http.StatusOK || detail.Diagnostics == nil {
+			t.Fatalf("Got %d without diagnostics for %s", code, query)
+		}
+		diagnostics := detail.Diagnostics
+		if !diagnostics.Ping.Success || diagnostics.Ping.LatencyMs != 12 || diagnostics.Ping.Path != tailscale.PathDirect {
+			t.Errorf("Got ping %+v, want a direct 12ms pong", diagnostics.Ping)
+		}
+		// The path of the ping replaces the one in the status
+		if diagnostics.Endpoint != "198.51.100.9:41641" || diagnostics.Relay != "fra" {
+			t.Errorf("Got endpoint %q and relay %q", diagnostics.Endpoint, diagnostics.Relay)
+		}
+		if diagnostics.LastHandshake == nil || !diagnostics.LastHandshake.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Got last handshake %v", diagnostics.LastHandshake)
+		}
+	}
+	for _, query := range []string{"diagnostics=false", "diagnostics=0", "diagnostics=maybe"} {
+		if _, detail := get("exit", query); detail.Diagnostics != nil {
+			t.Errorf("Got diagnostics for %s", query)
+		}
+	}
+
+	// A peer that doesn't answer keeps the endpoint from the status
+	code, detail := get("laptop", "diagnostics=true")
+	if code != http.StatusOK || detail.Diagnostics == nil {
+		t.Fatalf("Got %d without diagnostics", code)
+	}
+	if detail.Diagnostics.Ping.Success || detail.Diagnostics.Ping.Error == "" {
+		t.Errorf("Got ping %+v, want a failure", detail.Diagnostics.Ping)
+	}
+	if detail.Diagnostics.Endpoint != "" || detail.Diagnostics.LastHandshake != nil {
+		t.Errorf("Got %+v for a peer without a path", detail.Diagnostics)
+	}
+}
+
+// fakeManager records the device changes made through it and fails route
+// approvals with routesErr
+type fakeManager struct {
+	calls     []string
+	routesErr error
+}
+
+func (m *fakeManager) DeleteDevice(ctx context.Context, nodeKey string) error {
+	m.calls = append(m.calls, "delete")
+	return nil
+}
+
+func (m *fakeManager) ExpireKey(ctx context.Context, nodeKey string) error {
+	m.calls = append(m.calls, "expire")
+	return nil
+}
+
+func (m *fakeManager) SetTags(ctx context.Context, nodeKey string, tags []string) error {
+	m.calls = append(m.calls, "setTags "+strings.Join(tags, ","))
+	return nil
+}
+
+func (m *fakeManager) AuthorizeDevice(ctx context.Context, nodeKey string) error {
+	m.calls = append(m.calls, "authorize")
+	return nil
+}
+
+func (m *fakeManager) ApproveRoutes(ctx context.Context, nodeKey string, routes []string) error {
+	if m.routesErr != nil {
+		return m.routesErr
+	}
+	m.calls = append(m.calls, "approveRoutes "+strings.Join(routes, ","))
+	return nil
+}
+
+func TestPatchPeer(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		routesErr error
+		status    int
+		calls     []string
+		message   string
+	}{
+		{
+			name:   "tags and routes",
+			body:   `{"publicKey": "nodekey:a", "tags": ["tag:web"], "routes": ["10.0.0.0/24"]}`,
+			status: http.StatusOK,
+			calls:  []string{"setTags tag:web", "approveRoutes 10.0.0.0/24"},
+		},
+		{
+			name:    "invalid route",
+			body:    `{"publicKey": "nodekey:a", "tags": ["tag:web"], "routes": ["10.0.0.0/24", "nonsense"]}`,
+			status:  http.StatusBadRequest,
+			message: `Invalid route "nonsense"`,
+		},
+		{
+			name:      "route approval failing after the tags",
+			body:      `{"publicKey": "nodekey:a", "tags": ["tag:web"], "routes": ["10.0.0.0/24"]}`,
+			routesErr: errors.New("connection reset"),
+			status:    http.StatusBadGateway,
+			calls:     []string{"setTags tag:web"},
+			message:   "Failed to approveRoutes peer: connection reset (setTags already applied)",
+		},
+		{
+			name:      "route approval rejected",
+			body:      `{"publicKey": "nodekey:a", "routes": ["10.0.0.0/24"]}`,
+			routesErr: &controlplane.APIError{StatusCode: http.StatusBadRequest, Message: "route not advertised"},
+			status:    http.StatusBadRequest,
+			message:   "route not advertised",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manager := &fakeManager{routesErr: test.routesErr}
+			peerManager = manager
+			defer func() { peerManager = nil }()
+
+			recorder := httptest.NewRecorder()
+			handleChangePeer(recorder, httptest.NewRequest(http.MethodPatch, "/peer", strings.NewReader(test.body)))
+			if recorder.Code != test.status {
+				t.Fatalf("Got status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if !slices.Equal(manager.calls, test.calls) {
+				t.Errorf("Got calls %q, want %q", manager.calls, test.calls)
+			}
+			if test.message == "" {
+				return
+			}
+			var response ErrorResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error.Message != test.message {
+				t.Errorf("Got message %q, want %q", response.Error.Message, test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// probeConcurrency limits how many peers are pinged at once
+const probeConcurrency = 8
+
+// ProbeSample is the result of one probe of a peer
+type ProbeSample struct {
+	Time       time.Time `json:"time"`
+	Success    bool      `json:"success"`
+	LatencyMs  float64   `json:"latencyMs,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Endpoint   string    `json:"endpoint,omitempty"`
+	DERPRegion string    `json:"derpRegion,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// PeerLatency summarizes the probe history of a peer
+type PeerLatency struct {
+	PublicKey   string  `json:"publicKey"`
+	Hostname    string  `json:"hostname"`
+	Samples     int     `json:"samples"`
+	Successes   int     `json:"successes"`
+	LossPercent float64 `json:"lossPercent"`
+	MinMs       float64 `json:"minMs"`
+	P50Ms       float64 `json:"p50Ms"`
+	P90Ms       float64 `json:"p90Ms"`
+	P99Ms       float64 `json:"p99Ms"`
+	MaxMs       float64 `json:"maxMs"`
+	Path        string  `json:"path,omitempty"`
+	Endpoint    string  `json:"endpoint,omitempty"`
+	DERPRegion  string  `json:"derpRegion,omitempty"`
+	// Relayed is set while the latest successful probe went through DERP,
+	// whether or not the peer was ever reached directly
+	Relayed bool `json:"relayed"`
+	// DERPFallback is set while a peer that was reached directly is only
+	// reached through DERP
+	DERPFallback bool          `json:"derpFallback"`
+	History      []ProbeSample `json:"history,omitempty"`
+}
+
+// probeHistory is the rolling history of one peer
+type probeHistory struct {
+	hostname string
+	samples  []ProbeSample
+	// everDirect records whether the peer was reached directly, so a later
+	// DERP path is a fallback rather than how the peer is always reached
+	everDirect   bool
+	derpFallback bool
+}
+
+// peerProber pings peers in the background and keeps their latency history
+type peerProber struct {
+	peers    []string
+	interval time.Duration
+	pingType string
+	size     int
+
+	mu      sync.Mutex
+	history map[string]*probeHistory
+}
+
+var prober *peerProber
+
+// newPeerProber creates a prober for the given peers, or all online peers if
+// none are given, keeping size samples per peer
+func newPeerProber(peers []string, interval time.Duration, pingType string, size int) *peerProber {
+	return &peerProber{
+		peers:    peers,
+		interval: interval,
+		pingType: pingType,
+		size:     size,
+		history:  make(map[string]*probeHistory),
+	}
+}
+
+func (p *peerProber) run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.probe(); err != nil {
+			logger.Warn("Peer probe failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe pings every target peer once
+func (p *peerProber) probe() error {
+	status, err := tsClient.Status()
+	if err != nil {
+		return fmt.Errorf("failed to get Tailscale status: %v", err)
+	}
+
+	var targets []tailscale.PeerInfo
+	if len(p.peers) == 0 {
+		for _, peer := range status.Peers {
+			if peer.Online {
+				targets = append(targets, peer)
+			}
+		}
+	} else {
+		for _, id := range p.peers {
+			if peer, ok := findPeer(status.Peers, id); ok {
+				targets = append(targets, peer)
+			} else {
+				logger.Debug("Probed peer %s is not in the tailnet", id)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, probeConcurrency)
+	for _, peer := range targets {
+		if peer.TailscaleIPs == "" {
+			continue
+		}
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(peer tailscale.PeerInfo) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			p.record(peer, p.ping(peer))
+		}(peer)
+	}
+	wg.Wait()
+
+	p.evict(status.Peers)
+	return nil
+}
+
+// evict drops the history of peers that left the tailnet, so it doesn't
+// grow with every peer ever seen
+func (p *peerProber) evict(peers []tailscale.PeerInfo) {
+	current := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		current[peer.PublicKey] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, history := range p.history {
+		if !current[key] {
+			logger.Debug("Dropping probe history of departed peer %s", history.hostname)
+			delete(p.history, key)
+		}
+	}
+}
+
+func (p *peerProber) ping(peer tailscale.PeerInfo) ProbeSample {
+	sample := ProbeSample{Time: time.Now()}
+	result, err := tsClient.PingDetailType(peer.TailscaleIPs, p.pingType)
+	if err != nil {
+		sample.Error = err.Error()
+		return sample
+	}
+	sample.Success = result.Success
+	sample.LatencyMs = result.LatencyMs
+	sample.Path = result.Path
+	sample.Endpoint = result.Endpoint
+	sample.DERPRegion = result.DERPRegion
+	sample.Error = result.Error
+	return sample
+}
+
+// record adds a sample to the peer's history and flags DERP fallbacks
+func (p *peerProber) record(peer tailscale.PeerInfo, sample ProbeSample) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	history, ok := p.history[peer.PublicKey]
+	if !ok {
+		history = &probeHistory{}
+		p.history[peer.PublicKey] = history
+	}
+	history.hostname = peer.Hostname
+	history.samples = append(history.samples, sample)
+	if len(history.samples) > p.size {
+		history.samples = history.samples[len(history.samples)-p.size:]
+	}
+
+	switch sample.Path {
+	case tailscale.PathDirect:
+		if history.derpFallback {
+			logger.Info("Peer %s is reachable directly again via %s", peer.Hostname, sample.Endpoint)
+		}
+		history.everDirect = true
+		history.derpFallback = false
+	case tailscale.PathDERP:
+		if history.everDirect && !history.derpFallback {
+			logger.Warn("Peer %s fell back to DERP relay %s", peer.Hostname, sample.DERPRegion)
+		}
+		history.derpFallback = history.everDirect
+	}
+}
+
+// latency summarizes the history of a peer
+func (p *peerProber) latency(publicKey string, withHistory bool) (*PeerLatency, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	history, ok := p.history[publicKey]
+	if !ok {
+		return nil, false
+	}
+
+	summary := &PeerLatency{
+		PublicKey:    publicKey,
+		Hostname:     history.hostname,
+		Samples:      len(history.samples),
+		DERPFallback: history.derpFallback,
+	}
+	var latencies []float64
+	for _, sample := range history.samples {
+		if !sample.Success {
+			continue
+		}
+		summary.Successes++
+		latencies = append(latencies, sample.LatencyMs)
+		if sample.Path != "" {
+			summary.Path = sample.Path
+			summary.Endpoint = sample.Endpoint
+			summary.DERPRegion = sample.DERPRegion
+		}
+	}
+	summary.Relayed = summary.Path == tailscale.PathDERP
+	if summary.Samples > 0 {
+		summary.LossPercent = 100 * float64(summary.Samples-summary.Successes) / float64(summary.Samples)
+	}
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		summary.MinMs = latencies[0]
+		summary.P50Ms = percentile(latencies, 50)
+		summary.P90Ms = percentile(latencies, 90)
+		summary.P99Ms = percentile(latencies, 99)
+		summary.MaxMs = latencies[len(latencies)-1]
+	}
+	if withHistory {
+		summary.History = slices.Clone(history.samples)
+	}
+	return summary, true
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func handlePeerLatency(w http.ResponseWriter, r *http.Request) {
+	if prober == nil {
+		writeError(w, r, http.StatusNotImplemented, errCodeNotImplemented, "Peer probing is disabled, set probe-interval to enable it")
+		return
+	}
+
+	status, err := tailscaleClient(r.Context()).Status()
+	if err != nil {
+		writeStatusError(w, r, err)
+		return
+	}
+	id := r.PathValue("id")
+	peer, ok := findPeer(status.Peers, id)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Peer not found")
+		return
+	}
+
+	latency, ok := prober.latency(peer.PublicKey, r.URL.Query().Get("history") != "false")
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Peer %s has not been probed yet", id)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, latency)
+}
+
+// proberMetrics exports the latency percentiles, loss and DERP fallback of probed peers
+func proberMetrics() []metrics.Metric {
+	if prober == nil {
+		return nil
+	}
+
+	prober.mu.Lock()
+	keys := make([]string, 0, len(prober.history))
+	for key := range prober.history {
+		keys = append(keys, key)
+	}
+	prober.mu.Unlock()
+	slices.Sort(keys)
+
+	latency := metrics.Metric{
+		Name: "gerbil_peer_latency_seconds",
+		Help: "Round trip time percentiles of the probes in each peer's history.",
+		Type: metrics.Gauge,
+	}
+	loss := metrics.Metric{
+		Name: "gerbil_peer_probe_loss_ratio",
+		Help: "Share of failed probes in each peer's history.",
+		Type: metrics.Gauge,
+	}
+	relayed := metrics.Metric{
+		Name: "gerbil_peer_relayed",
+		Help: "Whether the latest successful probe of a peer went through DERP.",
+		Type: metrics.Gauge,
+	}
+	fallback := metrics.Metric{
+		Name: "gerbil_peer_derp_fallback",
+		Help: "Whether a peer that was reachable directly is now only reachable through DERP.",
+		Type: metrics.Gauge,
+	}
+	for _, key := range keys {
+		summary, ok := prober.latency(key, false)
+		if !ok {
+			continue
+		}
+		labels := func(extra ...string) map[string]string {
+			l := map[string]string{"peer": summary.Hostname, "public_key": key}
+			for i := 0; i+1 < len(extra); i += 2 {
+				l[extra[i]] = extra[i+1]
+			}
+			return l
+		}
+		if summary.Successes > 0 {
+			for _, q := range []struct {
+				quantile string
+				ms       float64
+			}{{"0.5", summary.P50Ms}, {"0.9", summary.P90Ms}, {"0.99", summary.P99Ms}} {
+				latency.Samples = append(latency.Samples, metrics.Sample{Labels: labels("quantile", q.quantile), Value: q.ms / 1000})
+			}
+		}
+		loss.Samples = append(loss.Samples, metrics.Sample{Labels: labels(), Value: summary.LossPercent / 100})
+		relayed.Samples = append(relayed.Samples, metrics.Sample{Labels: labels(), Value: metrics.Bool(summary.Relayed)})
+		fallback.Samples = append(fallback.Samples, metrics.Sample{Labels: labels(), Value: metrics.Bool(summary.DERPFallback)})
+	}
+	return []metrics.Metric{latency, loss, relayed, fallback}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+func TestProberDERPPath(t *testing.T) {
+	direct := ProbeSample{Success: true, LatencyMs: 5, Path: tailscale.PathDirect, Endpoint: "198.51.100.2:41641"}
+	derp := ProbeSample{Success: true, LatencyMs: 40, Path: tailscale.PathDERP, DERPRegion: "fra"}
+	failed := ProbeSample{Error: "timeout"}
+
+	tests := []struct {
+		name     string
+		samples  []ProbeSample
+		relayed  bool
+		fallback bool
+	}{
+		{name: "always direct", samples: []ProbeSample{direct, direct}},
+		{name: "always relayed", samples: []ProbeSample{derp, derp}, relayed: true},
+		{name: "fell back to DERP", samples: []ProbeSample{direct, derp}, relayed: true, fallback: true},
+		{name: "direct again", samples: []ProbeSample{direct, derp, direct}},
+		{name: "failed probe keeps the last path", samples: []ProbeSample{derp, failed}, relayed: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newPeerProber(nil, time.Minute, "disco", 10)
+			peer := tailscale.PeerInfo{PublicKey: "nodekey:peer", Hostname: "peer"}
+			for _, sample := range test.samples {
+				p.record(peer, sample)
+			}
+
+			summary, ok := p.latency(peer.PublicKey, false)
+			if !ok {
+				t.Fatal("Peer has no history")
+			}
+			if summary.Relayed != test.relayed || summary.DERPFallback != test.fallback {
+				t.Errorf("Got relayed %t and fallback %t, want %t and %t", summary.Relayed, summary.DERPFallback, test.relayed, test.fallback)
+			}
+		})
+	}
+}
+
+func TestProberEvictsDepartedPeers(t *testing.T) {
+	fakeTailscaleCLI(t, testStatusJSON)
+
+	p := newPeerProber(nil, time.Minute, "disco", 10)
+	p.record(tailscale.PeerInfo{PublicKey: "nodekey:exit", Hostname: "exit"}, ProbeSample{Success: true, LatencyMs: 5})
+	p.record(tailscale.PeerInfo{PublicKey: "nodekey:gone", Hostname: "gone"}, ProbeSample{Success: true, LatencyMs: 5})
+
+	if err := p.probe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.latency("nodekey:gone", false); ok {
+		t.Error("Kept the history of a peer that left the tailnet")
+	}
+	if summary, ok := p.latency("nodekey:exit", false); !ok || summary.Samples != 2 {
+		t.Errorf("Got %+v for a peer still in the tailnet, want its history plus the new probe", summary)
+	}
+	// Offline peers aren't probed, but their history stays until they leave
+	p.record(tailscale.PeerInfo{PublicKey: "nodekey:laptop", Hostname: "laptop"}, ProbeSample{Success: true, LatencyMs: 5})
+	if err := p.probe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.latency("nodekey:laptop", false); !ok {
+		t.Error("Dropped the history of an offline peer")
+	}
+}
+
+func TestPeerLatencyContract(t *testing.T) {
+	fakeTailscaleCLI(t, testStatusJSON)
+	spec := loadOpenAPI(t)
+
+	prober = newPeerProber(nil, time.Minute, "disco", 10)
+	defer func() { prober = nil }()
+	prober.record(tailscale.PeerInfo{PublicKey: "nodekey:exit", Hostname: "exit"}, ProbeSample{Time: time.Now(), Success: true, LatencyMs: 40, Path: tailscale.PathDERP, DERPRegion: "fra"})
+
+	mux := http.NewServeMux()
+	registerAPI(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiPrefix+"/peers/exit/latency", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got status %d: %s", w.Code, w.Body)
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := spec.responseSchema("/peers/{id}/latency", http.MethodGet, w.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.validate(schema, body, "response"); err != nil {
+		t.Errorf("Response doesn't match the OpenAPI document: %v", err)
+	}
+	if relayed := body.(map[string]interface{})["relayed"]; relayed != true {
+		t.Errorf("Got relayed %v for a peer reached through DERP", relayed)
+	}
+}
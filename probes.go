@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// probeCheckTimeout bounds each component check of a probe
+const probeCheckTimeout = 5 * time.Second
+
+// Statuses of a probe and its checks
+const (
+	checkOK = "ok"
+	// checkDegraded is a check that is failing but still within its grace period
+	checkDegraded = "degraded"
+	checkFail     = "fail"
+)
+
+// processStart is when the process started, for uptimes
+var processStart = time.Now()
+
+// ProbeResponse is the body of /livez and /readyz
+type ProbeResponse struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// CheckResult is the outcome of one component check
+type CheckResult struct {
+	Name         string     `json:"name"`
+	Status       string     `json:"status"`
+	LatencyMs    float64    `json:"latencyMs"`
+	Message      string     `json:"message,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	LastErrorAt  *time.Time `json:"lastErrorAt,omitempty"`
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+}
+
+// componentCheck checks one component and remembers its failures across
+// probes, so it only fails once it has been failing for its grace period
+type componentCheck struct {
+	name  string
+	grace time.Duration
+	// check returns a short message on success
+	check func(ctx context.Context) (string, error)
+	// now is the clock, time.Now unless replaced by tests
+	now func() time.Time
+
+	mu           sync.Mutex
+	failingSince time.Time
+	lastError    string
+	lastErrorAt  time.Time
+}
+
+func (c *componentCheck) run(ctx context.Context) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, probeCheckTimeout)
+	defer cancel()
+
+	type outcome struct {
+		message string
+		err     error
+	}
+	clock := c.now
+	if clock == nil {
+		clock = time.Now
+	}
+	start := clock()
+	done := make(chan outcome, 1)
+	go func() {
+		message, err := c.check(ctx)
+		done <- outcome{message, err}
+	}()
+	var result outcome
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result.err = fmt.Errorf("check timed out after %s", probeCheckTimeout)
+	}
+	now := clock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	check := CheckResult{
+		Name:      c.name,
+		Status:    checkOK,
+		LatencyMs: float64(now.Sub(start).Microseconds()) / 1000,
+		Message:   result.message,
+	}
+	if result.err != nil {
+		c.lastError = result.err.Error()
+		c.lastErrorAt = now
+		if c.failingSince.IsZero() {
+			c.failingSince = now
+		}
+		check.Status = checkDegraded
+		if now.Sub(c.failingSince) >= c.grace {
+			check.Status = checkFail
+		}
+		failingSince := c.failingSince
+		check.FailingSince = &failingSince
+	} else {
+		c.failingSince = time.Time{}
+	}
+	if c.lastError != "" {
+		lastErrorAt := c.lastErrorAt
+		check.LastError = c.lastError
+		check.LastErrorAt = &lastErrorAt
+	}
+	return check
+}
+
+// healthProbe runs a set of checks concurrently
+type healthProbe struct {
+	checks []*componentCheck
+}
+
+func (p *healthProbe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	results := make([]CheckResult, len(p.checks))
+	var wg sync.WaitGroup
+	for i, check := range p.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = check.run(r.Context())
+		}()
+	}
+	wg.Wait()
+
+	response := ProbeResponse{Status: checkOK, Checks: results}
+	for _, result := range results {
+		if result.Status == checkFail {
+			response.Status = checkFail
+		}
+	}
+	status := http.StatusOK
+	if response.Status == checkFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, response)
+}
+
+// livenessProbe only shows that the process and its HTTP loop are
+// serving. It doesn't depend on Tailscale, so a control plane outage
+// doesn't get the process restarted.
+func livenessProbe() *healthProbe {
+	return &healthProbe{checks: []*componentCheck{{
+		name: "process",
+		check: func(ctx context.Context) (string, error) {
+			return fmt.Sprintf("up %s", time.Since(processStart).Round(time.Second)), nil
+		},
+	}}}
+}
+
+// readinessProbe checks everything the node needs to do its job
+func readinessProbe(cfg Config) *healthProbe {
+	p := &healthProbe{checks: []*componentCheck{{
+		name:  "tailscale",
+		grace: cfg.ReadyGracePeriod,
+		check: checkTailscale,
+	}}}
+	if cfg.RemoteConfigURL != "" {
+		p.checks = append(p.checks, &componentCheck{
+			name:  "config",
+			check: remoteConfigStatus.check(0),
+		}, &componentCheck{
+			name:  "bandwidth",
+			check: bandwidthReportStatus.check(cfg.BandwidthMaxAge),
+		})
+	}
+	return p
+}
+
+// checkTailscale requires the node to be logged in with its backend Running
+func checkTailscale(ctx context.Context) (string, error) {
+	status, err := tailscaleClient(ctx).Status()
+	if err != nil {
+		return "", err
+	}
+	if err := status.CheckLoggedIn(); err != nil {
+		return "", err
+	}
+	if status.BackendState != tailscale.StateRunning {
+		return "", fmt.Errorf("backend is %s", status.BackendState)
+	}
+	return "logged in and running", nil
+}
+
+// taskStatus records the outcome of a recurring task, such as the
+// bandwidth reports
+type taskStatus struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	lastError   error
+	// now is the clock, time.Now unless replaced by tests
+	now func() time.Time
+}
+
+var (
+	remoteConfigStatus    taskStatus
+	bandwidthReportStatus taskStatus
+)
+
+// record stores the outcome of one run of the task
+func (s *taskStatus) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+	if err == nil {
+		s.lastSuccess = s.clock()
+	}
+}
+
+func (s *taskStatus) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// check fails until the task has succeeded, and when maxAge is set, once
+// its last success is older than that. The age is counted from process start
+// until the first run, so a task doesn't fail before it had a chance to run.
+func (s *taskStatus) check(maxAge time.Duration) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.lastSuccess.IsZero() {
+			if maxAge > 0 && s.clock().Sub(processStart) < maxAge {
+				return "waiting for the first run", nil
+			}
+			if s.lastError != nil {
+				return "", s.lastError
+			}
+			return "", errors.New("has not succeeded yet")
+		}
+		age := s.clock().Sub(s.lastSuccess)
+		if maxAge > 0 && age > maxAge {
+			if s.lastError != nil {
+				return "", fmt.Errorf("last success %s ago: %v", age.Round(time.Second), s.lastError)
+			}
+			return "", fmt.Errorf("last success %s ago", age.Round(time.Second))
+		}
+		return fmt.Sprintf("last success %s ago", age.Round(time.Second)), nil
+	}
+}
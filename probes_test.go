@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when told to
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func TestComponentCheckGracePeriod(t *testing.T) {
+	errDown := errors.New("down")
+	type step struct {
+		// after is how long after the previous step the check runs
+		after  time.Duration
+		err    error
+		status string
+	}
+	tests := []struct {
+		name  string
+		grace time.Duration
+		steps []step
+	}{
+		{
+			name:  "healthy",
+			grace: time.Minute,
+			steps: []step{{status: checkOK}, {after: time.Hour, status: checkOK}},
+		},
+		{
+			name:  "failing within and after the grace period",
+			grace: time.Minute,
+			steps: []step{
+				{err: errDown, status: checkDegraded},
+				{after: 59 * time.Second, err: errDown, status: checkDegraded},
+				{after: time.Second, err: errDown, status: checkFail},
+				{after: time.Hour, err: errDown, status: checkFail},
+			},
+		},
+		{
+			name:  "recovery restarts the grace period",
+			grace: time.Minute,
+			steps: []step{
+				{err: errDown, status: checkDegraded},
+				{after: time.Minute, err: errDown, status: checkFail},
+				{after: time.Second, status: checkOK},
+				{after: time.Second, err: errDown, status: checkDegraded},
+				{after: 30 * time.Second, err: errDown, status: checkDegraded},
+			},
+		},
+		{
+			name:  "no grace period",
+			steps: []step{{err: errDown, status: checkFail}, {status: checkOK}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+			var err error
+			check := &componentCheck{
+				name:  "component",
+				grace: test.grace,
+				check: func(context.Context) (string, error) { return "fine", err },
+				now:   clock.Now,
+			}
+			var failedAt time.Time
+			for i, step := range test.steps {
+				clock.Add(step.after)
+				err = step.err
+				result := check.run(context.Background())
+				if result.Status != step.status {
+					t.Fatalf("Step %d: got %s, want %s", i, result.Status, step.status)
+				}
+				if step.err == nil {
+					if result.FailingSince != nil {
+						t.Errorf("Step %d: got failing since %v while healthy", i, result.FailingSince)
+					}
+					continue
+				}
+				if failedAt.IsZero() || test.steps[i-1].err == nil {
+					failedAt = clock.Now()
+				}
+				if result.FailingSince == nil || !result.FailingSince.Equal(failedAt) {
+					t.Errorf("Step %d: got failing since %v, want %v", i, result.FailingSince, failedAt)
+				}
+				if result.LastError != "down" || !result.LastErrorAt.Equal(clock.Now()) {
+					t.Errorf("Step %d: got last error %q at %v", i, result.LastError, result.LastErrorAt)
+				}
+			}
+		})
+	}
+}
+
+func TestComponentCheckKeepsLastError(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := errors.New("down")
+	check := &componentCheck{
+		name:  "component",
+		check: func(context.Context) (string, error) { return "fine", err },
+		now:   clock.Now,
+	}
+	check.run(context.Background())
+	failedAt := clock.Now()
+
+	clock.Add(time.Minute)
+	err = nil
+	result := check.run(context.Background())
+	if result.Status != checkOK || result.Message != "fine" {
+		t.Errorf("Got %+v, want ok", result)
+	}
+	if result.LastError != "down" || !result.LastErrorAt.Equal(failedAt) {
+		t.Errorf("Got last error %q at %v, want the earlier failure", result.LastError, result.LastErrorAt)
+	}
+}
+
+func TestTaskStatusCheck(t *testing.T) {
+	errFailed := errors.New("connection refused")
+	tests := []struct {
+		name   string
+		maxAge time.Duration
+		// since is how long after process start the check runs
+		since time.Duration
+		// succeeded is how long after process start the task last succeeded
+		succeeded *time.Duration
+		err       error
+		want      string
+		fails     bool
+	}{
+		{name: "before the first run", maxAge: time.Minute, since: 30 * time.Second, want: "waiting for the first run"},
+		{name: "first run failed within max age", maxAge: time.Minute, since: 30 * time.Second, err: errFailed, want: "waiting for the first run"},
+		{name: "no run within max age", maxAge: time.Minute, since: 2 * time.Minute, fails: true, want: "has not succeeded yet"},
+		{name: "first run failed after max age", maxAge: time.Minute, since: 2 * time.Minute, err: errFailed, fails: true, want: "connection refused"},
+		{name: "no max age", fails: true, want: "has not succeeded yet"},
+		{name: "fresh", maxAge: time.Minute, since: 2 * time.Minute, succeeded: durationPtr(90 * time.Second), want: "last success 30s ago"},
+		{name: "stale", maxAge: time.Minute, since: 3 * time.Minute, succeeded: durationPtr(90 * time.Second), fails: true, want: "last success 1m30s ago"},
+		{name: "stale and failing", maxAge: time.Minute, since: 3 * time.Minute, succeeded: durationPtr(90 * time.Second), err: errFailed, fails: true, want: "last success 1m30s ago: connection refused"},
+		{name: "never stale without max age", since: time.Hour, succeeded: durationPtr(time.Second), err: errFailed, want: "last success 59m59s ago"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := &fakeClock{t: processStart}
+			status := &taskStatus{now: clock.Now}
+			if test.succeeded != nil {
+				clock.Add(*test.succeeded)
+				status.record(nil)
+			}
+			if test.err != nil {
+				status.record(test.err)
+			}
+			clock.t = processStart.Add(test.since)
+
+			message, err := status.check(test.maxAge)(context.Background())
+			if test.fails {
+				if err == nil || err.Error() != test.want {
+					t.Errorf("Got %q and %v, want error %q", message, err, test.want)
+				}
+				return
+			}
+			if err != nil || message != test.want {
+				t.Errorf("Got %q and %v, want %q", message, err, test.want)
+			}
+		})
+	}
+}
+
+func TestTaskStatusRecovers(t *testing.T) {
+	clock := &fakeClock{t: processStart}
+	status := &taskStatus{now: clock.Now}
+	check := &componentCheck{name: "bandwidth", check: status.check(time.Minute), now: clock.Now}
+
+	status.record(nil)
+	clock.Add(2 * time.Minute)
+	status.record(errors.New("timeout"))
+	if result := check.run(context.Background()); result.Status != checkFail || !strings.Contains(result.LastError, "timeout") {
+		t.Errorf("Got %+v, want a stale failure", result)
+	}
+
+	clock.Add(time.Second)
+	status.record(nil)
+	if result := check.run(context.Background()); result.Status != checkOK || result.Message != "last success 0s ago" {
+		t.Errorf("Got %+v, want recovered", result)
+	}
+}
+
+func TestHealthProbeStatus(t *testing.T) {
+	fails := func(context.Context) (string, error) { return "", errors.New("down") }
+	succeeds := func(context.Context) (string, error) { return "fine", nil }
+	tests := []struct {
+		name   string
+		checks []*componentCheck
+		code   int
+		status string
+	}{
+		{name: "all ok", checks: []*componentCheck{{name: "a", check: succeeds}, {name: "b", check: succeeds}}, code: http.StatusOK, status: checkOK},
+		{name: "degraded stays ready", checks: []*componentCheck{{name: "a", check: succeeds}, {name: "b", grace: time.Hour, check: fails}}, code: http.StatusOK, status: checkOK},
+		{name: "failing", checks: []*componentCheck{{name: "a", check: succeeds}, {name: "b", check: fails}}, code: http.StatusServiceUnavailable, status: checkFail},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			(&healthProbe{checks: test.checks}).ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+			var response ProbeResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if recorder.Code != test.code || response.Status != test.status || len(response.Checks) != len(test.checks) {
+				t.Errorf("Got %d with %+v, want %d and %s", recorder.Code, response, test.code, test.status)
+			}
+			for i, check := range response.Checks {
+				if check.Name != test.checks[i].name {
+					t.Errorf("Got check %s at %d, want %s", check.Name, i, test.checks[i].name)
+				}
+			}
+		})
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+var (
+	// routesFile persists the desired set of advertised subnet routes
+	routesFile string
+	routesMu   sync.Mutex
+)
+
+// RouteInfo describes one subnet route of this node
+type RouteInfo struct {
+	Prefix     string `json:"prefix"`
+	Advertised bool   `json:"advertised"`
+	Approved   bool   `json:"approved"`
+}
+
+// RoutesResponse lists the subnet routes of this node
+type RoutesResponse struct {
+	Routes []RouteInfo `json:"routes"`
+}
+
+// RoutesRequest is the body of PUT, POST and DELETE requests on /routes
+type RoutesRequest struct {
+	Routes []string `json:"routes"`
+}
+
+// errRouteConflict marks a route that overlaps one already advertised
+var errRouteConflict = errors.New("route overlaps an advertised route")
+
+// handleRoutes lists the subnet routes on GET. PUT replaces the advertised
+// routes, POST adds to them and DELETE removes from them.
+var handleRoutes = allowMethods(map[string]http.HandlerFunc{
+	http.MethodGet:    handleGetRoutes,
+	http.MethodPut:    handleChangeRoutes,
+	http.MethodPost:   handleChangeRoutes,
+	http.MethodDelete: handleChangeRoutes,
+})
+
+func handleGetRoutes(w http.ResponseWriter, r *http.Request) {
+	writeRoutes(w, r)
+}
+
+func handleChangeRoutes(w http.ResponseWriter, r *http.Request) {
+	var request RoutesRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Invalid request body: %v", err)
+			return
+		}
+	}
+	request.Routes = append(request.Routes, r.URL.Query()["route"]...)
+
+	requested, err := parseRoutes(request.Routes)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "%v", err)
+		return
+	}
+	if len(requested) == 0 && r.Method != http.MethodPut {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "No routes given")
+		return
+	}
+
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	current, err := advertisedSubnetRoutes(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to get routes: %v", err)
+		return
+	}
+
+	var desired []netip.Prefix
+	switch r.Method {
+	case http.MethodPut:
+		desired = requested
+	case http.MethodPost:
+		desired, err = addRoutes(current, requested)
+	case http.MethodDelete:
+		desired = removeRoutes(current, requested)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusConflict, errCodeConflict, "%v", err)
+		return
+	}
+
+	if err := applyRoutes(r.Context(), desired); err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to set routes: %v", err)
+		return
+	}
+	logger.Info("Advertised routes set to %v", desired)
+
+	writeRoutes(w, r)
+}
+
+// writeRoutes responds with the advertised and approved routes
+func writeRoutes(w http.ResponseWriter, r *http.Request) {
+	advertised, err := advertisedSubnetRoutes(r.Context())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to get routes: %v", err)
+		return
+	}
+	approved, err := tailscaleClient(r.Context()).GetApprovedRoutes()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, errCodeTailscale, "Failed to get approved routes: %v", err)
+		return
+	}
+
+	routes := []RouteInfo{}
+	for _, prefix := range advertised {
+		routes = append(routes, RouteInfo{
+			Prefix:     prefix.String(),
+			Advertised: true,
+			Approved:   slices.Contains(approved, prefix.String()),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, RoutesResponse{Routes: routes})
+}
+
+// parseRoutes validates subnet routes; exit node routes are managed separately
+func parseRoutes(routes []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %q: %v", route, err)
+		}
+		if prefix != prefix.Masked() {
+			return nil, fmt.Errorf("invalid route %q: host bits set, did you mean %s?", route, prefix.Masked())
+		}
+		if prefix.Bits() == 0 {
+			return nil, fmt.Errorf("invalid route %q: use the exit node settings to route all traffic", route)
+		}
+		for _, other := range prefixes {
+			if other.Overlaps(prefix) {
+				return nil, fmt.Errorf("route %s overlaps %s", prefix, other)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// addRoutes adds routes to the current set, rejecting overlaps
+func addRoutes(current, added []netip.Prefix) ([]netip.Prefix, error) {
+	routes := slices.Clone(current)
+	for _, prefix := range added {
+		if slices.Contains(routes, prefix) {
+			continue
+		}
+		for _, other := range routes {
+			if other.Overlaps(prefix) {
+				return nil, fmt.Errorf("%w: %s overlaps %s", errRouteConflict, prefix, other)
+			}
+		}
+		routes = append(routes, prefix)
+	}
+	return routes, nil
+}
+
+// removeRoutes returns the current set without the given routes
+func removeRoutes(current, removed []netip.Prefix) []netip.Prefix {
+	return slices.DeleteFunc(slices.Clone(current), func(prefix netip.Prefix) bool {
+		return slices.Contains(removed, prefix)
+	})
+}
+
+// advertisedSubnetRoutes returns the advertised routes without exit node routes
+func advertisedSubnetRoutes(ctx context.Context) ([]netip.Prefix, error) {
+	routes, err := tailscaleClient(ctx).GetRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return subnetRoutes(routes), nil
+}
+
+// subnetRoutes parses routes, leaving out the default routes of an exit node
+func subnetRoutes(routes []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil || prefix.Bits() == 0 {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// applyRoutes advertises the routes and saves them as the desired set
+func applyRoutes(ctx context.Context, prefixes []netip.Prefix) error {
+	routes := []string{}
+	for _, prefix := range prefixes {
+		routes = append(routes, prefix.String())
+	}
+	if err := tailscaleClient(ctx).SetRoutes(routes); err != nil {
+		return err
+	}
+	return saveRoutes(routes)
+}
+
+// saveRoutes writes the desired routes to the routes file
+func saveRoutes(routes []string) error {
+	if routesFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(RoutesRequest{Routes: routes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(routesFile), 0o700); err != nil {
+		return err
+	}
+	// Write and rename so a crash never leaves a truncated file behind
+	tmp := routesFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, routesFile)
+}
+
+// restoreRoutes advertises the routes saved by a previous run the way the
+// API does, so the exit node routes stay advertised
+func restoreRoutes() error {
+	if routesFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(routesFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved RoutesRequest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", routesFile, err)
+	}
+	// The exit node settings own the default routes, so a file edited by
+	// hand can't withdraw or add them
+	routes := slices.DeleteFunc(slices.Clone(saved.Routes), func(route string) bool {
+		prefix, err := netip.ParsePrefix(route)
+		return err == nil && prefix.Bits() == 0
+	})
+	if len(routes) != len(saved.Routes) {
+		logger.Warn("Ignoring exit node routes in %s, use the exit node settings instead", routesFile)
+	}
+	prefixes, err := parseRoutes(routes)
+	if err != nil {
+		return fmt.Errorf("invalid routes in %s: %v", routesFile, err)
+	}
+
+	routesMu.Lock()
+	defer routesMu.Unlock()
+
+	if err := applyRoutes(context.Background(), prefixes); err != nil {
+		return err
+	}
+	logger.Info("Restored advertised routes %v", prefixes)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func prefixes(t *testing.T, routes ...string) []netip.Prefix {
+	t.Helper()
+	var result []netip.Prefix
+	for _, route := range routes {
+		result = append(result, netip.MustParsePrefix(route))
+	}
+	return result
+}
+
+func TestParseRoutes(t *testing.T) {
+	tests := []struct {
+		routes []string
+		// err is part of the error, or empty when the routes are valid
+		err string
+	}{
+		{routes: []string{"10.0.0.0/24", "192.168.0.0/16", "fd00::/64"}},
+		{routes: []string{"10.0.0.1/24"}, err: "host bits set, did you mean 10.0.0.0/24?"},
+		{routes: []string{"fd00::1/64"}, err: "did you mean fd00::/64?"},
+		{routes: []string{"10.0.0.0/8", "10.1.0.0/16"}, err: "route 10.1.0.0/16 overlaps 10.0.0.0/8"},
+		{routes: []string{"10.0.0.0/24", "10.0.0.0/24"}, err: "overlaps"},
+		{routes: []string{"0.0.0.0/0"}, err: "use the exit node settings"},
+		{routes: []string{"::/0"}, err: "use the exit node settings"},
+		{routes: []string{"10.0.0.0"}, err: "invalid route"},
+	}
+	for _, test := range tests {
+		parsed, err := parseRoutes(test.routes)
+		if test.err == "" {
+			if err != nil || len(parsed) != len(test.routes) {
+				t.Errorf("Got %v and %v for %q, want the routes", parsed, err, test.routes)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Got %v for %q, want an error about %q", err, test.routes, test.err)
+		}
+	}
+}
+
+func TestAddRoutes(t *testing.T) {
+	current := prefixes(t, "10.0.0.0/24", "fd00::/64")
+	tests := []struct {
+		added    []string
+		want     []string
+		conflict bool
+	}{
+		// Routes already advertised are kept once
+		{added: []string{"10.0.0.0/24", "10.0.1.0/24"}, want: []string{"10.0.0.0/24", "fd00::/64", "10.0.1.0/24"}},
+		{added: []string{"10.0.0.0/16"}, conflict: true},
+		{added: []string{"10.0.0.128/25"}, conflict: true},
+		{added: []string{"fd00::/48"}, conflict: true},
+		{added: []string{"fd01::/64"}, want: []string{"10.0.0.0/24", "fd00::/64", "fd01::/64"}},
+	}
+	for _, test := range tests {
+		routes, err := addRoutes(current, prefixes(t, test.added...))
+		if test.conflict {
+			if !errors.Is(err, errRouteConflict) {
+				t.Errorf("Got %v and %v adding %q, want a conflict", routes, err, test.added)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(routes, prefixes(t, test.want...)) {
+			t.Errorf("Got %v and %v adding %q, want %q", routes, err, test.added, test.want)
+		}
+	}
+	if !slices.Equal(current, prefixes(t, "10.0.0.0/24", "fd00::/64")) {
+		t.Errorf("Adding changed the current routes to %v", current)
+	}
+}
+
+func TestRemoveRoutes(t *testing.T) {
+	current := prefixes(t, "10.0.0.0/24", "10.0.1.0/24", "fd00::/64")
+	// Only exact matches go, not routes inside or around them
+	routes := removeRoutes(current, prefixes(t, "10.0.1.0/24", "10.0.0.0/25", "fd00::/48"))
+	if want := prefixes(t, "10.0.0.0/24", "fd00::/64"); !slices.Equal(routes, want) {
+		t.Errorf("Got %v, want %v", routes, want)
+	}
+	if len(current) != 3 {
+		t.Errorf("Removing changed the current routes to %v", current)
+	}
+}
+
+func TestSaveAndRestoreRoutes(t *testing.T) {
+	dir := fakeTailscaleCLI(t, testStatusJSON)
+	prefsFile := filepath.Join(dir, "prefs.json")
+	defer func(file string) { routesFile = file }(routesFile)
+	routesFile = filepath.Join(t.TempDir(), "state", "routes.json")
+
+	if err := restoreRoutes(); err != nil {
+		t.Errorf("Got %v without a routes file, want nothing restored", err)
+	}
+
+	if err := applyRoutes(context.Background(), prefixes(t, "192.168.1.0/24", "fd00::/64")); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(routesFile); err != nil || !strings.Contains(string(content), `"192.168.1.0/24"`) {
+		t.Fatalf("Got routes file %q and %v, want the routes saved", content, err)
+	}
+
+	// A restart finds tailscaled advertising other routes and an exit node
+	tests := []struct {
+		name  string
+		saved string
+	}{
+		{name: "saved routes"},
+		{name: "saved with an exit node route", saved: `{"routes": ["192.168.1.0/24", "0.0.0.0/0", "fd00::/64"]}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.saved != "" {
+				if err := os.WriteFile(routesFile, []byte(test.saved), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(prefsFile, []byte(testPrefsJSON), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := restoreRoutes(); err != nil {
+				t.Fatal(err)
+			}
+
+			routes, err := tsClient.GetRoutes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"192.168.1.0/24", "fd00::/64", "0.0.0.0/0", "::/0"}
+			if !slices.Equal(routes, want) {
+				t.Errorf("Got advertised routes %q, want %q with the exit node routes kept", routes, want)
+			}
+		})
+	}
+
+	if err := os.WriteFile(routesFile, []byte(`{"routes": ["10.0.0.1/24"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restoreRoutes(); err == nil {
+		t.Error("Restored invalid routes")
+	}
+}
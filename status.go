@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// StatusResponse is served by GET /api/v1/status
+type StatusResponse struct {
+	// Version is the Gerbil build
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"startedAt"`
+	UptimeSeconds float64   `json:"uptimeSeconds"`
+
+	LoggedIn         bool               `json:"loggedIn"`
+	BackendState     string             `json:"backendState"`
+	TailscaleVersion string             `json:"tailscaleVersion,omitempty"`
+	ControlURL       string             `json:"controlURL,omitempty"`
+	Tailnet          *tailscale.Tailnet `json:"tailnet"`
+	// Self is null when the node is not logged in or tailscaled is down
+	Self       *SelfStatus      `json:"self"`
+	ListenPort int              `json:"listenPort,omitempty"`
+	PeerCount  int              `json:"peerCount"`
+	ExitNode   *ExitNodeInfo    `json:"exitNode"`
+	Routes     RouteStatus      `json:"routes"`
+	Networking NetworkingStatus `json:"networking"`
+
+	// StatusError is why the Tailscale status query failed, such as
+	// daemon_unavailable or needs_login
+	StatusError string `json:"statusError,omitempty"`
+	// Errors holds the parts of the status that couldn't be read, by name.
+	// The rest of the document is still served.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// SelfStatus describes this node
+type SelfStatus struct {
+	Hostname      string     `json:"hostname"`
+	DNSName       string     `json:"dnsName,omitempty"`
+	TailscaleIPs  string     `json:"tailscaleIPs"`
+	Addresses     []string   `json:"addresses"`
+	PublicKey     string     `json:"publicKey"`
+	Online        bool       `json:"online"`
+	KeyExpiry     *time.Time `json:"keyExpiry"`
+	KeyExpiryDays *float64   `json:"keyExpiryDays"`
+}
+
+// RouteStatus lists the subnet routes of this node
+type RouteStatus struct {
+	Advertised []string `json:"advertised"`
+	// Approved are the routes the control plane made this node primary for
+	Approved []string `json:"approved"`
+}
+
+// NetworkingStatus describes how tailscaled is attached to the network
+type NetworkingStatus struct {
+	// Mode is embedded, kernel or userspace, or external for a tailscaled
+	// gerbil didn't launch, whose options it doesn't know
+	Mode        string `json:"mode"`
+	Tun         string `json:"tun,omitempty"`
+	Socks5Proxy string `json:"socks5Proxy,omitempty"`
+	HTTPProxy   string `json:"httpProxy,omitempty"`
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	client := tailscaleClient(r.Context())
+	response := StatusResponse{
+		Version:       buildVersion(),
+		StartedAt:     processStart.UTC(),
+		UptimeSeconds: time.Since(processStart).Round(time.Second).Seconds(),
+		Routes: RouteStatus{
+			Advertised: []string{},
+			Approved:   []string{},
+		},
+		Networking: networkingStatus(),
+		Errors:     make(map[string]string),
+	}
+
+	// Serve what can be read; the status matters most when something is down
+	status, err := client.Status()
+	if err == nil {
+		err = status.CheckLoggedIn()
+	}
+	if err != nil {
+		response.Errors["status"] = err.Error()
+		response.StatusError = tailscale.StatusErrorReason(err)
+	}
+	if status != nil {
+		response.LoggedIn = status.LoggedIn
+		response.BackendState = string(status.BackendState)
+		response.Tailnet = status.Tailnet
+		response.PeerCount = len(status.Peers)
+		if self := status.Self; self != nil {
+			response.Self = &SelfStatus{
+				Hostname:      self.Hostname,
+				DNSName:       self.DNSName,
+				TailscaleIPs:  self.TailscaleIPs,
+				Addresses:     append([]string{}, self.Addresses...),
+				PublicKey:     self.PublicKey,
+				Online:        self.Online,
+				KeyExpiry:     self.KeyExpiry,
+				KeyExpiryDays: keyExpiryDays(*self),
+			}
+			response.Routes.Approved = append(response.Routes.Approved, self.PrimaryRoutes...)
+		}
+		for _, peer := range status.Peers {
+			if peer.ExitNode {
+				response.ExitNode = &ExitNodeInfo{
+					PublicKey: peer.PublicKey,
+					Hostname:  peer.Hostname,
+					IP:        peer.TailscaleIPs,
+					Online:    peer.Online,
+					Active:    true,
+					Location:  peer.Location,
+				}
+			}
+		}
+	}
+
+	if prefs, err := client.GetPrefs(); err != nil {
+		response.Errors["prefs"] = err.Error()
+	} else {
+		response.ControlURL = prefs.ControlURL
+		for _, prefix := range subnetRoutes(prefs.AdvertiseRoutes) {
+			response.Routes.Advertised = append(response.Routes.Advertised, prefix.String())
+		}
+	}
+
+	if tsVersion, err := client.GetVersion(); err != nil {
+		response.Errors["tailscaleVersion"] = err.Error()
+	} else {
+		response.TailscaleVersion = tsVersion
+	}
+
+	// A tailscaled we launched listens on the configured port. Otherwise,
+	// including when 0 left the choice to tailscaled, the port is read from
+	// the endpoints the node advertises.
+	if tsDaemon != nil && daemonConfig.Port != 0 {
+		response.ListenPort = daemonConfig.Port
+	} else if status != nil {
+		response.ListenPort = status.ListenPort
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// networkingStatus describes how tailscaled is attached to the network
+func networkingStatus() NetworkingStatus {
+	if tsEmbedded != nil {
+		return NetworkingStatus{Mode: "embedded"}
+	}
+	if tsDaemon == nil {
+		return NetworkingStatus{Mode: "external"}
+	}
+	if !daemonConfig.Userspace() {
+		return NetworkingStatus{Mode: "kernel", Tun: daemonConfig.Tun}
+	}
+	return NetworkingStatus{
+		Mode:        "userspace",
+		Socks5Proxy: daemonConfig.Socks5Addr,
+		HTTPProxy:   daemonConfig.HTTPProxyAddr,
+	}
+}
+
+// tailscaleStatusMetrics reports why Tailscale status queries fail. It reads
+// the outcomes recorded by the queries made elsewhere rather than querying.
+func tailscaleStatusMetrics() []metrics.Metric {
+	counts := tailscale.StatusErrorCounts()
+	last := tailscale.LastStatusErrorReason()
+
+	failures := metrics.Metric{
+		Name: "gerbil_tailscale_status_errors_total",
+		Help: "Tailscale status queries that failed or found the node logged out, by reason.",
+		Type: metrics.Counter,
+	}
+	for _, reason := range []string{
+		tailscale.ReasonDaemonUnavailable,
+		tailscale.ReasonNeedsLogin,
+		tailscale.ReasonNeedsMachineAuth,
+		tailscale.ReasonStopped,
+		tailscale.ReasonInvalidStatus,
+		tailscale.ReasonOther,
+	} {
+		failures.Samples = append(failures.Samples, metrics.Sample{
+			Labels: map[string]string{"reason": reason},
+			Value:  float64(counts[reason]),
+		})
+	}
+
+	return []metrics.Metric{
+		failures,
+		{
+			Name:    "gerbil_tailscale_daemon_up",
+			Help:    "Whether tailscaled answered the latest status query.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(last != tailscale.ReasonDaemonUnavailable)}},
+		},
+		{
+			Name:    "gerbil_tailscale_logged_in",
+			Help:    "Whether the latest status query succeeded with the node logged in and authorized.",
+			Type:    metrics.Gauge,
+			Samples: []metrics.Sample{{Value: metrics.Bool(last == "")}},
+		},
+	}
+}
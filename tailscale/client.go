@@ -1,32 +1,120 @@
 package tailscale
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/hhftechnology/gerbil/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	localapi "tailscale.com/client/tailscale"
+	"tailscale.com/version"
 )
 
 // Client represents a Tailscale client
-type Client struct{}
+type Client struct {
+	// Socket is the tailscaled socket to talk to; empty uses the CLI default
+	Socket string
+
+	// local is set for an embedded node, which has no CLI to shell out to
+	local *localapi.LocalClient
+
+	// ctx carries the span calls are traced under, set with WithContext
+	ctx context.Context
+}
+
+// WithContext returns a copy of the client whose calls are traced as child
+// spans of the span in ctx
+func (c *Client) WithContext(ctx context.Context) *Client {
+	client := *c
+	client.ctx = ctx
+	return &client
+}
+
+// trace starts a span for a call when the client has a traced context. The
+// returned function ends it with the call's error.
+func (c *Client) trace(name string) func(*error) {
+	_, span := tracing.StartChild(c.ctx, "tailscale."+name, trace.SpanKindClient)
+	if !span.IsRecording() {
+		return func(*error) {}
+	}
+	if c.local != nil {
+		span.SetAttributes(attribute.String("tailscale.mode", "embedded"))
+	} else {
+		span.SetAttributes(attribute.String("tailscale.mode", "cli"))
+	}
+	return func(err *error) {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
 
 // Status represents the Tailscale status
 type Status struct {
-	LoggedIn bool       `json:"loggedIn"`
-	Self     *PeerInfo  `json:"self"`
-	Peers    []PeerInfo `json:"peers"`
+	LoggedIn     bool         `json:"loggedIn"`
+	BackendState BackendState `json:"backendState"`
+	Self         *PeerInfo    `json:"self"`
+	Peers        []PeerInfo   `json:"peers"`
+	// TUN is whether tailscaled uses a kernel TUN device rather than
+	// userspace networking
+	TUN bool `json:"tun"`
+	// Tailnet is nil until the node has joined a tailnet
+	Tailnet *Tailnet `json:"tailnet,omitempty"`
+	// ListenPort is the UDP port WireGuard listens on, or 0 until the node
+	// has found its endpoints
+	ListenPort int `json:"listenPort,omitempty"`
+}
+
+// Tailnet describes the tailnet the node is in
+type Tailnet struct {
+	Name            string `json:"name"`
+	MagicDNSSuffix  string `json:"magicDNSSuffix,omitempty"`
+	MagicDNSEnabled bool   `json:"magicDNSEnabled"`
 }
 
 // PeerInfo represents information about a Tailscale peer
 type PeerInfo struct {
-	PublicKey      string   `json:"publicKey"`
-	Hostname       string   `json:"hostName"`
-	TailscaleIPs   string   `json:"tailscaleIPs"`
-	AllowedIPs     []string `json:"allowedIPs"`
-	Online         bool     `json:"online"`
-	RxBytes        int64    `json:"rxBytes"`
-	TxBytes        int64    `json:"txBytes"`
+	PublicKey      string     `json:"publicKey"`
+	Hostname       string     `json:"hostName"`
+	DNSName        string     `json:"dnsName"`
+	OS             string     `json:"os"`
+	TailscaleIPs   string     `json:"tailscaleIPs"`
+	Addresses      []string   `json:"addresses"`
+	AllowedIPs     []string   `json:"allowedIPs"`
+	PrimaryRoutes  []string   `json:"primaryRoutes,omitempty"`
+	Tags           []string   `json:"tags,omitempty"`
+	Online         bool       `json:"online"`
+	Active         bool       `json:"active"`
+	ExitNode       bool       `json:"exitNode"`
+	ExitNodeOption bool       `json:"exitNodeOption"`
+	CurAddr        string     `json:"curAddr,omitempty"`
+	Relay          string     `json:"relay,omitempty"`
+	RxBytes        int64      `json:"rxBytes"`
+	TxBytes        int64      `json:"txBytes"`
+	Location       *Location  `json:"location,omitempty"`
+	LastSeen       time.Time  `json:"lastSeen"`
+	LastHandshake  time.Time  `json:"lastHandshake"`
+	KeyExpiry      *time.Time `json:"keyExpiry,omitempty"`
+}
+
+// Location is the geographic location a peer reports, if any
+type Location struct {
+	Country     string `json:"country,omitempty"`
+	CountryCode string `json:"countryCode,omitempty"`
+	City        string `json:"city,omitempty"`
+	CityCode    string `json:"cityCode,omitempty"`
 }
 
 // NewClient creates a new Tailscale client
@@ -34,22 +122,43 @@ func NewClient() *Client {
 	return &Client{}
 }
 
-// Status returns the current Tailscale status
-func (c *Client) Status() (*Status, error) {
-	cmd := exec.Command("tailscale", "status", "--json")
-	output, err := cmd.Output()
+// Command returns a tailscale CLI command that talks to the client's daemon
+func (c *Client) Command(args ...string) *exec.Cmd {
+	if c.Socket != "" {
+		args = append([]string{"--socket=" + c.Socket}, args...)
+	}
+	return exec.Command("tailscale", args...)
+}
+
+// statusJSON returns the raw `tailscale status --json` document
+func (c *Client) statusJSON() ([]byte, error) {
+	if c.local != nil {
+		return c.localStatusJSON()
+	}
+	return c.Command("status", "--json").Output()
+}
+
+// Status returns the current Tailscale status. It fails with
+// ErrDaemonUnavailable when tailscaled can't be reached and ErrInvalidStatus
+// when its answer can't be parsed. A node that is logged out still has a
+// status; use CheckLoggedIn to tell whether it is up.
+func (c *Client) Status() (_ *Status, err error) {
+	defer c.trace("Status")(&err)
+	status, err := c.status()
+	recordStatus(status, err)
+	return status, err
+}
+
+func (c *Client) status() (*Status, error) {
+	output, err := c.statusJSON()
 	if err != nil {
-		// If tailscale is not running or not logged in, return a minimal status
-		return &Status{
-			LoggedIn: false,
-			Peers:    []PeerInfo{},
-		}, nil
+		return nil, daemonUnavailable(err)
 	}
 
 	// Parse the JSON output from tailscale status
 	var rawStatus map[string]interface{}
 	if err := json.Unmarshal(output, &rawStatus); err != nil {
-		return nil, fmt.Errorf("failed to parse tailscale status: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStatus, err)
 	}
 
 	status := &Status{
@@ -57,72 +166,34 @@ func (c *Client) Status() (*Status, error) {
 		Peers:    []PeerInfo{},
 	}
 
+	if state, ok := rawStatus["BackendState"].(string); ok {
+		status.BackendState = BackendState(state)
+	}
+	status.TUN, _ = rawStatus["TUN"].(bool)
+
 	// Check if we're logged in
 	if self, ok := rawStatus["Self"].(map[string]interface{}); ok {
 		status.LoggedIn = true
 		
-		selfInfo := &PeerInfo{}
-		if hostName, ok := self["HostName"].(string); ok {
-			selfInfo.Hostname = hostName
-		}
-		if pubKey, ok := self["PublicKey"].(string); ok {
-			selfInfo.PublicKey = pubKey
-		}
-		if online, ok := self["Online"].(bool); ok {
-			selfInfo.Online = online
-		}
-		
-		// Get Tailscale IPs
-		if tailscaleIPs, ok := self["TailscaleIPs"].([]interface{}); ok && len(tailscaleIPs) > 0 {
-			if ip, ok := tailscaleIPs[0].(string); ok {
-				selfInfo.TailscaleIPs = ip
-			}
+		selfInfo := parsePeerInfo(self)
+		status.Self = &selfInfo
+		if addrs, ok := self["Addrs"].([]interface{}); ok {
+			status.ListenPort = listenPort(addrs)
 		}
-		
-		status.Self = selfInfo
+	}
+
+	if tailnet, ok := rawStatus["CurrentTailnet"].(map[string]interface{}); ok {
+		status.Tailnet = &Tailnet{}
+		status.Tailnet.Name, _ = tailnet["Name"].(string)
+		status.Tailnet.MagicDNSSuffix, _ = tailnet["MagicDNSSuffix"].(string)
+		status.Tailnet.MagicDNSEnabled, _ = tailnet["MagicDNSEnabled"].(bool)
 	}
 
 	// Parse peers
 	if peers, ok := rawStatus["Peer"].(map[string]interface{}); ok {
 		for _, peerData := range peers {
 			if peer, ok := peerData.(map[string]interface{}); ok {
-				peerInfo := PeerInfo{}
-				
-				if hostName, ok := peer["HostName"].(string); ok {
-					peerInfo.Hostname = hostName
-				}
-				if pubKey, ok := peer["PublicKey"].(string); ok {
-					peerInfo.PublicKey = pubKey
-				}
-				if online, ok := peer["Online"].(bool); ok {
-					peerInfo.Online = online
-				}
-				
-				// Get Tailscale IPs
-				if tailscaleIPs, ok := peer["TailscaleIPs"].([]interface{}); ok && len(tailscaleIPs) > 0 {
-					if ip, ok := tailscaleIPs[0].(string); ok {
-						peerInfo.TailscaleIPs = ip
-					}
-				}
-				
-				// Get allowed IPs
-				if allowedIPs, ok := peer["AllowedIPs"].([]interface{}); ok {
-					for _, ip := range allowedIPs {
-						if ipStr, ok := ip.(string); ok {
-							peerInfo.AllowedIPs = append(peerInfo.AllowedIPs, ipStr)
-						}
-					}
-				}
-				
-				// Get traffic statistics
-				if rxBytes, ok := peer["RxBytes"].(float64); ok {
-					peerInfo.RxBytes = int64(rxBytes)
-				}
-				if txBytes, ok := peer["TxBytes"].(float64); ok {
-					peerInfo.TxBytes = int64(txBytes)
-				}
-				
-				status.Peers = append(status.Peers, peerInfo)
+				status.Peers = append(status.Peers, parsePeerInfo(peer))
 			}
 		}
 	}
@@ -130,11 +201,151 @@ func (c *Client) Status() (*Status, error) {
 	return status, nil
 }
 
+// listenPort picks the WireGuard port from this node's endpoints. Endpoints
+// on private addresses are the host's own sockets. Public ones may have been
+// found through STUN or port mapping, with a port translated by a NAT, so
+// they are only used when there is no private one.
+func listenPort(addrs []interface{}) int {
+	public := 0
+	for _, addr := range addrs {
+		s, _ := addr.(string)
+		endpoint, err := netip.ParseAddrPort(s)
+		if err != nil || endpoint.Port() == 0 {
+			continue
+		}
+		ip := endpoint.Addr().Unmap()
+		if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			return int(endpoint.Port())
+		}
+		if public == 0 {
+			public = int(endpoint.Port())
+		}
+	}
+	return public
+}
+
+// CheckLoggedIn returns ErrNeedsMachineAuth while a tailnet admin has to
+// approve the node, ErrNeedsLogin when it is otherwise not logged in,
+// ErrStopped when it was taken down with `tailscale down`, and nil when it
+// is logged in and up
+func (s *Status) CheckLoggedIn() error {
+	switch {
+	case s.BackendState == StateNeedsMachineAuth:
+		return ErrNeedsMachineAuth
+	case s.BackendState == StateNeedsLogin, !s.LoggedIn:
+		return ErrNeedsLogin
+	case s.BackendState == StateStopped:
+		// A stopped node keeps its login but isn't on the tailnet
+		return ErrStopped
+	}
+	return nil
+}
+
+// parsePeerInfo extracts a peer from its `tailscale status --json` entry
+func parsePeerInfo(peer map[string]interface{}) PeerInfo {
+	peerInfo := PeerInfo{}
+
+	if hostName, ok := peer["HostName"].(string); ok {
+		peerInfo.Hostname = hostName
+	}
+	if dnsName, ok := peer["DNSName"].(string); ok {
+		peerInfo.DNSName = dnsName
+	}
+	if osName, ok := peer["OS"].(string); ok {
+		peerInfo.OS = osName
+	}
+	if pubKey, ok := peer["PublicKey"].(string); ok {
+		peerInfo.PublicKey = pubKey
+	}
+	if online, ok := peer["Online"].(bool); ok {
+		peerInfo.Online = online
+	}
+	if active, ok := peer["Active"].(bool); ok {
+		peerInfo.Active = active
+	}
+	if exitNode, ok := peer["ExitNode"].(bool); ok {
+		peerInfo.ExitNode = exitNode
+	}
+	if exitNodeOption, ok := peer["ExitNodeOption"].(bool); ok {
+		peerInfo.ExitNodeOption = exitNodeOption
+	}
+
+	// Get Tailscale IPs, the first one is the primary address
+	peerInfo.Addresses = stringList(peer["TailscaleIPs"])
+	if len(peerInfo.Addresses) > 0 {
+		peerInfo.TailscaleIPs = peerInfo.Addresses[0]
+	}
+
+	peerInfo.AllowedIPs = stringList(peer["AllowedIPs"])
+	peerInfo.PrimaryRoutes = stringList(peer["PrimaryRoutes"])
+	peerInfo.Tags = stringList(peer["Tags"])
+
+	// Get the current path to the peer
+	if curAddr, ok := peer["CurAddr"].(string); ok {
+		peerInfo.CurAddr = curAddr
+	}
+	if relay, ok := peer["Relay"].(string); ok {
+		peerInfo.Relay = relay
+	}
+
+	// Get traffic statistics
+	if rxBytes, ok := peer["RxBytes"].(float64); ok {
+		peerInfo.RxBytes = int64(rxBytes)
+	}
+	if txBytes, ok := peer["TxBytes"].(float64); ok {
+		peerInfo.TxBytes = int64(txBytes)
+	}
+
+	// Get the location, which is only known for some exit nodes
+	if location, ok := peer["Location"].(map[string]interface{}); ok {
+		peerInfo.Location = &Location{}
+		peerInfo.Location.Country, _ = location["Country"].(string)
+		peerInfo.Location.CountryCode, _ = location["CountryCode"].(string)
+		peerInfo.Location.City, _ = location["City"].(string)
+		peerInfo.Location.CityCode, _ = location["CityCode"].(string)
+	}
+
+	peerInfo.LastSeen = parseTime(peer["LastSeen"])
+	peerInfo.LastHandshake = parseTime(peer["LastHandshake"])
+
+	// Tagged nodes and nodes with expiry disabled have no key expiry
+	if keyExpiry := parseTime(peer["KeyExpiry"]); !keyExpiry.IsZero() {
+		peerInfo.KeyExpiry = &keyExpiry
+	}
+
+	return peerInfo
+}
+
+// stringList converts a JSON array of strings, skipping anything else
+func stringList(value interface{}) []string {
+	var list []string
+	if items, ok := value.([]interface{}); ok {
+		for _, item := range items {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+	}
+	return list
+}
+
+// parseTime converts an RFC 3339 JSON string, returning the zero time otherwise
+func parseTime(value interface{}) time.Time {
+	str, ok := value.(string)
+	if !ok {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil || t.Year() <= 1 {
+		return time.Time{}
+	}
+	return t
+}
+
 // GetPeerTraffic returns the traffic statistics for a specific peer
 func (c *Client) GetPeerTraffic(publicKey string) (rxBytes, txBytes int64) {
 	// Use tailscale CLI to get detailed peer information
-	cmd := exec.Command("tailscale", "status", "--json")
-	output, err := cmd.Output()
+	output, err := c.statusJSON()
 	if err != nil {
 		return 0, 0
 	}
@@ -164,7 +375,11 @@ func (c *Client) GetPeerTraffic(publicKey string) (rxBytes, txBytes int64) {
 }
 
 // Login logs into Tailscale with the provided auth key
-func (c *Client) Login(authKey string, hostname string, controlURL string) error {
+func (c *Client) Login(authKey string, hostname string, controlURL string) (err error) {
+	defer c.trace("Login")(&err)
+	if c.local != nil {
+		return ErrNotSupportedEmbedded
+	}
 	args := []string{"up", "--authkey", authKey}
 	
 	if hostname != "" {
@@ -175,7 +390,7 @@ func (c *Client) Login(authKey string, hostname string, controlURL string) error
 		args = append(args, "--login-server", controlURL)
 	}
 	
-	cmd := exec.Command("tailscale", args...)
+	cmd := c.Command(args...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to login: %v, output: %s", err, string(output))
@@ -185,8 +400,12 @@ func (c *Client) Login(authKey string, hostname string, controlURL string) error
 }
 
 // Logout logs out from Tailscale
-func (c *Client) Logout() error {
-	cmd := exec.Command("tailscale", "logout")
+func (c *Client) Logout() (err error) {
+	defer c.trace("Logout")(&err)
+	if c.local != nil {
+		return c.localLogout()
+	}
+	cmd := c.Command("logout")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		// Check if already logged out
@@ -199,8 +418,12 @@ func (c *Client) Logout() error {
 }
 
 // GetIP returns the Tailscale IP address of the current node
-func (c *Client) GetIP() (string, error) {
-	cmd := exec.Command("tailscale", "ip", "-4")
+func (c *Client) GetIP() (_ string, err error) {
+	defer c.trace("GetIP")(&err)
+	if c.local != nil {
+		return c.localIP()
+	}
+	cmd := c.Command("ip", "-4")
 	output, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to get Tailscale IP: %v", err)
@@ -211,15 +434,116 @@ func (c *Client) GetIP() (string, error) {
 }
 
 // Ping pings a Tailscale peer
-func (c *Client) Ping(target string) (bool, error) {
-	cmd := exec.Command("tailscale", "ping", "-c", "1", target)
-	err := cmd.Run()
+func (c *Client) Ping(target string) (_ bool, err error) {
+	defer c.trace("Ping")(&err)
+	if c.local != nil {
+		return c.localPing(target)
+	}
+	cmd := c.Command("ping", "-c", "1", target)
+	err = cmd.Run()
 	return err == nil, err
 }
 
+// PingResult describes the outcome of a single ping to a peer
+type PingResult struct {
+	Target     string  `json:"target"`
+	NodeName   string  `json:"nodeName,omitempty"`
+	NodeIP     string  `json:"nodeIP,omitempty"`
+	Success    bool    `json:"success"`
+	LatencyMs  float64 `json:"latencyMs,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	Endpoint   string  `json:"endpoint,omitempty"`
+	DERPRegion string  `json:"derpRegion,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Ping types for PingDetailType. Disco pings go peer to peer below WireGuard
+// and report the path taken; TSMP pings go through WireGuard and prove the
+// peer's Tailscale stack is up.
+const (
+	PingDisco = "disco"
+	PingTSMP  = "TSMP"
+)
+
+const (
+	// PathDirect means the peer was reached over a direct UDP path
+	PathDirect = "direct"
+	// PathDERP means the peer was reached through a DERP relay
+	PathDERP = "derp"
+)
+
+// pongPattern matches `tailscale ping` output such as
+// "pong from host (100.64.0.2) via 203.0.113.5:41641 in 23ms"
+var pongPattern = regexp.MustCompile(`^pong from (\S+) \(([^,)]+)[^)]*\) via (\S+) in (\S+)`)
+
+// PingDetail pings a Tailscale peer once and reports latency and the path used.
+// A failed ping is reported in the result rather than as an error.
+func (c *Client) PingDetail(target string) (*PingResult, error) {
+	return c.PingDetailType(target, PingDisco)
+}
+
+// PingDetailType is PingDetail with the given ping type
+func (c *Client) PingDetailType(target, pingType string) (_ *PingResult, err error) {
+	defer c.trace("PingDetailType")(&err)
+	if c.local != nil {
+		return c.localPingDetail(target, pingType)
+	}
+
+	result := &PingResult{Target: target}
+	args := []string{"ping", "-c", "1", "--until-direct=false"}
+	switch pingType {
+	case PingDisco:
+	case PingTSMP:
+		args = append(args, "--tsmp")
+	default:
+		return nil, fmt.Errorf("unknown ping type %q", pingType)
+	}
+	cmd := c.Command(append(args, target)...)
+	output, err := cmd.CombinedOutput()
+
+	for _, line := range strings.Split(string(output), "\n") {
+		match := pongPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+
+		result.Success = true
+		result.NodeName = match[1]
+		result.NodeIP = match[2]
+		if latency, err := time.ParseDuration(match[4]); err == nil {
+			result.LatencyMs = float64(latency) / float64(time.Millisecond)
+		}
+
+		// TSMP pings don't report a path, so the CLI prints the ping type instead
+		via := match[3]
+		if strings.HasPrefix(via, "DERP(") {
+			result.Path = PathDERP
+			result.DERPRegion = strings.TrimSuffix(strings.TrimPrefix(via, "DERP("), ")")
+		} else if via != pingType {
+			result.Path = PathDirect
+			result.Endpoint = via
+		}
+		return result, nil
+	}
+
+	if err != nil {
+		result.Error = strings.TrimSpace(string(output))
+		if result.Error == "" {
+			result.Error = err.Error()
+		}
+	} else {
+		result.Error = "no reply"
+	}
+	return result, nil
+}
+
 // GetVersion returns the Tailscale version
-func (c *Client) GetVersion() (string, error) {
-	cmd := exec.Command("tailscale", "version")
+func (c *Client) GetVersion() (_ string, err error) {
+	defer c.trace("GetVersion")(&err)
+	if c.local != nil {
+		return version.Long(), nil
+	}
+	cmd := c.Command("version")
 	output, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to get version: %v", err)
@@ -234,8 +558,12 @@ func (c *Client) GetVersion() (string, error) {
 }
 
 // EnableExitNode enables using a specific exit node
-func (c *Client) EnableExitNode(exitNode string) error {
-	cmd := exec.Command("tailscale", "up", "--exit-node", exitNode)
+func (c *Client) EnableExitNode(exitNode string) (err error) {
+	defer c.trace("EnableExitNode")(&err)
+	if c.local != nil {
+		return c.localSetExitNode(exitNode)
+	}
+	cmd := c.Command("set", "--exit-node="+exitNode)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to enable exit node: %v, output: %s", err, string(output))
@@ -244,8 +572,12 @@ func (c *Client) EnableExitNode(exitNode string) error {
 }
 
 // DisableExitNode disables using an exit node
-func (c *Client) DisableExitNode() error {
-	cmd := exec.Command("tailscale", "up", "--exit-node=")
+func (c *Client) DisableExitNode() (err error) {
+	defer c.trace("DisableExitNode")(&err)
+	if c.local != nil {
+		return c.localSetExitNode("")
+	}
+	cmd := c.Command("set", "--exit-node=")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to disable exit node: %v, output: %s", err, string(output))
@@ -253,44 +585,141 @@ func (c *Client) DisableExitNode() error {
 	return nil
 }
 
-// SetRoutes sets the routes to advertise
-func (c *Client) SetRoutes(routes []string) error {
-	args := []string{"up", "--advertise-routes", strings.Join(routes, ",")}
-	cmd := exec.Command("tailscale", args...)
+// SetExitNodeAllowLANAccess sets whether the local LAN stays reachable
+// while traffic goes through an exit node
+func (c *Client) SetExitNodeAllowLANAccess(allow bool) (err error) {
+	defer c.trace("SetExitNodeAllowLANAccess")(&err)
+	if c.local != nil {
+		return c.localSetExitNodeAllowLANAccess(allow)
+	}
+	cmd := c.Command("set", "--exit-node-allow-lan-access="+strconv.FormatBool(allow))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to set routes: %v, output: %s", err, string(output))
+		return fmt.Errorf("failed to set exit node LAN access: %v, output: %s", err, string(output))
 	}
 	return nil
 }
 
-// GetRoutes returns the currently advertised routes
-func (c *Client) GetRoutes() ([]string, error) {
-	cmd := exec.Command("tailscale", "status", "--json")
-	output, err := cmd.Output()
+// SetAdvertiseExitNode sets whether this node offers itself as an exit node.
+// Advertised subnet routes are left unchanged.
+func (c *Client) SetAdvertiseExitNode(advertise bool) (err error) {
+	defer c.trace("SetAdvertiseExitNode")(&err)
+	if c.local != nil {
+		return c.localSetAdvertiseExitNode(advertise)
+	}
+	cmd := c.Command("set", "--advertise-exit-node="+strconv.FormatBool(advertise))
+	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get status: %v", err)
+		return fmt.Errorf("failed to set exit node advertisement: %v, output: %s", err, string(output))
 	}
+	return nil
+}
 
-	var rawStatus map[string]interface{}
-	if err := json.Unmarshal(output, &rawStatus); err != nil {
-		return nil, fmt.Errorf("failed to parse status: %v", err)
+// ExitNodeApproved reports whether the control plane has approved this node
+// as an exit node, which puts the default routes in its allowed IPs
+func (c *Client) ExitNodeApproved() (bool, error) {
+	status, err := c.Status()
+	if err != nil {
+		return false, err
+	}
+	if status.Self == nil {
+		return false, nil
 	}
+	for _, ip := range status.Self.AllowedIPs {
+		if isExitRoute(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
 
-	routes := []string{}
-	if self, ok := rawStatus["Self"].(map[string]interface{}); ok {
-		if allowedIPs, ok := self["AllowedIPs"].([]interface{}); ok {
-			for _, ip := range allowedIPs {
-				if ipStr, ok := ip.(string); ok {
-					routes = append(routes, ipStr)
-				}
-			}
+// Prefs holds the tailscaled preferences gerbil reads
+type Prefs struct {
+	ControlURL             string
+	AdvertiseRoutes        []string
+	ExitNodeID             string
+	ExitNodeIP             string
+	ExitNodeAllowLANAccess bool
+}
+
+// AdvertiseExitNode reports whether the default routes are advertised
+func (p *Prefs) AdvertiseExitNode() bool {
+	for _, route := range p.AdvertiseRoutes {
+		if isExitRoute(route) {
+			return true
 		}
 	}
+	return false
+}
+
+// isExitRoute reports whether route is one of the default routes an exit node serves
+func isExitRoute(route string) bool {
+	return route == "0.0.0.0/0" || route == "::/0"
+}
+
+// GetPrefs returns the current tailscaled preferences
+func (c *Client) GetPrefs() (_ *Prefs, err error) {
+	defer c.trace("GetPrefs")(&err)
+	var output []byte
+	if c.local != nil {
+		output, err = c.localPrefsJSON()
+	} else {
+		output, err = c.Command("debug", "prefs").Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get prefs: %v", err)
+	}
+
+	var prefs Prefs
+	if err := json.Unmarshal(output, &prefs); err != nil {
+		return nil, fmt.Errorf("failed to parse prefs: %v", err)
+	}
+	return &prefs, nil
+}
+
+// SetRoutes sets the routes to advertise. Other prefs, including whether
+// this node advertises itself as an exit node, are left unchanged.
+func (c *Client) SetRoutes(routes []string) (err error) {
+	defer c.trace("SetRoutes")(&err)
+	if c.local != nil {
+		return c.localSetRoutes(routes)
+	}
+	args := []string{"set", "--advertise-routes=" + strings.Join(routes, ",")}
+	cmd := c.Command(args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set routes: %v, output: %s", err, string(output))
+	}
+	return nil
+}
 
+// GetRoutes returns the currently advertised routes
+func (c *Client) GetRoutes() (_ []string, err error) {
+	defer c.trace("GetRoutes")(&err)
+	prefs, err := c.GetPrefs()
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []string{}
+	routes = append(routes, prefs.AdvertiseRoutes...)
 	return routes, nil
 }
 
+// GetApprovedRoutes returns the advertised routes the control plane has
+// approved and this node is currently serving
+func (c *Client) GetApprovedRoutes() (_ []string, err error) {
+	defer c.trace("GetApprovedRoutes")(&err)
+	status, err := c.Status()
+	if err != nil {
+		return nil, err
+	}
+	if status.Self == nil {
+		return []string{}, nil
+	}
+	return append([]string{}, status.Self.PrimaryRoutes...), nil
+}
+
 // GetPeers returns a list of all peers
 func (c *Client) GetPeers() ([]PeerInfo, error) {
 	status, err := c.Status()
@@ -300,53 +729,30 @@ func (c *Client) GetPeers() ([]PeerInfo, error) {
 	return status.Peers, nil
 }
 
-// GetNetworkStats returns network statistics
+// GetNetworkStats returns whether UDP works and the public IPv4 and IPv6
+// addresses seen by netcheck. Use Netcheck for the full report.
 func (c *Client) GetNetworkStats() (map[string]interface{}, error) {
-	cmd := exec.Command("tailscale", "netcheck")
-	output, err := cmd.Output()
+	report, err := c.Netcheck()
 	if err != nil {
-		return nil, fmt.Errorf("failed to run netcheck: %v", err)
-	}
-
-	stats := make(map[string]interface{})
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "UDP:") {
-			stats["udp"] = strings.TrimSpace(strings.Split(line, ":")[1])
-		} else if strings.Contains(line, "IPv4:") {
-			stats["ipv4"] = strings.TrimSpace(strings.Split(line, ":")[1])
-		} else if strings.Contains(line, "IPv6:") {
-			stats["ipv6"] = strings.TrimSpace(strings.Split(line, ":")[1])
-		}
+		return nil, err
 	}
-
-	return stats, nil
+	return map[string]interface{}{
+		"udp":  report.UDP,
+		"ipv4": report.GlobalV4,
+		"ipv6": report.GlobalV6,
+	}, nil
 }
 
-// GetListenPort returns the current Tailscale listen port
-func (c *Client) GetListenPort() (int, error) {
-	cmd := exec.Command("tailscale", "debug", "prefs")
-	output, err := cmd.Output()
+// GetListenPort returns the UDP port WireGuard listens on, as found in the
+// endpoints tailscaled advertises. It fails until the node has found any.
+func (c *Client) GetListenPort() (_ int, err error) {
+	defer c.trace("GetListenPort")(&err)
+	status, err := c.Status()
 	if err != nil {
-		return 0, fmt.Errorf("failed to get prefs: %v", err)
+		return 0, err
 	}
-
-	// Parse the prefs output to find the listen port
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "ListenPort") {
-			parts := strings.Split(line, ":")
-			if len(parts) >= 2 {
-				portStr := strings.TrimSpace(parts[1])
-				portStr = strings.TrimSuffix(portStr, ",")
-				port, err := strconv.Atoi(portStr)
-				if err == nil {
-					return port, nil
-				}
-			}
-		}
+	if status.ListenPort == 0 {
+		return 0, errors.New("failed to get listen port: the node has no endpoints yet")
 	}
-
-	// Default Tailscale port
-	return 41641, nil
-}
\ No newline at end of file
+	return status.ListenPort, nil
+}
@@ -0,0 +1,171 @@
+package tailscale
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeCLI puts a tailscale script with the given body first in PATH and
+// returns its directory, where the script can keep files
+func fakeCLI(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tailscale CLI is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\ncd " + dir + "\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "tailscale"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return dir
+}
+
+const runningStatus = `{
+  "BackendState": "Running",
+  "Self": {"HostName": "gerbil", "DNSName": "gerbil.example.ts.net.", "TailscaleIPs": ["100.64.0.1", "fd7a:115c:a1e0::1"], "Online": true},
+  "CurrentTailnet": {"Name": "example.com", "MagicDNSSuffix": "example.ts.net", "MagicDNSEnabled": true},
+  "Peer": {
+    "nodekey:1": {"HostName": "laptop", "PublicKey": "nodekey:1", "TailscaleIPs": ["100.64.0.2"], "Online": true, "RxBytes": 10, "TxBytes": 20}
+  }
+}`
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		// err is the error of Status and loggedIn the one of CheckLoggedIn
+		err      error
+		loggedIn error
+		reason   string
+	}{
+		{
+			name:   "daemon unavailable",
+			script: `echo "failed to connect to local tailscaled; it doesn't appear to be running" >&2; exit 1`,
+			err:    ErrDaemonUnavailable,
+			reason: ReasonDaemonUnavailable,
+		},
+		{
+			name:   "invalid status",
+			script: `echo "{not json"`,
+			err:    ErrInvalidStatus,
+			reason: ReasonInvalidStatus,
+		},
+		{
+			name:     "needs login",
+			script:   `echo '{"BackendState": "NeedsLogin"}'`,
+			loggedIn: ErrNeedsLogin,
+			reason:   ReasonNeedsLogin,
+		},
+		{
+			name:     "needs machine auth",
+			script:   `echo '{"BackendState": "NeedsMachineAuth", "Self": {"HostName": "gerbil"}}'`,
+			loggedIn: ErrNeedsMachineAuth,
+			reason:   ReasonNeedsMachineAuth,
+		},
+		{
+			name:     "stopped",
+			script:   `echo '{"BackendState": "Stopped", "Self": {"HostName": "gerbil"}}'`,
+			loggedIn: ErrStopped,
+			reason:   ReasonStopped,
+		},
+		{
+			name:   "running",
+			script: "cat <<'EOF'\n" + runningStatus + "\nEOF",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeCLI(t, test.script)
+			status, err := NewClient().Status()
+			if !errors.Is(err, test.err) || (test.err == nil) != (err == nil) {
+				t.Fatalf("Got error %v, want %v", err, test.err)
+			}
+			if err != nil {
+				if StatusErrorReason(err) != test.reason {
+					t.Errorf("Got reason %q, want %q", StatusErrorReason(err), test.reason)
+				}
+				if test.err == ErrDaemonUnavailable && !strings.Contains(err.Error(), "doesn't appear to be running") {
+					t.Errorf("Got %q, want the CLI's explanation included", err)
+				}
+				return
+			}
+
+			err = status.CheckLoggedIn()
+			if !errors.Is(err, test.loggedIn) || (test.loggedIn == nil) != (err == nil) {
+				t.Fatalf("Got CheckLoggedIn %v, want %v", err, test.loggedIn)
+			}
+			if reason := StatusErrorReason(err); reason != test.reason {
+				t.Errorf("Got reason %q, want %q", reason, test.reason)
+			}
+			if LastStatusErrorReason() != test.reason {
+				t.Errorf("Recorded reason %q, want %q", LastStatusErrorReason(), test.reason)
+			}
+		})
+	}
+}
+
+func TestStatusParsesRunningNode(t *testing.T) {
+	fakeCLI(t, "cat <<'EOF'\n"+runningStatus+"\nEOF")
+	status, err := NewClient().Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.LoggedIn || status.BackendState != StateRunning {
+		t.Errorf("Got logged in %v in state %s, want a running node", status.LoggedIn, status.BackendState)
+	}
+	if self := status.Self; self == nil || self.Hostname != "gerbil" || self.TailscaleIPs != "100.64.0.1" || len(self.Addresses) != 2 {
+		t.Errorf("Got self %+v, want gerbil with its two addresses", status.Self)
+	}
+	if tailnet := status.Tailnet; tailnet == nil || tailnet.Name != "example.com" || !tailnet.MagicDNSEnabled {
+		t.Errorf("Got tailnet %+v, want example.com with MagicDNS", status.Tailnet)
+	}
+	if len(status.Peers) != 1 || status.Peers[0].Hostname != "laptop" || status.Peers[0].RxBytes != 10 || status.Peers[0].TxBytes != 20 {
+		t.Errorf("Got peers %+v, want the laptop with its traffic", status.Peers)
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []interface{}
+		want  int
+	}{
+		{name: "none"},
+		{name: "private after public", addrs: []interface{}{"198.51.100.7:62000", "192.168.1.10:41641"}, want: 41641},
+		{name: "ipv6 link-local", addrs: []interface{}{"[2001:db8::7]:62000", "[fe80::1]:41641"}, want: 41641},
+		{name: "public only", addrs: []interface{}{"198.51.100.7:41641", "203.0.113.9:41642"}, want: 41641},
+		{name: "unparsable", addrs: []interface{}{"nonsense", 42, "10.0.0.1:0"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := listenPort(test.addrs); got != test.want {
+				t.Errorf("Got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetListenPort(t *testing.T) {
+	dir := fakeCLI(t, `cat status.json`)
+	client := NewClient()
+
+	status := strings.Replace(runningStatus, `"HostName": "gerbil",`, `"HostName": "gerbil", "Addrs": ["198.51.100.7:62000", "10.0.0.5:41641"],`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "status.json"), []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := client.GetListenPort(); err != nil || port != 41641 {
+		t.Errorf("Got %d and %v, want 41641", port, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "status.json"), []byte(runningStatus), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := client.GetListenPort(); err == nil {
+		t.Errorf("Got port %d for a node without endpoints, want an error", port)
+	}
+}
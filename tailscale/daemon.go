@@ -0,0 +1,252 @@
+package tailscale
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+const (
+	// TunUserspace runs tailscaled without a kernel TUN device
+	TunUserspace = "userspace-networking"
+	// DefaultProxyAddr is where the outbound proxies listen in userspace mode
+	// unless configured otherwise; tailscaled serves SOCKS5 and HTTP on one port
+	DefaultProxyAddr = "localhost:1055"
+)
+
+// Restart backoff, shortened by tests
+var (
+	minRestartBackoff = 1 * time.Second
+	maxRestartBackoff = 30 * time.Second
+	// stableRunTime is how long tailscaled must stay up before the backoff resets
+	stableRunTime = 1 * time.Minute
+)
+
+var errDaemonStopped = errors.New("tailscaled supervisor is stopped")
+
+// log is the logger of this package, so its level can be set on its own
+var log = logger.Named("tailscale")
+
+// DaemonConfig holds the options used to launch tailscaled
+type DaemonConfig struct {
+	Binary   string
+	StateDir string
+	Socket   string
+	Tun      string
+	Port     int
+	// Socks5Addr and HTTPProxyAddr are the listen addresses of the outbound
+	// proxies tailscaled provides in userspace mode
+	Socks5Addr    string
+	HTTPProxyAddr string
+}
+
+// Userspace reports whether tailscaled runs without a kernel TUN device
+func (c DaemonConfig) Userspace() bool {
+	return c.Tun == TunUserspace
+}
+
+// Daemon runs tailscaled as a child process and restarts it when it exits
+type Daemon struct {
+	config DaemonConfig
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// NewDaemon creates a supervisor for tailscaled with the given config
+func NewDaemon(config DaemonConfig) *Daemon {
+	if config.Binary == "" {
+		config.Binary = "tailscaled"
+	}
+	return &Daemon{
+		config: config,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// Args returns the command line tailscaled is started with
+func (d *Daemon) Args() []string {
+	var args []string
+	if d.config.StateDir != "" {
+		args = append(args, "--statedir="+d.config.StateDir)
+	}
+	if d.config.Socket != "" {
+		args = append(args, "--socket="+d.config.Socket)
+	}
+	if d.config.Tun != "" {
+		args = append(args, "--tun="+d.config.Tun)
+	}
+	if d.config.Port != 0 {
+		args = append(args, "--port="+strconv.Itoa(d.config.Port))
+	}
+	if d.config.Socks5Addr != "" {
+		args = append(args, "--socks5-server="+d.config.Socks5Addr)
+	}
+	if d.config.HTTPProxyAddr != "" {
+		args = append(args, "--outbound-http-proxy-listen="+d.config.HTTPProxyAddr)
+	}
+	return args
+}
+
+// Start launches tailscaled and keeps it running until Stop is called.
+// An error is only returned if the first launch fails.
+func (d *Daemon) Start() error {
+	cmd, err := d.launch()
+	if err != nil {
+		return err
+	}
+	go d.supervise(cmd)
+	return nil
+}
+
+// Stop terminates tailscaled, killing it if it has not exited within timeout
+func (d *Daemon) Stop(timeout time.Duration) error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return nil
+	}
+	d.stopped = true
+	close(d.stopCh)
+	cmd := d.cmd
+	d.mu.Unlock()
+
+	// Never started, so there is no supervisor to wait for
+	if cmd == nil {
+		return nil
+	}
+
+	if cmd.Process != nil {
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Debug("Failed to signal tailscaled: %v", err)
+		}
+	}
+
+	select {
+	case <-d.doneCh:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	log.Warn("tailscaled did not exit within %s, killing it", timeout)
+	if cmd.Process != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			return fmt.Errorf("failed to kill tailscaled: %v", err)
+		}
+	}
+	<-d.doneCh
+	return nil
+}
+
+// launch starts a single tailscaled process with its output piped to the logger
+func (d *Daemon) launch() (*exec.Cmd, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return nil, errDaemonStopped
+	}
+
+	cmd := exec.Command(d.config.Binary, d.Args()...)
+	cmd.Stdout = &logWriter{}
+	cmd.Stderr = &logWriter{}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Info("Started tailscaled (pid %d)", cmd.Process.Pid)
+
+	d.cmd = cmd
+	return cmd, nil
+}
+
+// supervise waits for tailscaled to exit and restarts it with backoff
+func (d *Daemon) supervise(cmd *exec.Cmd) {
+	defer close(d.doneCh)
+
+	backoff := minRestartBackoff
+	for {
+		started := time.Now()
+		err := cmd.Wait()
+		flushOutput(cmd)
+
+		select {
+		case <-d.stopCh:
+			log.Info("tailscaled stopped")
+			return
+		default:
+		}
+
+		if time.Since(started) > stableRunTime {
+			backoff = minRestartBackoff
+		}
+		log.Error("tailscaled exited unexpectedly: %v, restarting in %s", err, backoff)
+
+		for {
+			select {
+			case <-d.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > maxRestartBackoff {
+				backoff = maxRestartBackoff
+			}
+
+			cmd, err = d.launch()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, errDaemonStopped) {
+				return
+			}
+			log.Error("Failed to restart tailscaled: %v, retrying in %s", err, backoff)
+		}
+	}
+}
+
+// flushOutput logs what tailscaled wrote after its last newline, once Wait
+// has copied all of its output
+func flushOutput(cmd *exec.Cmd) {
+	for _, w := range []interface{}{cmd.Stdout, cmd.Stderr} {
+		if w, ok := w.(*logWriter); ok {
+			w.Flush()
+		}
+	}
+}
+
+// logWriter forwards each line tailscaled writes to the gerbil logger
+type logWriter struct {
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Info("tailscaled: %s", bytes.TrimRight(w.buf[:i], "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs the rest of the output, which has no newline at its end
+func (w *logWriter) Flush() {
+	if len(w.buf) > 0 {
+		log.Info("tailscaled: %s", bytes.TrimRight(w.buf, "\r"))
+		w.buf = nil
+	}
+}
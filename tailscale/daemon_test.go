@@ -0,0 +1,176 @@
+package tailscale
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+)
+
+// logMessages is a sink keeping the messages logged during a test
+type logMessages struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *logMessages) Write(e logger.Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, e.Message)
+	return nil
+}
+
+func (l *logMessages) Close() error {
+	return nil
+}
+
+// matching returns the messages containing substr
+func (l *logMessages) matching(substr string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var matches []string
+	for _, message := range l.messages {
+		if strings.Contains(message, substr) {
+			matches = append(matches, message)
+		}
+	}
+	return matches
+}
+
+// waitFor polls until at least n messages contain substr
+func (l *logMessages) waitFor(t *testing.T, substr string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		matches := l.matching(substr)
+		if len(matches) >= n {
+			return matches
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got %d messages with %q, want %d", len(matches), substr, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func recordLogs(t *testing.T) *logMessages {
+	messages := &logMessages{}
+	root := logger.GetLogger()
+	previous := root.Outputs()
+	root.SetOutputs(logger.Output{Sink: messages, Level: logger.DEBUG})
+	t.Cleanup(func() { root.SetOutputs(previous...) })
+	return messages
+}
+
+// fakeDaemon writes a tailscaled stub running body in its own directory
+func fakeDaemon(t *testing.T, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tailscaled is a shell script")
+	}
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "tailscaled")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\ncd "+dir+"\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func shortenBackoff(t *testing.T) {
+	min, max, stable := minRestartBackoff, maxRestartBackoff, stableRunTime
+	minRestartBackoff, maxRestartBackoff, stableRunTime = 20*time.Millisecond, 80*time.Millisecond, 300*time.Millisecond
+	t.Cleanup(func() { minRestartBackoff, maxRestartBackoff, stableRunTime = min, max, stable })
+}
+
+func TestDaemonRestartBackoff(t *testing.T) {
+	shortenBackoff(t)
+	messages := recordLogs(t)
+	// Every run exits at once, except the fifth, which stays up long enough
+	// to reset the backoff. Output without a final newline is still logged.
+	binary := fakeDaemon(t, `n=$(($(cat runs 2>/dev/null || echo 0) + 1))
+echo $n > runs
+[ $n -eq 5 ] && sleep 0.5
+printf 'run %d\npartial %d' $n $n
+exit 1`)
+
+	d := NewDaemon(DaemonConfig{Binary: binary})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exits := messages.waitFor(t, "exited unexpectedly", 6)
+	if err := d.Stop(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var backoffs []string
+	for _, message := range exits[:6] {
+		_, backoff, _ := strings.Cut(message, "restarting in ")
+		backoffs = append(backoffs, backoff)
+	}
+	want := []string{"20ms", "40ms", "80ms", "80ms", "20ms", "40ms"}
+	if strings.Join(backoffs, " ") != strings.Join(want, " ") {
+		t.Errorf("Got backoffs %v, want %v", backoffs, want)
+	}
+	for _, line := range []string{"tailscaled: run 1", "tailscaled: partial 1", "tailscaled: partial 5"} {
+		if len(messages.matching(line)) != 1 {
+			t.Errorf("Got no %q log line", line)
+		}
+	}
+}
+
+func TestDaemonStop(t *testing.T) {
+	shortenBackoff(t)
+	messages := recordLogs(t)
+	binary := fakeDaemon(t, `echo started
+trap 'echo terminated; exit 0' TERM
+while :; do sleep 0.01; done`)
+
+	d := NewDaemon(DaemonConfig{Binary: binary})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	messages.waitFor(t, "tailscaled: started", 1)
+	if err := d.Stop(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	messages.waitFor(t, "tailscaled stopped", 1)
+	if len(messages.matching("tailscaled: terminated")) != 1 {
+		t.Error("tailscaled wasn't asked to terminate")
+	}
+
+	// Nothing is restarted after a stop
+	time.Sleep(4 * minRestartBackoff)
+	if started := messages.matching("Started tailscaled"); len(started) != 1 || len(messages.matching("exited unexpectedly")) != 0 {
+		t.Errorf("Got %q, want tailscaled started once", started)
+	}
+	if err := d.Stop(time.Second); err != nil {
+		t.Errorf("Stopping twice failed: %v", err)
+	}
+}
+
+func TestDaemonStopKills(t *testing.T) {
+	messages := recordLogs(t)
+	// An ignored SIGTERM stays ignored across exec
+	binary := fakeDaemon(t, `echo started
+trap '' TERM
+exec sleep 10`)
+
+	d := NewDaemon(DaemonConfig{Binary: binary})
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	messages.waitFor(t, "tailscaled: started", 1)
+	start := time.Now()
+	if err := d.Stop(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("Stop took %s, want tailscaled killed after the timeout", took)
+	}
+	messages.waitFor(t, "killing it", 1)
+}
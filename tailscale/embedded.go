@@ -0,0 +1,337 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/net/netmon"
+	"tailscale.com/net/portmapper"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tsnet"
+	tslogger "tailscale.com/types/logger"
+)
+
+// localAPITimeout bounds each LocalAPI call made against an embedded node
+const localAPITimeout = 10 * time.Second
+
+// netcheckTimeout bounds an in-process netcheck run
+const netcheckTimeout = 30 * time.Second
+
+// ErrNotSupportedEmbedded is returned for operations that need the tailscale CLI
+var ErrNotSupportedEmbedded = errors.New("not supported by the embedded tailscale node")
+
+// EmbeddedConfig holds the options for a tsnet node running inside gerbil
+type EmbeddedConfig struct {
+	StateDir     string
+	Hostname     string
+	AuthKey      string
+	ControlURL   string
+	Port         uint16
+	AcceptRoutes bool
+	ExitNode     string
+}
+
+// Embedded is a Tailscale node running in-process, without tailscaled
+type Embedded struct {
+	config EmbeddedConfig
+	server *tsnet.Server
+}
+
+// NewEmbedded creates an embedded node with the given config
+func NewEmbedded(config EmbeddedConfig) *Embedded {
+	return &Embedded{
+		config: config,
+		server: &tsnet.Server{
+			Dir:        config.StateDir,
+			Hostname:   config.Hostname,
+			AuthKey:    config.AuthKey,
+			ControlURL: config.ControlURL,
+			Port:       config.Port,
+			Logf: func(format string, args ...any) {
+				log.Debug("tsnet: "+format, args...)
+			},
+			UserLogf: func(format string, args ...any) {
+				log.Info("tsnet: "+format, args...)
+			},
+		},
+	}
+}
+
+// Up starts the node, waits for it to reach the Running state and returns a
+// Client that talks to it over the LocalAPI
+func (e *Embedded) Up(ctx context.Context) (*Client, error) {
+	if err := e.server.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start embedded node: %v", err)
+	}
+	local, err := e.server.LocalClient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get LocalAPI client: %v", err)
+	}
+	client := &Client{local: local}
+
+	if _, err := e.server.Up(ctx); err != nil {
+		// Report why the node did not come up when the backend knows
+		if state, stateErr := client.BackendState(); stateErr == nil {
+			switch state {
+			case StateNeedsMachineAuth:
+				return nil, ErrNeedsMachineAuth
+			case StateNeedsLogin:
+				return nil, ErrNeedsLogin
+			}
+		}
+		return nil, fmt.Errorf("embedded node did not reach Running: %v", err)
+	}
+
+	if e.config.AcceptRoutes {
+		if err := client.editPrefs(&ipn.MaskedPrefs{
+			Prefs:       ipn.Prefs{RouteAll: true},
+			RouteAllSet: true,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to accept routes: %v", err)
+		}
+	}
+	if e.config.ExitNode != "" {
+		if err := client.EnableExitNode(e.config.ExitNode); err != nil {
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// Listen opens a TCP listener on the node's tailnet addresses
+func (e *Embedded) Listen(addr string) (net.Listener, error) {
+	return e.server.Listen("tcp", addr)
+}
+
+// Close shuts the node down
+func (e *Embedded) Close() error {
+	return e.server.Close()
+}
+
+func (c *Client) localStatusJSON() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	status, err := c.local.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(status)
+}
+
+func (c *Client) localLogout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+	return c.local.Logout(ctx)
+}
+
+func (c *Client) localIP() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	status, err := c.local.Status(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Tailscale IP: %v", err)
+	}
+	for _, ip := range status.TailscaleIPs {
+		if ip.Is4() {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("failed to get Tailscale IP: node has no IPv4 address")
+}
+
+func (c *Client) localPing(target string) (bool, error) {
+	result, err := c.localPingDetail(target, PingDisco)
+	if err != nil {
+		return false, err
+	}
+	if !result.Success {
+		return false, errors.New(result.Error)
+	}
+	return true, nil
+}
+
+func (c *Client) localPingDetail(target, pingType string) (*PingResult, error) {
+	ip, err := netip.ParseAddr(target)
+	if err != nil {
+		return nil, fmt.Errorf("embedded ping needs a Tailscale IP: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	pong, err := c.local.Ping(ctx, ip, tailcfg.PingType(pingType))
+	if err != nil {
+		return &PingResult{Target: target, Error: err.Error()}, nil
+	}
+	return pingResultFromPong(target, pong), nil
+}
+
+// pingResultFromPong converts a LocalAPI ping response
+func pingResultFromPong(target string, pong *ipnstate.PingResult) *PingResult {
+	result := &PingResult{
+		Target:   target,
+		NodeName: pong.NodeName,
+		NodeIP:   pong.NodeIP,
+		Error:    pong.Err,
+	}
+	if pong.Err != "" {
+		return result
+	}
+
+	result.Success = true
+	result.LatencyMs = pong.LatencySeconds * 1000
+	if pong.DERPRegionID != 0 {
+		result.Path = PathDERP
+		result.DERPRegion = pong.DERPRegionCode
+	} else if pong.Endpoint != "" {
+		result.Path = PathDirect
+		result.Endpoint = pong.Endpoint
+	}
+	return result
+}
+
+func (c *Client) localSetExitNode(exitNode string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	prefs := &ipn.MaskedPrefs{ExitNodeIDSet: true, ExitNodeIPSet: true}
+	if exitNode != "" {
+		status, err := c.local.Status(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to enable exit node: %v", err)
+		}
+		if err := prefs.SetExitNodeIP(exitNode, status); err != nil {
+			return fmt.Errorf("failed to enable exit node: %v", err)
+		}
+	}
+	if err := c.editPrefs(prefs); err != nil {
+		return fmt.Errorf("failed to set exit node: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) localSetRoutes(routes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	current, err := c.local.GetPrefs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set routes: %v", err)
+	}
+
+	// Keep the exit node routes, like `tailscale set --advertise-routes` does
+	prefs := &ipn.MaskedPrefs{AdvertiseRoutesSet: true}
+	for _, route := range current.AdvertiseRoutes {
+		if route.Bits() == 0 {
+			prefs.AdvertiseRoutes = append(prefs.AdvertiseRoutes, route)
+		}
+	}
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return fmt.Errorf("failed to set routes: %v", err)
+		}
+		prefs.AdvertiseRoutes = append(prefs.AdvertiseRoutes, prefix)
+	}
+	if err := c.editPrefs(prefs); err != nil {
+		return fmt.Errorf("failed to set routes: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) localPrefsJSON() ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	prefs, err := c.local.GetPrefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(prefs)
+}
+
+func (c *Client) localSetExitNodeAllowLANAccess(allow bool) error {
+	if err := c.editPrefs(&ipn.MaskedPrefs{
+		Prefs:                     ipn.Prefs{ExitNodeAllowLANAccess: allow},
+		ExitNodeAllowLANAccessSet: true,
+	}); err != nil {
+		return fmt.Errorf("failed to set exit node LAN access: %v", err)
+	}
+	return nil
+}
+
+func (c *Client) localSetAdvertiseExitNode(advertise bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	current, err := c.local.GetPrefs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to set exit node advertisement: %v", err)
+	}
+
+	prefs := &ipn.MaskedPrefs{Prefs: *current, AdvertiseRoutesSet: true}
+	prefs.SetAdvertiseExitNode(advertise)
+	if err := c.editPrefs(prefs); err != nil {
+		return fmt.Errorf("failed to set exit node advertisement: %v", err)
+	}
+	return nil
+}
+
+// localNetcheck runs netcheck in process like the tailscale CLI does, using
+// the embedded node's DERP map
+func (c *Client) localNetcheck() (*netcheck.Report, *tailcfg.DERPMap, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), netcheckTimeout)
+	defer cancel()
+
+	derpMap, err := c.local.CurrentDERPMap(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if derpMap == nil || len(derpMap.Regions) == 0 {
+		return nil, nil, errors.New("no DERP map yet")
+	}
+
+	netMon, err := netmon.New(log.Debug)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer netMon.Close()
+
+	// Closing the port mapper releases any mappings the check created
+	portMapper := portmapper.NewClient(log.Debug, netMon, nil, nil, nil)
+	defer portMapper.Close()
+
+	checker := &netcheck.Client{
+		NetMon:     netMon,
+		PortMapper: portMapper,
+		Logf:       tslogger.Discard,
+	}
+	if err := checker.Standalone(ctx, ""); err != nil {
+		log.Debug("netcheck: UDP test failure: %v", err)
+	}
+	report, err := checker.GetReport(ctx, derpMap, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return report, derpMap, nil
+}
+
+// editPrefs applies a partial prefs update over the LocalAPI
+func (c *Client) editPrefs(prefs *ipn.MaskedPrefs) error {
+	ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+	defer cancel()
+
+	_, err := c.local.EditPrefs(ctx, prefs)
+	return err
+}
@@ -0,0 +1,180 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+
+	localapi "tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// fakeLocalAPI serves the prefs endpoints of the LocalAPI an embedded node
+// answers on
+type fakeLocalAPI struct {
+	mu    sync.Mutex
+	prefs ipn.Prefs
+}
+
+func (f *fakeLocalAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.URL.Path != "/localapi/v0/prefs":
+		http.NotFound(w, r)
+		return
+	case r.Method == http.MethodPatch:
+		var masked ipn.MaskedPrefs
+		if err := json.NewDecoder(r.Body).Decode(&masked); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.prefs.ApplyEdits(&masked)
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(f.prefs)
+}
+
+func (f *fakeLocalAPI) routes() []netip.Prefix {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.prefs.AdvertiseRoutes
+}
+
+// newFakeEmbeddedClient returns a client for an embedded node whose LocalAPI
+// is served by api
+func newFakeEmbeddedClient(t *testing.T, api http.Handler) *Client {
+	t.Helper()
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return &Client{local: &localapi.LocalClient{
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", server.Listener.Addr().String())
+		},
+		OmitAuth: true,
+	}}
+}
+
+func prefixes(routes ...string) []netip.Prefix {
+	var parsed []netip.Prefix
+	for _, route := range routes {
+		parsed = append(parsed, netip.MustParsePrefix(route))
+	}
+	return parsed
+}
+
+func TestPingResultFromPong(t *testing.T) {
+	tests := []struct {
+		name string
+		pong ipnstate.PingResult
+		want PingResult
+	}{
+		{
+			name: "direct",
+			pong: ipnstate.PingResult{NodeName: "exit", NodeIP: "100.64.0.2", LatencySeconds: 0.0125, Endpoint: "203.0.113.5:41641"},
+			want: PingResult{Target: "100.64.0.2", Success: true, NodeName: "exit", NodeIP: "100.64.0.2", LatencyMs: 12.5, Path: PathDirect, Endpoint: "203.0.113.5:41641"},
+		},
+		{
+			name: "derp",
+			pong: ipnstate.PingResult{NodeName: "exit", NodeIP: "100.64.0.2", LatencySeconds: 0.08, DERPRegionID: 2, DERPRegionCode: "fra"},
+			want: PingResult{Target: "100.64.0.2", Success: true, NodeName: "exit", NodeIP: "100.64.0.2", LatencyMs: 80, Path: PathDERP, DERPRegion: "fra"},
+		},
+		{
+			// TSMP pongs carry neither an endpoint nor a DERP region
+			name: "no path",
+			pong: ipnstate.PingResult{NodeName: "exit", NodeIP: "100.64.0.2", LatencySeconds: 0.002},
+			want: PingResult{Target: "100.64.0.2", Success: true, NodeName: "exit", NodeIP: "100.64.0.2", LatencyMs: 2},
+		},
+		{
+			name: "error",
+			pong: ipnstate.PingResult{NodeIP: "100.64.0.2", Err: "timeout", Endpoint: "203.0.113.5:41641"},
+			want: PingResult{Target: "100.64.0.2", NodeIP: "100.64.0.2", Error: "timeout"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := pingResultFromPong("100.64.0.2", &test.pong)
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("Got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedSetRoutesKeepsExitRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []netip.Prefix
+		routes  []string
+		want    []netip.Prefix
+	}{
+		{name: "exit node", current: prefixes("10.0.0.0/24", "0.0.0.0/0", "::/0"), routes: []string{"10.1.0.0/24"}, want: prefixes("0.0.0.0/0", "::/0", "10.1.0.0/24")},
+		{name: "exit node without routes", current: prefixes("0.0.0.0/0", "::/0", "10.0.0.0/24"), want: prefixes("0.0.0.0/0", "::/0")},
+		{name: "no exit node", current: prefixes("10.0.0.0/24"), routes: []string{"10.1.0.0/24", "fd00::/64"}, want: prefixes("10.1.0.0/24", "fd00::/64")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := &fakeLocalAPI{prefs: ipn.Prefs{AdvertiseRoutes: test.current}}
+			client := newFakeEmbeddedClient(t, api)
+			if err := client.SetRoutes(test.routes); err != nil {
+				t.Fatal(err)
+			}
+			if got := api.routes(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedSetRoutesRejectsInvalidRoute(t *testing.T) {
+	api := &fakeLocalAPI{prefs: ipn.Prefs{AdvertiseRoutes: prefixes("10.0.0.0/24")}}
+	client := newFakeEmbeddedClient(t, api)
+	if err := client.SetRoutes([]string{"10.1.0.0/24", "nonsense"}); err == nil {
+		t.Fatal("Set an invalid route")
+	}
+	if got, want := api.routes(), prefixes("10.0.0.0/24"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want the routes unchanged", got)
+	}
+}
+
+func TestEmbeddedAdvertiseExitNode(t *testing.T) {
+	api := &fakeLocalAPI{prefs: ipn.Prefs{AdvertiseRoutes: prefixes("10.0.0.0/24")}}
+	client := newFakeEmbeddedClient(t, api)
+
+	if err := client.SetAdvertiseExitNode(true); err != nil {
+		t.Fatal(err)
+	}
+	prefs, err := client.GetPrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !prefs.AdvertiseExitNode() || !reflect.DeepEqual(prefs.AdvertiseRoutes, []string{"10.0.0.0/24", "0.0.0.0/0", "::/0"}) {
+		t.Errorf("Got routes %v, want the subnet and exit routes", prefs.AdvertiseRoutes)
+	}
+
+	if err := client.SetAdvertiseExitNode(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.routes(); !reflect.DeepEqual(got, prefixes("10.0.0.0/24")) {
+		t.Errorf("Got %v, want the subnet route alone", got)
+	}
+}
+
+func TestEmbeddedUnsupported(t *testing.T) {
+	client := newFakeEmbeddedClient(t, http.NotFoundHandler())
+	if err := client.Login("tskey-auth-test", "gerbil", ""); !errors.Is(err, ErrNotSupportedEmbedded) {
+		t.Errorf("Got %v from Login, want ErrNotSupportedEmbedded", err)
+	}
+}
@@ -0,0 +1,171 @@
+package tailscale
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Sysctls that must be enabled for an exit node or subnet router using a
+// kernel TUN device. Userspace networking forwards packets itself.
+var (
+	ipv4ForwardingSysctl = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardingSysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+)
+
+// Kernel statistics read for the forwarding and interface counters
+var (
+	snmpFile  = "/proc/net/snmp"
+	snmp6File = "/proc/net/snmp6"
+	sysNetDir = "/sys/class/net"
+)
+
+// Forwarding reports whether the kernel forwards IPv4 and IPv6 packets
+type Forwarding struct {
+	IPv4 bool `json:"ipv4"`
+	IPv6 bool `json:"ipv6"`
+}
+
+// Enabled reports whether forwarding is enabled for both address families
+func (f Forwarding) Enabled() bool {
+	return f.IPv4 && f.IPv6
+}
+
+// IPForwarding reads the kernel IP forwarding sysctls
+func IPForwarding() (Forwarding, error) {
+	var forwarding Forwarding
+	var err error
+	if forwarding.IPv4, err = readSysctlBool(ipv4ForwardingSysctl); err != nil {
+		return forwarding, err
+	}
+	// Hosts without IPv6 have no IPv6 sysctls to read
+	if _, statErr := os.Stat(ipv6ForwardingSysctl); statErr == nil {
+		if forwarding.IPv6, err = readSysctlBool(ipv6ForwardingSysctl); err != nil {
+			return forwarding, err
+		}
+	} else {
+		forwarding.IPv6 = true
+	}
+	return forwarding, nil
+}
+
+// EnableIPForwarding turns on the kernel IP forwarding sysctls. This needs
+// root, or CAP_NET_ADMIN with a writable /proc/sys.
+func EnableIPForwarding() error {
+	for _, sysctl := range []string{ipv4ForwardingSysctl, ipv6ForwardingSysctl} {
+		if _, err := os.Stat(sysctl); err != nil {
+			continue
+		}
+		if err := os.WriteFile(sysctl, []byte("1\n"), 0o644); err != nil {
+			return fmt.Errorf("failed to enable %s: %v", sysctl, err)
+		}
+	}
+	return nil
+}
+
+// ForwardedPackets returns how many IPv4 and IPv6 packets the kernel has
+// forwarded between any of the host's interfaces. This includes, but is not
+// limited to, the traffic of clients using this node as an exit node.
+func ForwardedPackets() (ipv4, ipv6 uint64, err error) {
+	// /proc/net/snmp holds a header line followed by a value line per protocol
+	data, err := os.ReadFile(snmpFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	var header []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "Ip:" {
+			continue
+		}
+		if header == nil {
+			header = fields
+			continue
+		}
+		for i, name := range header {
+			if name == "ForwDatagrams" && i < len(fields) {
+				ipv4, _ = strconv.ParseUint(fields[i], 10, 64)
+			}
+		}
+		break
+	}
+
+	snmp6, err := os.Open(snmp6File)
+	if err != nil {
+		// No IPv6 on this host
+		return ipv4, 0, nil
+	}
+	defer snmp6.Close()
+
+	scanner := bufio.NewScanner(snmp6)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "Ip6OutForwDatagrams" {
+			ipv6, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return ipv4, ipv6, scanner.Err()
+}
+
+// InterfaceBytes returns the bytes received and sent on a network interface
+func InterfaceBytes(name string) (rx, tx uint64, err error) {
+	statistics := filepath.Join(sysNetDir, name, "statistics")
+	if rx, err = readSysfsUint(filepath.Join(statistics, "rx_bytes")); err != nil {
+		return 0, 0, err
+	}
+	if tx, err = readSysfsUint(filepath.Join(statistics, "tx_bytes")); err != nil {
+		return 0, 0, err
+	}
+	return rx, tx, nil
+}
+
+func readSysctlBool(path string) (bool, error) {
+	value, err := readSysfsUint(path)
+	if err != nil {
+		return false, err
+	}
+	return value != 0, nil
+}
+
+func readSysfsUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return value, nil
+}
+
+// InterfaceWithAddr returns the name of the network interface holding one
+// of the addresses, such as the TUN device holding a node's Tailscale IPs
+func InterfaceWithAddr(addrs []netip.Addr) (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range interfaces {
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifaceAddr := range ifaceAddrs {
+			prefix, err := netip.ParsePrefix(ifaceAddr.String())
+			if err != nil {
+				continue
+			}
+			if slices.Contains(addrs, prefix.Addr()) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface holds %v", addrs)
+}
@@ -0,0 +1,169 @@
+package tailscale
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeProc points the forwarding sysctls and kernel statistics at files in
+// a temporary directory, written from files, and returns the directory
+func fakeProc(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := []string{ipv4ForwardingSysctl, ipv6ForwardingSysctl, snmpFile, snmp6File, sysNetDir}
+	ipv4ForwardingSysctl = filepath.Join(dir, "ip_forward")
+	ipv6ForwardingSysctl = filepath.Join(dir, "forwarding6")
+	snmpFile = filepath.Join(dir, "snmp")
+	snmp6File = filepath.Join(dir, "snmp6")
+	sysNetDir = filepath.Join(dir, "net")
+	t.Cleanup(func() {
+		ipv4ForwardingSysctl, ipv6ForwardingSysctl, snmpFile, snmp6File, sysNetDir = previous[0], previous[1], previous[2], previous[3], previous[4]
+	})
+	return dir
+}
+
+func TestIPForwarding(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  Forwarding
+		err   bool
+	}{
+		{name: "both enabled", files: map[string]string{"ip_forward": "1\n", "forwarding6": "1\n"}, want: Forwarding{IPv4: true, IPv6: true}},
+		{name: "ipv6 disabled", files: map[string]string{"ip_forward": "1\n", "forwarding6": "0\n"}, want: Forwarding{IPv4: true}},
+		// Without IPv6 on the host there is nothing to forward
+		{name: "no ipv6", files: map[string]string{"ip_forward": "0\n"}, want: Forwarding{IPv6: true}},
+		{name: "no ipv4 sysctl", files: map[string]string{"forwarding6": "1\n"}, err: true},
+		{name: "unparsable", files: map[string]string{"ip_forward": "yes\n"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeProc(t, test.files)
+			forwarding, err := IPForwarding()
+			if test.err {
+				if err == nil {
+					t.Errorf("Got %+v, want an error", forwarding)
+				}
+				return
+			}
+			if err != nil || forwarding != test.want {
+				t.Errorf("Got %+v and %v, want %+v", forwarding, err, test.want)
+			}
+		})
+	}
+}
+
+func TestEnableIPForwarding(t *testing.T) {
+	dir := fakeProc(t, map[string]string{"ip_forward": "0\n", "forwarding6": "0\n"})
+	if err := EnableIPForwarding(); err != nil {
+		t.Fatal(err)
+	}
+	forwarding, err := IPForwarding()
+	if err != nil || !forwarding.Enabled() {
+		t.Errorf("Got %+v and %v, want forwarding enabled", forwarding, err)
+	}
+
+	// A host without IPv6 only has the IPv4 sysctl to enable
+	os.Remove(filepath.Join(dir, "forwarding6"))
+	os.WriteFile(filepath.Join(dir, "ip_forward"), []byte("0\n"), 0o644)
+	if err := EnableIPForwarding(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "forwarding6")); err == nil {
+		t.Errorf("Created the IPv6 sysctl")
+	}
+	if forwarding, _ := IPForwarding(); !forwarding.IPv4 {
+		t.Errorf("Got IPv4 forwarding disabled")
+	}
+
+	// Root can write to read-only files
+	if os.Getuid() == 0 {
+		return
+	}
+	os.Chmod(filepath.Join(dir, "ip_forward"), 0o444)
+	if err := EnableIPForwarding(); err == nil || !strings.Contains(err.Error(), "ip_forward") {
+		t.Errorf("Got %v, want an error naming the sysctl", err)
+	}
+}
+
+func TestForwardedPackets(t *testing.T) {
+	fakeProc(t, map[string]string{
+		"snmp": `Ip: Forwarding DefaultTTL InReceives InHdrErrors InAddrErrors ForwDatagrams InUnknownProtos
+Ip: 1 64 123456 0 2 4242 0
+Icmp: InMsgs InErrors
+Icmp: 7 0
+`,
+		"snmp6": `Ip6InReceives                   	9001
+Ip6OutForwDatagrams             	77
+Ip6InDelivers                   	8000
+`,
+	})
+	ipv4, ipv6, err := ForwardedPackets()
+	if err != nil || ipv4 != 4242 || ipv6 != 77 {
+		t.Errorf("Got %d, %d and %v, want 4242 and 77", ipv4, ipv6, err)
+	}
+}
+
+func TestForwardedPacketsWithoutIPv6(t *testing.T) {
+	fakeProc(t, map[string]string{"snmp": "Ip: Forwarding ForwDatagrams\nIp: 1 12\n"})
+	ipv4, ipv6, err := ForwardedPackets()
+	if err != nil || ipv4 != 12 || ipv6 != 0 {
+		t.Errorf("Got %d, %d and %v, want 12 and 0", ipv4, ipv6, err)
+	}
+}
+
+func TestInterfaceBytes(t *testing.T) {
+	fakeProc(t, map[string]string{
+		"net/tailscale0/statistics/rx_bytes": "1024\n",
+		"net/tailscale0/statistics/tx_bytes": "2048\n",
+	})
+	rx, tx, err := InterfaceBytes("tailscale0")
+	if err != nil || rx != 1024 || tx != 2048 {
+		t.Errorf("Got %d, %d and %v, want 1024 and 2048", rx, tx, err)
+	}
+	if _, _, err := InterfaceBytes("missing0"); err == nil {
+		t.Errorf("Got no error for a missing interface")
+	}
+}
+
+func TestInterfaceWithAddr(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("No loopback interface")
+	}
+
+	name, err := InterfaceWithAddr([]netip.Addr{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != loopback {
+		t.Errorf("Got interface %q, want %q", name, loopback)
+	}
+	if name, err := InterfaceWithAddr([]netip.Addr{netip.MustParseAddr("192.0.2.1")}); err == nil {
+		t.Errorf("Got interface %q for an address no interface holds", name)
+	}
+}
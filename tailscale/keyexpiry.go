@@ -0,0 +1,46 @@
+package tailscale
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	localapi "tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+// reauthTimeout bounds a re-authentication with an auth key
+const reauthTimeout = 30 * time.Second
+
+// KeyExpiresIn returns how long until the peer's node key expires, and false
+// if the key does not expire
+func (p *PeerInfo) KeyExpiresIn() (time.Duration, bool) {
+	if p.KeyExpiry == nil {
+		return 0, false
+	}
+	return time.Until(*p.KeyExpiry), true
+}
+
+// Reauthenticate logs this node in again with authKey, which renews its node
+// key. It goes through the LocalAPI because `tailscale up` would reset any
+// prefs not repeated on its command line, such as routes set through the API.
+// The connection drops briefly while the node logs in.
+func (c *Client) Reauthenticate(authKey string) (err error) {
+	defer c.trace("Reauthenticate")(&err)
+	lc := c.local
+	if lc == nil {
+		lc = &localapi.LocalClient{Socket: c.Socket, UseSocketOnly: c.Socket != ""}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reauthTimeout)
+	defer cancel()
+
+	// Without UpdatePrefs the current prefs are kept
+	if err := lc.Start(ctx, ipn.Options{AuthKey: authKey}); err != nil {
+		return fmt.Errorf("failed to re-authenticate: %v", err)
+	}
+	if err := lc.StartLoginInteractive(ctx); err != nil {
+		return fmt.Errorf("failed to re-authenticate: %v", err)
+	}
+	return nil
+}
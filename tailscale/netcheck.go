@@ -0,0 +1,158 @@
+package tailscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+// NAT types derived from whether the public mapping depends on the destination
+const (
+	NATEasy    = "easy"
+	NATHard    = "hard"
+	NATUnknown = "unknown"
+)
+
+// NetcheckReport is a typed summary of a netcheck run
+type NetcheckReport struct {
+	Time                  time.Time     `json:"time"`
+	UDP                   bool          `json:"udp"`
+	IPv4                  bool          `json:"ipv4"`
+	IPv6                  bool          `json:"ipv6"`
+	IPv4CanSend           bool          `json:"ipv4CanSend"`
+	IPv6CanSend           bool          `json:"ipv6CanSend"`
+	OSHasIPv6             bool          `json:"osHasIPv6"`
+	GlobalV4              string        `json:"globalV4,omitempty"`
+	GlobalV6              string        `json:"globalV6,omitempty"`
+	NATType               string        `json:"natType"`
+	MappingVariesByDestIP *bool         `json:"mappingVariesByDestIP"`
+	PortMapping           []string      `json:"portMapping"`
+	CaptivePortal         *bool         `json:"captivePortal,omitempty"`
+	PreferredDERP         *DERPLatency  `json:"preferredDERP"`
+	DERPLatency           []DERPLatency `json:"derpLatency"`
+}
+
+// DERPLatency is the measured latency to one DERP region
+type DERPLatency struct {
+	RegionID   int     `json:"regionId"`
+	RegionCode string  `json:"regionCode,omitempty"`
+	RegionName string  `json:"regionName,omitempty"`
+	LatencyMs  float64 `json:"latencyMs"`
+	IPv4Ms     float64 `json:"ipv4Ms,omitempty"`
+	IPv6Ms     float64 `json:"ipv6Ms,omitempty"`
+}
+
+// Netcheck measures NAT behaviour and DERP latency. It takes a few seconds.
+func (c *Client) Netcheck() (_ *NetcheckReport, err error) {
+	defer c.trace("Netcheck")(&err)
+	var report *netcheck.Report
+	var derpMap *tailcfg.DERPMap
+	if c.local != nil {
+		if report, derpMap, err = c.localNetcheck(); err != nil {
+			return nil, fmt.Errorf("failed to run netcheck: %v", err)
+		}
+	} else {
+		output, err := c.Command("netcheck", "--format=json").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to run netcheck: %v", err)
+		}
+		// Skip anything logged before the report
+		if i := bytes.IndexByte(output, '{'); i > 0 {
+			output = output[i:]
+		}
+		report = new(netcheck.Report)
+		if err := json.Unmarshal(output, report); err != nil {
+			return nil, fmt.Errorf("failed to parse netcheck report: %v", err)
+		}
+
+		// Region names come from the DERP map; the report only has IDs
+		if output, err := c.Command("debug", "derp-map").Output(); err == nil {
+			derpMap = new(tailcfg.DERPMap)
+			if err := json.Unmarshal(output, derpMap); err != nil {
+				derpMap = nil
+			}
+		}
+	}
+	return newNetcheckReport(report, derpMap), nil
+}
+
+// newNetcheckReport converts a netcheck report, naming regions from derpMap if set
+func newNetcheckReport(report *netcheck.Report, derpMap *tailcfg.DERPMap) *NetcheckReport {
+	result := &NetcheckReport{
+		Time:                  report.Now,
+		UDP:                   report.UDP,
+		IPv4:                  report.IPv4,
+		IPv6:                  report.IPv6,
+		IPv4CanSend:           report.IPv4CanSend,
+		IPv6CanSend:           report.IPv6CanSend,
+		OSHasIPv6:             report.OSHasIPv6,
+		NATType:               NATUnknown,
+		MappingVariesByDestIP: optBool(report.MappingVariesByDestIP),
+		CaptivePortal:         optBool(report.CaptivePortal),
+		PortMapping:           []string{},
+		DERPLatency:           []DERPLatency{},
+	}
+	if report.GlobalV4.IsValid() {
+		result.GlobalV4 = report.GlobalV4.String()
+	}
+	if report.GlobalV6.IsValid() {
+		result.GlobalV6 = report.GlobalV6.String()
+	}
+	if result.MappingVariesByDestIP != nil {
+		// A mapping that changes per destination defeats NAT traversal
+		result.NATType = NATEasy
+		if *result.MappingVariesByDestIP {
+			result.NATType = NATHard
+		}
+	}
+	for name, present := range map[string]opt.Bool{"UPnP": report.UPnP, "NAT-PMP": report.PMP, "PCP": report.PCP} {
+		if present.EqualBool(true) {
+			result.PortMapping = append(result.PortMapping, name)
+		}
+	}
+	sort.Strings(result.PortMapping)
+
+	for id, latency := range report.RegionLatency {
+		region := DERPLatency{
+			RegionID:  id,
+			LatencyMs: milliseconds(latency),
+			IPv4Ms:    milliseconds(report.RegionV4Latency[id]),
+			IPv6Ms:    milliseconds(report.RegionV6Latency[id]),
+		}
+		if derpMap != nil {
+			if r, ok := derpMap.Regions[id]; ok && r != nil {
+				region.RegionCode = r.RegionCode
+				region.RegionName = r.RegionName
+			}
+		}
+		result.DERPLatency = append(result.DERPLatency, region)
+	}
+	sort.Slice(result.DERPLatency, func(i, j int) bool {
+		return result.DERPLatency[i].LatencyMs < result.DERPLatency[j].LatencyMs
+	})
+	for i := range result.DERPLatency {
+		if result.DERPLatency[i].RegionID == report.PreferredDERP {
+			preferred := result.DERPLatency[i]
+			result.PreferredDERP = &preferred
+		}
+	}
+	return result
+}
+
+func optBool(b opt.Bool) *bool {
+	value, ok := b.Get()
+	if !ok {
+		return nil
+	}
+	return &value
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,135 @@
+package tailscale
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// netcheckDERPMap is a `tailscale debug derp-map` excerpt naming the regions
+const netcheckDERPMap = `{"Regions": {
+  "1": {"RegionID": 1, "RegionCode": "nyc", "RegionName": "New York City"},
+  "2": {"RegionID": 2, "RegionCode": "sfo", "RegionName": "San Francisco"},
+  "9": {"RegionID": 9, "RegionCode": "dfw", "RegionName": "Dallas"}
+}}`
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestNetcheck(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		report  string
+		derpMap string
+		want    *NetcheckReport
+	}{
+		{
+			name: "dual stack",
+			report: `{
+  "Now": "2024-05-01T12:00:00Z",
+  "UDP": true, "IPv6": true, "IPv4": true, "IPv6CanSend": true, "IPv4CanSend": true, "OSHasIPv6": true, "ICMPv4": false,
+  "MappingVariesByDestIP": false, "UPnP": true, "PMP": null, "PCP": false,
+  "PreferredDERP": 2,
+  "RegionLatency": {"1": 41000000, "2": 12500000, "9": 30000000},
+  "RegionV4Latency": {"1": 41000000, "2": 12500000, "9": 30000000},
+  "RegionV6Latency": {"1": 43000000, "2": 13000000},
+  "GlobalV4Counters": {"198.51.100.7:41641": 3},
+  "GlobalV6Counters": {"[2001:db8::7]:41641": 3},
+  "GlobalV4": "198.51.100.7:41641",
+  "GlobalV6": "[2001:db8::7]:41641",
+  "CaptivePortal": null
+}`,
+			derpMap: netcheckDERPMap,
+			want: &NetcheckReport{
+				Time: now, UDP: true, IPv4: true, IPv6: true, IPv4CanSend: true, IPv6CanSend: true, OSHasIPv6: true,
+				GlobalV4:              "198.51.100.7:41641",
+				GlobalV6:              "[2001:db8::7]:41641",
+				NATType:               NATEasy,
+				MappingVariesByDestIP: boolPtr(false),
+				PortMapping:           []string{"UPnP"},
+				PreferredDERP:         &DERPLatency{RegionID: 2, RegionCode: "sfo", RegionName: "San Francisco", LatencyMs: 12.5, IPv4Ms: 12.5, IPv6Ms: 13},
+				// Fastest first
+				DERPLatency: []DERPLatency{
+					{RegionID: 2, RegionCode: "sfo", RegionName: "San Francisco", LatencyMs: 12.5, IPv4Ms: 12.5, IPv6Ms: 13},
+					{RegionID: 9, RegionCode: "dfw", RegionName: "Dallas", LatencyMs: 30, IPv4Ms: 30},
+					{RegionID: 1, RegionCode: "nyc", RegionName: "New York City", LatencyMs: 41, IPv4Ms: 41, IPv6Ms: 43},
+				},
+			},
+		},
+		{
+			// Without the DERP map, regions are only known by ID
+			name: "unknown mapping",
+			report: `{
+  "Now": "2024-05-01T12:00:00Z",
+  "UDP": true, "IPv4": true, "IPv4CanSend": true,
+  "MappingVariesByDestIP": null, "UPnP": null, "PMP": true, "PCP": true,
+  "PreferredDERP": 1,
+  "RegionLatency": {"1": 20000000, "9": 35000000},
+  "RegionV4Latency": {"1": 20000000, "9": 35000000},
+  "GlobalV4": "198.51.100.7:41641",
+  "GlobalV6": "",
+  "CaptivePortal": false
+}`,
+			want: &NetcheckReport{
+				Time: now, UDP: true, IPv4: true, IPv4CanSend: true,
+				GlobalV4:      "198.51.100.7:41641",
+				NATType:       NATUnknown,
+				PortMapping:   []string{"NAT-PMP", "PCP"},
+				CaptivePortal: boolPtr(false),
+				PreferredDERP: &DERPLatency{RegionID: 1, LatencyMs: 20, IPv4Ms: 20},
+				DERPLatency: []DERPLatency{
+					{RegionID: 1, LatencyMs: 20, IPv4Ms: 20},
+					{RegionID: 9, LatencyMs: 35, IPv4Ms: 35},
+				},
+			},
+		},
+		{
+			name: "hard NAT without UDP",
+			report: `{
+  "Now": "2024-05-01T12:00:00Z",
+  "MappingVariesByDestIP": true,
+  "PreferredDERP": 0,
+  "RegionLatency": {},
+  "GlobalV4": "",
+  "GlobalV6": ""
+}`,
+			derpMap: netcheckDERPMap,
+			want: &NetcheckReport{
+				Time:                  now,
+				NATType:               NATHard,
+				MappingVariesByDestIP: boolPtr(true),
+				PortMapping:           []string{},
+				DERPLatency:           []DERPLatency{},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := fakeCLI(t, `case "$*" in
+"netcheck --format=json") echo "logtail started"; cat report.json ;;
+"debug derp-map") cat derp-map.json ;;
+*) exit 1 ;;
+esac`)
+			if err := os.WriteFile(filepath.Join(dir, "report.json"), []byte(test.report), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if test.derpMap != "" {
+				if err := os.WriteFile(filepath.Join(dir, "derp-map.json"), []byte(test.derpMap), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := NewClient().Netcheck()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(report, test.want) {
+				t.Errorf("Got %+v, want %+v", report, test.want)
+			}
+		})
+	}
+}
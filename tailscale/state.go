@@ -0,0 +1,119 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BackendState is the state of the tailscaled backend as reported by
+// `tailscale status --json`
+type BackendState string
+
+const (
+	StateNoState          BackendState = "NoState"
+	StateStarting         BackendState = "Starting"
+	StateRunning          BackendState = "Running"
+	StateNeedsLogin       BackendState = "NeedsLogin"
+	StateNeedsMachineAuth BackendState = "NeedsMachineAuth"
+	StateStopped          BackendState = "Stopped"
+)
+
+var (
+	// ErrNeedsLogin is returned when the node is not authenticated to the tailnet
+	ErrNeedsLogin = errors.New("tailscale node needs login")
+	// ErrNeedsMachineAuth is returned when the node is waiting for an admin to approve it
+	ErrNeedsMachineAuth = errors.New("tailscale node is waiting for machine authorization by a tailnet admin")
+	// ErrStopped is returned when the backend has been stopped with `tailscale down`
+	ErrStopped = errors.New("tailscale backend is stopped")
+)
+
+// pollInterval is how often the backend state is queried while waiting,
+// shortened by tests
+var pollInterval = 500 * time.Millisecond
+
+// BackendState returns the current state of the tailscaled backend
+func (c *Client) BackendState() (_ BackendState, err error) {
+	defer c.trace("BackendState")(&err)
+	output, err := c.statusJSON()
+	if err != nil {
+		return StateNoState, daemonUnavailable(err)
+	}
+
+	var rawStatus map[string]interface{}
+	if err := json.Unmarshal(output, &rawStatus); err != nil {
+		return StateNoState, fmt.Errorf("%w: %v", ErrInvalidStatus, err)
+	}
+
+	if state, ok := rawStatus["BackendState"].(string); ok {
+		return BackendState(state), nil
+	}
+	return StateNoState, nil
+}
+
+// WaitForDaemon polls until tailscaled answers and has left the NoState
+// state, returning the state it settled in
+func (c *Client) WaitForDaemon(ctx context.Context) (BackendState, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		state, err := c.BackendState()
+		if err == nil && state != StateNoState {
+			return state, nil
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return StateNoState, fmt.Errorf("tailscaled did not become ready: %w", lastErr)
+			}
+			return StateNoState, fmt.Errorf("tailscaled did not become ready: still in state %s", state)
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForState polls the backend until it reaches one of the target states.
+// Terminal states that are not in targets end the wait early with a typed
+// error so callers can report why the node cannot come up.
+func (c *Client) WaitForState(ctx context.Context, targets ...BackendState) (BackendState, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	var state BackendState
+	for {
+		var err error
+		state, err = c.BackendState()
+		if err == nil {
+			for _, target := range targets {
+				if state == target {
+					return state, nil
+				}
+			}
+
+			switch state {
+			case StateNeedsMachineAuth:
+				return state, ErrNeedsMachineAuth
+			case StateStopped:
+				return state, ErrStopped
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if state == StateNeedsLogin {
+				return state, ErrNeedsLogin
+			}
+			if err != nil {
+				return state, fmt.Errorf("timed out waiting for tailscale state %v: %w", targets, err)
+			}
+			return state, fmt.Errorf("timed out waiting for tailscale state %v: still in state %s", targets, state)
+		case <-ticker.C:
+		}
+	}
+}
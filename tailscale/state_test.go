@@ -0,0 +1,136 @@
+package tailscale
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStates makes the fake CLI answer each status query with the next of
+// the backend states, repeating the last one. "down" fails like a daemon
+// that isn't running. It returns a function counting the queries.
+func fakeStates(t *testing.T, states ...string) func() int {
+	t.Helper()
+	dir := fakeCLI(t, `n=$(cat count 2>/dev/null || echo 0)
+echo $((n + 1)) > count
+state=$(sed -n "$((n + 1))p" states)
+[ -n "$state" ] || state=$(tail -n 1 states)
+if [ "$state" = down ]; then
+	echo "failed to connect to local tailscaled" >&2
+	exit 1
+fi
+echo "{\"BackendState\": \"$state\"}"`)
+	if err := os.WriteFile(filepath.Join(dir, "states"), []byte(strings.Join(states, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := pollInterval
+	pollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { pollInterval = previous })
+
+	return func() int {
+		data, _ := os.ReadFile(filepath.Join(dir, "count"))
+		n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return n
+	}
+}
+
+func TestWaitForState(t *testing.T) {
+	tests := []struct {
+		name   string
+		states []string
+		want   BackendState
+		err    error
+		// message is part of the error when it has no type of its own
+		message string
+		// queries is how many status queries it takes, or 0 to wait until
+		// the deadline
+		queries int
+	}{
+		{name: "starts", states: []string{"NoState", "Starting", "Starting", "Running"}, want: StateRunning, queries: 4},
+		{name: "daemon comes up", states: []string{"down", "down", "Running"}, want: StateRunning, queries: 3},
+		{name: "needs machine auth", states: []string{"Starting", "NeedsMachineAuth", "Running"}, want: StateNeedsMachineAuth, err: ErrNeedsMachineAuth, queries: 2},
+		{name: "stopped", states: []string{"Stopped"}, want: StateStopped, err: ErrStopped, queries: 1},
+		// An auth key may still log the node in, so NeedsLogin waits
+		{name: "needs login", states: []string{"NeedsLogin"}, want: StateNeedsLogin, err: ErrNeedsLogin},
+		{name: "deadline", states: []string{"Starting"}, want: StateStarting, message: "still in state Starting"},
+		{name: "daemon unavailable", states: []string{"down"}, want: StateNoState, err: ErrDaemonUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queries := fakeStates(t, test.states...)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			state, err := NewClient().WaitForState(ctx, StateRunning)
+			if state != test.want {
+				t.Errorf("Got state %q, want %q", state, test.want)
+			}
+			switch {
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Errorf("Got error %v, want %v", err, test.err)
+				}
+			case test.message != "":
+				if err == nil || !strings.Contains(err.Error(), test.message) {
+					t.Errorf("Got error %v, want one about %q", err, test.message)
+				}
+			case err != nil:
+				t.Errorf("Got error %v, want none", err)
+			}
+
+			if test.queries > 0 {
+				if n := queries(); n != test.queries {
+					t.Errorf("Queried the status %d times, want %d", n, test.queries)
+				}
+			} else if ctx.Err() == nil {
+				t.Error("Returned before the deadline")
+			}
+		})
+	}
+}
+
+func TestWaitForDaemon(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  []string
+		want    BackendState
+		err     error
+		message string
+	}{
+		{name: "comes up", states: []string{"down", "down", "NoState", "NeedsLogin"}, want: StateNeedsLogin},
+		// Any state past NoState will do
+		{name: "stopped", states: []string{"Stopped"}, want: StateStopped},
+		{name: "unavailable", states: []string{"down"}, want: StateNoState, err: ErrDaemonUnavailable},
+		{name: "no state", states: []string{"NoState"}, want: StateNoState, message: "still in state NoState"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fakeStates(t, test.states...)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			state, err := NewClient().WaitForDaemon(ctx)
+			if state != test.want {
+				t.Errorf("Got state %q, want %q", state, test.want)
+			}
+			switch {
+			case test.err != nil:
+				if !errors.Is(err, test.err) {
+					t.Errorf("Got error %v, want %v", err, test.err)
+				}
+			case test.message != "":
+				if err == nil || !strings.Contains(err.Error(), test.message) {
+					t.Errorf("Got error %v, want one about %q", err, test.message)
+				}
+			case err != nil:
+				t.Errorf("Got error %v, want none", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package tailscale
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrDaemonUnavailable is returned when tailscaled can't be reached, such
+	// as when it crashed or its socket is wrong
+	ErrDaemonUnavailable = errors.New("tailscaled is unavailable")
+	// ErrInvalidStatus is returned when the status can't be parsed
+	ErrInvalidStatus = errors.New("invalid tailscale status")
+)
+
+// Reasons a status query fails or finds the node logged out, as returned
+// by StatusErrorReason
+const (
+	ReasonDaemonUnavailable = "daemon_unavailable"
+	ReasonNeedsLogin        = "needs_login"
+	ReasonNeedsMachineAuth  = "needs_machine_auth"
+	ReasonStopped           = "stopped"
+	ReasonInvalidStatus     = "invalid_status"
+	ReasonOther             = "other"
+)
+
+// StatusErrorReason classifies an error returned by Status, or returns ""
+// for nil
+func StatusErrorReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrDaemonUnavailable):
+		return ReasonDaemonUnavailable
+	case errors.Is(err, ErrNeedsLogin):
+		return ReasonNeedsLogin
+	case errors.Is(err, ErrNeedsMachineAuth):
+		return ReasonNeedsMachineAuth
+	case errors.Is(err, ErrStopped):
+		return ReasonStopped
+	case errors.Is(err, ErrInvalidStatus):
+		return ReasonInvalidStatus
+	default:
+		return ReasonOther
+	}
+}
+
+// daemonUnavailable wraps the failure to query tailscaled, with the CLI's
+// own explanation when it gave one
+func daemonUnavailable(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if stderr := strings.TrimSpace(string(exitErr.Stderr)); stderr != "" {
+			return fmt.Errorf("%w: %v: %s", ErrDaemonUnavailable, err, stderr)
+		}
+	}
+	return fmt.Errorf("%w: %v", ErrDaemonUnavailable, err)
+}
+
+// statusOutcomes counts the outcomes of status queries and logs when the
+// reason they fail for changes, rather than on every query
+var statusOutcomes = struct {
+	sync.Mutex
+	last   string
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// recordStatus counts the outcome of a status query, including a node that
+// answered but isn't logged in
+func recordStatus(status *Status, err error) {
+	if err == nil {
+		err = status.CheckLoggedIn()
+	}
+	reason := StatusErrorReason(err)
+
+	statusOutcomes.Lock()
+	defer statusOutcomes.Unlock()
+	if reason != "" {
+		statusOutcomes.counts[reason]++
+	}
+	if reason == statusOutcomes.last {
+		return
+	}
+	previous := statusOutcomes.last
+	statusOutcomes.last = reason
+	switch reason {
+	case "":
+		log.Info("Tailscale is up again after %s", previous)
+	case ReasonNeedsLogin, ReasonNeedsMachineAuth, ReasonStopped:
+		log.Warn("Tailscale node is not logged in (%s): %v", reason, err)
+	default:
+		log.Error("Tailscale status failed (%s): %v", reason, err)
+	}
+}
+
+// StatusErrorCounts returns how many status queries failed, by reason
+func StatusErrorCounts() map[string]uint64 {
+	statusOutcomes.Lock()
+	defer statusOutcomes.Unlock()
+	counts := make(map[string]uint64, len(statusOutcomes.counts))
+	for reason, count := range statusOutcomes.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// LastStatusErrorReason returns why the latest status query failed, or ""
+// when it succeeded
+func LastStatusErrorReason() string {
+	statusOutcomes.Lock()
+	defer statusOutcomes.Unlock()
+	return statusOutcomes.last
+}
@@ -0,0 +1,61 @@
+package tailscale
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// Identity describes the tailnet user and node behind a connection
+type Identity struct {
+	LoginName string   `json:"loginName"`
+	NodeName  string   `json:"nodeName"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// String returns the identity in a form suitable for logs
+func (i *Identity) String() string {
+	if len(i.Tags) > 0 {
+		return fmt.Sprintf("%s %v", i.NodeName, i.Tags)
+	}
+	return fmt.Sprintf("%s (%s)", i.LoginName, i.NodeName)
+}
+
+// WhoIs looks up the tailnet identity of a remote ip:port address
+func (c *Client) WhoIs(remoteAddr string) (_ *Identity, err error) {
+	defer c.trace("WhoIs")(&err)
+	var who *apitype.WhoIsResponse
+	if c.local != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), localAPITimeout)
+		defer cancel()
+
+		var err error
+		who, err = c.local.WhoIs(ctx, remoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %v", remoteAddr, err)
+		}
+	} else {
+		output, err := c.Command("whois", "--json", remoteAddr).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up %s: %v", remoteAddr, err)
+		}
+		if err := json.Unmarshal(output, &who); err != nil {
+			return nil, fmt.Errorf("failed to parse whois response: %v", err)
+		}
+	}
+
+	if who == nil || who.Node == nil {
+		return nil, fmt.Errorf("no tailnet node found for %s", remoteAddr)
+	}
+
+	identity := &Identity{
+		NodeName: who.Node.Name,
+		Tags:     who.Node.Tags,
+	}
+	if who.UserProfile != nil {
+		identity.LoginName = who.UserProfile.LoginName
+	}
+	return identity, nil
+}
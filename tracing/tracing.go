@@ -0,0 +1,102 @@
+// Package tracing sets up OpenTelemetry tracing with an OTLP/HTTP exporter.
+// Until Setup runs, the global tracer provider is a no-op, so callers can
+// always start spans without checking whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of Gerbil's spans
+const instrumentationName = "github.com/hhftechnology/gerbil"
+
+// tracesPath is where OTLP/HTTP collectors take spans
+const tracesPath = "/v1/traces"
+
+// Config configures the OTLP/HTTP exporter
+type Config struct {
+	// Endpoint is the collector's base URL, such as http://localhost:4318.
+	// Spans are posted to its /v1/traces path.
+	Endpoint string
+	// Headers are added to every request, for collector authentication
+	Headers     map[string]string
+	ServiceName string
+	// OnError is called when spans can't be exported; nil ignores errors
+	OnError func(error)
+}
+
+// Setup installs a tracer provider that batches spans and exports them to
+// the collector, and the W3C trace context propagator. The returned function
+// flushes the remaining spans and stops the exporter.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	endpoint, err := endpointURL(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithHeaders(config.Headers),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = "gerbil"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", config.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the service: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	if config.OnError != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(config.OnError))
+	}
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// endpointURL validates the collector URL and adds the traces path
+func endpointURL(endpoint string) (string, error) {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid OTLP endpoint %q, use a URL like http://localhost:4318", endpoint)
+	}
+	if !strings.HasSuffix(endpoint, tracesPath) {
+		endpoint += tracesPath
+	}
+	return endpoint, nil
+}
+
+// Tracer returns the tracer Gerbil's spans are started with
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// StartChild starts a span only when ctx already carries one, so calls made
+// outside of a traced operation don't start traces of their own. Otherwise
+// the returned span does nothing.
+func StartChild(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return Tracer().Start(ctx, name, trace.WithSpanKind(kind))
+}
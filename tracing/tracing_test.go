@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestEndpointURL(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		want     string
+	}{
+		{endpoint: "http://localhost:4318", want: "http://localhost:4318/v1/traces"},
+		{endpoint: "https://otel.example.com/", want: "https://otel.example.com/v1/traces"},
+		{endpoint: "http://localhost:4318/v1/traces", want: "http://localhost:4318/v1/traces"},
+		{endpoint: "localhost:4318"},
+		{endpoint: "grpc://localhost:4317"},
+		{endpoint: ""},
+	}
+	for _, test := range tests {
+		url, err := endpointURL(test.endpoint)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("Got %q for %q, want an error", url, test.endpoint)
+			}
+			continue
+		}
+		if err != nil || url != test.want {
+			t.Errorf("Got %q and %v for %q, want %q", url, err, test.endpoint, test.want)
+		}
+	}
+}
+
+func TestStartChildWithoutParent(t *testing.T) {
+	for _, ctx := range []context.Context{nil, context.Background()} {
+		if _, span := StartChild(ctx, "tailscale.Status", trace.SpanKindClient); span.IsRecording() {
+			t.Error("Started a span outside of a traced operation")
+		}
+	}
+}
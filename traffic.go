@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/hhftechnology/gerbil/logger"
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// forwardedPackets, interfaceBytes and interfaceWithAddr read the kernel's
+// traffic counters and interfaces
+var (
+	forwardedPackets  = tailscale.ForwardedPackets
+	interfaceBytes    = tailscale.InterfaceBytes
+	interfaceWithAddr = tailscale.InterfaceWithAddr
+)
+
+// tunInterfaceTTL is how long scrapes reuse the TUN device name of a
+// tailscaled gerbil didn't launch, which takes a status query to find
+const tunInterfaceTTL = 30 * time.Second
+
+var tunInterfaceCache struct {
+	mu      sync.Mutex
+	name    string
+	fetched time.Time
+}
+
+// hostTrafficMetrics reports the host's forwarding counters and the byte
+// counters of the Tailscale TUN device. Neither is exit node traffic alone:
+// the kernel counts every forwarded packet, subnet routes included, and the
+// TUN device carries all of this node's tailnet traffic. Userspace networking
+// and embedded nodes forward in process and have no such counters.
+func hostTrafficMetrics() []metrics.Metric {
+	tun, err := cachedTUNInterface()
+	if err != nil {
+		logger.Debug("Failed to find the TUN device: %v", err)
+		return nil
+	}
+	if tun == "" {
+		return nil
+	}
+
+	var collected []metrics.Metric
+	if ipv4, ipv6, err := forwardedPackets(); err == nil {
+		collected = append(collected, metrics.Metric{
+			Name: "gerbil_host_forwarded_packets_total",
+			Help: "Packets the kernel forwarded between any of the host's interfaces, not only for exit node clients.",
+			Type: metrics.Counter,
+			Samples: []metrics.Sample{
+				{Labels: map[string]string{"family": "ipv4"}, Value: float64(ipv4)},
+				{Labels: map[string]string{"family": "ipv6"}, Value: float64(ipv6)},
+			},
+		})
+	}
+	if rx, tx, err := interfaceBytes(tun); err == nil {
+		collected = append(collected, metrics.Metric{
+			Name: "gerbil_tun_interface_bytes_total",
+			Help: "Bytes through the Tailscale TUN device, which carries all of this node's tailnet traffic.",
+			Type: metrics.Counter,
+			Samples: []metrics.Sample{
+				{Labels: map[string]string{"direction": "rx", "interface": tun}, Value: float64(rx)},
+				{Labels: map[string]string{"direction": "tx", "interface": tun}, Value: float64(tx)},
+			},
+		})
+	}
+	return collected
+}
+
+// cachedTUNInterface returns the TUN device name found within
+// tunInterfaceTTL, or finds it again
+func cachedTUNInterface() (string, error) {
+	tunInterfaceCache.mu.Lock()
+	defer tunInterfaceCache.mu.Unlock()
+
+	if !tunInterfaceCache.fetched.IsZero() && time.Since(tunInterfaceCache.fetched) < tunInterfaceTTL {
+		return tunInterfaceCache.name, nil
+	}
+	name, err := tunInterface(context.Background())
+	if err != nil {
+		return "", err
+	}
+	tunInterfaceCache.name = name
+	tunInterfaceCache.fetched = time.Now()
+	return name, nil
+}
+
+// resetTUNInterface makes the next scrape find the TUN device again
+func resetTUNInterface() {
+	tunInterfaceCache.mu.Lock()
+	defer tunInterfaceCache.mu.Unlock()
+	tunInterfaceCache.fetched = time.Time{}
+}
+
+// tunInterface returns the name of the kernel TUN device tailscaled uses, or
+// "" when it forwards in process. gerbil knows the device it launched
+// tailscaled with; for any other tailscaled it is the interface holding the
+// node's Tailscale IPs.
+func tunInterface(ctx context.Context) (string, error) {
+	switch {
+	case tsEmbedded != nil:
+		return "", nil
+	case tsDaemon != nil:
+		if daemonConfig.Userspace() {
+			return "", nil
+		}
+		return daemonConfig.Tun, nil
+	}
+
+	status, err := tailscaleClient(ctx).Status()
+	if err != nil {
+		return "", err
+	}
+	if !status.TUN || status.Self == nil {
+		return "", nil
+	}
+	var addrs []netip.Addr
+	for _, address := range status.Self.Addresses {
+		if addr, err := netip.ParseAddr(address); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return interfaceWithAddr(addrs)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/hhftechnology/gerbil/metrics"
+	"github.com/hhftechnology/gerbil/tailscale"
+)
+
+// fakeTraffic replaces the kernel counters and interfaces. The interface
+// holding any of the node's IPs is tailscale1, and its lookups are recorded.
+func fakeTraffic(t *testing.T) *[][]netip.Addr {
+	t.Helper()
+	var lookups [][]netip.Addr
+	previousPackets, previousBytes, previousInterface := forwardedPackets, interfaceBytes, interfaceWithAddr
+	forwardedPackets = func() (uint64, uint64, error) { return 7, 3, nil }
+	interfaceBytes = func(name string) (uint64, uint64, error) { return 100, 200, nil }
+	interfaceWithAddr = func(addrs []netip.Addr) (string, error) {
+		lookups = append(lookups, addrs)
+		return "tailscale1", nil
+	}
+	t.Cleanup(func() {
+		forwardedPackets, interfaceBytes, interfaceWithAddr = previousPackets, previousBytes, previousInterface
+		resetTUNInterface()
+	})
+	return &lookups
+}
+
+func TestTUNInterface(t *testing.T) {
+	defer func(config tailscale.DaemonConfig) { daemonConfig, tsDaemon = config, nil }(daemonConfig)
+
+	tests := []struct {
+		name     string
+		launched bool
+		tun      string
+		// status is what an external tailscaled reports
+		status string
+		want   string
+		lookup bool
+	}{
+		{name: "launched kernel", launched: true, tun: "tailscale0", want: "tailscale0"},
+		{name: "launched userspace", launched: true, tun: tailscale.TunUserspace},
+		// A tailscaled gerbil didn't launch may use another device than configured
+		{name: "external kernel", tun: "tailscale0", status: strings.Replace(testStatusJSON, `"BackendState": "Running",`, `"BackendState": "Running", "TUN": true,`, 1), want: "tailscale1", lookup: true},
+		{name: "external userspace", tun: "tailscale0", status: testStatusJSON},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status := test.status
+			if status == "" {
+				status = testStatusJSON
+			}
+			fakeTailscaleCLI(t, status)
+			lookups := fakeTraffic(t)
+			daemonConfig = tailscale.DaemonConfig{Tun: test.tun}
+			tsDaemon = nil
+			if test.launched {
+				tsDaemon = tailscale.NewDaemon(daemonConfig)
+			}
+
+			tun, err := cachedTUNInterface()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tun != test.want {
+				t.Errorf("Got TUN device %q, want %q", tun, test.want)
+			}
+			want := [][]netip.Addr{{netip.MustParseAddr("100.64.0.1"), netip.MustParseAddr("fd7a:115c:a1e0::1")}}
+			if !test.lookup {
+				want = nil
+			}
+			if !slices.EqualFunc(*lookups, want, slices.Equal) {
+				t.Errorf("Looked up interfaces for %v, want %v", *lookups, want)
+			}
+		})
+	}
+}
+
+func TestHostTrafficMetrics(t *testing.T) {
+	defer func(config tailscale.DaemonConfig) { daemonConfig, tsDaemon = config, nil }(daemonConfig)
+	fakeTailscaleCLI(t, strings.Replace(testStatusJSON, `"BackendState": "Running",`, `"BackendState": "Running", "TUN": true,`, 1))
+	lookups := fakeTraffic(t)
+	daemonConfig = tailscale.DaemonConfig{Tun: "tailscale0"}
+	tsDaemon = nil
+
+	collected := map[string][]metrics.Sample{}
+	for _, metric := range hostTrafficMetrics() {
+		collected[metric.Name] = metric.Samples
+	}
+	packets := collected["gerbil_host_forwarded_packets_total"]
+	if len(packets) != 2 || packets[0].Value != 7 || packets[1].Value != 3 {
+		t.Errorf("Got forwarded packets %+v, want 7 IPv4 and 3 IPv6", packets)
+	}
+	bytes := collected["gerbil_tun_interface_bytes_total"]
+	if len(bytes) != 2 || bytes[0].Value != 100 || bytes[1].Value != 200 || bytes[0].Labels["interface"] != "tailscale1" {
+		t.Errorf("Got interface bytes %+v, want 100 received and 200 sent on tailscale1", bytes)
+	}
+
+	// Scrapes reuse the device until the cache expires
+	hostTrafficMetrics()
+	if len(*lookups) != 1 {
+		t.Errorf("Looked up the TUN device %d times, want once", len(*lookups))
+	}
+
+	// Userspace networking has no kernel counters
+	resetTUNInterface()
+	tsDaemon = tailscale.NewDaemon(tailscale.DaemonConfig{Tun: tailscale.TunUserspace})
+	daemonConfig = tailscale.DaemonConfig{Tun: tailscale.TunUserspace}
+	if collected := hostTrafficMetrics(); len(collected) != 0 {
+		t.Errorf("Got %d metrics with userspace networking, want none", len(collected))
+	}
+}